@@ -0,0 +1,170 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+)
+
+// read a DaemonSpec from a yaml or json file, or stdin when filename is -;
+// unknown fields are an error so a misspelled one isn't silently ignored
+func ReadSpec(filename string) (*DaemonSpec, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, fatal(err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	spec := DaemonSpec{}
+	err = decoder.Decode(&spec)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fatalf("invalid spec %s: %v", filename, err)
+	}
+	return &spec, nil
+}
+
+// converge the daemon described by spec: install it if it is missing,
+// delete and install it if its config has drifted, then start or stop it
+// and enable or disable it to match; return the actions taken, in order,
+// which are empty when the daemon already matches. A daemon
+// that is updated is started again if it was running, unless Running says
+// otherwise, and the running state of a oneshot is not supported.
+func Apply(spec DaemonSpec) ([]string, error) {
+	d, err := NewDaemonFromSpec(spec)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if spec.Running != nil && isOneshot(d) {
+		return nil, fatalf("%w: running state of oneshot %s", ErrNotSupported, spec.Name)
+	}
+	actions := []string{}
+	running, err := d.Query()
+	switch {
+	case errors.Is(err, ErrNotInstalled):
+		err = d.Install()
+		if err != nil {
+			return actions, fatal(err)
+		}
+		actions = append(actions, "install")
+	case err != nil:
+		return actions, fatal(err)
+	default:
+		drift, err := drifted(d)
+		if err != nil {
+			return actions, fatal(err)
+		}
+		if drift {
+			err = reinstall(d)
+			if err != nil {
+				return actions, fatal(err)
+			}
+			actions = append(actions, "update")
+		}
+	}
+	if spec.Running != nil {
+		running = *spec.Running
+	}
+	if !isOneshot(d) {
+		current, err := d.Query()
+		if err != nil {
+			return actions, fatal(err)
+		}
+		switch {
+		case running && !current:
+			err = d.Start()
+			actions = append(actions, "start")
+		case !running && current:
+			err = d.Stop()
+			actions = append(actions, "stop")
+		}
+		if err != nil {
+			return actions, fatal(err)
+		}
+	}
+	// Start enables the daemon on some backends, so the enabled state is
+	// set last
+	if spec.Enabled != nil {
+		changed, err := SetEnabled(d, *spec.Enabled)
+		if err != nil {
+			return actions, fatal(err)
+		}
+		switch {
+		case changed && *spec.Enabled:
+			actions = append(actions, "enable")
+		case changed:
+			actions = append(actions, "disable")
+		}
+	}
+	return actions, nil
+}
+
+// delete and install d under one lock, leaving its running state to the
+// caller
+func reinstall(d CobraDaemon) error {
+	unlock, err := lockOperation(d)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	err = d.Delete()
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.Install()
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// report whether the installed config differs from the one Install would
+// write, by its parsed fields or by its spec hash; the windows backends
+// keep no config file and compare the parsed fields only, and a config
+// installed without a spec hash has drifted
+func drifted(d CobraDaemon) (bool, error) {
+	diff, err := Diff(d)
+	if err != nil {
+		return false, fatal(err)
+	}
+	if diff != "" {
+		return true, nil
+	}
+	current, err := IsCurrent(d, "")
+	if errors.Is(err, ErrNotSupported) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fatal(err)
+	}
+	return !current, nil
+}
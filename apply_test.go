@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "systemctl", `
+case "$1" in
+is-active) [ -f $FAKE_STATE/active ];;
+is-enabled) [ -f $FAKE_STATE/enabled ];;
+start) touch $FAKE_STATE/active;;
+stop) rm -f $FAKE_STATE/active;;
+enable) touch $FAKE_STATE/enabled;;
+disable) rm -f $FAKE_STATE/enabled;;
+esac`)
+	testConfig(t, "daemon.linux.backend", "systemd")
+	// Apply sets the spec's config, so it is cleared after the test
+	testConfig(t, "daemon.nice", "")
+
+	filename := filepath.Join(root, "spec.yaml")
+	require.Nil(t, os.WriteFile(filename, []byte(`
+name: testd
+dir: `+root+`
+executable: `+executable+`
+args: [serve]
+config:
+  nice: "5"
+running: true
+`), 0644))
+	spec, err := ReadSpec(filename)
+	require.Nil(t, err)
+	require.Equal(t, []string{"serve"}, spec.Args)
+	require.Nil(t, spec.Enabled)
+
+	// systemd enables a unit as it starts it
+	actions, err := Apply(*spec)
+	require.Nil(t, err)
+	require.Equal(t, []string{"install", "start"}, actions)
+	require.FileExists(t, filepath.Join(state, "enabled"))
+	data, err := os.ReadFile(filepath.Join(systemdRoot, "testd.service"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "\nNice=5\n")
+
+	actions, err = Apply(*spec)
+	require.Nil(t, err)
+	require.Empty(t, actions)
+
+	spec.Args = []string{"serve", "--debug"}
+	actions, err = Apply(*spec)
+	require.Nil(t, err)
+	require.Equal(t, []string{"update", "start"}, actions)
+
+	running, enabled := false, false
+	spec.Running, spec.Enabled = &running, &enabled
+	actions, err = Apply(*spec)
+	require.Nil(t, err)
+	require.Equal(t, []string{"stop", "disable"}, actions)
+	require.NoFileExists(t, filepath.Join(state, "active"))
+	require.NoFileExists(t, filepath.Join(state, "enabled"))
+
+	actions, err = Apply(*spec)
+	require.Nil(t, err)
+	require.Empty(t, actions)
+
+	require.Nil(t, os.WriteFile(filename, []byte(`{"name": "testd", "runing": true}`), 0644))
+	_, err = ReadSpec(filename)
+	require.ErrorContains(t, err, "field runing not found")
+}
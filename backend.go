@@ -0,0 +1,117 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"os/user"
+	"runtime"
+)
+
+// a backend constructor as NewDaemonFromSpec calls it, with the spec
+// validated, its user looked up, and its run directory resolved
+type backendConstructor func(spec DaemonSpec, serviceUser *user.User) (CobraDaemon, error)
+
+// a BackendFactory creates the daemon a spec describes for a backend added
+// with RegisterBackend. NewDaemonFromSpec calls it with the spec validated,
+// User set to the username the daemon runs as, and Dir to its existing run
+// directory. The global config is left as it is, so the factory reads a
+// setting from the spec Config before the global config. It should check
+// the settings it uses without changing the host, as Install does the
+// work. The daemon it returns implements every CobraDaemon method:
+// methods other than Install return an error wrapping ErrNotInstalled for
+// a daemon that isn't installed, Install one wrapping ErrAlreadyInstalled
+// for one that is, and features the supervisor lacks return ErrNotSupported.
+type BackendFactory func(spec DaemonSpec) (CobraDaemon, error)
+
+// lookup returns a daemon that can only inspect the installed daemon name,
+// for QueryByName and StatusByName
+type backend struct {
+	factory      BackendFactory
+	list         func() ([]DaemonInfo, error)
+	lookup       func(name string) (CobraDaemon, error)
+	capabilities DaemonCapabilities
+}
+
+// the backends available on this os, registered by the platform files
+// and by RegisterBackend
+var backends = map[string]backend{}
+
+// return the name of the registered backend to use on this host; the
+// platform files replace this default
+var selectBackend = func(settings daemonSettings) (string, error) {
+	return "", fatalf("%w: unsupported os: %s", ErrNotSupported, runtime.GOOS)
+}
+
+// RegisterBackend makes a backend available as daemon.backend=name,
+// replacing any backend registered with that name. Call it from an init
+// function or before NewDaemon. ListDaemons, QueryByName and StatusByName
+// are not supported for a registered backend, and as it has no
+// capabilities the cli hides the commands and flags of the optional
+// features.
+func RegisterBackend(name string, factory BackendFactory) {
+	backends[name] = backend{factory: factory}
+}
+
+// register a built-in backend, which looks up the spec user again, and the
+// list, lookup and capabilities that RegisterBackend leaves unset
+func registerBackend(name string, constructor backendConstructor, list func() ([]DaemonInfo, error), lookup func(string) (CobraDaemon, error), capabilities DaemonCapabilities) {
+	RegisterBackend(name, func(spec DaemonSpec) (CobraDaemon, error) {
+		serviceUser, err := daemonUser(daemonSettings(spec.Config), spec.User)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		return constructor(spec, serviceUser)
+	})
+	b := backends[name]
+	b.list = list
+	b.lookup = lookup
+	b.capabilities = capabilities
+	backends[name] = b
+}
+
+// return the name of the backend to use: daemon.backend when set, or the
+// one selected for this host
+func backendName(settings daemonSettings) (string, error) {
+	name := settings.getString("daemon.backend")
+	if name != "" {
+		return name, nil
+	}
+	name, err := selectBackend(settings)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return name, nil
+}
+
+// return the backend selected for this host
+func platformBackend(settings daemonSettings) (backend, error) {
+	name, err := backendName(settings)
+	if err != nil {
+		return backend{}, fatal(err)
+	}
+	b, ok := backends[name]
+	if !ok {
+		return backend{}, fatalf("%w: %s backend on %s", ErrNotSupported, name, runtime.GOOS)
+	}
+	return b, nil
+}
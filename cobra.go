@@ -22,15 +22,30 @@ THE SOFTWARE.
 package daemon
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rstms/cobra-daemon/common"
 	"github.com/spf13/cobra"
+	"log/slog"
 	"os"
+	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// the daemon args passed to AddDaemonCommands; set once, before the
+// commands run
 var daemonArgs []string
 
 var daemonCmd = &cobra.Command{
@@ -43,60 +58,307 @@ subcommands for daemon management
 OS       | Utility      | Config File
 -------- | ------------ | --------------------- 
 OpenBSD  | rcctl        | /etc/rc.d/NAME
+NetBSD   | service      | /etc/rc.d/NAME
 Linux    | daemontools  | /etc/service/NAME
+Linux    | runit        | /etc/sv/NAME
+Linux    | s6           | /etc/s6/sv/NAME
+Linux    | systemd      | /etc/systemd/system/NAME.service
 Windows  | schtasks.exe | internal XML config
+Windows  | sc.exe       | service control manager
+
+daemon.backend selects a backend by name instead of the one chosen for
+the OS. The daemon.* settings, the platform notes, and the exit codes
+the subcommands return are described in README.md; 2 means the daemon is
+not installed, 5 that the operation is not supported, and 8 that it
+needs root, or Administrator on windows.
 
 `,
 }
 
-func daemonDefaults() (string, string) {
-	binary, err := os.Executable()
-	cobra.CheckErr(err)
-	binary = filepath.Clean(binary)
+var errorExits = []struct {
+	err     error
+	code    int
+	message string
+}{
+	{ErrNotInstalled, 2, "daemon is not installed"},
+	{ErrAlreadyInstalled, 3, "daemon is already installed; use --force to replace it"},
+	{ErrNotSupported, 5, "not supported on this system"},
+	{ErrSupervisorUnavailable, 6, "service supervisor is not available"},
+	{ErrCommandTimeout, 7, "service supervisor command timed out"},
+	{ErrPermissionDenied, 8, "permission denied; this operation requires root, or Administrator on windows"},
+	{ErrWaitTimeout, 9, "daemon did not reach the requested state before the timeout"},
+	{ErrLocked, 10, "another install or delete of the daemon is running"},
+	{context.Canceled, 130, "interrupted"},
+}
+
+// return the exit code the daemon commands use for err: 0 for nil, the
+// code of the package error it wraps, or 1 for any other error
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	for _, e := range errorExits {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return 1
+}
 
-	_, name := filepath.Split(binary)
-	name, _, _ = strings.Cut(name, ".")
+// the source location fatal and fatalf prefix an error with
+var errorLocation = regexp.MustCompile(`[\w.-]+\.go:\d+ \w+: `)
 
+// return err without the source locations, after the message of the
+// package error it wraps in place of that error's own text
+func errorMessage(err error) string {
+	detail := errorLocation.ReplaceAllString(err.Error(), "")
+	for _, e := range errorExits {
+		if errors.Is(err, e.err) {
+			if detail == e.err.Error() {
+				return e.message
+			}
+			return e.message + ": " + strings.TrimPrefix(detail, e.err.Error()+": ")
+		}
+	}
+	return detail
+}
+
+// exit with the error and a distinct exit code for the package errors;
+// --verbose adds the error with the source locations it passed through
+func checkErr(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Error: %s\n", errorMessage(err))
+	if common.ViperGetBool("verbose") {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	os.Exit(ExitCode(err))
+}
+
+// return the binary to install, --binary or the running executable, and
+// the default daemon name from its file name; --binary-sha256 is checked
+// against the binary when set
+func daemonDefaults() (string, string) {
+	binary, name, err := executableDefaults()
+	checkErr(err)
+	if value := common.ViperGetString("daemon.binary"); value != "" {
+		binary, err = filepath.Abs(value)
+		checkErr(err)
+		checkErr(checkExecutable(binary))
+		name, _, _ = strings.Cut(filepath.Base(binary), ".")
+	}
+	if digest := common.ViperGetString("daemon.binary_sha256"); digest != "" {
+		checkErr(checkDigest(binary, digest))
+	}
 	return binary, name
 }
 
-func initDaemon() CobraDaemon {
+// the values initDaemon passes to NewDaemon, resolved from the flags, the
+// config, and the running executable
+type resolvedDaemon struct {
+	Binary     string   `json:"binary"`
+	Name       string   `json:"name"`
+	User       string   `json:"user"`
+	Uid        string   `json:"uid"`
+	Gid        string   `json:"gid"`
+	Group      string   `json:"group"`
+	Dir        string   `json:"dir"`
+	Args       []string `json:"args"`
+	Backend    string   `json:"backend"`
+	Executable string   `json:"executable"`
+}
+
+func initDaemon(args []string) CobraDaemon {
+	r := resolveDaemon(args)
+	d, err := NewDaemon(r.Name, r.User, r.Dir, r.Binary, r.Args...)
+	checkErr(err)
+	return d
+}
+
+func resolveDaemon(args []string) *resolvedDaemon {
 
 	binary, defaultName := daemonDefaults()
 	common.ViperSetDefault("daemon.name", defaultName)
 
 	systemUser, err := user.Current()
-	cobra.CheckErr(err)
+	checkErr(err)
 	common.ViperSetDefault("daemon.user", systemUser.Username)
 
-	daemonUser, err := user.Lookup(common.ViperGetString("daemon.user"))
-	cobra.CheckErr(err)
-	common.ViperSetDefault("daemon.dir", daemonUser.HomeDir)
+	daemonUser, err := lookupUser(common.ViperGetString("daemon.user"))
+	checkErr(err)
+	common.ViperSetDefault("daemon.dir", defaultDir(daemonUser))
 
-	name := common.ViperGetString("daemon.name")
-	user := common.ViperGetString("daemon.user")
-	dir := common.ViperGetString("daemon.dir")
-	d, err := NewDaemon(name, user, dir, binary, daemonArgs...)
-	cobra.CheckErr(err)
-	return d
+	if common.ViperGetBool("verbose") {
+		SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+
+	setDaemonOptions()
+
+	return &resolvedDaemon{
+		Binary: binary,
+		Name:   common.ViperGetString("daemon.name"),
+		User:   common.ViperGetString("daemon.user"),
+		Dir:    common.ViperGetString("daemon.dir"),
+		Args:   serviceArgs(args),
+	}
+}
+
+// resolve the daemon as initDaemon does and fill in the user's ids and the
+// backend, with the args and executable the backend renders, which add the
+// log flag and the installed copy of the binary
+func explainDaemon(args []string) *resolvedDaemon {
+	r := resolveDaemon(args)
+	taskUser, err := daemonUser(nil, r.User)
+	checkErr(err)
+	r.Uid, r.Gid = taskUser.Uid, taskUser.Gid
+	if group, err := user.LookupGroupId(taskUser.Gid); err == nil {
+		r.Group = group.Name
+	}
+	r.Backend, err = backendName(nil)
+	checkErr(err)
+	d, err := NewDaemon(r.Name, r.User, r.Dir, r.Binary, r.Args...)
+	checkErr(err)
+	desired, err := d.DesiredConfig()
+	checkErr(err)
+	r.Args, r.Executable = desired.Args, desired.Executable
+	return r
+}
+
+// copy the daemon flags whose config keys differ from their flag names
+func setDaemonOptions() {
+	setOption("daemon.memory_limit", "daemon.limits.memory")
+	setOption("daemon.nofile_limit", "daemon.limits.nofile")
+	setOption("daemon.systemd_scope", "daemon.systemd.scope")
+	setOption("daemon.cpu_affinity", "daemon.cpuaffinity")
+}
+
+// the application's args followed by the --arg values or daemon.args, or
+// only those with daemon.replace_args
+func serviceArgs(appArgs []string) []string {
+	args := common.ViperGetStringSlice("daemon.arg")
+	if len(args) == 0 {
+		args = common.ViperGetStringSlice("daemon.args")
+	}
+	if common.ViperGetBool("daemon.replace_args") {
+		return args
+	}
+	return append(slices.Clone(appArgs), args...)
+}
+
+// override daemon.stop_timeout with the subcommand --timeout flag
+func setStopTimeout(key string) {
+	setOption(key, "daemon.stop_timeout")
+}
+
+// copy a flag value set on the command line to its config key
+func setOption(flagKey, configKey string) {
+	value := common.ViperGetString(flagKey)
+	if value != "" && value != "0" && value != "false" {
+		common.ViperSet(configKey, value)
+	}
 }
 
 var daemonInstallCmd = &cobra.Command{
 	Use:   "install",
 	Short: "install daemon",
 	Long: `
-install daemon config
+install daemon config; with --now, start the daemon as well
+
+with --replace, an installed daemon is updated without deleting it: when
+the binary is unchanged its config files are rewritten in place and it is
+restarted only if they changed while it was running; a changed binary, or
+a windows daemon, is deleted and installed again as reinstall does
+
+with force set, an installed daemon is deleted first, after listing its
+files and asking to confirm; --yes skips the question, and without a
+terminal it is required
+
+--start-type sets how install leaves the daemon: auto enables it to start
+at boot, manual installs it so it runs only when started, and disabled so
+that start refuses to run it; unset, it is left stopped and disabled
+until start enables it
+
+install needs root, or an elevated prompt on windows, except for systemd
+user units and windows tasks that run as the current user, and waits up
+to daemon.lock_timeout (default 1m) for another install or delete of the
+daemon to finish
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
-		_, err := d.GetConfig()
-		if err == nil && common.ViperGetBool("force") {
-			err := d.Delete()
-			cobra.CheckErr(err)
+		setWaitOptions("install")
+		if source := common.ViperGetString("install.binary_url"); source != "" {
+			if value := common.ViperGetString("daemon.copy_binary"); value != "" {
+				if copy, err := strconv.ParseBool(value); err == nil && !copy {
+					checkErr(fatalf("--binary-url requires daemon.copy_binary"))
+				}
+			}
+			binary, err := DownloadBinary(source, common.ViperGetString("daemon.binary_sha256"))
+			checkErr(err)
+			defer os.RemoveAll(filepath.Dir(binary))
+			common.ViperSet("daemon.binary", binary)
+		}
+		if common.ViperGetBool("install.replace") && common.ViperGetBool("force") {
+			checkErr(fatalf("--replace and --force are exclusive"))
+		}
+		d := initDaemon(daemonArgs)
+		if common.ViperGetBool("install.replace") {
+			checkErr(Replace(d))
+		} else {
+			if common.ViperGetBool("force") {
+				confirmRemove(d, "install --force", "install.yes")
+			}
+			unlock, err := lockOperation(d)
+			checkErr(err)
+			_, err = d.GetConfig()
+			if err == nil && common.ViperGetBool("force") {
+				err := d.Delete()
+				checkErr(err)
+			}
+			err = d.Install()
+			unlock()
+			checkErr(err)
+		}
+		if common.ViperGetBool("install.now") {
+			err := startDaemon(d, "install")
+			checkErr(err)
+		}
+	},
+}
+
+var daemonReinstallCmd = &cobra.Command{
+	Use:   "reinstall",
+	Short: "reinstall daemon",
+	Long: `
+delete and install daemon, starting it again if it was running; installs
+the daemon if it is not installed
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		err := Reinstall(d)
+		checkErr(err)
+	},
+}
+
+var daemonUpdateBinaryCmd = &cobra.Command{
+	Use:   "update-binary",
+	Short: "replace the daemon's binary",
+	Long: `
+copy the running executable, or the --binary file, over the binary the
+installed daemon runs without touching its config; with --restart a
+running daemon is restarted when the binary changed. A daemon installed
+with daemon.copy_binary=false runs its executable in place and has no copy
+to update, and windows daemons are reinstalled instead.
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		changed, err := UpdateBinary(d, common.ViperGetBool("update_binary.restart"))
+		checkErr(err)
+		if !changed {
+			fmt.Println("up to date")
 		}
-		err = d.Install()
-		cobra.CheckErr(err)
 	},
 }
 
@@ -104,27 +366,290 @@ var daemonStartCmd = &cobra.Command{
 	Use:   "start",
 	Short: "start daemon",
 	Long: `
-start daemon
+start daemon; with --wait, --wait-port, or --wait-cmd, retry the health
+check until it passes or --wait-timeout expires; a daemon that is already
+running is left alone, or restarted with --restart-if-running
+
+a daemontools, runit or s6 service is started once the scanner has
+created its supervise directory, waiting up to daemon.settle_timeout
+(default 10s, 0 to skip); a oneshot is run again
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		setWaitOptions("start")
+		d := initDaemon(daemonArgs)
+		if showCommands(d, "start") {
+			return
+		}
+		err := startDaemon(d, "start")
+		checkErr(err)
+	},
+}
+
+var daemonEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "enable daemon",
+	Long: `
+enable the daemon to start at boot; with --now, start it as well, with
+the --wait options of start. A daemon already enabled is left alone, and
+"already enabled" is printed.
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		setWaitOptions("enable")
+		d := initDaemon(daemonArgs)
+		changed, err := SetEnabled(d, true)
+		checkErr(err)
+		if !changed {
+			fmt.Println("already enabled")
+		}
+		if common.ViperGetBool("enable.now") {
+			err = startDaemon(d, "enable")
+			checkErr(err)
+		}
+	},
+}
+
+var daemonDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "disable daemon",
+	Long: `
+keep the daemon from starting at boot; a running daemon is not stopped.
+A daemon already disabled is left alone, and "already disabled" is
+printed.
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
-		err := d.Start()
-		cobra.CheckErr(err)
+		d := initDaemon(daemonArgs)
+		changed, err := SetEnabled(d, false)
+		checkErr(err)
+		if !changed {
+			fmt.Println("already disabled")
+		}
 	},
 }
 
+var daemonApplyCmd = &cobra.Command{
+	Use:   "apply SPEC_FILE",
+	Short: "converge daemon to a spec file",
+	Long: `
+read the desired state of the daemon from a yaml or json spec file, or
+stdin with -, and run only the operations needed to reach it: install
+the daemon if it is missing, reinstall it if its config has drifted,
+start or stop it, and enable or disable it; print each action taken, or
+"up to date" when there was nothing to do
+
+name, user, dir, executable, and args default to the daemon options and
+the running binary; config sets daemon options, named without the
+daemon. prefix; running and enabled, true or false, are left as they are
+when omitted:
+
+    name: myapp
+    args: [serve]
+    config:
+      start_type: auto
+      logfile: /var/log/myapp.log
+    running: true
+    enabled: true
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		spec, err := ReadSpec(args[0])
+		checkErr(err)
+		binary, defaultName := daemonDefaults()
+		common.ViperSetDefault("daemon.name", defaultName)
+		if common.ViperGetBool("verbose") {
+			SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		}
+		setDaemonOptions()
+		if spec.Name == "" {
+			spec.Name = common.ViperGetString("daemon.name")
+		}
+		if spec.User == "" {
+			spec.User = common.ViperGetString("daemon.user")
+		}
+		if spec.Dir == "" {
+			spec.Dir = common.ViperGetString("daemon.dir")
+		}
+		if spec.Executable == "" {
+			spec.Executable = binary
+		}
+		if spec.Args == nil {
+			spec.Args = serviceArgs(daemonArgs)
+		}
+		actions, err := Apply(*spec)
+		for _, action := range actions {
+			fmt.Println(action)
+		}
+		checkErr(err)
+		if len(actions) == 0 {
+			fmt.Println("up to date")
+		}
+	},
+}
+
+// report whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// before action removes an installed daemon, list the files it removes and
+// ask to go on; --yes, read from yesKey, skips the question, and without a
+// terminal to ask on it is required
+func confirmRemove(d CobraDaemon, action, yesKey string) {
+	if common.ViperGetBool(yesKey) {
+		return
+	}
+	_, err := d.GetConfig()
+	if err != nil {
+		// not installed, so there is nothing to remove; action reports it
+		return
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		checkErr(fatalf("%s removes the installed daemon; pass --yes to confirm", action))
+	}
+	fmt.Printf("%s removes:\n", action)
+	paths := d.Paths()
+	for _, name := range sortedKeys(paths) {
+		fmt.Printf("  %s=%s\n", name, paths[name])
+	}
+	fmt.Print("continue? [y/N]: ")
+	response, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	checkErr(err)
+	response = strings.ToLower(strings.TrimSpace(response))
+	if response != "y" && response != "yes" {
+		checkErr(fatalf("%s cancelled", action))
+	}
+}
+
+// with --show-command, print the supervisor commands of action instead
+// of running them
+func showCommands(d CobraDaemon, action string) bool {
+	if !common.ViperGetBool("daemon.show_command") {
+		return false
+	}
+	checkErr(ShowCommands(d, action, os.Stdout))
+	return true
+}
+
+// copy the --wait-port, --wait-cmd, and --wait-timeout flags of the
+// subcommand to the healthcheck config
+func setWaitOptions(subcommand string) {
+	setOption(subcommand+".wait_port", "daemon.healthcheck.port")
+	setOption(subcommand+".wait_cmd", "daemon.healthcheck.command")
+	setOption(subcommand+".wait_timeout", "daemon.healthcheck.timeout")
+}
+
+// start the daemon, or with --restart-if-running restart it if it is
+// already running, then run the healthcheck if a --wait option of the
+// subcommand is set
+func startDaemon(d CobraDaemon, subcommand string) error {
+	running, err := d.Query()
+	if err != nil {
+		return err
+	}
+	switch {
+	case isOneshot(d):
+		// Query reports the last run of a oneshot, which Start runs again
+		err = d.Start()
+	case running && common.ViperGetBool(subcommand+".restart_if_running"):
+		err = d.Restart()
+	case running:
+		fmt.Println("already running")
+	default:
+		err = d.Start()
+	}
+	if err != nil {
+		return err
+	}
+	if common.ViperGetBool(subcommand+".wait") || common.ViperGetString(subcommand+".wait_port") != "" || common.ViperGetString(subcommand+".wait_cmd") != "" {
+		ctx, stop := interruptContext()
+		defer stop()
+		return HealthCheckContext(ctx)
+	}
+	return nil
+}
+
+// return a context cancelled by SIGINT or SIGTERM, so a wait ends promptly
+// and reports the interrupt
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// add the healthcheck options run after the daemon is started
+func addWaitOptions(cobraCmd *cobra.Command) {
+	common.OptionSwitch(cobraCmd, "wait", "", "run the configured healthcheck after start")
+	common.OptionString(cobraCmd, "wait-port", "", "", "wait until HOST:PORT accepts connections")
+	common.OptionString(cobraCmd, "wait-cmd", "", "", "wait until command exits 0")
+	common.OptionString(cobraCmd, "wait-timeout", "", "", "healthcheck timeout (default 30s)")
+}
+
 var daemonStopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "stop daemon",
 	Long: `
-stop daemon
+stop daemon with daemon.stop_signal (default TERM), and send KILL if it
+is still running after --timeout or daemon.stop_timeout
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
+		setStopTimeout("stop.timeout")
+		d := initDaemon(daemonArgs)
+		if showCommands(d, "stop") {
+			return
+		}
 		err := d.Stop()
-		cobra.CheckErr(err)
+		checkErr(err)
+	},
+}
+
+var daemonWaitCmd = &cobra.Command{
+	Use:   "wait",
+	Short: "wait for the daemon to be running, stopped or supervised",
+	Long: `
+poll the daemon status until it matches --for, running or stopped; exit
+with status 9 if it does not before --timeout (default the command timeout)
+
+--for supervised waits until the supervisor knows the installed daemon and
+start can act on it: until svscan, runsvdir or s6-svscan has created the
+supervise directory of a daemontools, runit or s6 service, or systemd has
+loaded the unit. rc.d scripts and Windows tasks and services are known as
+soon as they are installed. The default --timeout is daemon.settle_timeout
+(default 10s), and on expiry it exits with status 6.
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		var running, supervised bool
+		switch state := common.ViperGetString("wait.for"); state {
+		case "running":
+			running = true
+		case "stopped":
+		case "supervised":
+			supervised = true
+		default:
+			checkErr(fatalf("invalid --for state: %q; expected running, stopped or supervised", state))
+		}
+		timeout, err := commandTimeout(nil)
+		checkErr(err)
+		if supervised {
+			timeout, err = settleTimeout(nil)
+			checkErr(err)
+		}
+		if value := common.ViperGetString("wait.timeout"); value != "" {
+			timeout, err = time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				checkErr(fatalf("invalid --timeout: %s", value))
+			}
+		}
+		ctx, stop := interruptContext()
+		defer stop()
+		if supervised {
+			checkErr(waitSupervised(ctx, d, timeout))
+			return
+		}
+		checkErr(WaitForContext(ctx, d, running, timeout))
 	},
 }
 
@@ -136,11 +661,10 @@ restart daemon
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
-		err := d.Stop()
-		cobra.CheckErr(err)
-		err = d.Start()
-		cobra.CheckErr(err)
+		setStopTimeout("restart.timeout")
+		d := initDaemon(daemonArgs)
+		err := d.Restart()
+		checkErr(err)
 	},
 }
 
@@ -148,13 +672,45 @@ var daemonDeleteCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "delete daemon",
 	Long: `
-delete daemon config
+delete daemon config; each step is attempted when an earlier one fails,
+so a daemon that won't stop is removed and the errors are reported
+together; with --force, it is killed and the stop error is only a warning
+
+delete lists the daemon's files and asks to confirm first; --yes skips
+the question, and without a terminal it is required
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
+		setOption("delete.force", "force")
+		d := initDaemon(daemonArgs)
+		if showCommands(d, "delete") {
+			return
+		}
+		confirmRemove(d, "delete", "delete.yes")
 		err := d.Delete()
-		cobra.CheckErr(err)
+		checkErr(err)
+	},
+}
+
+var daemonPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "delete daemon and remove its logs and binary",
+	Long: `
+delete daemon config, then remove the log file or directory and the
+binary copied on install; the binary is kept while another installed
+daemon runs it, and files already gone are skipped; with --force, a
+daemon that won't stop is killed and removed anyway
+
+purge lists the daemon's files and asks to confirm first; --yes skips
+the question, and without a terminal it is required
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		setOption("purge.force", "force")
+		d := initDaemon(daemonArgs)
+		confirmRemove(d, "purge", "purge.yes")
+		err := d.Purge()
+		checkErr(err)
 	},
 }
 
@@ -162,29 +718,217 @@ var daemonShowCmd = &cobra.Command{
 	Use:   "show",
 	Short: "show daemon config",
 	Long: `
-show daemon config
+show daemon config; --output raw (the default) prints the native config,
+such as the run script, unit file, or task XML, while yaml and json print
+the name, user, executable, args, dir, env, and enabled state parsed from
+it, leaving out fields the backend doesn't record
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
-		out, err := d.GetConfig()
-		cobra.CheckErr(err)
+		d := initDaemon(daemonArgs)
+		output := common.ViperGetString("show.output")
+		if output == "raw" {
+			out, err := d.GetConfig()
+			checkErr(err)
+			fmt.Println(out)
+			return
+		}
+		config, err := d.GetDaemonConfig()
+		checkErr(err)
+		out, err := config.format(output)
+		checkErr(err)
 		fmt.Println(out)
 	},
 }
 
+var daemonExplainCmd = &cobra.Command{
+	Use:   "explain",
+	Short: "show the resolved daemon settings",
+	Long: `
+print the values the other daemon commands would use, resolved from the
+flags, the config file and the running executable, without doing
+anything: the binary installed, the daemon name, its user with uid, gid
+and group, run directory, backend, the executable the daemon runs and
+its final argument list. --output json prints them as a json object.
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		r := explainDaemon(daemonArgs)
+		switch output := common.ViperGetString("explain.output"); output {
+		case "json":
+			data, err := json.MarshalIndent(r, "", "  ")
+			checkErr(err)
+			fmt.Println(string(data))
+		case "text":
+			fmt.Printf("binary=%s\nname=%s\nuser=%s\nuid=%s\ngid=%s\ngroup=%s\ndir=%s\nbackend=%s\nexecutable=%s\nargs=%s\n",
+				r.Binary, r.Name, r.User, r.Uid, r.Gid, r.Group, r.Dir, r.Backend, r.Executable, quoteArgs(r.Args, quoteShell))
+		default:
+			checkErr(fatalf("invalid output format: %q; expected text or json", output))
+		}
+	},
+}
+
+var daemonPathsCmd = &cobra.Command{
+	Use:   "paths",
+	Short: "show daemon file locations",
+	Long: `
+show the installed file locations as NAME=PATH lines
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		paths := d.Paths()
+		for _, name := range sortedKeys(paths) {
+			fmt.Printf("%s=%s\n", name, paths[name])
+		}
+	},
+}
+
+var daemonLogPathCmd = &cobra.Command{
+	Use:   "logpath",
+	Short: "show where the daemon writes logs",
+	Long: `
+print the daemon's log file, or the log directory for daemontools, runit
+and s6; --logfile or daemon.logfile overrides it. A systemd unit without a
+log file logs to the journal and has no path.
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		path, err := d.LogPath()
+		checkErr(err)
+		fmt.Println(path)
+	},
+}
+
+var daemonPidCmd = &cobra.Command{
+	Use:   "pid",
+	Short: "show daemon process id",
+	Long: `
+show the process id of the running daemon, read from the daemon.pidfile
+when one is configured; 0 if the daemon is not running
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		pid, err := d.Pid()
+		checkErr(err)
+		fmt.Println(pid)
+	},
+}
+
+// edit config in a temp file with the user's editor and return the result
+func editConfig(config string) (string, error) {
+	editCommand := "vi"
+	envVisual := os.Getenv("VISUAL")
+	envEditor := os.Getenv("EDITOR")
+	switch {
+	case envVisual != "":
+		editCommand = envVisual
+	case envEditor != "":
+		editCommand = envEditor
+	case runtime.GOOS == "windows":
+		editCommand = "notepad.exe"
+	}
+	tempFile, err := os.CreateTemp("", "daemon-edit-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.WriteString(config)
+	if err != nil {
+		tempFile.Close()
+		return "", err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return "", err
+	}
+	editor := exec.Command(editCommand, tempFile.Name())
+	editor.Stdin = os.Stdin
+	editor.Stdout = os.Stdout
+	editor.Stderr = os.Stderr
+	err = editor.Run()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+var daemonEditCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "edit daemon config",
+	Long: `
+edit the installed daemon config with $EDITOR and apply the changes
+`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		config, err := d.GetConfig()
+		checkErr(err)
+		edited, err := editConfig(config)
+		checkErr(err)
+		if edited == config {
+			fmt.Println("config unchanged")
+			return
+		}
+		err = d.SetConfig(edited)
+		checkErr(err)
+	},
+}
+
+var daemonValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "validate daemon config",
+	Long: `
+check the daemon config for problems before installing
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		err := d.Validate()
+		if err != nil {
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Println(line)
+			}
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	},
+}
+
 var daemonQueryCmd = &cobra.Command{
 	Use:   "query",
 	Short: "query daemon status",
 	Long: `
-return 0 if daemon is running, 1 if not
+return 0 if daemon is running, 1 if not; with --log also print the state
+of the daemontools, runit, or s6 log service
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		d := initDaemon()
+		d := initDaemon(daemonArgs)
+		if showCommands(d, "query") {
+			return
+		}
 		quiet := common.ViperGetBool("daemon.query.quiet")
 		running, err := d.Query()
 		if !quiet {
-			cobra.CheckErr(err)
+			checkErr(err)
+		}
+		if common.ViperGetBool("query.log") && !quiet {
+			logger, ok := d.(interface{ QueryLog() (bool, error) })
+			if !ok || !d.Capabilities().LogService {
+				checkErr(fatalf("%w: no separate log service", ErrNotSupported))
+			}
+			logRunning, err := logger.QueryLog()
+			checkErr(err)
+			state := "stopped"
+			if logRunning {
+				state = "running"
+			}
+			fmt.Printf("log %s\n", state)
 		}
 		if running {
 			if !quiet {
@@ -199,18 +943,268 @@ return 0 if daemon is running, 1 if not
 	},
 }
 
+// the exit codes of the status command
+var stateExits = map[DaemonState]int{StateRunning: 0, StateStopped: 1, StateFailed: 4}
+
+var daemonStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show whether the daemon is running, stopped, or failed",
+	Long: `
+print running, stopped, or failed and exit 0, 1, or 4; a failed daemon
+exited on its own and is down, or waiting for its supervisor to start it
+again, where a stopped one was stopped or never started. On OpenBSD and
+NetBSD an enabled daemon that is not running is reported failed, as rc.d
+doesn't record why it stopped. A windows task also prints the time of its
+last run and the result code the task scheduler recorded for it.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		state, err := d.Status()
+		checkErr(err)
+		if !common.ViperGetBool("status.quiet") {
+			fmt.Println(state)
+			if task, ok := d.(interface{ History() (*TaskHistory, error) }); ok {
+				history, err := task.History()
+				checkErr(err)
+				fmt.Printf("last run %s\nlast result %s\n", history.LastRunTime, history.LastTaskResult)
+			}
+		}
+		os.Exit(stateExits[state])
+	},
+}
+
+var daemonDiffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "compare installed daemon config with current options",
+	Long: `
+print a unified diff of the installed config against the config install
+would write with the current options; exit 0 if they match, 1 if not
+
+with --spec, only compare the cobra-daemon-spec hash recorded in the
+installed config file with the hash of the one install would write, and
+print "up to date" or "drifted"; the windows backends keep no config
+file and don't support it
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		if common.ViperGetBool("diff.spec") {
+			current, err := IsCurrent(d, "")
+			checkErr(err)
+			if current {
+				if !common.ViperGetBool("diff.quiet") {
+					fmt.Println("up to date")
+				}
+				os.Exit(0)
+			}
+			if !common.ViperGetBool("diff.quiet") {
+				fmt.Println("drifted")
+			}
+			os.Exit(1)
+		}
+		diff, err := Diff(d)
+		checkErr(err)
+		if diff == "" {
+			os.Exit(0)
+		}
+		if !common.ViperGetBool("diff.quiet") {
+			fmt.Print(diff)
+		}
+		os.Exit(1)
+	},
+}
+
+var daemonDoctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "check the install prerequisites",
+	Long: `
+print a checklist of the install prerequisites: the backend selected on
+this system, its supervisor tools, the daemon user, whether the current
+user can write the install locations, and the validate checks; exit 1 if
+any check fails
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		binary, defaultName := daemonDefaults()
+		common.ViperSetDefault("daemon.name", defaultName)
+		if common.ViperGetBool("verbose") {
+			SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		}
+		setDaemonOptions()
+		name := common.ViperGetString("daemon.name")
+		user := common.ViperGetString("daemon.user")
+		dir := common.ViperGetString("daemon.dir")
+		failed := false
+		for _, check := range Doctor(name, user, dir, binary, serviceArgs(daemonArgs)...) {
+			result, detail := "ok", check.Detail
+			if check.Err != nil {
+				result, detail, failed = "FAIL", check.Err.Error(), true
+			}
+			fmt.Printf("%-4s %s: %s\n", result, check.Name, detail)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var daemonRenderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "render daemon config without installing",
+	Long: `
+write the config files install would write to stdout, or with --output-dir
+under that directory at their installed paths, without changing the system
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := initDaemon(daemonArgs)
+		dir := common.ViperGetString("render.output_dir")
+		if dir != "" {
+			checkErr(RenderDir(d, dir))
+			return
+		}
+		checkErr(Render(d, os.Stdout))
+	},
+}
+
+var daemonListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list installed daemons",
+	Long: `
+list daemons installed by this program
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		list, err := ListDaemons()
+		checkErr(err)
+		for _, info := range list {
+			state := "stopped"
+			if info.Running {
+				state = "running"
+			}
+			fmt.Printf("%s %s\n", info.Name, state)
+		}
+	},
+}
+
 func AddDaemonCommands(rootCmd *cobra.Command, args ...string) {
 	daemonArgs = args
 	common.CobraAddCommand(rootCmd, rootCmd, daemonCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonInstallCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonReinstallCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonUpdateBinaryCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonStartCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonEnableCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonDisableCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonStopCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonRestartCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonWaitCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonDeleteCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonPurgeCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonShowCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonPathsCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonExplainCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonLogPathCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonPidCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonEditCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonValidateCmd)
 	common.CobraAddCommand(rootCmd, daemonCmd, daemonQueryCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonStatusCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonDiffCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonRenderCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonDoctorCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonListCmd)
+	common.CobraAddCommand(rootCmd, daemonCmd, daemonApplyCmd)
 	common.OptionString(daemonCmd, "name", "", "", "daemon name")
 	common.OptionString(daemonCmd, "user", "", "", "run as username")
-	common.OptionString(daemonCmd, "dir", "", "", "run directory")
+	common.OptionString(daemonCmd, "group", "", "", "run as group instead of the user's primary group")
+	common.OptionStringSlice(daemonCmd, "supplementary-groups", "", []string{}, "also run with these groups (ignored on windows)")
+	common.OptionString(daemonCmd, "dir", "", "", "run directory (default the user's home, or / or /var/empty when it has none)")
+	common.OptionSwitch(daemonCmd, "create-dir", "", "create run directory on install")
+	common.OptionStringSlice(daemonCmd, "arg", "", []string{}, "append an argument to the daemon's command line (repeatable)")
+	common.OptionSwitch(daemonCmd, "replace-args", "", "run the daemon with only the --arg values instead of the built-in args")
+	common.OptionStringSlice(daemonCmd, "env", "", []string{}, "set KEY=VALUE in the daemon environment")
+	common.OptionSwitch(daemonCmd, "wrapper", "", "start the daemon through a generated wrapper script that sets env and run directory")
+	common.OptionString(daemonCmd, "nice", "", "", "cpu nice value -20..19 (task priority on windows, not applied on openbsd)")
+	common.OptionString(daemonCmd, "ionice", "", "", "io scheduling CLASS[:LEVEL], realtime, best-effort, or idle (linux only)")
+	common.OptionString(daemonCmd, "cpu-affinity", "", "", "run the daemon on these cpus, such as 0-3,7 (linux only)")
+	common.OptionString(daemonCmd, "memory-limit", "", "", "memory limit in bytes or with a K, M, G suffix (not applied on windows)")
+	common.OptionInt(daemonCmd, "nofile-limit", "", 0, "open file limit (not applied on windows)")
+	common.OptionStringSlice(daemonCmd, "after", "", []string{}, "start after these daemons (not supported on windows)")
+	common.OptionStringSlice(daemonCmd, "requires", "", []string{}, "run only while these daemons are running (not supported on windows)")
+	common.OptionString(daemonCmd, "prestart", "", "", "shell command to run before the daemon starts")
+	common.OptionString(daemonCmd, "poststop", "", "", "shell command to run after the daemon exits")
+	common.OptionString(daemonCmd, "pidfile", "", "", "write the daemon's pid to this file (not supported on windows)")
+	common.OptionString(daemonCmd, "type", "", "", "simple for a supervised daemon, oneshot for a task that runs once when started (default simple)")
+	common.OptionString(daemonCmd, "start-type", "", "", "auto starts the daemon at boot, manual only when started, disabled not at all (default: enabled by start)")
+	common.OptionString(daemonCmd, "umask", "", "", "octal file mode creation mask for the daemon, such as 027 (not applied on windows)")
+	common.OptionSwitch(daemonCmd, "sandbox", "", "run the daemon with systemd sandbox directives (systemd only)")
+	common.OptionString(daemonCmd, "password", "", "", "windows account password, so the task runs whether or not the user is logged on")
+	common.OptionString(daemonCmd, "systemd-scope", "", "", "systemd units as system or user units (default system for root, user otherwise)")
+	common.OptionString(daemonCmd, "command-timeout", "", "", "kill a supervisor command that runs longer than this (default 30s)")
+	common.OptionString(daemonCmd, "stop-signal", "", "", "signal that stops the daemon, KILL follows after the stop timeout (default TERM)")
+	common.OptionString(daemonCmd, "binary", "", "", "install this binary instead of the running executable")
+	common.OptionString(daemonCmd, "binary-sha256", "", "", "hex sha256 digest the binary must match")
+	common.OptionString(daemonCmd, "copy-binary", "", "", "copy the executable to the bin directory on install (default true); false runs it in place")
+	common.OptionString(daemonCmd, "logfile", "", "", "log file path, or the log directory for daemontools, runit and s6")
+	common.OptionString(daemonCmd, "stdin", "", "", "daemon standard input, null, inherit, or a file path (default null)")
+	common.OptionInt(daemonCmd, "log-size", "", 0, "log file size in bytes before rotation (daemontools, runit, s6)")
+	common.OptionInt(daemonCmd, "log-keep", "", 0, "number of rotated log files to keep (daemontools, runit, s6)")
+	common.OptionSwitch(daemonCmd, "show-command", "", "print the supervisor commands of start, stop, query, or delete and exit without running them")
 	common.OptionSwitch(daemonQueryCmd, "quiet", "q", "suppress output")
+	common.OptionSwitch(daemonQueryCmd, "log", "", "also print the log service state (daemontools, runit, s6)")
+	common.OptionSwitch(daemonStatusCmd, "quiet", "q", "suppress output")
+	common.OptionSwitch(daemonDeleteCmd, "force", "", "kill and remove a daemon that won't stop")
+	common.OptionSwitch(daemonPurgeCmd, "force", "", "kill and remove a daemon that won't stop")
+	common.OptionSwitch(daemonDeleteCmd, "yes", "y", "delete without asking to confirm")
+	common.OptionSwitch(daemonPurgeCmd, "yes", "y", "purge without asking to confirm")
+	common.OptionSwitch(daemonInstallCmd, "yes", "y", "replace an installed daemon with --force without asking to confirm")
+	addWaitOptions(daemonStartCmd)
+	common.OptionSwitch(daemonStartCmd, "restart-if-running", "", "restart the daemon if it is already running")
+	common.OptionSwitch(daemonInstallCmd, "now", "", "start the daemon after install")
+	common.OptionSwitch(daemonInstallCmd, "replace", "", "update an installed daemon in place, restarting it only if needed")
+	common.OptionSwitch(daemonUpdateBinaryCmd, "restart", "", "restart the daemon if it is running and the binary changed")
+	common.OptionString(daemonInstallCmd, "binary-url", "", "", "download the binary to install from this http or https url")
+	addWaitOptions(daemonInstallCmd)
+	common.OptionSwitch(daemonEnableCmd, "now", "", "start the daemon after enabling it")
+	addWaitOptions(daemonEnableCmd)
+	common.OptionSwitch(daemonEnableCmd, "restart-if-running", "", "with --now, restart the daemon if it is already running")
+	common.OptionSwitch(daemonDiffCmd, "quiet", "q", "suppress output")
+	common.OptionSwitch(daemonDiffCmd, "spec", "", "compare only the spec hash of the config file")
+	common.OptionString(daemonShowCmd, "output", "o", "raw", "output format, raw, yaml, or json")
+	common.OptionString(daemonExplainCmd, "output", "o", "text", "output format, text or json")
+	common.OptionString(daemonRenderCmd, "output-dir", "o", "", "write files under this directory")
+	common.OptionString(daemonStopCmd, "timeout", "", "", "stop timeout before kill (default 10s)")
+	common.OptionString(daemonRestartCmd, "timeout", "", "", "stop timeout before kill (default 10s)")
+	common.OptionString(daemonWaitCmd, "for", "", "running", "state to wait for, running, stopped or supervised")
+	common.OptionString(daemonWaitCmd, "timeout", "", "", "give up after this long (default the command timeout)")
+	// daemon.backend may be set in the config file, which is read only
+	// when a command runs, so the backend's commands are chosen as help
+	// or usage is shown
+	daemonCmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		hideUnsupported()
+		daemonCmd.Parent().HelpFunc()(cmd, args)
+	})
+	daemonCmd.SetUsageFunc(func(cmd *cobra.Command) error {
+		hideUnsupported()
+		return daemonCmd.Parent().UsageFunc()(cmd)
+	})
+}
+
+// hide the commands and flags the selected backend doesn't support; they
+// still run and report ErrNotSupported
+func hideUnsupported() {
+	capabilities, err := PlatformCapabilities()
+	if err != nil {
+		return
+	}
+	daemonPidCmd.Hidden = !capabilities.Pid
+	hidden := map[string]bool{
+		"pidfile":     !capabilities.PidFile,
+		"stop-signal": !capabilities.StopSignal,
+		"after":       !capabilities.Dependencies,
+		"requires":    !capabilities.Dependencies,
+		"sandbox":     !capabilities.Sandbox,
+		"type":        !capabilities.Oneshot,
+	}
+	for name, hide := range hidden {
+		daemonCmd.PersistentFlags().Lookup(name).Hidden = hide
+	}
+	daemonQueryCmd.PersistentFlags().Lookup("log").Hidden = !capabilities.LogService
 }
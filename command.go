@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultCommandTimeout = 30 * time.Second
+
+// time allowed for output pipes to close after a timed out command is killed
+const commandWaitDelay = time.Second
+
+// return the configured daemon.command_timeout duration
+func commandTimeout(settings daemonSettings) (time.Duration, error) {
+	value := settings.getString("daemon.command_timeout")
+	if value == "" {
+		return defaultCommandTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fatalf("invalid command_timeout: %s", value)
+	}
+	return timeout, nil
+}
+
+// messages printed by the supervisor tools when the caller lacks privileges
+var permissionMessages = []string{
+	"permission denied",
+	"access denied",
+	"access is denied",
+	"operation not permitted",
+	"need root privileges",
+	"needs root privileges",
+	"interactive authentication required",
+}
+
+// return true if output reports a privilege failure
+func permissionDenied(output string) bool {
+	output = strings.ToLower(output)
+	for _, message := range permissionMessages {
+		if strings.Contains(output, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// run name with args until it exits or ctx is done, returning its stdout,
+// stderr, and exit code, which is -1 if it did not run to completion;
+// the error reports a command killed when ctx expired as ErrCommandTimeout
+// and a failure caused by missing privileges as ErrPermissionDenied;
+// tests replace it with a fake runner
+var runCommand = func(ctx context.Context, name string, args ...string) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Run()
+	code := -1
+	if cmd.ProcessState != nil {
+		code = cmd.ProcessState.ExitCode()
+	}
+	err = commandError(ctx, cmd.String(), err, stdout.String(), stderr.String())
+	attrs := []any{"args", cmd.Args, "duration", time.Since(start), "exit", code, "output", stdout.String()}
+	if stderr.Len() > 0 {
+		attrs = append(attrs, "stderr", stderr.String())
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	debugLog("exec", attrs...)
+	return stdout.String(), stderr.String(), code, err
+}
+
+// run a supervisor command with runCommand, killing it after timeout, or
+// after defaultCommandTimeout when timeout is zero
+func runTimeout(timeout time.Duration, name string, args ...string) (string, string, int, error) {
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return runCommand(ctx, name, args...)
+}
+
+// return true if err only reports that a command ran and exited nonzero
+func exitFailure(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && !errors.Is(err, errTransient)
+}
+
+// pass a command's output on, as rcctl and systemctl report progress
+func printOutput(stdout, stderr string) {
+	fmt.Fprint(os.Stdout, stdout)
+	fmt.Fprint(os.Stderr, stderr)
+}
+
+// replace the kill error of a timed out command, which would otherwise
+// look like an ordinary nonzero exit, and the exit error of a command
+// refused for lack of privileges or failing in a way worth retrying;
+// other failures are reported with the command line and its stderr
+func commandError(ctx context.Context, command string, err error, stdout, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	output := strings.TrimSpace(stdout + stderr)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s: %w", ErrCommandTimeout, command, ctx.Err())
+	}
+	if permissionDenied(output) {
+		return fmt.Errorf("%w: %s: %s", ErrPermissionDenied, command, output)
+	}
+	if transientFailure(output) {
+		return fmt.Errorf("%w: %s: %w: %s", errTransient, command, err, output)
+	}
+	if message := strings.TrimSpace(stderr); message != "" {
+		return fmt.Errorf("%s: %w: %s", command, err, message)
+	}
+	return fmt.Errorf("%s: %w", command, err)
+}
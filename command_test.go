@@ -0,0 +1,55 @@
+package daemon
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	initTestConfig(t)
+	fakeCommand(t, "svc", `echo "$1"; echo "svc: fatal: unable to control $2" >&2; exit 111`)
+
+	stdout, stderr, code, err := runTimeout(0, "svc", "-u", "/service/testd")
+	require.Equal(t, "-u\n", stdout)
+	require.Equal(t, "svc: fatal: unable to control /service/testd\n", stderr)
+	require.Equal(t, 111, code)
+	require.ErrorContains(t, err, "exit status 111: svc: fatal: unable to control /service/testd")
+	require.True(t, exitFailure(err))
+
+	fakeCommand(t, "svc", `echo "svc: warning: unable to control $2: access denied" >&2; exit 111`)
+	_, _, _, err = runTimeout(0, "svc", "-u", "/service/testd")
+	require.ErrorIs(t, err, ErrPermissionDenied)
+	require.False(t, exitFailure(err))
+
+	_, _, code, err = runTimeout(0, "no-such-command")
+	require.Equal(t, -1, code)
+	require.False(t, exitFailure(err))
+}
+
+func TestFakeRunner(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeCommand(t, "systemctl", "exit 0")
+	saved := runCommand
+	t.Cleanup(func() { runCommand = saved })
+	commands := []string{}
+	runCommand = func(ctx context.Context, name string, args ...string) (string, string, int, error) {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		if len(args) > 0 && args[0] == "is-active" {
+			return "", "", 3, &exec.ExitError{}
+		}
+		return "", "", 0, nil
+	}
+
+	d, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.False(t, running)
+	require.Equal(t, []string{"systemctl daemon-reload", "systemctl is-active --quiet testd"}, commands)
+}
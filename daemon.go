@@ -23,68 +23,1713 @@ THE SOFTWARE.
 package daemon
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/rstms/go-common"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
 	"os/user"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const Version = "0.0.20"
 
+// system locations used by the unix backends
+var (
+	serviceRoot = "/etc/service"
+	svcRoot     = "/var/svc.d"
+	svRoot      = "/etc/sv"
+	s6Root      = "/etc/s6/sv"
+	s6ScanRoot  = "/run/service"
+	logRoot     = "/var/log"
+	binRoot     = "/usr/local/bin"
+	rcRoot      = "/etc/rc.d"
+	rcConfRoot  = "/etc/rc.conf.d"
+	systemdRoot = "/etc/systemd/system"
+	systemdRun  = "/run/systemd/system"
+)
+
+var linuxBackends = []string{"daemontools", "runit", "s6", "systemd"}
+
+const defaultStopTimeout = 10 * time.Second
+
+const defaultLogSize = 10000000
+
+const defaultLogKeep = 10
+
+// time allowed for a killed process to exit
+const killTimeout = 5 * time.Second
+
+const pollInterval = 250 * time.Millisecond
+
+// daemon instances created by NewDaemon, keyed by name
+var registry = struct {
+	sync.Mutex
+	daemons map[string]CobraDaemon
+}{daemons: make(map[string]CobraDaemon)}
+
+// each backend names its supervisor and the commands it runs
+type supervisorTools interface {
+	tools() (string, []string)
+}
+
+// a daemon managed by one of the backends; NewDaemonFromSpec leaves the
+// global config unchanged, so daemons may be created from separate
+// goroutines, and distinct instances are safe to use from them, but a
+// single instance is not
 type CobraDaemon interface {
 	Install() error
 	Delete() error
+	Purge() error
+	Enable() error
+	Disable() error
 	Start() error
 	Stop() error
+	Restart() error
 	GetConfig() (string, error)
+	GetDaemonConfig() (*DaemonConfig, error)
+	DesiredConfig() (*DaemonConfig, error)
+	ConfigFiles() ([]ConfigFile, error)
+	Paths() map[string]string
+	LogPath() (string, error)
+	SetConfig(config string) error
 	Query() (bool, error)
+	Status() (DaemonState, error)
+	Pid() (int, error)
+	Validate() error
+	Capabilities() DaemonCapabilities
+	Commands(action string) ([][]string, error)
+}
+
+// the optional features a backend supports; the cli hides the commands
+// and flags for the others
+type DaemonCapabilities struct {
+	Pid          bool // Pid reports the process id
+	PidFile      bool // daemon.pidfile
+	StopSignal   bool // daemon.stop_signal other than TERM
+	Dependencies bool // daemon.after and daemon.requires
+	LogService   bool // a separately supervised log service, see QueryLog
+	Sandbox      bool // daemon.sandbox and its directives
+	Oneshot      bool // daemon.type=oneshot
+}
+
+// return the run directory of a daemon given none: the user's home, or for
+// a service account whose home is missing, such as nobody's /nonexistent,
+// /var/empty where the system has it, or the root directory
+func defaultDir(u *user.User) string {
+	if u.HomeDir != "" && common.IsDir(u.HomeDir) {
+		return u.HomeDir
+	}
+	dir := filepath.VolumeName(os.Getenv("SystemRoot")) + string(filepath.Separator)
+	if common.IsDir("/var/empty") {
+		dir = "/var/empty"
+	}
+	debugLog("no home directory", "user", u.Username, "home", u.HomeDir, "dir", dir)
+	return dir
+}
+
+// the configuration of a daemon, created by NewDaemonFromSpec, and its
+// desired state for Apply; Config holds the daemon.* settings without the
+// prefix, such as group, env, limits.memory, or start_type, and a nil
+// Enabled or Running leaves that state as it is
+type DaemonSpec struct {
+	Name       string            `yaml:"name"`
+	User       string            `yaml:"user"`
+	Dir        string            `yaml:"dir"`
+	Executable string            `yaml:"executable"`
+	Args       []string          `yaml:"args"`
+	Config     map[string]string `yaml:"config"`
+	Enabled    *bool             `yaml:"enabled"`
+	Running    *bool             `yaml:"running"`
+}
+
+// the state Status reports: a stopped daemon was stopped or never started,
+// while a failed one exited on its own and is down or waiting for its
+// supervisor to start it again
+type DaemonState string
+
+const (
+	StateRunning DaemonState = "running"
+	StateStopped DaemonState = "stopped"
+	StateFailed  DaemonState = "failed"
+)
+
+// installed daemon configuration parsed from the backend's native format;
+// fields a backend doesn't record are left empty and omitted from yaml and
+// json output
+type DaemonConfig struct {
+	Name       string            `yaml:"name,omitempty" json:"name,omitempty"`
+	User       string            `yaml:"user,omitempty" json:"user,omitempty"`
+	Executable string            `yaml:"executable,omitempty" json:"executable,omitempty"`
+	Args       []string          `yaml:"args,omitempty" json:"args,omitempty"`
+	Dir        string            `yaml:"dir,omitempty" json:"dir,omitempty"`
+	Env        map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	Enabled    bool              `yaml:"enabled" json:"enabled"`
 }
 
+// the positional form of NewDaemonFromSpec, kept for compatibility
 func NewDaemon(name, username, dir, command string, args ...string) (CobraDaemon, error) {
+	return NewDaemonFromSpec(DaemonSpec{Name: name, User: username, Dir: dir, Executable: command, Args: args})
+}
+
+// create the daemon spec describes with the backend selected on this host;
+// the Config settings override the global config for this daemon only, the
+// user defaults to the current user and the run directory to its home, or to /
+// or /var/empty for an account without one
+func NewDaemonFromSpec(spec DaemonSpec) (CobraDaemon, error) {
+	err := spec.validate()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	settings := daemonSettings(spec.Config)
+
+	taskUser, err := daemonUser(settings, spec.User)
+	if err != nil {
+		return nil, fatal(err)
+	}
+
+	if spec.Dir == "" {
+		spec.Dir = defaultDir(taskUser)
+	}
+
+	// with daemon.create_dir set, a missing run directory is created by Install
+	if !common.IsDir(spec.Dir) && !(settings.getBool("daemon.create_dir") && !common.IsFile(spec.Dir)) {
+		return nil, fatalf("not directory: %s", spec.Dir)
+	}
+
+	backend, err := platformBackend(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	spec.User = taskUser.Username
+	daemon, err := backend.factory(spec)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// fail here rather than with an exec error from the first command run
+	if supervisor, ok := daemon.(supervisorTools); ok {
+		err = checkTools(supervisor.tools())
+		if err != nil {
+			return nil, fatal(err)
+		}
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.daemons[spec.Name] = daemon
+	return daemon, nil
+}
+
+// the daemon names NewDaemon accepts
+var validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
 
-	if !regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`).MatchString(name) {
-		return nil, common.Fatalf("invalid characters in name: %s", name)
+// config keys are given without the daemon. prefix
+var specConfigKey = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)*$`)
+
+// check the fields of a spec that don't depend on the host
+func (spec *DaemonSpec) validate() error {
+	if !validName.MatchString(spec.Name) {
+		return fatalf("invalid characters in name: %s", spec.Name)
+	}
+	if spec.Executable == "" {
+		return fatalf("no executable for %s", spec.Name)
 	}
+	for key := range spec.Config {
+		if strings.HasPrefix(key, "daemon.") {
+			return fatalf("invalid config key %s: give it without the daemon. prefix", key)
+		}
+		if !specConfigKey.MatchString(key) {
+			return fatalf("invalid config key: %s", key)
+		}
+	}
+	return nil
+}
 
+// return the user the daemon runs as, the current user if username is
+// empty, with daemon.group as its primary group when set; windows tasks
+// have no process group and ignore it
+func daemonUser(settings daemonSettings, username string) (*user.User, error) {
 	taskUser, err := user.Current()
 	if err != nil {
-		return nil, common.Fatal(err)
+		return nil, fatal(err)
 	}
 	if username != "" {
-		taskUser, err = user.Lookup(username)
+		taskUser, err = lookupUser(username)
+		if err != nil {
+			return nil, fatal(err)
+		}
+	}
+	groupname := settings.getString("daemon.group")
+	if groupname != "" {
+		group, err := user.LookupGroup(groupname)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		override := *taskUser
+		override.Gid = group.Gid
+		taskUser = &override
+	}
+	return taskUser, nil
+}
+
+// look up username, accepting the windows built-in principals SYSTEM,
+// LocalSystem, LocalService and NetworkService on windows
+func lookupUser(username string) (*user.User, error) {
+	if runtime.GOOS == "windows" {
+		principal, ok := windowsPrincipal(username)
+		if ok {
+			return principal, nil
+		}
+	}
+	return user.Lookup(username)
+}
+
+// render the fields compared by Diff one per line; Enabled is left out
+// because it follows start and stop rather than the install spec
+func (c *DaemonConfig) lines() []string {
+	lines := []string{
+		"name: " + c.Name,
+		"user: " + c.User,
+		"executable: " + c.Executable,
+		"dir: " + c.Dir,
+	}
+	for _, arg := range c.Args {
+		lines = append(lines, fmt.Sprintf("arg: %q", arg))
+	}
+	keys := []string{}
+	for key := range c.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("env: %s=%q", key, c.Env[key]))
+	}
+	for i := range lines {
+		lines[i] += "\n"
+	}
+	return lines
+}
+
+// render the config as yaml or json for show --output
+func (c *DaemonConfig) format(output string) (string, error) {
+	switch output {
+	case "yaml":
+		data, err := yaml.Marshal(c)
+		if err != nil {
+			return "", fatal(err)
+		}
+		return strings.TrimSuffix(string(data), "\n"), nil
+	case "json":
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return "", fatal(err)
+		}
+		return string(data), nil
+	}
+	return "", fatalf("invalid output format: %q; expected yaml, json, or raw", output)
+}
+
+// return a unified diff of the installed config against the config Install
+// would write now, or an empty string if they match
+func Diff(d CobraDaemon) (string, error) {
+	installed, err := d.GetDaemonConfig()
+	if err != nil {
+		return "", fatal(err)
+	}
+	desired, err := d.DesiredConfig()
+	if err != nil {
+		return "", fatal(err)
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        installed.lines(),
+		B:        desired.lines(),
+		FromFile: "installed",
+		ToFile:   "desired",
+		Context:  3,
+	})
+	if err != nil {
+		return "", fatal(err)
+	}
+	return diff, nil
+}
+
+// delete and install d, starting it again if it was running; a daemon that
+// isn't installed yet is only installed, and a oneshot is not run again
+func Reinstall(d CobraDaemon) error {
+	unlock, err := lockOperation(d)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	running, err := d.Query()
+	if err != nil && !errors.Is(err, ErrNotInstalled) {
+		return fatal(err)
+	}
+	if err == nil {
+		err = d.Delete()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	err = d.Install()
+	if err != nil {
+		return fatal(err)
+	}
+	if running && !isOneshot(d) {
+		err = d.Start()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
+
+// a backend that can rewrite its installed config without deleting it
+type configReplacer interface {
+	// the executable install copies and the copy the daemon runs
+	binaries() (string, string)
+	// write the config files that differ from the installed ones and
+	// report whether any did
+	rewriteConfig() (bool, error)
+}
+
+// update d in place: when the binary it runs is unchanged, rewrite its
+// config files and restart it only if one changed while it is running,
+// so it keeps running through a config change; a changed binary, or a
+// backend that can't rewrite its config in place, is reinstalled, and a
+// daemon that isn't installed yet is installed
+func Replace(d CobraDaemon) error {
+	unlock, err := lockOperation(d)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	installed, err := d.GetDaemonConfig()
+	if errors.Is(err, ErrNotInstalled) {
+		err = d.Install()
+		if err != nil {
+			return fatal(err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fatal(err)
+	}
+	r, ok := d.(configReplacer)
+	if !ok {
+		debugLog("reinstall", "name", installed.Name, "reason", "no in place update")
+		return Reinstall(d)
+	}
+	desired, err := d.DesiredConfig()
+	if err != nil {
+		return fatal(err)
+	}
+	source, binary := r.binaries()
+	changed := installed.Executable != desired.Executable
+	if !changed && source != binary {
+		same, err := sameContents(source, binary)
+		if err != nil {
+			return fatal(err)
+		}
+		changed = !same
+	}
+	if changed {
+		debugLog("reinstall", "name", installed.Name, "reason", "binary changed")
+		return Reinstall(d)
+	}
+	rewritten, err := r.rewriteConfig()
+	if err != nil {
+		return fatal(err)
+	}
+	if !rewritten || isOneshot(d) {
+		return nil
+	}
+	running, err := d.Query()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		err = d.Restart()
 		if err != nil {
-			return nil, common.Fatal(err)
+			return fatal(err)
 		}
 	}
+	return nil
+}
 
-	taskDir := dir
-	if taskDir == "" {
-		taskDir = taskUser.HomeDir
+// report whether two files hold the same bytes; a missing file matches
+// nothing
+func sameContents(a, b string) (bool, error) {
+	aData, err := os.ReadFile(a)
+	if err != nil {
+		return false, fatal(err)
+	}
+	bData, err := os.ReadFile(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fatal(err)
 	}
+	return bytes.Equal(aData, bData), nil
+}
 
-	if !common.IsDir(taskDir) {
-		return nil, common.Fatalf("not directory: %s", taskDir)
+// write each file whose content differs from the one on disk, and report
+// whether any did
+func rewriteFiles(files []ConfigFile) (bool, error) {
+	changed := false
+	for _, file := range files {
+		data, err := os.ReadFile(file.Path)
+		if err == nil && bytes.Equal(data, file.Data) {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return false, fatal(err)
+		}
+		err = os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			return false, fatal(err)
+		}
+		err = writeFileAtomic(file.Path, file.Data, file.Mode)
+		if err != nil {
+			return false, fatal(err)
+		}
+		changed = true
 	}
+	return changed, nil
+}
+
+// a backend that runs a copy of its executable
+type binaryUpdater interface {
+	// the executable install copies and the copy the daemon runs
+	binaries() (string, string)
+	// copy the executable over the installed copy
+	updateBinary() error
+}
 
-	var daemon CobraDaemon
-	switch runtime.GOOS {
-	case "windows":
-		daemon, err = NewWindowsTask(name, taskUser, taskDir, command, args...)
+// copy d's executable over the binary the installed daemon runs, leaving
+// its config alone, and report whether the binary changed; with restart a
+// running daemon is restarted after a change
+func UpdateBinary(d CobraDaemon, restart bool) (bool, error) {
+	installed, err := d.GetDaemonConfig()
+	if err != nil {
+		return false, fatal(err)
+	}
+	u, ok := d.(binaryUpdater)
+	if !ok {
+		return false, fatalf("%w: %s does not copy its binary; use reinstall", ErrNotSupported, installed.Name)
+	}
+	source, binary := u.binaries()
+	if source == binary {
+		return false, fatalf("%w: %s runs %s in place; copy_binary is false", ErrNotSupported, installed.Name, binary)
+	}
+	desired, err := d.DesiredConfig()
+	if err != nil {
+		return false, fatal(err)
+	}
+	if installed.Executable != desired.Executable {
+		return false, fatalf("%s runs %s, not %s; use install --replace", installed.Name, installed.Executable, desired.Executable)
+	}
+	same, err := sameContents(source, binary)
+	if err != nil {
+		return false, fatal(err)
+	}
+	if same {
+		return false, nil
+	}
+	err = u.updateBinary()
+	if err != nil {
+		return false, fatal(err)
+	}
+	if !restart || isOneshot(d) {
+		return true, nil
+	}
+	running, err := d.Query()
+	if err != nil {
+		return true, fatal(err)
+	}
+	if running {
+		err = d.Restart()
 		if err != nil {
-			return nil, common.Fatal(err)
+			return true, fatal(err)
+		}
+	}
+	return true, nil
+}
+
+// enable or disable the installed daemon and report whether its state
+// changed; one already in that state is left alone, as read from the down
+// file of daemontools, runit and s6, systemctl is-enabled, rcctl, or the
+// enabled flag of the windows task or service start type
+func SetEnabled(d CobraDaemon, enabled bool) (bool, error) {
+	config, err := d.GetDaemonConfig()
+	if err != nil {
+		return false, fatal(err)
+	}
+	if config.Enabled == enabled {
+		return false, nil
+	}
+	if enabled {
+		err = d.Enable()
+	} else {
+		err = d.Disable()
+	}
+	if err != nil {
+		return false, fatal(err)
+	}
+	return true, nil
+}
+
+// flags a program offers to install itself, left out of the installed
+// daemon's arguments
+var installSelfFlags = []string{"--install-service"}
+
+// install the running binary as a daemon that runs with the arguments of
+// this invocation followed by extraArgs; the name defaults to the binary
+// name, and daemon.name, daemon.user, and daemon.dir apply as they do for
+// the daemon commands
+func InstallSelf(extraArgs ...string) error {
+	binary, name, err := executableDefaults()
+	if err != nil {
+		return fatal(err)
+	}
+	if common.ViperGetString("daemon.name") != "" {
+		name = common.ViperGetString("daemon.name")
+	}
+	args := []string{}
+	for _, arg := range os.Args[1:] {
+		if !slices.Contains(installSelfFlags, arg) {
+			args = append(args, arg)
+		}
+	}
+	args = append(args, extraArgs...)
+	d, err := NewDaemon(name, common.ViperGetString("daemon.user"), common.ViperGetString("daemon.dir"), binary, args...)
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.Install()
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// return the absolute path of the running binary, and its name without
+// an extension as the default daemon name
+func executableDefaults() (string, string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return "", "", fatal(err)
+	}
+	binary, err = filepath.Abs(binary)
+	if err != nil {
+		return "", "", fatal(err)
+	}
+	_, name := filepath.Split(binary)
+	name, _, _ = strings.Cut(name, ".")
+	return binary, name, nil
+}
+
+// time allowed for DownloadBinary
+const downloadTimeout = 5 * time.Minute
+
+// download the binary at source, an http or https url, to a file of the
+// same name in a new temp directory and make it executable, checking it
+// against the hex sha256 digest when one is given; the caller removes the
+// directory when it is done with the file
+func DownloadBinary(source, digest string) (string, error) {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return "", fatal(err)
+	}
+	name := path.Base(parsed.Path)
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || name == "." || name == "/" {
+		return "", fatalf("invalid binary url: %s", source)
+	}
+	client := http.Client{Timeout: downloadTimeout}
+	response, err := client.Get(source)
+	if err != nil {
+		return "", fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fatalf("download %s: %s", source, response.Status)
+	}
+	dir, err := os.MkdirTemp("", "cobra-daemon-")
+	if err != nil {
+		return "", fatal(err)
+	}
+	binary := filepath.Join(dir, name)
+	ofp, err := os.OpenFile(binary, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0755)
+	if err == nil {
+		_, err = io.Copy(ofp, response.Body)
+		if closeErr := ofp.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil && digest != "" {
+		err = checkDigest(binary, digest)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fatal(err)
+	}
+	debugLog("download", "url", source, "path", binary)
+	return binary, nil
+}
+
+// return an error unless the sha256 digest of the file is the hex digest
+func checkDigest(filename, digest string) error {
+	ifp, err := os.Open(filename)
+	if err != nil {
+		return fatal(err)
+	}
+	defer ifp.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, ifp)
+	if err != nil {
+		return fatal(err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(sum, digest) {
+		return fatalf("sha256 mismatch for %s: got %s, expected %s", filename, sum, digest)
+	}
+	return nil
+}
+
+// return the daemon instance created by NewDaemon for name
+func LookupDaemon(name string) (CobraDaemon, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	daemon, ok := registry.daemons[name]
+	return daemon, ok
+}
+
+// return the sorted names of all daemon instances created by NewDaemon
+func DaemonNames() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := []string{}
+	for name := range registry.daemons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// select the linux service manager from daemon.linux.backend or by
+// inspecting the host, preferring an installed supervisor over systemd
+func linuxBackend(settings daemonSettings) (string, error) {
+	backend := settings.getString("daemon.linux.backend")
+	if backend != "" {
+		for _, name := range linuxBackends {
+			if backend == name {
+				return backend, nil
+			}
+		}
+		return "", fatalf("%w: unsupported linux backend: %s", ErrNotSupported, backend)
+	}
+	checked := []string{}
+	hasCommands := func(commands ...string) bool {
+		for _, command := range commands {
+			_, err := exec.LookPath(command)
+			if err != nil {
+				checked = append(checked, command+" not found in PATH")
+				return false
+			}
+		}
+		return true
+	}
+	hasDir := func(dir string) bool {
+		if !common.IsDir(dir) {
+			checked = append(checked, dir+" not found")
+			return false
+		}
+		return true
+	}
+	if hasCommands("svc", "svstat") && hasDir(serviceRoot) {
+		return "daemontools", nil
+	}
+	if hasCommands("sv") && hasDir(svRoot) && hasDir(serviceRoot) {
+		return "runit", nil
+	}
+	if hasDir(systemdRun) && hasCommands("systemctl") {
+		return "systemd", nil
+	}
+	return "", fatalf("%w: no usable linux backend: %s", ErrSupervisorUnavailable, strings.Join(checked, "; "))
+}
+
+// return the configured daemon.stop_timeout duration
+func stopTimeout(settings daemonSettings) (time.Duration, error) {
+	value := settings.getString("daemon.stop_timeout")
+	if value == "" {
+		return defaultStopTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fatalf("invalid stop_timeout: %s", value)
+	}
+	return timeout, nil
+}
+
+// signals that may be configured with daemon.stop_signal
+var stopSignals = []string{"TERM", "INT", "HUP", "QUIT", "USR1", "USR2", "ALRM", "KILL"}
+
+// return the configured daemon.stop_signal name without a SIG prefix,
+// TERM if unset
+func stopSignal(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.stop_signal")
+	if value == "" {
+		return "TERM", nil
+	}
+	signal := strings.TrimPrefix(strings.ToUpper(value), "SIG")
+	if !slices.Contains(stopSignals, signal) {
+		return "", fatalf("invalid stop_signal: %s", value)
+	}
+	return signal, nil
+}
+
+// return the configured daemon.nice value, or "" if unset
+func niceness(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.nice")
+	if value == "" {
+		return "", nil
+	}
+	nice, err := strconv.Atoi(value)
+	if err != nil || nice < -20 || nice > 19 {
+		return "", fatalf("invalid nice: %s", value)
+	}
+	return strconv.Itoa(nice), nil
+}
+
+// return the configured daemon.umask as four octal digits, or "" if unset
+func umask(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.umask")
+	if value == "" {
+		return "", nil
+	}
+	mask, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mask > 0777 {
+		return "", fatalf("invalid umask: %s", value)
+	}
+	return fmt.Sprintf("%04o", mask), nil
+}
+
+// return the systemd sandbox directives; daemon.sandbox sets
+// ProtectSystem=full, PrivateTmp=yes, and NoNewPrivileges=yes, and
+// daemon.protect_system, daemon.private_tmp, daemon.no_new_privileges, and
+// daemon.read_only_paths set or override them one at a time
+func sandbox(settings daemonSettings) ([]string, error) {
+	enabled := settings.getBool("daemon.sandbox")
+	directives := []string{}
+	protect := settings.getString("daemon.protect_system")
+	switch protect {
+	case "full", "strict":
+	case "":
+		if enabled {
+			protect = "full"
 		}
-	case "openbsd":
-		daemon, err = NewRCDaemon(name, taskUser, taskDir, command, args...)
+	default:
+		value, err := sandboxSwitch(settings, "daemon.protect_system", false)
 		if err != nil {
-			return nil, common.Fatal(err)
+			return nil, fatalf("invalid protect_system: %s; expected yes, no, full, or strict", protect)
 		}
-	case "linux":
-		daemon, err = NewDaemontools(name, taskUser, taskDir, command, args...)
+		protect = value
+	}
+	if protect != "" {
+		directives = append(directives, "ProtectSystem="+protect)
+	}
+	for _, directive := range []struct{ key, name string }{
+		{"daemon.private_tmp", "PrivateTmp"},
+		{"daemon.no_new_privileges", "NoNewPrivileges"},
+	} {
+		value, err := sandboxSwitch(settings, directive.key, enabled)
 		if err != nil {
-			return nil, common.Fatal(err)
+			return nil, fatal(err)
 		}
+		if value != "" {
+			directives = append(directives, directive.name+"="+value)
+		}
+	}
+	paths := settings.getStringSlice("daemon.read_only_paths")
+	for _, path := range paths {
+		// a - prefix ignores a path that does not exist
+		if !filepath.IsAbs(strings.TrimPrefix(path, "-")) || strings.ContainsAny(path, " \t\n\r") {
+			return nil, fatalf("invalid read_only_paths entry: %q", path)
+		}
+	}
+	if len(paths) > 0 {
+		directives = append(directives, "ReadOnlyPaths="+strings.Join(paths, " "))
+	}
+	return directives, nil
+}
+
+// return yes or no for the boolean set for key, or with it unset, yes if
+// enabled and "" otherwise
+func sandboxSwitch(settings daemonSettings, key string, enabled bool) (string, error) {
+	value := settings.getString(key)
+	if value == "" {
+		if enabled {
+			return "yes", nil
+		}
+		return "", nil
+	}
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", fatalf("invalid %s: %s", strings.TrimPrefix(key, "daemon."), value)
+	}
+	if on {
+		return "yes", nil
+	}
+	return "no", nil
+}
+
+// return daemon.start_type: auto enables the daemon at install, manual
+// installs it so it runs only when started, and disabled keeps it from
+// starting; unset, install leaves the daemon stopped and disabled until
+// Start enables it. daemon.install_stopped=false selects auto, and true
+// only checks that start_type is not auto.
+func startType(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.start_type")
+	switch value {
+	case "", "auto", "manual", "disabled":
 	default:
-		return nil, common.Fatalf("unsuported os: %s", runtime.GOOS)
+		return "", fatalf("invalid start_type: %s; expected auto, manual, or disabled", value)
 	}
-	return daemon, nil
+	stopped := settings.getString("daemon.install_stopped")
+	if stopped == "" {
+		return value, nil
+	}
+	installStopped, err := strconv.ParseBool(stopped)
+	if err != nil {
+		return "", fatalf("invalid install_stopped: %s", stopped)
+	}
+	switch {
+	case installStopped && value == "auto":
+		return "", fatalf("install_stopped conflicts with start_type auto")
+	case !installStopped && value == "":
+		return "auto", nil
+	case !installStopped && value != "auto":
+		return "", fatalf("install_stopped=false conflicts with start_type %s", value)
+	}
+	return value, nil
+}
+
+// return daemon.type: simple for a supervised daemon, the default, or
+// oneshot for a task that runs once each time it is started and exits
+func daemonType(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.type")
+	switch value {
+	case "", "simple":
+		return "simple", nil
+	case "oneshot":
+		return value, nil
+	}
+	return "", fatalf("invalid type: %s; expected simple or oneshot", value)
+}
+
+// report whether d is a oneshot task, whose Query reports whether its
+// last run succeeded rather than whether it is running
+func isOneshot(d CobraDaemon) bool {
+	task, ok := d.(interface{ oneshot() bool })
+	return ok && task.oneshot()
+}
+
+// refuse to start a daemon installed with start_type disabled
+func checkStartType(name, startType string) error {
+	if startType == "disabled" {
+		return fatalf("%s has start_type disabled and is not started", name)
+	}
+	return nil
+}
+
+// return the configured daemon.cpuaffinity list of cpus and ranges, such
+// as 0-3,7, or "" if unset
+func cpuAffinity(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.cpuaffinity")
+	if value == "" {
+		return "", nil
+	}
+	for _, cpus := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(cpus, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return "", fatalf("invalid cpuaffinity: %s", value)
+		}
+		if isRange {
+			end, err := strconv.Atoi(last)
+			if err != nil || end < start {
+				return "", fatalf("invalid cpuaffinity: %s", value)
+			}
+		}
+	}
+	return value, nil
+}
+
+// return the daemon.ionice class and priority level from CLASS[:LEVEL],
+// where CLASS is realtime, best-effort, or idle and LEVEL is 0..7
+func ioScheduling(settings daemonSettings) (string, string, error) {
+	value := settings.getString("daemon.ionice")
+	if value == "" {
+		return "", "", nil
+	}
+	class, level, hasLevel := strings.Cut(value, ":")
+	switch class {
+	case "realtime", "best-effort":
+	case "idle":
+		if hasLevel {
+			return "", "", fatalf("invalid ionice: idle takes no level: %s", value)
+		}
+	default:
+		return "", "", fatalf("invalid ionice class: %s", class)
+	}
+	if hasLevel {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return "", "", fatalf("invalid ionice level: %s", level)
+		}
+	}
+	return class, level, nil
+}
+
+// time a run script waits for a daemon.after dependency before starting anyway
+const afterWait = 10
+
+var dependencyName = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.@-]*$`)
+
+// return the daemon.after names this daemon starts after and the
+// daemon.requires names it will not run without
+func dependencies(settings daemonSettings) ([]string, []string, error) {
+	after := settings.getStringSlice("daemon.after")
+	requires := settings.getStringSlice("daemon.requires")
+	for _, name := range append(append([]string{}, after...), requires...) {
+		if !dependencyName.MatchString(name) {
+			return nil, nil, fatalf("invalid dependency name: %s", name)
+		}
+	}
+	return after, requires, nil
+}
+
+// return the daemon.prestart and daemon.poststop shell commands; both run
+// as root, except in windows tasks. prestart runs after any dependency
+// checks and must succeed before the daemon starts; poststop runs after the
+// daemon exits and its failure is ignored
+func hooks(settings daemonSettings) (string, string, error) {
+	commands := []string{}
+	for _, key := range []string{"daemon.prestart", "daemon.poststop"} {
+		command := ""
+		if value := settings.get(key); value != nil {
+			var ok bool
+			command, ok = value.(string)
+			if !ok {
+				return "", "", fatalf("%s must be a command string", key)
+			}
+		}
+		if command != "" && strings.TrimSpace(command) == "" {
+			return "", "", fatalf("%s command is empty", key)
+		}
+		commands = append(commands, command)
+	}
+	return commands[0], commands[1], nil
+}
+
+// return daemon.extra_config, text the unix backends add verbatim to the
+// config they generate for directives the package doesn't model, ending
+// with a newline; a line starting with one of markers would end or run
+// the generated config early, so it is refused
+func extraConfig(settings daemonSettings, markers ...string) (string, error) {
+	extra := settings.getString("daemon.extra_config")
+	if strings.TrimSpace(extra) == "" {
+		return "", nil
+	}
+	if strings.ContainsRune(extra, 0) {
+		return "", fatalf("invalid extra_config: contains a NUL byte")
+	}
+	for _, line := range strings.Split(extra, "\n") {
+		for _, marker := range markers {
+			if strings.HasPrefix(strings.TrimSpace(line), marker) {
+				return "", fatalf("invalid extra_config line: %q", line)
+			}
+		}
+	}
+	return strings.TrimRight(extra, "\n") + "\n", nil
+}
+
+// report a stop failure that a forced Delete continues past
+func forceWarning(name string, err error) {
+	fmt.Fprintf(os.Stderr, "warning: %s: stop failed, removing anyway: %v\n", name, err)
+}
+
+// fail unless each dependency is installed
+func checkDependencies(names []string, installed func(string) bool) error {
+	for _, name := range names {
+		if !installed(name) {
+			return fatalf("dependency not installed: %s", name)
+		}
+	}
+	return nil
+}
+
+// parse a byte count with an optional K, M, G, or T binary suffix
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		trimmed, ok := strings.CutSuffix(number, suffix)
+		if ok {
+			number = trimmed
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fatalf("invalid size: %s", value)
+	}
+	return size * multiplier, nil
+}
+
+// return the daemon.limits.memory bytes and daemon.limits.nofile count,
+// zero when unset
+func resourceLimits(settings daemonSettings) (int64, int, error) {
+	var memory int64
+	value := settings.getString("daemon.limits.memory")
+	if value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return 0, 0, fatalf("invalid limits.memory: %w", err)
+		}
+		memory = size
+	}
+	nofile := settings.getInt("daemon.limits.nofile")
+	if nofile < 0 {
+		return 0, 0, fatalf("invalid limits.nofile: %d", nofile)
+	}
+	return memory, nofile, nil
+}
+
+// return the configured daemon.log_size bytes per file and daemon.log_keep file count;
+// only multilog and svlogd use these, openbsd and windows leave rotation to
+// newsyslog and the program itself and systemd to the journald configuration
+func logRotation(settings daemonSettings) (int, int, error) {
+	size := settings.getInt("daemon.log_size")
+	if size == 0 {
+		size = defaultLogSize
+	}
+	keep := settings.getInt("daemon.log_keep")
+	if keep == 0 {
+		keep = defaultLogKeep
+	}
+	// multilog requires at least 4096 bytes and 2 files
+	if size < 4096 {
+		return 0, 0, fatalf("invalid log_size: %d", size)
+	}
+	if keep < 2 {
+		return 0, 0, fatalf("invalid log_keep: %d", keep)
+	}
+	return size, keep, nil
+}
+
+// poll isUp until it returns false or the timeout elapses; return true if stopped
+func waitStopped(isUp func() (bool, error), timeout time.Duration) (bool, error) {
+	return waitStoppedContext(context.Background(), isUp, timeout)
+}
+
+// waitStopped, returning the ctx error if ctx is done first
+func waitStoppedContext(ctx context.Context, isUp func() (bool, error), timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		up, err := isUp()
+		if err != nil {
+			return false, fatal(err)
+		}
+		if !up {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		err = sleepContext(ctx, pollInterval)
+		if err != nil {
+			return false, fatal(err)
+		}
+	}
+}
+
+// sleep for delay, returning the ctx error if ctx is done first
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// poll d.Query until the daemon is running, or stopped when running is
+// false; return ErrWaitTimeout if it is not in that state after timeout
+func WaitFor(d CobraDaemon, running bool, timeout time.Duration) error {
+	return WaitForContext(context.Background(), d, running, timeout)
+}
+
+// WaitFor, returning the ctx error if ctx is cancelled before the daemon
+// reaches the state
+func WaitForContext(ctx context.Context, d CobraDaemon, running bool, timeout time.Duration) error {
+	reached, err := waitStoppedContext(ctx, func() (bool, error) {
+		up, err := d.Query()
+		return up != running, err
+	}, timeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if !reached {
+		state := "stopped"
+		if running {
+			state = "running"
+		}
+		return fatalf("%w: daemon not %s after %v", ErrWaitTimeout, state, timeout)
+	}
+	return nil
+}
+
+// wait until the supervisor knows the installed daemon, so it can be
+// started; rc.d scripts and the task scheduler know a daemon as soon as
+// it is installed, and return ErrSupervisorUnavailable after timeout
+func waitSupervised(ctx context.Context, d CobraDaemon, timeout time.Duration) error {
+	if s, ok := d.(interface {
+		waitSupervised(context.Context, time.Duration) error
+	}); ok {
+		return s.waitSupervised(ctx, timeout)
+	}
+	if i, ok := d.(interface{ installed() bool }); ok && !i.installed() {
+		config, err := d.DesiredConfig()
+		if err != nil {
+			return fatal(err)
+		}
+		return fatalf("%w: %s", ErrNotInstalled, config.Name)
+	}
+	return nil
+}
+
+// return the name of the user's Gid group and whether it differs from the
+// primary group in the user database
+func userGroup(u *user.User) (string, bool, error) {
+	group, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		return "", false, fatal(err)
+	}
+	account, err := user.Lookup(u.Username)
+	if err != nil {
+		return "", false, fatal(err)
+	}
+	return group.Name, account.Gid != u.Gid, nil
+}
+
+// look up the daemon.supplementary_groups the daemon runs with in addition
+// to its primary group
+func supplementaryGroups(settings daemonSettings) ([]*user.Group, error) {
+	groups := []*user.Group{}
+	for _, name := range settings.getStringSlice("daemon.supplementary_groups") {
+		if name == "" || strings.ContainsAny(name, ": \t\n\r") {
+			return nil, fatalf("invalid supplementary group: %q", name)
+		}
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			return nil, fatalf("supplementary group %s: %v", name, err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// return an error naming the supervisor and each tool not found in PATH
+func checkTools(supervisor string, tools []string) error {
+	errs := []error{}
+	for _, tool := range tools {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s not installed: %s not found in PATH", ErrSupervisorUnavailable, supervisor, tool))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// return an error if executable is not an executable regular file
+func checkExecutable(executable string) error {
+	info, err := os.Stat(executable)
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("executable is not a regular file: %s", executable)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("executable is not executable: %s", executable)
+	}
+	return nil
+}
+
+// return an error if the run directory is missing or cannot be written by uid/gid
+func checkRunDir(settings daemonSettings, dir, uid, gid string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) && settings.getBool("daemon.create_dir") {
+			return nil
+		}
+		return fmt.Errorf("run directory: %w", err)
+	}
+	return checkWritable("run directory", dir, info, uid, gid)
+}
+
+// return an error if the directory described by info cannot be written by uid/gid
+func checkWritable(label, dir string, info os.FileInfo, uid, gid string) error {
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory: %s", label, dir)
+	}
+	owner, group, ok := fileOwner(info)
+	if !ok || uid == "0" {
+		return nil
+	}
+	mode := info.Mode().Perm()
+	switch {
+	case owner == uid && mode&0200 != 0:
+	case group == gid && mode&0020 != 0:
+	case mode&0002 != 0:
+	default:
+		return fmt.Errorf("%s is not writable by uid %s: %s", label, uid, dir)
+	}
+	return nil
+}
+
+// create a missing run directory owned by the daemon user
+func createRunDir(dir, uid, gid string) error {
+	if common.IsDir(dir) {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("mkdir", "path", dir, "uid", uid, "gid", gid)
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	ownerUid, err := strconv.Atoi(uid)
+	if err != nil {
+		return fatal(err)
+	}
+	ownerGid, err := strconv.Atoi(gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chown(dir, ownerUid, ownerGid)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// create dir and any missing parents, each owned by the daemon user
+func createOwnedDirs(dir, uid, gid string) error {
+	if common.IsDir(dir) {
+		return nil
+	}
+	err := createOwnedDirs(filepath.Dir(dir), uid, gid)
+	if err != nil {
+		return fatal(err)
+	}
+	return createRunDir(dir, uid, gid)
+}
+
+// return the args that tell the daemon where to log: daemon.log_flag
+// (default -L) with the value - for stdout, or with logFile when it is set
+// (--logfile logFile when daemon.log_flag is unset); none with
+// daemon.inject_log_flag=false, for programs that accept neither
+func logArgs(settings daemonSettings, logFile string) ([]string, error) {
+	value := settings.getString("daemon.inject_log_flag")
+	if value != "" {
+		inject, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fatalf("invalid inject_log_flag: %s", value)
+		}
+		if !inject {
+			return nil, nil
+		}
+	}
+	flag := settings.getString("daemon.log_flag")
+	if flag != "" && !regexp.MustCompile(`^--?[a-zA-Z0-9][a-zA-Z0-9_-]*$`).MatchString(flag) {
+		return nil, fatalf("invalid log_flag: %s", flag)
+	}
+	switch {
+	case logFile != "" && flag == "":
+		return []string{"--logfile", logFile}, nil
+	case logFile != "" && strings.HasPrefix(flag, "--"):
+		return []string{flag + "=" + logFile}, nil
+	case logFile != "":
+		return []string{flag, logFile}, nil
+	case flag == "":
+		return []string{"-L-"}, nil
+	case strings.HasPrefix(flag, "--"):
+		return []string{flag + "=-"}, nil
+	}
+	return []string{flag + "-"}, nil
+}
+
+// return daemon.logfile, or defaultPath when it is unset
+func logPath(settings daemonSettings, defaultPath string) (string, error) {
+	path := settings.getString("daemon.logfile")
+	if path == "" {
+		return defaultPath, nil
+	}
+	if !filepath.IsAbs(path) {
+		return "", fatalf("logfile must be an absolute path: %s", path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// reject config content that can't be a valid replacement
+func checkConfig(config string) error {
+	if strings.TrimSpace(config) == "" {
+		return fatalf("config is empty")
+	}
+	return nil
+}
+
+// return the path the service runs: a copy of executable in binDir, or
+// executable itself when daemon.copy_binary is false
+func serviceBinary(settings daemonSettings, binDir, executable string) (string, error) {
+	value := settings.getString("daemon.copy_binary")
+	if value == "" {
+		return filepath.Join(binDir, filepath.Base(executable)), nil
+	}
+	copy, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", fatalf("invalid copy_binary: %s", value)
+	}
+	if copy {
+		return filepath.Join(binDir, filepath.Base(executable)), nil
+	}
+	if !filepath.IsAbs(executable) {
+		return "", fatalf("copy_binary=false requires an absolute executable path: %s", executable)
+	}
+	return executable, nil
+}
+
+// return daemon.chown_binary, which gives the copied binary to the daemon
+// user so it can replace it; false if unset
+func chownBinary(settings daemonSettings) (bool, error) {
+	value := settings.getString("daemon.chown_binary")
+	if value == "" {
+		return false, nil
+	}
+	chown, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fatalf("invalid chown_binary: %s", value)
+	}
+	return chown, nil
+}
+
+// daemon.split_logs sends stderr to its own log next to the stdout log
+func splitLogs(settings daemonSettings) (bool, error) {
+	value := settings.getString("daemon.split_logs")
+	if value == "" {
+		return false, nil
+	}
+	split, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fatalf("invalid split_logs: %s", value)
+	}
+	return split, nil
+}
+
+// return the file the daemon reads stdin from, set by daemon.stdin: null
+// or unset for /dev/null, an absolute path, or inherit, returned as an
+// empty string, to leave it connected as the supervisor leaves it
+func daemonStdin(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.stdin")
+	switch value {
+	case "", "null":
+		return os.DevNull, nil
+	case "inherit":
+		return "", nil
+	}
+	if !filepath.IsAbs(value) || strings.ContainsAny(value, "\n\r") {
+		return "", fatalf("invalid stdin: %q; expected null, inherit, or an absolute path", value)
+	}
+	return value, nil
+}
+
+// copy the executable via a temp file and rename so a binary shared by
+// several running instances is replaced rather than rewritten in place;
+// the copy is owned by uid and gid when uid is set, and an executable
+// that is run in place is left alone
+func copyBinary(src, dst, uid, gid string) error {
+	if src == dst {
+		return nil
+	}
+	ifp, err := os.Open(src)
+	if err != nil {
+		return fatal(err)
+	}
+	defer ifp.Close()
+	dir, basename := filepath.Split(dst)
+	ofp, err := os.CreateTemp(dir, "."+basename+"-*")
+	if err != nil {
+		return fatal(err)
+	}
+	defer os.Remove(ofp.Name())
+	_, err = io.Copy(ofp, ifp)
+	if err != nil {
+		ofp.Close()
+		return fatal(err)
+	}
+	err = ofp.Close()
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chmod(ofp.Name(), 0755)
+	if err != nil {
+		return fatal(err)
+	}
+	if uid != "" {
+		err = chownFile(ofp.Name(), uid, gid)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	err = os.Rename(ofp.Name(), dst)
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("copy", "src", src, "path", dst)
+	return nil
+}
+
+// fail early with ErrPermissionDenied when action needs root, or an
+// elevated Administrator on windows, and the process lacks it, rather than
+// with an error from the first file written
+func checkPrivileges(action, target string) error {
+	if privileged() {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		return fatalf("%w: %s %s needs Administrator; run it from an elevated prompt", ErrPermissionDenied, action, target)
+	}
+	return fatalf("%w: %s %s needs root; run it with sudo", ErrPermissionDenied, action, target)
+}
+
+// give path to uid and gid, which only root may do for another user
+func chownFile(path, uid, gid string) error {
+	ownerUid, err := strconv.Atoi(uid)
+	if err != nil {
+		return fatal(err)
+	}
+	ownerGid, err := strconv.Atoi(gid)
+	if err != nil {
+		return fatal(err)
+	}
+	if euid := os.Geteuid(); euid != 0 && euid != ownerUid {
+		return fatalf("%w: chown_binary to uid %s requires root", ErrPermissionDenied, uid)
+	}
+	err = os.Chown(path, ownerUid, ownerGid)
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("chown", "path", path, "uid", uid, "gid", gid)
+	return nil
+}
+
+// the comment line in each generated unix config file that marks it as ours
+const generatedMarker = "# generated by cobra-daemon"
+
+// report whether path exists and whether it holds generatedMarker
+func generatedFile(path string) (bool, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fatal(err)
+	}
+	return true, strings.Contains(string(data), generatedMarker+"\n"), nil
+}
+
+// refuse to install over path; a file without generatedMarker was put there
+// by something else, and is replaced only with force
+func checkInstallTarget(path string, force bool) error {
+	exists, ours, err := generatedFile(path)
+	if err != nil {
+		return fatal(err)
+	}
+	if !exists {
+		return nil
+	}
+	if ours {
+		return fatalf("%w: %s", ErrAlreadyInstalled, path)
+	}
+	if !force {
+		return fatalf("%w: %s was not installed by this program", ErrAlreadyInstalled, path)
+	}
+	return nil
+}
+
+// write data to a temp file in the destination directory and rename it into
+// place, so path holds either its previous content or all of data
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	dir, basename := filepath.Split(path)
+	ofp, err := os.CreateTemp(dir, "."+basename+"-*")
+	if err != nil {
+		return fatal(err)
+	}
+	defer os.Remove(ofp.Name())
+	_, err = ofp.Write(data)
+	if err != nil {
+		ofp.Close()
+		return fatal(err)
+	}
+	err = ofp.Close()
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chmod(ofp.Name(), mode)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Rename(ofp.Name(), path)
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("write", "path", path, "mode", mode, "size", len(data))
+	return nil
+}
+
+// create a symlink to target at a dot-prefixed temp name beside path, which
+// supervisors scanning the directory skip, and rename it over path, so an
+// existing link is repointed without path ever going missing; a directory
+// at path can't be renamed over and is removed first
+func symlinkAtomic(target, path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.IsDir() {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	dir, basename := filepath.Split(path)
+	temp := filepath.Join(dir, fmt.Sprintf(".%s-%d", basename, os.Getpid()))
+	err = os.Remove(temp)
+	if err != nil && !os.IsNotExist(err) {
+		return fatal(err)
+	}
+	err = os.Symlink(target, temp)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Rename(temp, path)
+	if err != nil {
+		os.Remove(temp)
+		return fatal(err)
+	}
+	debugLog("link", "path", path, "target", target)
+	return nil
+}
+
+type DaemonInfo struct {
+	Name    string
+	Running bool
+}
+
+// return a daemon of the host's backend that can only inspect the
+// installed daemon name, whatever it was installed with
+func daemonByName(name string) (CobraDaemon, error) {
+	if !validName.MatchString(name) {
+		return nil, fatalf("invalid characters in name: %s", name)
+	}
+	backend, err := platformBackend(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if backend.lookup == nil {
+		return nil, fatalf("%w: looking up daemons of a registered backend", ErrNotSupported)
+	}
+	d, err := backend.lookup(name)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if i, ok := d.(interface{ installed() bool }); ok && !i.installed() {
+		return nil, fatalf("%w: %s", ErrNotInstalled, name)
+	}
+	return d, nil
+}
+
+// report whether the installed daemon name is running, knowing only its
+// name; a oneshot is reported as a daemon, running only while it runs
+func QueryByName(name string) (bool, error) {
+	d, err := daemonByName(name)
+	if err != nil {
+		return false, fatal(err)
+	}
+	running, err := d.Query()
+	if err != nil {
+		return false, fatal(err)
+	}
+	return running, nil
+}
+
+// return the state of the installed daemon name, knowing only its name
+func StatusByName(name string) (DaemonState, error) {
+	d, err := daemonByName(name)
+	if err != nil {
+		return "", fatal(err)
+	}
+	state, err := d.Status()
+	if err != nil {
+		return "", fatal(err)
+	}
+	return state, nil
+}
+
+// return the capabilities of the backend NewDaemon selects on this host
+func PlatformCapabilities() (DaemonCapabilities, error) {
+	backend, err := platformBackend(nil)
+	if err != nil {
+		return DaemonCapabilities{}, fatal(err)
+	}
+	return backend.capabilities, nil
+}
+
+// return the daemons installed by this tool on the current os
+func ListDaemons() ([]DaemonInfo, error) {
+	backend, err := platformBackend(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if backend.list == nil {
+		return nil, fatalf("%w: listing daemons of a registered backend", ErrNotSupported)
+	}
+	list, err := backend.list()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return list, nil
 }
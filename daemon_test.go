@@ -1,10 +1,1680 @@
 package daemon
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/rstms/cobra-daemon/common"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDaemon(t *testing.T) {
 	require.True(t, true)
 }
+
+func initTestConfig(t *testing.T) {
+	common.Init("cobra-daemon", Version, filepath.Join("testdata", "config.yaml"))
+}
+
+// point the system locations at a temp dir for the duration of the test
+func initTestRoots(t *testing.T) string {
+	root := t.TempDir()
+	saved := []string{serviceRoot, svcRoot, svRoot, s6Root, s6ScanRoot, logRoot, binRoot, rcRoot, rcConfRoot, systemdRoot, systemdRun, lockRoot}
+	serviceRoot = filepath.Join(root, "etc", "service")
+	svcRoot = filepath.Join(root, "var", "svc.d")
+	svRoot = filepath.Join(root, "etc", "sv")
+	s6Root = filepath.Join(root, "etc", "s6", "sv")
+	s6ScanRoot = filepath.Join(root, "run", "service")
+	logRoot = filepath.Join(root, "var", "log")
+	binRoot = filepath.Join(root, "usr", "local", "bin")
+	rcRoot = filepath.Join(root, "etc", "rc.d")
+	rcConfRoot = filepath.Join(root, "etc", "rc.conf.d")
+	systemdRoot = filepath.Join(root, "etc", "systemd", "system")
+	systemdRun = filepath.Join(root, "run", "systemd", "system")
+	lockRoot = filepath.Join(root, "tmp")
+	for _, dir := range []string{serviceRoot, s6ScanRoot, logRoot, binRoot, rcRoot, systemdRoot} {
+		require.Nil(t, os.MkdirAll(dir, 0755))
+	}
+	t.Cleanup(func() {
+		serviceRoot, svcRoot, svRoot, s6Root, s6ScanRoot, logRoot, binRoot, rcRoot, rcConfRoot, systemdRoot, systemdRun = saved[0], saved[1], saved[2], saved[3], saved[4], saved[5], saved[6], saved[7], saved[8], saved[9], saved[10]
+		lockRoot = saved[11]
+	})
+	// the temp roots are writable without root
+	testPrivileged(t, true)
+	return root
+}
+
+// replace the root or Administrator check for the duration of the test
+func testPrivileged(t *testing.T, value bool) {
+	saved := privileged
+	privileged = func() bool { return value }
+	t.Cleanup(func() { privileged = saved })
+}
+
+// set a viper config value for the duration of the test
+func testConfig(t *testing.T, key string, value any) {
+	common.ViperSet(key, value)
+	t.Cleanup(func() {
+		common.ViperSet(key, nil)
+	})
+}
+
+// install a shell script as a fake supervisor command at the front of PATH
+func fakeCommand(t *testing.T, name, script string) {
+	dir := filepath.Join(t.TempDir(), "bin")
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	require.Nil(t, err)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// install fake daemontools commands so NewDaemon finds its supervisor
+func fakeDaemontools(t *testing.T) {
+	for _, name := range []string{"svc", "svstat", "setuidgid", "multilog", "chpst"} {
+		fakeCommand(t, name, "exit 0")
+	}
+}
+
+// create a stand-in for the daemon executable
+func testExecutable(t *testing.T, root string) string {
+	executable := filepath.Join(root, "testd")
+	require.Nil(t, os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755))
+	return executable
+}
+
+func TestDaemonRegistry(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+
+	web, err := NewDaemon("registry_web", "", root, executable)
+	require.Nil(t, err)
+	worker, err := NewDaemon("registry_worker", "", root, executable)
+	require.Nil(t, err)
+
+	d, ok := LookupDaemon("registry_web")
+	require.True(t, ok)
+	require.Same(t, web, d)
+	d, ok = LookupDaemon("registry_worker")
+	require.True(t, ok)
+	require.Same(t, worker, d)
+	_, ok = LookupDaemon("registry_missing")
+	require.False(t, ok)
+	require.Subset(t, DaemonNames(), []string{"registry_web", "registry_worker"})
+}
+
+func TestLinuxBackend(t *testing.T) {
+	initTestConfig(t)
+	initTestRoots(t)
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := linuxBackend(nil)
+	require.ErrorContains(t, err, "svc not found in PATH")
+
+	require.Nil(t, os.MkdirAll(systemdRun, 0755))
+	fakeCommand(t, "systemctl", "exit 0")
+	backend, err := linuxBackend(nil)
+	require.Nil(t, err)
+	require.Equal(t, "systemd", backend)
+
+	require.Nil(t, os.MkdirAll(svRoot, 0755))
+	fakeCommand(t, "sv", "exit 0")
+	backend, err = linuxBackend(nil)
+	require.Nil(t, err)
+	require.Equal(t, "runit", backend)
+
+	fakeCommand(t, "svc", "exit 0")
+	fakeCommand(t, "svstat", "exit 0")
+	backend, err = linuxBackend(nil)
+	require.Nil(t, err)
+	require.Equal(t, "daemontools", backend)
+
+	testConfig(t, "daemon.linux.backend", "systemd")
+	backend, err = linuxBackend(nil)
+	require.Nil(t, err)
+	require.Equal(t, "systemd", backend)
+
+	testConfig(t, "daemon.linux.backend", "upstart")
+	_, err = linuxBackend(nil)
+	require.ErrorContains(t, err, "unsupported linux backend: upstart")
+}
+
+func testUser(t *testing.T) *user.User {
+	u, err := user.Current()
+	require.Nil(t, err)
+	return u
+}
+
+// return two existing groups to use as supplementary groups, or skip
+func testGroups(t *testing.T) []*user.Group {
+	groups := []*user.Group{}
+	for _, name := range []string{"daemon", "nogroup", "users", "adm"} {
+		group, err := user.LookupGroup(name)
+		if err == nil {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) < 2 {
+		t.Skip("no supplementary groups available")
+	}
+	return groups[:2]
+}
+
+func TestResourceLimits(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	for value, expected := range map[string]int64{"4096": 4096, "512M": 512 << 20, "2g": 2 << 30, "64KB": 64 << 10} {
+		size, err := parseSize(value)
+		require.Nil(t, err)
+		require.Equal(t, expected, size)
+	}
+	_, err := parseSize("12X")
+	require.ErrorContains(t, err, "invalid size")
+
+	testConfig(t, "daemon.limits.memory", "512M")
+	testConfig(t, "daemon.limits.nofile", 4096)
+	render := map[string]string{}
+	for backend, newDaemon := range map[string]func(string, *user.User, string, string, ...string) (CobraDaemon, error){
+		"daemontools": NewDaemontools, "runit": NewRunit, "systemd": NewSystemd, "openbsd": NewRCDaemon,
+	} {
+		d, err := newDaemon("testd", testUser(t), root, executable)
+		require.Nil(t, err)
+		switch d := d.(type) {
+		case *Daemontools:
+			runTemplate, _ := d.templates()
+			render[backend] = string(d.templateData(runTemplate))
+		case *Systemd:
+			render[backend] = string(d.templateData(unitTemplate))
+		case *RCDaemon:
+			render[backend] = string(d.rcData())
+		}
+	}
+	require.Contains(t, render["daemontools"], " softlimit -m 536870912 -o 4096 setuidgid ")
+	require.Contains(t, render["runit"], " chpst -m 536870912 -o 4096 chpst -u ")
+	require.Contains(t, render["systemd"], "\nMemoryMax=536870912\nLimitNOFILE=4096\n")
+	require.Contains(t, render["openbsd"], "rc_start() {\n\trc_exec \"ulimit -d 524288; ulimit -n 4096; ${daemon} ${daemon_flags} </dev/null\"\n}\n")
+}
+
+func TestDependencies(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.after", []string{"logger"})
+	testConfig(t, "daemon.requires", []string{"database"})
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorContains(t, d.Install(), "dependency not installed: logger")
+	require.Nil(t, os.MkdirAll(filepath.Join(serviceRoot, "logger"), 0755))
+	require.Nil(t, os.MkdirAll(filepath.Join(serviceRoot, "database"), 0755))
+	require.Nil(t, d.Install())
+	data, err := os.ReadFile(filepath.Join(svcRoot, "testd", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "\nn=0; until svstat "+filepath.Join(serviceRoot, "logger")+" | grep -q ': up ' || [ $n -ge 10 ]; do sleep 1; n=$((n+1)); done\n")
+	require.Contains(t, string(data), "\nsvstat "+filepath.Join(serviceRoot, "database")+" | grep -q ': up ' || { sleep 1; exit 1; }\ncd ")
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nAfter=network.target logger.service database.service\nRequires=database.service\n")
+
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(rc.(*RCDaemon).rcData()), "\nrc_pre() {\n\trcctl check database >/dev/null\n}\n")
+
+	testConfig(t, "daemon.requires", []string{"bad;name"})
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid dependency name")
+}
+
+func TestSandbox(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.NotContains(t, string(unit.(*Systemd).templateData(unitTemplate)), "ProtectSystem=")
+
+	testConfig(t, "daemon.sandbox", true)
+	unit, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nProtectSystem=full\nPrivateTmp=yes\nNoNewPrivileges=yes\n")
+
+	testConfig(t, "daemon.protect_system", "strict")
+	testConfig(t, "daemon.private_tmp", "false")
+	testConfig(t, "daemon.read_only_paths", []string{"/etc/testd", "-/srv/testd"})
+	unit, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nProtectSystem=strict\nPrivateTmp=no\nNoNewPrivileges=yes\nReadOnlyPaths=/etc/testd -/srv/testd\n")
+
+	testConfig(t, "daemon.read_only_paths", []string{"etc/testd"})
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid read_only_paths entry")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid read_only_paths entry")
+
+	testConfig(t, "daemon.read_only_paths", nil)
+	testConfig(t, "daemon.protect_system", "everything")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid protect_system: everything")
+}
+
+func TestOneshot(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "systemctl", `
+echo "$@" >> $FAKE_STATE/systemctl.log
+case "$1" in
+is-active) exit 3;;
+show) cat $FAKE_STATE/result;;
+esac`)
+	testConfig(t, "daemon.type", "oneshot")
+	service := filepath.Join(serviceRoot, "testd")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.True(t, d.Capabilities().Oneshot)
+	script := string(d.(*Daemontools).templateData(runTemplate))
+	require.Contains(t, script, "\nexec 2>&1\nexec </dev/null\nsvc -o "+service+"\n")
+	require.Contains(t, script, "\ncommand \\\n")
+	require.Contains(t, script, "\necho \"$status\" > "+filepath.Join(svcRoot, "testd", "exit-status")+"\nexit $status\n")
+	config, err := d.DesiredConfig()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+	commands, err := d.Commands("start")
+	require.Nil(t, err)
+	require.Equal(t, []string{"svc", "-uo", service}, commands[1])
+	require.Nil(t, d.Install())
+	succeeded, err := d.Query()
+	require.Nil(t, err)
+	require.False(t, succeeded)
+	require.Nil(t, os.WriteFile(filepath.Join(svcRoot, "testd", "exit-status"), []byte("0\n"), 0644))
+	succeeded, err = d.Query()
+	require.Nil(t, err)
+	require.True(t, succeeded)
+	require.Nil(t, os.WriteFile(filepath.Join(svcRoot, "testd", "exit-status"), []byte("2\n"), 0644))
+	succeeded, err = d.Query()
+	require.Nil(t, err)
+	require.False(t, succeeded)
+
+	r, err := NewRunit("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(r.(*Daemontools).templateData(runitRunTemplate)), "\nexec 2>&1\nexec </dev/null\nsv once "+service+"\n")
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	data := string(unit.(*Systemd).templateData(unitTemplate))
+	require.Contains(t, data, "\nType=oneshot\n")
+	require.NotContains(t, data, "Restart=")
+	require.Nil(t, unit.Install())
+	require.Nil(t, os.WriteFile(filepath.Join(state, "result"), []byte("Result=success\nExecMainStatus=0\nExecMainExitTimestampMonotonic=0\n"), 0644))
+	succeeded, err = unit.Query()
+	require.Nil(t, err)
+	require.False(t, succeeded)
+	require.Nil(t, os.WriteFile(filepath.Join(state, "result"), []byte("Result=success\nExecMainStatus=0\nExecMainExitTimestampMonotonic=1234\n"), 0644))
+	succeeded, err = unit.Query()
+	require.Nil(t, err)
+	require.True(t, succeeded)
+	require.Nil(t, os.WriteFile(filepath.Join(state, "result"), []byte("Result=exit-code\nExecMainStatus=1\nExecMainExitTimestampMonotonic=1234\n"), 0644))
+	succeeded, err = unit.Query()
+	require.Nil(t, err)
+	require.False(t, succeeded)
+	require.Nil(t, os.Remove(filepath.Join(state, "systemctl.log")))
+	require.Nil(t, unit.Start())
+	log, err := os.ReadFile(filepath.Join(state, "systemctl.log"))
+	require.Nil(t, err)
+	require.Equal(t, "is-active --quiet testd\nenable testd\nstart --no-block testd\n", string(log))
+
+	principal, _ := windowsPrincipal("LocalSystem")
+	t.Setenv("SystemRoot", root)
+	_, err = NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.ErrorContains(t, err, "oneshot tasks require a daemon.windows.trigger of daily@HH:MM, not boot")
+	testConfig(t, "daemon.windows.trigger", "daily@03:00")
+	task, err := NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	commands, err = task.Commands("query")
+	require.Nil(t, err)
+	require.Equal(t, []string{"schtasks.exe", "/QUERY", "/TN", "testd", "/V", "/FO", "LIST"}, commands[0])
+
+	_, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.ErrorIs(t, err, ErrNotSupported)
+	testConfig(t, "daemon.type", "cron")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid type: cron")
+}
+
+func TestStdin(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	input := filepath.Join(root, "input")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	script := string(d.(*Daemontools).templateData(runTemplate))
+	require.Contains(t, script, "\nexec 2>&1\nexec </dev/null\ncd ")
+	config, err := parseRunScript(script)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nStandardInput=null\n")
+
+	testConfig(t, "daemon.stdin", input)
+	d, err = NewRunit("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(d.(*Daemontools).templateData(runitRunTemplate)), "\nexec <"+input+"\n")
+	unit, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nStandardInput=file:"+input+"\n")
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(rc.(*RCDaemon).rcData()), "\trc_exec \"${daemon} ${daemon_flags} <"+input+"\"\n")
+	netbsd, err := NewNetBSDDaemon("testnb", testUser(t), root, executable)
+	require.Nil(t, err)
+	data := string(netbsd.(*NetBSDDaemon).rcData())
+	require.Contains(t, data, " <"+input+" >>")
+	config, err = parseNetBSDRCFile("testnb", data, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"--logfile", filepath.Join(logRoot, "testnb")}, config.Args)
+
+	testConfig(t, "daemon.stdin", "inherit")
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.NotContains(t, string(d.(*Daemontools).templateData(runTemplate)), "exec <")
+	unit, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.NotContains(t, string(unit.(*Systemd).templateData(unitTemplate)), "StandardInput=")
+	rc, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.NotContains(t, string(rc.(*RCDaemon).rcData()), "rc_start()")
+
+	testConfig(t, "daemon.stdin", "input")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid stdin")
+}
+
+func TestExtraConfig(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	testConfig(t, "daemon.extra_config", "ulimit -c 0\n")
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	script := string(d.(*Daemontools).templateData(runTemplate))
+	require.Contains(t, script, "\ncd "+root+"\nulimit -c 0\n")
+	config, err := parseRunScript(script)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+
+	testConfig(t, "daemon.extra_config", "LimitCORE=0\nTasksMax=64")
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nLimitCORE=0\nTasksMax=64\n\n[Install]\n")
+
+	testConfig(t, "daemon.extra_config", "daemon_timeout=60\n")
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(rc.(*RCDaemon).rcData()), "\ndaemon_timeout=60\n\nrc_cmd ")
+	netbsd, err := NewNetBSDDaemon("testnb", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(netbsd.(*NetBSDDaemon).rcData()), "\ndaemon_timeout=60\n\nload_rc_config ")
+
+	testConfig(t, "daemon.extra_config", "LimitCORE=0\n[Install]\nWantedBy=default.target")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, `invalid extra_config line: "[Install]"`)
+	testConfig(t, "daemon.extra_config", "rc_cmd start")
+	_, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid extra_config line")
+}
+
+func TestSplitLogs(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeCommand(t, "svc", "exit 0")
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	testConfig(t, "daemon.split_logs", "true")
+	logDir := filepath.Join(logRoot, "testd")
+	fifo := filepath.Join(svcRoot, "testd", "stderr")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	script := string(d.(*Daemontools).templateData(runTemplate))
+	require.Contains(t, script, "\n[ -p "+fifo+" ] || mkfifo -m 0600 "+fifo+"\nmultilog t s10000000 n10 "+logDir+".stderr < "+fifo+" &\nexec 2>"+fifo+"\n")
+	require.Contains(t, string(d.(*Daemontools).templateData(logTemplate)), "multilog t s10000000 n10 "+logDir+"\n")
+	require.Equal(t, logDir+".stderr", d.Paths()["stderr"])
+	config, err := parseRunScript(script)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+	require.Nil(t, d.Install())
+	require.True(t, common.IsDir(logDir))
+	require.True(t, common.IsDir(logDir+".stderr"))
+	require.Nil(t, d.Purge())
+	require.False(t, common.IsDir(logDir+".stderr"))
+
+	r, err := NewRunit("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(r.(*Daemontools).templateData(runitRunTemplate)), "\nsvlogd -tt "+logDir+".stderr < ")
+	files, err := r.ConfigFiles()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(logDir+".stderr", "config"), files[len(files)-1].Path)
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nStandardError=append:"+logDir+".stderr\n")
+	testConfig(t, "daemon.logfile", filepath.Join(root, "testd.log"))
+	unit, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	data := string(unit.(*Systemd).templateData(unitTemplate))
+	require.Contains(t, data, " --logfile "+filepath.Join(root, "testd.log")+"\n")
+	require.Contains(t, data, "\nStandardError=append:"+filepath.Join(root, "testd.log.stderr")+"\n")
+
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	data = string(rc.(*RCDaemon).rcData())
+	require.Contains(t, data, " --logfile "+filepath.Join(root, "testd.log")+`"`)
+	require.Contains(t, data, "\trc_exec \"${daemon} ${daemon_flags} </dev/null 2>>"+filepath.Join(root, "testd.log.stderr")+"\"\n")
+
+	netbsd, err := NewNetBSDDaemon("testnb", testUser(t), root, executable)
+	require.Nil(t, err)
+	data = string(netbsd.(*NetBSDDaemon).rcData())
+	require.Contains(t, data, " >>"+filepath.Join(root, "testd.log")+" 2>>"+filepath.Join(root, "testd.log.stderr")+` &"`)
+	config, err = parseNetBSDRCFile("testnb", data, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"--logfile", filepath.Join(root, "testd.log")}, config.Args)
+
+	testConfig(t, "daemon.split_logs", "sometimes")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid split_logs: sometimes")
+}
+
+func TestHooks(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.prestart", "mkdir -p /run/testd")
+	testConfig(t, "daemon.poststop", "rm -f /run/testd/sock")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	run := filepath.Join(svcRoot, "testd", "run")
+	data, err := os.ReadFile(run)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "\nsh -c 'mkdir -p /run/testd' || { sleep 1; exit 1; }\ntrap ")
+	require.Contains(t, string(data), " &\npid=$!\n")
+	require.True(t, strings.HasSuffix(string(data), "\nsh -c 'rm -f /run/testd/sock'\nexit $status\n"))
+	require.Nil(t, exec.Command("sh", "-n", run).Run())
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+	require.Equal(t, []string{"-L-"}, config.Args)
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	data = unit.(*Systemd).templateData(unitTemplate)
+	require.Contains(t, string(data), "\nExecStartPre=+/bin/sh -c \"mkdir -p /run/testd\"\nExecStart=")
+	require.Contains(t, string(data), " -L-\nExecStopPost=+/bin/sh -c \"rm -f /run/testd/sock\"\n")
+
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	data = rc.(*RCDaemon).rcData()
+	require.Contains(t, string(data), "\nrc_pre() {\n\tsh -c 'mkdir -p /run/testd'\n}\nrc_post() {\n\tsh -c 'rm -f /run/testd/sock'\n}\n")
+
+	require.Contains(t, string(powershellWrapper(root, executable, nil, "mkdir x", "del x")), "\r\n$status = $LASTEXITCODE\r\n& cmd.exe /C 'del x'\r\nexit $status\r\n")
+
+	testConfig(t, "daemon.prestart", " ")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "daemon.prestart command is empty")
+}
+
+func TestMissingSupervisor(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := NewDaemon("missing_tools", "", root, executable)
+	require.ErrorIs(t, err, ErrSupervisorUnavailable)
+	require.ErrorContains(t, err, "daemontools not installed: svc not found in PATH")
+	_, ok := LookupDaemon("missing_tools")
+	require.False(t, ok)
+
+	fakeDaemontools(t)
+	_, err = NewDaemon("missing_tools", "", root, executable)
+	require.Nil(t, err)
+}
+
+func TestInstallForeignService(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	for _, template := range []string{runTemplate, logTemplate, runitRunTemplate, runitLogTemplate, s6LogTemplate, unitTemplate, rcTemplate} {
+		require.Contains(t, template, generatedMarker+"\n")
+	}
+
+	rcFile := filepath.Join(rcRoot, "testrc")
+	require.Nil(t, os.WriteFile(rcFile, []byte("#!/bin/ksh\ndaemon=/usr/sbin/testrc\n"), 0755))
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	err = rc.Install()
+	require.ErrorIs(t, err, ErrAlreadyInstalled)
+	require.ErrorContains(t, err, rcFile+" was not installed by this program")
+	testConfig(t, "force", true)
+	rc, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, rc.Install())
+	err = rc.Install()
+	require.ErrorIs(t, err, ErrAlreadyInstalled)
+	require.NotContains(t, err.Error(), "not installed by")
+
+	testConfig(t, "force", false)
+	service := filepath.Join(serviceRoot, "testd")
+	require.Nil(t, os.MkdirAll(service, 0755))
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorContains(t, d.Install(), service+" was not installed by this program")
+	testConfig(t, "force", true)
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	target, err := os.Readlink(service)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(svcRoot, "testd"), target)
+}
+
+func TestPidFile(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeDaemontools(t)
+	fakeCommand(t, "svstat", `if [ -f $FAKE_STATE/up ]; then echo "$1: up (pid 123) 5 seconds"; else echo "$1: down 1 seconds"; fi`)
+	pidfile := filepath.Join(root, "var", "run", "testd.pid")
+	testConfig(t, "daemon.pidfile", pidfile)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorContains(t, d.Validate(), "pidfile directory")
+	require.Nil(t, os.MkdirAll(filepath.Dir(pidfile), 0755))
+	require.Nil(t, d.Install())
+	run := filepath.Join(svcRoot, "testd", "run")
+	data, err := os.ReadFile(run)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "\necho $$ > "+pidfile+"\nexec ")
+	require.Nil(t, exec.Command("sh", "-n", run).Run())
+	require.Equal(t, pidfile, d.Paths()["pidfile"])
+
+	pid, err := d.Pid()
+	require.Nil(t, err)
+	require.Equal(t, 0, pid)
+	require.Nil(t, os.WriteFile(filepath.Join(state, "up"), []byte{}, 0600))
+	pid, err = d.Pid()
+	require.Nil(t, err)
+	require.Equal(t, 123, pid)
+	require.Nil(t, os.WriteFile(pidfile, []byte("456\n"), 0644))
+	pid, err = d.Pid()
+	require.Nil(t, err)
+	require.Equal(t, 456, pid)
+
+	require.Nil(t, os.Remove(filepath.Join(state, "up")))
+	require.Nil(t, d.Delete())
+	require.False(t, common.IsFile(pidfile))
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	data = unit.(*Systemd).templateData(unitTemplate)
+	require.Contains(t, string(data), " -L-\nExecStartPost=+/bin/sh -c \"echo $$MAINPID > "+pidfile+"\"\nExecStopPost=+/bin/rm -f "+pidfile+"\n")
+
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(rc.(*RCDaemon).rcData()), "\nrc_start() {\n\trc_exec \"echo \\$\\$ > "+pidfile+"; exec ${daemon} ${daemon_flags} </dev/null\"\n}\n")
+
+	testConfig(t, "daemon.pidfile", "testd.pid")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "pidfile must be an absolute path")
+}
+
+func TestPlatformBackend(t *testing.T) {
+	initTestConfig(t)
+	initTestRoots(t)
+	testConfig(t, "daemon.linux.backend", "systemd")
+	b, err := platformBackend(nil)
+	require.Nil(t, err)
+	require.NotNil(t, b.factory)
+
+	saved := selectBackend
+	t.Cleanup(func() { selectBackend = saved })
+	selectBackend = func(settings daemonSettings) (string, error) { return "launchd", nil }
+	_, err = platformBackend(nil)
+	require.ErrorIs(t, err, ErrNotSupported)
+	_, err = NewDaemon("testd", "", t.TempDir(), "/bin/true")
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+// a custom backend keeping its state in memory; the CobraDaemon methods it
+// doesn't implement panic
+type fakeBackend struct {
+	CobraDaemon
+	spec  DaemonSpec
+	state map[string]string
+}
+
+func (f *fakeBackend) Install() error {
+	if f.state[f.spec.Name] != "" {
+		return fatalf("%w: %s", ErrAlreadyInstalled, f.spec.Name)
+	}
+	f.state[f.spec.Name] = "stopped"
+	return nil
+}
+
+func (f *fakeBackend) GetConfig() (string, error) {
+	if f.state[f.spec.Name] == "" {
+		return "", fatalf("%w: %s", ErrNotInstalled, f.spec.Name)
+	}
+	return "", nil
+}
+
+func (f *fakeBackend) DesiredConfig() (*DaemonConfig, error) {
+	return &DaemonConfig{Name: f.spec.Name, User: f.spec.User, Executable: f.spec.Executable, Args: f.spec.Args, Dir: f.spec.Dir}, nil
+}
+
+func (f *fakeBackend) Query() (bool, error) {
+	if f.state[f.spec.Name] == "" {
+		return false, fatalf("%w: %s", ErrNotInstalled, f.spec.Name)
+	}
+	return f.state[f.spec.Name] == "running", nil
+}
+
+func (f *fakeBackend) Start() error {
+	f.state[f.spec.Name] = "running"
+	return nil
+}
+
+func (f *fakeBackend) Stop() error {
+	f.state[f.spec.Name] = "stopped"
+	return nil
+}
+
+func TestHideUnsupported(t *testing.T) {
+	initTestConfig(t)
+	fakeDaemontools(t)
+	rootCmd := &cobra.Command{Use: "testd"}
+	AddDaemonCommands(rootCmd)
+	help := func(cmd *cobra.Command) string {
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		t.Cleanup(func() { cmd.SetOut(nil) })
+		cmd.HelpFunc()(cmd, nil)
+		return out.String()
+	}
+
+	// the backend is set after the commands are added, as a config file is
+	testConfig(t, "daemon.backend", "systemd")
+	require.NotContains(t, help(daemonQueryCmd), "      --log ")
+	require.Contains(t, help(daemonCmd), "--sandbox")
+	testConfig(t, "daemon.backend", "daemontools")
+	require.Contains(t, help(daemonQueryCmd), "      --log ")
+	require.NotContains(t, help(daemonCmd), "--sandbox")
+}
+
+func TestRegisterBackend(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	state := map[string]string{}
+	specs := []DaemonSpec{}
+	RegisterBackend("fake", func(spec DaemonSpec) (CobraDaemon, error) {
+		specs = append(specs, spec)
+		return &fakeBackend{spec: spec, state: state}, nil
+	})
+	t.Cleanup(func() { delete(backends, "fake") })
+	testConfig(t, "daemon.backend", "fake")
+	testConfig(t, "daemon.name", "testd")
+	testConfig(t, "daemon.dir", root)
+
+	daemonInstallCmd.Run(daemonInstallCmd, nil)
+	require.Equal(t, "stopped", state["testd"])
+	daemonStartCmd.Run(daemonStartCmd, nil)
+	require.Equal(t, "running", state["testd"])
+	daemonStopCmd.Run(daemonStopCmd, nil)
+	require.Equal(t, "stopped", state["testd"])
+	current, err := user.Current()
+	require.Nil(t, err)
+	require.Equal(t, "testd", specs[0].Name)
+	require.Equal(t, current.Username, specs[0].User)
+	require.Equal(t, root, specs[0].Dir)
+
+	capabilities, err := PlatformCapabilities()
+	require.Nil(t, err)
+	require.Equal(t, DaemonCapabilities{}, capabilities)
+	_, err = ListDaemons()
+	require.ErrorIs(t, err, ErrNotSupported)
+	name, err := backendName(nil)
+	require.Nil(t, err)
+	require.Equal(t, "fake", name)
+
+	testConfig(t, "daemon.backend", "nomad")
+	_, err = NewDaemon("testd", "", root, "/bin/true")
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestNoHomeDir(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	require.Equal(t, root, defaultDir(&user.User{Username: "testd", HomeDir: root}))
+	dir := defaultDir(&user.User{Username: "testd", HomeDir: filepath.Join(root, "nonexistent")})
+	expected := "/"
+	if common.IsDir("/var/empty") {
+		expected = "/var/empty"
+	}
+	require.Equal(t, expected, dir)
+	require.Equal(t, dir, defaultDir(&user.User{Username: "testd"}))
+
+	u, err := user.Lookup("nobody")
+	if err != nil || common.IsDir(u.HomeDir) {
+		t.Skip("no user without a home directory")
+	}
+	fakeDaemontools(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+	d, err := NewDaemonFromSpec(DaemonSpec{Name: "testd", User: "nobody", Executable: testExecutable(t, root)})
+	require.Nil(t, err)
+	require.Equal(t, dir, d.(*Daemontools).Dir)
+}
+
+func TestConfirmRemove(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	file, err := os.Create(filepath.Join(root, "stdin"))
+	require.Nil(t, err)
+	defer file.Close()
+	require.False(t, isTerminal(file))
+
+	state := map[string]string{}
+	d := &fakeBackend{spec: DaemonSpec{Name: "testd"}, state: state}
+	// not installed, so there is nothing to confirm
+	confirmRemove(d, "delete", "delete.yes")
+	require.Nil(t, d.Install())
+	testConfig(t, "delete.yes", true)
+	confirmRemove(d, "delete", "delete.yes")
+}
+
+func TestNewDaemonFromSpec(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+
+	args := make([]string, 1, 4)
+	args[0] = "serve"
+	d, err := NewDaemonFromSpec(DaemonSpec{
+		Name:       "testd",
+		Dir:        root,
+		Executable: executable,
+		Args:       args,
+		Config:     map[string]string{"env": "MODE=spec"},
+	})
+	require.Nil(t, err)
+	config, err := d.DesiredConfig()
+	require.Nil(t, err)
+	require.Equal(t, []string{"serve", "-L-"}, config.Args)
+	require.Equal(t, "spec", config.Env["MODE"])
+	// the backing array of the spec's args is not written
+	require.Equal(t, "", args[:2][1])
+
+	for spec, message := range map[*DaemonSpec]string{
+		{Name: "test-d", Executable: executable}: "invalid characters in name: test-d",
+		{Name: "testd"}:                          "no executable for testd",
+		{Name: "testd", Executable: executable, Config: map[string]string{"daemon.env": "A=1"}}: "invalid config key daemon.env: give it without the daemon. prefix",
+		{Name: "testd", Executable: executable, Config: map[string]string{"Env": "A=1"}}:        "invalid config key: Env",
+	} {
+		_, err = NewDaemonFromSpec(*spec)
+		require.ErrorContains(t, err, message)
+	}
+}
+
+func TestSpecSettings(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+
+	first, err := NewDaemonFromSpec(DaemonSpec{Name: "testa", Dir: root, Executable: executable, Config: map[string]string{"start_type": "auto", "nice": "5"}})
+	require.Nil(t, err)
+	require.Equal(t, "auto", first.(*Daemontools).StartType)
+	require.Equal(t, "5", first.(*Daemontools).Nice)
+
+	// a spec without the settings doesn't inherit them from the one before
+	second, err := NewDaemonFromSpec(DaemonSpec{Name: "testb", Dir: root, Executable: executable})
+	require.Nil(t, err)
+	require.Equal(t, "", second.(*Daemontools).StartType)
+	require.Equal(t, "", second.(*Daemontools).Nice)
+	require.Equal(t, "", common.ViperGetString("daemon.nice"))
+
+	// the global config applies to the keys a spec leaves unset
+	testConfig(t, "daemon.nice", "10")
+	testConfig(t, "daemon.umask", "027")
+	third, err := NewDaemonFromSpec(DaemonSpec{Name: "testc", Dir: root, Executable: executable, Config: map[string]string{"nice": "5"}})
+	require.Nil(t, err)
+	require.Equal(t, "5", third.(*Daemontools).Nice)
+	require.Equal(t, "0027", third.(*Daemontools).Umask)
+}
+
+func TestReplace(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "systemctl", `
+echo "$@" >> $FAKE_STATE/systemctl.log
+case "$1" in
+cat) exit 1;;
+is-active) [ -f $FAKE_STATE/active ];;
+start|restart) touch $FAKE_STATE/active;;
+stop) rm -f $FAKE_STATE/active;;
+esac`)
+	systemctlLog := func() string {
+		data, err := os.ReadFile(filepath.Join(state, "systemctl.log"))
+		require.Nil(t, err)
+		require.Nil(t, os.Remove(filepath.Join(state, "systemctl.log")))
+		return string(data)
+	}
+
+	d, err := NewSystemd("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	require.Nil(t, Replace(d))
+	require.FileExists(t, filepath.Join(systemdRoot, "testd.service"))
+	require.Nil(t, d.Start())
+	systemctlLog()
+
+	// an unchanged config is left alone
+	require.Nil(t, Replace(d))
+	require.Equal(t, "is-enabled --quiet testd\n", systemctlLog())
+
+	// new args are written in place, and the running unit restarted
+	d, err = NewSystemd("testd", testUser(t), root, executable, "serve", "--debug")
+	require.Nil(t, err)
+	require.Nil(t, Replace(d))
+	require.Equal(t, "is-enabled --quiet testd\ndaemon-reload\nis-active --quiet testd\nrestart testd\n", systemctlLog())
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, []string{"serve", "--debug", "-L-"}, config.Args)
+
+	// a changed binary is reinstalled
+	require.Nil(t, os.WriteFile(executable, []byte("#!/bin/sh\nexit 0\n"), 0755))
+	require.Nil(t, Replace(d))
+	log := systemctlLog()
+	require.Contains(t, log, "\nstop testd\n")
+	require.Contains(t, log, "\nstart testd\n")
+	data, err := os.ReadFile(filepath.Join(binRoot, "testd"))
+	require.Nil(t, err)
+	require.Equal(t, "#!/bin/sh\nexit 0\n", string(data))
+}
+
+func TestInstallStopped(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	t.Setenv("SystemRoot", root)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	fakeCommand(t, "svc", `echo "$@" >> $FAKE_STATE/svc.log`)
+	fakeCommand(t, "systemctl", `echo "$@" >> $FAKE_STATE/systemctl.log; [ "$1" != is-active ] && [ "$1" != is-enabled ]`)
+	fakeCommand(t, "rcctl", `
+echo "$@" >> $FAKE_STATE/rcctl.log
+case "$1" in
+check) exit 1;;
+get) echo "$2_flags=NO";;
+esac`)
+	fakeCommand(t, "service", fakeService)
+	fakeCommand(t, "sc.exe", fakeSC)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "logs"), 0755))
+	t.Setenv("DAEMON_PASSWORD", "s3cret")
+	readLog := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(state, name))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		require.Nil(t, err)
+		return string(data)
+	}
+	// installed, each backend is down and not enabled until Start
+	requireStopped := func(d CobraDaemon) {
+		require.Nil(t, d.Install())
+		running, err := d.Query()
+		require.Nil(t, err)
+		require.False(t, running)
+		config, err := d.GetDaemonConfig()
+		require.Nil(t, err)
+		require.False(t, config.Enabled)
+	}
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	requireStopped(d)
+	require.FileExists(t, filepath.Join(svcRoot, "testd", "down"))
+	require.Empty(t, readLog("svc.log"))
+
+	d, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	requireStopped(d)
+	require.Equal(t, "daemon-reload\nis-active --quiet testd\nis-enabled --quiet testd\n", readLog("systemctl.log"))
+
+	d, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	requireStopped(d)
+	require.NotContains(t, readLog("rcctl.log"), "enable")
+	require.NotContains(t, readLog("rcctl.log"), "start")
+
+	d, err = NewNetBSDDaemon("testnb", testUser(t), root, executable)
+	require.Nil(t, err)
+	requireStopped(d)
+	require.Equal(t, "onestatus\n", readLog("service.log"))
+
+	// a windows service starts on demand rather than at boot
+	u := *testUser(t)
+	u.HomeDir = root
+	d, err = NewWindowsService("testd", &u, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.False(t, running)
+	require.Contains(t, readLog("sc.log"), " start= demand ")
+
+	task, err := NewWindowsTask("testd", testUser(t), root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	data, err := task.(*WindowsTask).xmlData()
+	require.Nil(t, err)
+	require.Contains(t, data, "<Enabled>false</Enabled>")
+	commands, err := task.Commands("start")
+	require.Nil(t, err)
+	require.Equal(t, []string{"schtasks.exe", "/CHANGE", "/TN", "testd", "/ENABLE"}, commands[0])
+
+	testConfig(t, "daemon.install_stopped", "false")
+	start, err := startType(nil)
+	require.Nil(t, err)
+	require.Equal(t, "auto", start)
+	testConfig(t, "daemon.start_type", "manual")
+	_, err = startType(nil)
+	require.ErrorContains(t, err, "install_stopped=false conflicts with start_type manual")
+	testConfig(t, "daemon.install_stopped", "true")
+	start, err = startType(nil)
+	require.Nil(t, err)
+	require.Equal(t, "manual", start)
+	testConfig(t, "daemon.start_type", "auto")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "install_stopped conflicts with start_type auto")
+	testConfig(t, "daemon.install_stopped", "later")
+	_, err = startType(nil)
+	require.ErrorContains(t, err, "invalid install_stopped: later")
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	t.Setenv("HOME", root)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, ".config"))
+	fakeDaemontools(t)
+	fakeCommand(t, "systemctl", `case "$*" in *is-active*) exit 1;; esac`)
+	fakeCommand(t, "rcctl", "exit 0")
+	fakeCommand(t, "service", "exit 1")
+	fakeCommand(t, "sc.exe", fakeSC)
+	t.Setenv("FAKE_STATE", t.TempDir())
+	testPrivileged(t, false)
+
+	// the system locations are left alone
+	daemontools, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	err = daemontools.Install()
+	require.ErrorIs(t, err, ErrPermissionDenied)
+	require.ErrorContains(t, err, "install "+filepath.Join(serviceRoot, "testd")+" needs root; run it with sudo")
+	require.NoDirExists(t, filepath.Join(svcRoot, "testd"))
+	testConfig(t, "daemon.systemd.scope", "system")
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, unit.Install(), ErrPermissionDenied)
+	require.NoFileExists(t, filepath.Join(systemdRoot, "testd.service"))
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, rc.Install(), ErrPermissionDenied)
+	require.NoFileExists(t, filepath.Join(rcRoot, "testrc"))
+	netbsd, err := NewNetBSDDaemon("testnb", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, netbsd.Install(), ErrPermissionDenied)
+	u := *testUser(t)
+	u.HomeDir = root
+	service, err := NewWindowsService("testd", &u, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	require.ErrorIs(t, service.Install(), ErrPermissionDenied)
+	require.NoFileExists(t, filepath.Join(os.Getenv("FAKE_STATE"), "sc.log"))
+
+	// an installed daemon is not deleted either
+	testPrivileged(t, true)
+	require.Nil(t, daemontools.Install())
+	testPrivileged(t, false)
+	require.ErrorIs(t, daemontools.Delete(), ErrPermissionDenied)
+	require.DirExists(t, filepath.Join(svcRoot, "testd"))
+
+	// a systemd user unit and a task of the current user need no privileges
+	testConfig(t, "daemon.systemd.scope", "user")
+	unit, err = NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, unit.Install())
+	require.Nil(t, unit.Delete())
+	task, err := NewWindowsTask("testd", testUser(t), root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	require.Nil(t, task.(*WindowsTask).checkPrivileges("install"))
+	principal, _ := windowsPrincipal("SYSTEM")
+	task, err = NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	require.ErrorIs(t, task.(*WindowsTask).checkPrivileges("install"), ErrPermissionDenied)
+}
+
+func TestUpdateBinary(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "systemctl", `
+echo "$@" >> $FAKE_STATE/systemctl.log
+case "$1" in
+cat) exit 1;;
+is-active) [ -f $FAKE_STATE/active ];;
+start|restart) touch $FAKE_STATE/active;;
+stop) rm -f $FAKE_STATE/active;;
+esac`)
+
+	d, err := NewSystemd("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	_, err = UpdateBinary(d, false)
+	require.ErrorIs(t, err, ErrNotInstalled)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Start())
+	unit, err := os.ReadFile(filepath.Join(systemdRoot, "testd.service"))
+	require.Nil(t, err)
+
+	changed, err := UpdateBinary(d, true)
+	require.Nil(t, err)
+	require.False(t, changed)
+
+	require.Nil(t, os.Remove(filepath.Join(state, "systemctl.log")))
+	require.Nil(t, os.WriteFile(executable, []byte("#!/bin/sh\nexit 0\n"), 0755))
+	changed, err = UpdateBinary(d, true)
+	require.Nil(t, err)
+	require.True(t, changed)
+	data, err := os.ReadFile(filepath.Join(binRoot, "testd"))
+	require.Nil(t, err)
+	require.Equal(t, "#!/bin/sh\nexit 0\n", string(data))
+	data, err = os.ReadFile(filepath.Join(systemdRoot, "testd.service"))
+	require.Nil(t, err)
+	require.Equal(t, string(unit), string(data))
+	log, err := os.ReadFile(filepath.Join(state, "systemctl.log"))
+	require.Nil(t, err)
+	require.Equal(t, "is-enabled --quiet testd\nis-active --quiet testd\nrestart testd\n", string(log))
+
+	testConfig(t, "daemon.copy_binary", "false")
+	d, err = NewSystemd("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	_, err = UpdateBinary(d, false)
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestStatus(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+
+	// systemctl show --property ActiveState,SubState
+	for output, expected := range map[string]DaemonState{
+		"ActiveState=active\nSubState=running\n":            StateRunning,
+		"ActiveState=activating\nSubState=start\n":          StateRunning,
+		"ActiveState=deactivating\nSubState=stop-sigterm\n": StateRunning,
+		"ActiveState=inactive\nSubState=dead\n":             StateStopped,
+		"ActiveState=failed\nSubState=failed\n":             StateFailed,
+		"ActiveState=activating\nSubState=auto-restart\n":   StateFailed,
+	} {
+		status, err := parseSystemdState(output)
+		require.Nil(t, err, output)
+		require.Equal(t, expected, status, output)
+	}
+	_, err := parseSystemdState("Unit testd.service could not be found.\n")
+	require.ErrorContains(t, err, "unexpected systemctl show output")
+
+	fakeCommand(t, "systemctl", `[ "$1" != show ] || cat $FAKE_STATE/show`)
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	_, err = unit.Status()
+	require.ErrorIs(t, err, ErrNotInstalled)
+	require.Nil(t, unit.Install())
+	require.Nil(t, os.WriteFile(filepath.Join(state, "show"), []byte("ActiveState=failed\nSubState=failed\n"), 0644))
+	status, err := unit.Status()
+	require.Nil(t, err)
+	require.Equal(t, StateFailed, status)
+
+	fakeCommand(t, "svstat", "cat $FAKE_STATE/svstat")
+	fakeCommand(t, "svc", "exit 0")
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	service := filepath.Join(serviceRoot, "testd")
+	for output, expected := range map[string]DaemonState{
+		": up (pid 1234) 56 seconds\n":             StateRunning,
+		": down 7 seconds, normally up\n":          StateStopped,
+		": down 1 seconds, normally up, want up\n": StateFailed,
+	} {
+		require.Nil(t, os.WriteFile(filepath.Join(state, "svstat"), []byte(service+output), 0644))
+		status, err := d.Status()
+		require.Nil(t, err, output)
+		require.Equal(t, expected, status, output)
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	config := DaemonConfig{Name: "testd", Executable: "/usr/local/bin/testd", Args: []string{"--port", "80"}}
+
+	out, err := config.format("yaml")
+	require.Nil(t, err)
+	require.Equal(t, "name: testd\nexecutable: /usr/local/bin/testd\nargs:\n    - --port\n    - \"80\"\nenabled: false", out)
+
+	out, err = config.format("json")
+	require.Nil(t, err)
+	require.Equal(t, `{
+  "name": "testd",
+  "executable": "/usr/local/bin/testd",
+  "args": [
+    "--port",
+    "80"
+  ],
+  "enabled": false
+}`, out)
+
+	_, err = config.format("xml")
+	require.ErrorContains(t, err, "invalid output format")
+}
+
+func TestInstallSelf(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	fakeDaemontools(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+	testConfig(t, "daemon.name", "selftest")
+	testConfig(t, "daemon.dir", root)
+	testConfig(t, "daemon.copy_binary", "false")
+	saved := os.Args
+	t.Cleanup(func() { os.Args = saved })
+	os.Args = []string{"./selftest", "--port", "8080", "--install-service"}
+	t.Chdir(t.TempDir())
+
+	require.Nil(t, InstallSelf("--verbose"))
+	binary, err := os.Executable()
+	require.Nil(t, err)
+	d, ok := LookupDaemon("selftest")
+	require.True(t, ok)
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, binary, config.Executable)
+	require.Equal(t, []string{"--port", "8080", "--verbose", "-L-"}, config.Args)
+	require.Equal(t, root, config.Dir)
+}
+
+func TestDownloadBinary(t *testing.T) {
+	initTestConfig(t)
+	data := []byte("#!/bin/sh\nexit 0\n")
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dl/testd" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	binary, err := DownloadBinary(server.URL+"/dl/testd", strings.ToUpper(digest))
+	require.Nil(t, err)
+	defer os.RemoveAll(filepath.Dir(binary))
+	require.Equal(t, "testd", filepath.Base(binary))
+	require.Nil(t, checkExecutable(binary))
+	content, err := os.ReadFile(binary)
+	require.Nil(t, err)
+	require.Equal(t, data, content)
+
+	_, err = DownloadBinary(server.URL+"/dl/testd", strings.Repeat("0", 64))
+	require.ErrorContains(t, err, "sha256 mismatch")
+	_, err = DownloadBinary(server.URL+"/dl/missing", "")
+	require.ErrorContains(t, err, "404")
+	_, err = DownloadBinary("ftp://example.com/testd", "")
+	require.ErrorContains(t, err, "invalid binary url")
+	_, err = DownloadBinary(server.URL+"/", "")
+	require.ErrorContains(t, err, "invalid binary url")
+}
+
+func TestExplainDaemon(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+	testConfig(t, "daemon.binary", executable)
+	testConfig(t, "daemon.dir", root)
+	testConfig(t, "daemon.arg", []string{"--port", "8080"})
+
+	r := explainDaemon([]string{"serve"})
+	current, err := user.Current()
+	require.Nil(t, err)
+	require.Equal(t, executable, r.Binary)
+	require.Equal(t, "testd", r.Name)
+	require.Equal(t, current.Username, r.User)
+	require.Equal(t, current.Uid, r.Uid)
+	require.Equal(t, current.Gid, r.Gid)
+	require.Equal(t, root, r.Dir)
+	require.Equal(t, "daemontools", r.Backend)
+	require.Equal(t, filepath.Join(binRoot, "testd"), r.Executable)
+	require.Equal(t, []string{"serve", "--port", "8080", "-L-"}, r.Args)
+	require.False(t, common.IsDir(filepath.Join(serviceRoot, "testd")))
+}
+
+func TestServiceArgs(t *testing.T) {
+	initTestConfig(t)
+	appArgs := []string{"serve", "--port", "8080"}
+	testConfig(t, "daemon.args", nil)
+	require.Equal(t, appArgs, serviceArgs(appArgs))
+
+	testConfig(t, "daemon.arg", []string{"--port", "9090"})
+	require.Equal(t, []string{"serve", "--port", "8080", "--port", "9090"}, serviceArgs(appArgs))
+	require.Equal(t, []string{"serve", "--port", "8080"}, appArgs)
+
+	testConfig(t, "daemon.replace_args", true)
+	require.Equal(t, []string{"--port", "9090"}, serviceArgs(appArgs))
+}
+
+func TestLogArgs(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	testConfig(t, "daemon.log_flag", "--log")
+	d, err := NewSystemd("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	require.Equal(t, "serve --log=-", d.(*Systemd).Args)
+
+	testConfig(t, "daemon.log_flag", "-o")
+	dt, err := NewDaemontools("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	require.Equal(t, "serve -o-", dt.(*Daemontools).Args)
+
+	testConfig(t, "daemon.log_flag", "--log")
+	args, err := logArgs(nil, "/var/log/testd")
+	require.Nil(t, err)
+	require.Equal(t, []string{"--log=/var/log/testd"}, args)
+	testConfig(t, "daemon.log_flag", "-o")
+	args, err = logArgs(nil, "/var/log/testd")
+	require.Nil(t, err)
+	require.Equal(t, []string{"-o", "/var/log/testd"}, args)
+	args, err = logArgs(daemonSettings{"log_flag": "--out"}, "/var/log/testd")
+	require.Nil(t, err)
+	require.Equal(t, []string{"--out=/var/log/testd"}, args)
+	testConfig(t, "daemon.log_flag", "")
+	args, err = logArgs(nil, "/var/log/testd")
+	require.Nil(t, err)
+	require.Equal(t, []string{"--logfile", "/var/log/testd"}, args)
+	testConfig(t, "daemon.log_flag", "L")
+	_, err = logArgs(nil, "/var/log/testd")
+	require.ErrorContains(t, err, "invalid log_flag: L")
+	testConfig(t, "daemon.log_flag", "-o")
+
+	testConfig(t, "daemon.inject_log_flag", "false")
+	d, err = NewSystemd("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	require.Equal(t, "serve", d.(*Systemd).Args)
+	dt, err = NewDaemontools("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	require.Equal(t, "serve", dt.(*Daemontools).Args)
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	require.NotContains(t, string(rc.(*RCDaemon).rcData()), "--logfile")
+
+	testConfig(t, "daemon.inject_log_flag", "")
+	testConfig(t, "daemon.log_flag", "L")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid log_flag: L")
+	testConfig(t, "daemon.inject_log_flag", "maybe")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid inject_log_flag: maybe")
+}
+
+func TestLogPath(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	dt, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	path, err := dt.LogPath()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(logRoot, "testd"), path)
+
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	path, err = rc.LogPath()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(logRoot, "testrc"), path)
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	_, err = unit.LogPath()
+	require.ErrorIs(t, err, ErrNotSupported)
+
+	logFile := filepath.Join(root, "logs", "testd.log")
+	testConfig(t, "daemon.logfile", logFile)
+	for _, d := range []func() (CobraDaemon, error){
+		func() (CobraDaemon, error) { return NewSystemd("testd", testUser(t), root, executable) },
+		func() (CobraDaemon, error) { return NewRCDaemon("testrc", testUser(t), root, executable) },
+	} {
+		daemon, err := d()
+		require.Nil(t, err)
+		path, err := daemon.LogPath()
+		require.Nil(t, err)
+		require.Equal(t, logFile, path)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.linux.backend", "runit")
+	capabilities, err := PlatformCapabilities()
+	require.Nil(t, err)
+	require.True(t, capabilities.LogService)
+	d, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.False(t, d.Capabilities().LogService)
+	require.True(t, d.Capabilities().Pid)
+
+	principal, _ := windowsPrincipal("LocalSystem")
+	t.Setenv("SystemRoot", root)
+	task, err := NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	require.False(t, task.Capabilities().Pid)
+	_, err = task.Pid()
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestCustomTemplate(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	custom := filepath.Join(t.TempDir(), "unit")
+	require.Nil(t, os.WriteFile(custom, []byte("[Service]\n${TASK_CREDENTIALS}ExecStart=${TASK_BIN} ${TASK_ARGS}\nNice=5\n"), 0644))
+	testConfig(t, "daemon.template.systemd_unit", custom)
+	d, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	files, err := d.ConfigFiles()
+	require.Nil(t, err)
+	unit := "[Service]\nUser=root\nGroup=root\nExecStart=" + filepath.Join(binRoot, "testd") + " -L-\nNice=5\n"
+	require.Equal(t, "# "+specMarker+specHash([]byte(unit))+"\n"+unit, string(files[0].Data))
+
+	require.Nil(t, os.WriteFile(custom, []byte("[Service]\nExecStart=${TASK_BIN}\n"), 0644))
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "template systemd_unit does not use ${TASK_ARGS}, ${TASK_CREDENTIALS}")
+
+	require.ErrorContains(t, SetTemplate("unit", ""), "unknown template: unit")
+	require.ErrorContains(t, SetTemplate("daemontools_log", "exec multilog t\n"), "does not use ${TASK_LOG_DIR}")
+	require.Nil(t, SetTemplate("daemontools_log", "#!/bin/sh\nexec multilog t s100 ${TASK_LOG_DIR}\n"))
+	t.Cleanup(func() { delete(customTemplates.templates, "daemontools_log") })
+	dt, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	_, log := dt.(*Daemontools).templates()
+	require.Equal(t, "#!/bin/sh\nexec multilog t s100 "+filepath.Join(logRoot, "testd")+"\n", string(dt.(*Daemontools).templateData(log)))
+	run, _ := dt.(*Daemontools).templates()
+	require.Equal(t, runTemplate, run)
+}
+
+func TestConcurrentDaemons(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	fakeCommand(t, "svstat", `echo "$1: up (pid 123) 5 seconds"`)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+
+	// each spec's settings apply only to its own daemon; make race runs
+	// this under the race detector
+	names := []string{"testa", "testb"}
+	errs := make(chan error, 2*len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := NewDaemonFromSpec(DaemonSpec{
+				Name:       name,
+				Dir:        root,
+				Executable: executable,
+				Args:       []string{"serve", name},
+				Config:     map[string]string{"env": "NAME=" + name, "nice": strconv.Itoa(i + 1)},
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- d.Install()
+			running, err := d.Query()
+			if err == nil && !running {
+				err = fmt.Errorf("%s not running", name)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	for i, name := range names {
+		d, ok := LookupDaemon(name)
+		require.True(t, ok)
+		config, err := d.GetDaemonConfig()
+		require.Nil(t, err)
+		require.Equal(t, []string{"serve", name, "-L-"}, config.Args)
+		require.Equal(t, name, d.(*Daemontools).Env["NAME"])
+		require.Equal(t, strconv.Itoa(i+1), d.(*Daemontools).Nice)
+	}
+}
+
+func TestInstallLock(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+
+	// two installs of one daemon run one after the other, so the second
+	// finds it installed rather than a half written service directory
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := NewDaemon("testd", "", root, executable)
+			if err == nil {
+				err = d.Install()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	installed := 0
+	for err := range errs {
+		if err == nil {
+			installed++
+		} else {
+			require.ErrorIs(t, err, ErrAlreadyInstalled)
+		}
+	}
+	require.Equal(t, 1, installed)
+
+	d, err := NewDaemon("testd", "", root, executable)
+	require.Nil(t, err)
+	other, err := NewDaemon("testd", "", root, executable)
+	require.Nil(t, err)
+	unlock, err := lockDaemon(other, "testd")
+	require.Nil(t, err)
+	testConfig(t, "daemon.lock_timeout", "0")
+	require.ErrorIs(t, d.Delete(), ErrLocked)
+
+	// the holder may lock again, as Reinstall does around Delete and Install
+	again, err := lockDaemon(other, "testd")
+	require.Nil(t, err)
+	again()
+
+	testConfig(t, "daemon.lock_timeout", "10s")
+	start := time.Now()
+	time.AfterFunc(300*time.Millisecond, unlock)
+	require.Nil(t, d.Delete())
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	// another process holding the lock file
+	path, err := lockPath("testd")
+	require.Nil(t, err)
+	file, err := tryLockFile(path)
+	require.Nil(t, err)
+	_, err = tryLockFile(path)
+	require.ErrorIs(t, err, errLockBusy)
+	require.Nil(t, file.Close())
+}
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, 0, ExitCode(nil))
+	require.Equal(t, 1, ExitCode(fmt.Errorf("failed")))
+	require.Equal(t, 2, ExitCode(fatalf("%w: testd", ErrNotInstalled)))
+	require.Equal(t, 3, ExitCode(fatal(ErrAlreadyInstalled)))
+	require.Equal(t, 5, ExitCode(fatalf("%w: pid", ErrNotSupported)))
+	require.Equal(t, 8, ExitCode(fatal(ErrPermissionDenied)))
+	require.Equal(t, 9, ExitCode(ErrWaitTimeout))
+	require.Equal(t, 10, ExitCode(fatal(ErrLocked)))
+}
+
+func TestErrorMessage(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	err := fatal(checkTools("daemontools", []string{"svc"}))
+	require.Equal(t, "service supervisor is not available: daemontools not installed: svc not found in PATH", errorMessage(err))
+	require.Equal(t, "not supported on this system: SIGFOO stop signal", errorMessage(fatalf("%w: %s stop signal", ErrNotSupported, "SIGFOO")))
+	require.Equal(t, "daemon is not installed", errorMessage(fatal(ErrNotInstalled)))
+	require.Equal(t, "run directory: missing", errorMessage(fatalf("run directory: %s", "missing")))
+}
+
+func TestQueryByName(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	fakeCommand(t, "svstat", `echo "$1: up (pid 123) 5 seconds"`)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+
+	_, err := QueryByName("testd")
+	require.ErrorIs(t, err, ErrNotInstalled)
+	_, err = StatusByName("testd")
+	require.ErrorIs(t, err, ErrNotInstalled)
+	_, err = QueryByName("bad-name")
+	require.NotNil(t, err)
+
+	d, err := NewDaemon("testd", "", root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+
+	running, err := QueryByName("testd")
+	require.Nil(t, err)
+	require.True(t, running)
+	state, err := StatusByName("testd")
+	require.Nil(t, err)
+	require.Equal(t, StateRunning, state)
+}
+
+func TestWaitSupervised(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	ctx := context.Background()
+
+	// systemd knows the unit once it is loaded
+	fakeCommand(t, "systemctl", `[ "$1" != show ] || cat $FAKE_STATE/show`)
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, waitSupervised(ctx, unit, time.Second), ErrNotInstalled)
+	require.Nil(t, unit.Install())
+	require.Nil(t, os.WriteFile(filepath.Join(state, "show"), []byte("not-found\n"), 0644))
+	err = waitSupervised(ctx, unit, 100*time.Millisecond)
+	require.ErrorIs(t, err, ErrSupervisorUnavailable)
+	require.ErrorContains(t, err, "testd.service is not-found after 100ms")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.WriteFile(filepath.Join(state, "show"), []byte("loaded\n"), 0644)
+	}()
+	require.Nil(t, waitSupervised(ctx, unit, 5*time.Second))
+
+	// a daemontools service is supervised once svscan creates supervise
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, waitSupervised(ctx, d, time.Second), ErrNotInstalled)
+	require.Nil(t, d.Install())
+	service := filepath.Join(serviceRoot, "testd")
+	err = waitSupervised(ctx, d, 100*time.Millisecond)
+	require.ErrorIs(t, err, ErrSupervisorUnavailable)
+	require.ErrorContains(t, err, "is svscan running on "+serviceRoot)
+	require.Nil(t, os.Mkdir(filepath.Join(service, "supervise"), 0700))
+	require.Nil(t, os.Mkdir(filepath.Join(service, "log", "supervise"), 0700))
+	require.Nil(t, waitSupervised(ctx, d, 0))
+
+	// a cancelled wait ends with the context error
+	require.Nil(t, os.Remove(filepath.Join(service, "supervise")))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, waitSupervised(cancelled, d, time.Minute), context.Canceled)
+
+	// an installed rc.d script needs no wait
+	rc, err := NewRCDaemon("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, waitSupervised(ctx, rc, time.Second), ErrNotInstalled)
+}
@@ -23,15 +23,20 @@ THE SOFTWARE.
 package daemon
 
 import (
+	"context"
 	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/rstms/cobra-daemon/common"
-	"io"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 //go:embed template/daemontools_run
@@ -40,67 +45,699 @@ var runTemplate string
 //go:embed template/daemontools_log
 var logTemplate string
 
+//go:embed template/runit_run
+var runitRunTemplate string
+
+//go:embed template/runit_log
+var runitLogTemplate string
+
+//go:embed template/s6_log
+var s6LogTemplate string
+
 type Daemontools struct {
-	Name       string
-	Username   string
-	Uid        string
-	Gid        string
-	Executable string
-	Args       string
-	Dir        string
-	LogFile    string
-	service    string
-	serviceBin string
+	Name           string
+	Username       string
+	Uid            string
+	Gid            string
+	Group          string
+	Groups         []string
+	Executable     string
+	Args           string
+	Dir            string
+	LogFile        string
+	ErrorLog       string
+	Stdin          string
+	PidFile        string
+	Umask          string
+	StopTimeout    time.Duration
+	StopSignal     string
+	CommandTimeout time.Duration
+	Retries        int
+	RetryDelay     time.Duration
+	SettleTimeout  time.Duration
+	LogSize        int
+	LogKeep        int
+	Logging        string
+	Env            map[string]string
+	Wrapper        bool
+	Nice           string
+	IOClass        string
+	IOLevel        string
+	CPUAffinity    string
+	MemoryLimit    int64
+	NofileLimit    int
+	ChownBinary    bool
+	Force          bool
+	StartType      string
+	Type           string
+	After          []string
+	Requires       []string
+	PreStart       string
+	PostStop       string
+	ExtraConfig    string
+	service        string
+	serviceBin     string
+	definition     string
+	supervisor     string
+	altGroup       bool
+	groupGids      []string
+	wrapperFile    string
+	customRun      string
+	customLog      string
+	settings       daemonSettings
+}
+
+// runit shares the daemontools service directory model, controlled by sv
+func NewRunit(name string, serviceUser *user.User, runDir string, command string, args ...string) (CobraDaemon, error) {
+	return NewRunitFromSpec(DaemonSpec{Name: name, Dir: runDir, Executable: command, Args: args}, serviceUser)
+}
+
+func NewRunitFromSpec(spec DaemonSpec, serviceUser *user.User) (CobraDaemon, error) {
+	d, err := newDaemontools(spec, serviceUser)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	d.supervisor = "runit"
+	d.definition = filepath.Join(svRoot, spec.Name)
+	err = d.loadTemplates()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return d, nil
+}
+
+// s6 runs daemontools style service directories from its scan directory,
+// controlled by s6-svc and rescanned with s6-svscanctl
+func NewS6(name string, serviceUser *user.User, runDir string, command string, args ...string) (CobraDaemon, error) {
+	return NewS6FromSpec(DaemonSpec{Name: name, Dir: runDir, Executable: command, Args: args}, serviceUser)
+}
+
+func NewS6FromSpec(spec DaemonSpec, serviceUser *user.User) (CobraDaemon, error) {
+	d, err := newDaemontools(spec, serviceUser)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	d.supervisor = "s6"
+	d.service = filepath.Join(s6ScanRoot, spec.Name)
+	d.definition = filepath.Join(s6Root, spec.Name)
+	err = d.loadTemplates()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return d, nil
 }
 
 func NewDaemontools(name string, serviceUser *user.User, runDir string, command string, args ...string) (CobraDaemon, error) {
+	return NewDaemontoolsFromSpec(DaemonSpec{Name: name, Dir: runDir, Executable: command, Args: args}, serviceUser)
+}
+
+func NewDaemontoolsFromSpec(spec DaemonSpec, serviceUser *user.User) (CobraDaemon, error) {
+	d, err := newDaemontools(spec, serviceUser)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	_, err = d.stopCommands()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	err = d.loadTemplates()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return d, nil
+}
 
-	serviceDir := filepath.Join("/etc/service", name)
-	_, basename := filepath.Split(command)
-	args = append(args, "-L-")
+func newDaemontools(spec DaemonSpec, serviceUser *user.User) (*Daemontools, error) {
+	settings := daemonSettings(spec.Config)
+	name, runDir, command := spec.Name, spec.Dir, spec.Executable
+	args := append([]string{}, spec.Args...)
+
+	serviceDir := filepath.Join(serviceRoot, name)
+	serviceBin, err := serviceBinary(settings, binRoot, command)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	chown, err := chownBinary(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logging, err := daemontoolsLogging(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	timeout, err := stopTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	signal, err := stopSignal(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	cmdTimeout, err := commandTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	retries, retryDelay, err := retryPolicy(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	settle, err := settleTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logSize, logKeep, err := logRotation(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	group, alternate, err := userGroup(serviceUser)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	supplementary, err := supplementaryGroups(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	groups, groupGids := []string{}, []string{}
+	for _, g := range supplementary {
+		groups = append(groups, g.Name)
+		groupGids = append(groupGids, g.Gid)
+	}
+	// with multilog the daemon logs to stdout and the log service writes
+	// LogFile as a directory; with file the daemon writes LogFile itself,
+	// and with none its output goes wherever the supervisor's goes
+	logDir, logFile := "", ""
+	switch logging {
+	case "multilog":
+		logDir, err = logPath(settings, filepath.Join(logRoot, name))
+	case "file":
+		logDir, err = logPath(settings, filepath.Join(logRoot, name+".log"))
+		logFile = logDir
+	}
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if logging != "none" {
+		logFlags, err := logArgs(settings, logFile)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		args = append(args, logFlags...)
+	}
+	stdin, err := daemonStdin(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// with daemon.split_logs a second log service reads stderr from a fifo
+	split, err := splitLogs(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	errorLog := ""
+	if split {
+		if logging != "multilog" {
+			return nil, fatalf("%w: split_logs with daemontools logging %s", ErrNotSupported, logging)
+		}
+		errorLog = logDir + ".stderr"
+	}
+	env, err := daemonEnv(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	pidfile, err := pidFile(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	start, err := startType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	kind, err := daemonType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	nice, err := niceness(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	ioClass, ioLevel, err := ioScheduling(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	cpus, err := cpuAffinity(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	memoryLimit, nofileLimit, err := resourceLimits(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	mask, err := umask(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// the run scripts have no sandbox, so daemon.sandbox is only validated
+	_, err = sandbox(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	after, requires, err := dependencies(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	prestart, poststop, err := hooks(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	extra, err := extraConfig(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
 	t := Daemontools{
-		Name:       name,
-		Username:   serviceUser.Username,
-		Uid:        serviceUser.Uid,
-		Gid:        serviceUser.Gid,
-		Executable: command,
-		Args:       strings.Join(args, " "),
-		Dir:        runDir,
-		service:    serviceDir,
-		serviceBin: filepath.Join("/usr/local/bin", basename),
+		Name:           name,
+		Username:       serviceUser.Username,
+		Uid:            serviceUser.Uid,
+		Gid:            serviceUser.Gid,
+		Group:          group,
+		Groups:         groups,
+		Executable:     command,
+		Args:           quoteArgs(args, quoteShell),
+		Dir:            runDir,
+		LogFile:        logDir,
+		ErrorLog:       errorLog,
+		Stdin:          stdin,
+		PidFile:        pidfile,
+		Umask:          mask,
+		StopTimeout:    timeout,
+		StopSignal:     signal,
+		CommandTimeout: cmdTimeout,
+		Retries:        retries,
+		RetryDelay:     retryDelay,
+		SettleTimeout:  settle,
+		LogSize:        logSize,
+		LogKeep:        logKeep,
+		Logging:        logging,
+		Env:            env,
+		Wrapper:        settings.getBool("daemon.wrapper"),
+		Nice:           nice,
+		IOClass:        ioClass,
+		IOLevel:        ioLevel,
+		CPUAffinity:    cpus,
+		MemoryLimit:    memoryLimit,
+		NofileLimit:    nofileLimit,
+		ChownBinary:    chown,
+		Force:          common.ViperGetBool("force"),
+		StartType:      start,
+		Type:           kind,
+		After:          after,
+		Requires:       requires,
+		PreStart:       prestart,
+		PostStop:       poststop,
+		ExtraConfig:    extra,
+		supervisor:     "daemontools",
+		service:        serviceDir,
+		serviceBin:     serviceBin,
+		definition:     filepath.Join(svcRoot, name),
+		altGroup:       alternate,
+		groupGids:      groupGids,
+		wrapperFile:    wrapperPath(name, ""),
+		settings:       settings,
 	}
 
 	return &t, nil
 }
 
+// values are shell quoted; Args is quoted when the daemon is created
 func (d *Daemontools) templateData(template string) []byte {
 	data := os.Expand(template, func(key string) string {
 		switch key {
 		case "TASK_NAME":
-			return d.Name
+			return shellQuote(d.Name)
 		case "TASK_USER":
-			return d.Username
+			return shellQuote(d.Username)
+		case "TASK_GROUP":
+			return shellQuote(d.Group)
+		case "TASK_USER_GROUP":
+			return shellQuote(d.chpstUser())
+		case "TASK_SETUID":
+			// setuidgid only applies the user's primary group; chpst and
+			// s6-applyuidgid set the supplementary groups after it
+			if d.supervisor == "s6" {
+				if d.setsGroups() {
+					gids := strings.Join(append([]string{d.Gid}, d.groupGids...), ",")
+					return d.priority() + "s6-applyuidgid -u " + shellQuote(d.Uid) + " -g " + shellQuote(d.Gid) + " -G " + shellQuote(gids)
+				}
+				return d.priority() + "s6-setuidgid " + shellQuote(d.Username)
+			}
+			if d.setsGroups() {
+				return d.priority() + "chpst -u " + shellQuote(d.chpstUser())
+			}
+			return d.priority() + "setuidgid " + shellQuote(d.Username)
+		case "TASK_PRIORITY":
+			return d.priority()
+		case "TASK_DEPENDS":
+			return d.depends()
+		case "TASK_UMASK":
+			if d.Umask == "" {
+				return ""
+			}
+			return "umask " + d.Umask + "\n"
+		case "TASK_PRESTART":
+			if d.PreStart == "" {
+				return ""
+			}
+			return "sh -c " + shellQuote(d.PreStart) + " || { sleep 1; exit 1; }\n"
+		case "TASK_PIDFILE":
+			// exec keeps the shell's pid; with poststop or a oneshot the
+			// daemon's pid is written after it is started in the background
+			if d.PidFile == "" || d.child() {
+				return ""
+			}
+			return "echo $$ > " + shellQuote(d.PidFile) + "\n"
+		case "TASK_STDERR":
+			if d.ErrorLog == "" {
+				return ""
+			}
+			fifo := shellQuote(d.stderrFifo())
+			return fmt.Sprintf("[ -p %s ] || mkfifo -m 0600 %s\n%s < %s &\nexec 2>%s\n", fifo, fifo, d.stderrLogger(), fifo, fifo)
+		case "TASK_EXTRA":
+			return d.ExtraConfig
+		case "TASK_STDIN":
+			if d.Stdin == "" {
+				return ""
+			}
+			return "exec <" + shellQuote(d.Stdin) + "\n"
+		case "TASK_ONCE":
+			// the supervisor leaves a oneshot down when it exits, however
+			// it was started
+			if !d.oneshot() {
+				return ""
+			}
+			return quoteArgs(d.controlArgs(d.service, "once")[0], quoteShell) + "\n"
+		case "TASK_EXEC":
+			// exec would discard the trap, so the daemon runs as a child
+			// when poststop must run after it exits or a oneshot records its
+			// exit status
+			if !d.child() {
+				return "exec"
+			}
+			return "trap 'kill -TERM \"$pid\" 2>/dev/null' TERM INT HUP\ncommand"
+		case "TASK_POSTSTOP":
+			if !d.child() {
+				return ""
+			}
+			pidfile, cleanup, record, poststop := "", "", "", ""
+			if d.PidFile != "" {
+				pidfile = "echo \"$pid\" > " + shellQuote(d.PidFile) + "\n"
+				cleanup = "rm -f " + shellQuote(d.PidFile) + "\n"
+			}
+			if d.oneshot() {
+				record = "echo \"$status\" > " + shellQuote(d.exitFile()) + "\n"
+			}
+			if d.PostStop != "" {
+				poststop = "sh -c " + shellQuote(d.PostStop) + "\n"
+			}
+			return " &\npid=$!\n" + pidfile + "wait \"$pid\"; status=$?\n" +
+				"while kill -0 \"$pid\" 2>/dev/null; do wait \"$pid\"; status=$?; done\n" +
+				cleanup + record + poststop + "exit $status"
 		case "TASK_UID":
-			return d.Uid
+			return shellQuote(d.Uid)
 		case "TASK_BIN":
-			return d.serviceBin
+			if d.Wrapper {
+				return shellQuote(d.wrapperFile)
+			}
+			return shellQuote(d.serviceBin)
+		case "TASK_ENV":
+			words := []string{shellQuote("HOME=" + d.Dir)}
+			for _, key := range sortedKeys(d.Env) {
+				words = append(words, shellQuote(key+"="+d.Env[key]))
+			}
+			return strings.Join(words, " ")
 		case "TASK_ARGS":
 			return d.Args
 		case "TASK_DIR":
-			return d.Dir
+			return shellQuote(d.Dir)
+		case "TASK_LOG_DIR":
+			return shellQuote(d.LogFile)
+		case "TASK_LOG_SIZE":
+			return strconv.Itoa(d.LogSize)
+		case "TASK_LOG_KEEP":
+			return strconv.Itoa(d.LogKeep)
 		}
 		return "${" + key + "}"
 	})
 	return []byte(data)
 }
 
+var ioniceClass = map[string]string{"realtime": "1", "best-effort": "2", "idle": "3"}
+
+// return the nice, ionice, cpu affinity, and resource limit command prefix, run as root
+// before dropping privileges
+func (d *Daemontools) priority() string {
+	prefix := ""
+	if d.MemoryLimit > 0 || d.NofileLimit > 0 {
+		// chpst and s6-softlimit take the same limit options as softlimit
+		switch d.supervisor {
+		case "runit":
+			prefix += "chpst "
+		case "s6":
+			prefix += "s6-softlimit "
+		default:
+			prefix += "softlimit "
+		}
+		if d.MemoryLimit > 0 {
+			prefix += fmt.Sprintf("-m %d ", d.MemoryLimit)
+		}
+		if d.NofileLimit > 0 {
+			prefix += fmt.Sprintf("-o %d ", d.NofileLimit)
+		}
+	}
+	if d.Nice != "" {
+		prefix += "nice -n " + d.Nice + " "
+	}
+	if d.IOClass != "" {
+		prefix += "ionice -c " + ioniceClass[d.IOClass] + " "
+		if d.IOLevel != "" {
+			prefix += "-n " + d.IOLevel + " "
+		}
+	}
+	if d.CPUAffinity != "" {
+		prefix += "taskset -c " + d.CPUAffinity + " "
+	}
+	return prefix
+}
+
+// return run script lines that wait for dependencies, which the supervisors
+// can't order; a missing required service makes the run script exit so the
+// supervisor retries it, while daemon.after gives up waiting after afterWait seconds
+func (d *Daemontools) depends() string {
+	check := func(name string) string {
+		service := shellQuote(filepath.Join(filepath.Dir(d.service), name))
+		switch d.supervisor {
+		case "runit":
+			return "sv check " + service + " >/dev/null"
+		case "s6":
+			return "s6-svstat -u " + service + " | grep -q true"
+		}
+		return "svstat " + service + " | grep -q ': up '"
+	}
+	lines := ""
+	for _, name := range d.After {
+		lines += fmt.Sprintf("n=0; until %s || [ $n -ge %d ]; do sleep 1; n=$((n+1)); done\n", check(name), afterWait)
+	}
+	for _, name := range d.Requires {
+		lines += fmt.Sprintf("%s || { sleep 1; exit 1; }\n", check(name))
+	}
+	return lines
+}
+
+// the fifo the run script connects the daemon's stderr to
+func (d *Daemontools) stderrFifo() string {
+	return filepath.Join(d.definition, "stderr")
+}
+
+// return the logger command the run script starts on the stderr fifo,
+// rotated like the stdout log
+func (d *Daemontools) stderrLogger() string {
+	dir := shellQuote(d.ErrorLog)
+	switch d.supervisor {
+	case "runit":
+		return "svlogd -tt " + dir
+	case "s6":
+		return fmt.Sprintf("s6-log t s%d n%d %s", d.LogSize, d.LogKeep, dir)
+	}
+	return fmt.Sprintf("multilog t s%d n%d %s", d.LogSize, d.LogKeep, dir)
+}
+
+func (d *Daemontools) svlogdConfig() []byte {
+	return []byte(fmt.Sprintf("s%d\nn%d\n", d.LogSize, d.LogKeep))
+}
+
+func (d *Daemontools) templateNames() (string, string) {
+	switch d.supervisor {
+	case "runit":
+		return "runit_run", "runit_log"
+	case "s6":
+		return "daemontools_run", "s6_log"
+	}
+	return "daemontools_run", "daemontools_log"
+}
+
+func (d *Daemontools) loadTemplates() error {
+	runName, logName := d.templateNames()
+	var err error
+	d.customRun, err = customTemplate(d.settings, runName)
+	if err != nil {
+		return fatal(err)
+	}
+	d.customLog, err = customTemplate(d.settings, logName)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a oneshot service runs until its command exits, then stays down
+func (d *Daemontools) oneshot() bool {
+	return d.Type == "oneshot"
+}
+
+// the run script starts the daemon as a child rather than exec'ing it
+func (d *Daemontools) child() bool {
+	return d.PostStop != "" || d.oneshot()
+}
+
+// the file where a oneshot run script records the exit status of its last run
+func (d *Daemontools) exitFile() string {
+	return filepath.Join(d.definition, "exit-status")
+}
+
+func (d *Daemontools) templates() (string, string) {
+	run, log := runTemplate, logTemplate
+	switch d.supervisor {
+	case "runit":
+		run, log = runitRunTemplate, runitLogTemplate
+	case "s6":
+		log = s6LogTemplate
+	}
+	if d.customRun != "" {
+		run = d.customRun
+	}
+	if d.customLog != "" {
+		log = d.customLog
+	}
+	return run, log
+}
+
+// sv commands sending each stop signal; the first letter of each is the
+// corresponding svc and s6-svc flag
+var signalCommands = map[string]string{
+	"TERM": "term",
+	"INT":  "interrupt",
+	"HUP":  "hup",
+	"QUIT": "quit",
+	"USR1": "1",
+	"USR2": "2",
+	"ALRM": "alarm",
+	"KILL": "kill",
+}
+
+// return the control commands that stop the service with StopSignal; down
+// always sends TERM, so any other signal follows once, which keeps the
+// supervisor from restarting the process when it exits
+func (d *Daemontools) stopCommands() ([]string, error) {
+	if d.StopSignal == "" || d.StopSignal == "TERM" {
+		return []string{"down"}, nil
+	}
+	// daemontools svc has no flags for QUIT, USR1, or USR2
+	if d.supervisor == "daemontools" && slices.Contains([]string{"QUIT", "USR1", "USR2"}, d.StopSignal) {
+		return nil, fatalf("%w: daemontools cannot send SIG%s", ErrNotSupported, d.StopSignal)
+	}
+	return []string{"once", signalCommands[d.StopSignal]}, nil
+}
+
+// return the flag argument for control commands sent with svc or s6-svc
+func (d *Daemontools) controlFlags(commands []string) string {
+	flags := "-"
+	for _, command := range commands {
+		// s6-svc -o also brings a down service up; -O only stops a restart
+		if d.supervisor == "s6" && command == "once" {
+			flags += "O"
+			continue
+		}
+		flags += command[:1]
+	}
+	return flags
+}
+
+// the command lines sending up, down, once, kill, or signal commands to
+// the supervisor for serviceDir; sv takes one command at a time
+func (d *Daemontools) controlArgs(serviceDir string, commands ...string) [][]string {
+	if d.supervisor == "runit" {
+		argv := [][]string{}
+		for _, command := range commands {
+			argv = append(argv, []string{"sv", command, serviceDir})
+		}
+		return argv
+	}
+	svc := "svc"
+	if d.supervisor == "s6" {
+		svc = "s6-svc"
+	}
+	return [][]string{{svc, d.controlFlags(commands), serviceDir}}
+}
+
+func (d *Daemontools) control(serviceDir string, commands ...string) error {
+	for _, args := range d.controlArgs(serviceDir, commands...) {
+		err := d.run(args[0], args[1:]...)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
+
+// run a control command, retrying while the supervisor is not ready, as
+// when svscan has not yet started supervise for a new service
+func (d *Daemontools) run(name string, args ...string) error {
+	return retry(d.Retries, d.RetryDelay, func() error {
+		_, _, _, err := runTimeout(d.CommandTimeout, name, args...)
+		return err
+	})
+}
+
 func (d *Daemontools) enable() error {
 	downFile := filepath.Join(d.service, "down")
 	if common.IsFile(downFile) {
 		err := os.Remove(downFile)
 		if err != nil {
-			return common.Fatal(err)
+			return fatal(err)
 		}
+		debugLog("remove", "path", downFile)
+	}
+	return nil
+}
+
+// remove the down file so the supervisor starts the service when it scans
+func (d *Daemontools) Enable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	err := d.enable()
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// write the down file so the supervisor leaves the service down when it
+// starts; a running service is not stopped
+func (d *Daemontools) Disable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	err := d.disable()
+	if err != nil {
+		return fatal(err)
 	}
 	return nil
 }
@@ -108,157 +745,1334 @@ func (d *Daemontools) enable() error {
 func (d *Daemontools) disable() error {
 	downFile := filepath.Join(d.service, "down")
 	if !common.IsFile(downFile) {
-		err := os.WriteFile(downFile, []byte{}, 0600)
+		err := writeFileAtomic(downFile, []byte{}, 0600)
 		if err != nil {
-			return common.Fatal(err)
+			return fatal(err)
 		}
 	}
 	return nil
 }
 
-func (d *Daemontools) Install() error {
+// the service link exists in the supervised directory
+func (d *Daemontools) installed() bool {
+	_, err := os.Lstat(d.service)
+	return err == nil
+}
 
-	gid, err := strconv.Atoi(d.Gid)
-	if err != nil {
-		return common.Fatal(err)
+// a service link to the definition directory is ours; any other service
+// entry, or a definition without the generated run script, is only
+// replaced with Force, while a definition left by a previous install is reused
+func (d *Daemontools) checkInstallTarget() error {
+	if d.installed() {
+		target, err := os.Readlink(d.service)
+		if err == nil && target == d.definition {
+			return fatalf("%w: %s", ErrAlreadyInstalled, d.service)
+		}
+		if !d.Force {
+			return fatalf("%w: %s was not installed by this program", ErrAlreadyInstalled, d.service)
+		}
 	}
-	err = os.MkdirAll("/var/svc.d", 0755)
+	run := filepath.Join(d.definition, "run")
+	exists, ours, err := generatedFile(run)
 	if err != nil {
-		return err
+		return fatal(err)
 	}
-	dir := filepath.Join("/var/svc.d", d.Name)
-	err = os.MkdirAll(filepath.Join(dir, "log"), 0750)
+	if exists && !ours && !d.Force {
+		return fatalf("%w: %s was not installed by this program", ErrAlreadyInstalled, run)
+	}
+	return nil
+}
+
+func (d *Daemontools) Install() error {
+
+	err := checkPrivileges("install", d.service)
 	if err != nil {
-		return err
+		return fatal(err)
 	}
-	err = os.Chown(dir, -1, gid)
+	unlock, err := lockDaemon(d, d.Name)
 	if err != nil {
-		return err
+		return fatal(err)
 	}
-	err = os.WriteFile(filepath.Join(dir, "run"), d.templateData(runTemplate), 0700)
+	defer unlock()
+	err = d.checkInstallTarget()
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
-	err = os.WriteFile(filepath.Join(dir, "log", "run"), d.templateData(logTemplate), 0700)
+	err = checkDependencies(append(d.After, d.Requires...), func(name string) bool {
+		return common.IsDir(filepath.Join(filepath.Dir(d.service), name))
+	})
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
-	ifp, err := os.Open(d.Executable)
+	err = createRunDir(d.Dir, d.Uid, d.Gid)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
-	defer ifp.Close()
-	ofp, err := os.OpenFile(d.serviceBin, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	gid, err := strconv.Atoi(d.Gid)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
-	_, err = io.Copy(ofp, ifp)
+	dir := d.definition
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
 	if err != nil {
-		return common.Fatal(err)
+		return err
 	}
-
-	logdir := filepath.Join("/var/log", d.Name)
-	if !common.IsDir(logdir) {
-		err = os.Mkdir(logdir, 0770)
+	if d.hasLogService() {
+		err = os.MkdirAll(filepath.Join(dir, "log"), 0750)
+		if err != nil {
+			return err
+		}
+		debugLog("mkdir", "path", filepath.Join(dir, "log"))
+	} else {
+		err = os.MkdirAll(dir, 0750)
 		if err != nil {
-			return common.Fatal(err)
+			return err
 		}
 	}
-	err = os.WriteFile(filepath.Join(dir, "down"), []byte{}, 0600)
+	err = os.Chown(dir, -1, gid)
 	if err != nil {
-		return common.Fatal(err)
+		return err
 	}
-	err = os.Symlink(dir, d.service)
+	runTemplate, logTemplate := d.templates()
+	err = writeFileAtomic(filepath.Join(dir, "run"), stampSpec(d.templateData(runTemplate)), 0700)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
-	return nil
-}
-
-func (d *Daemontools) Delete() error {
-	running, err := d.svstat(d.service)
+	if d.hasLogService() {
+		err = writeFileAtomic(filepath.Join(dir, "log", "run"), stampSpec(d.templateData(logTemplate)), 0700)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	err = copyBinary(d.Executable, d.serviceBin, owner, group)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
-	if running {
-		err := d.Stop()
+	if d.Wrapper {
+		err = writeWrapper(d.wrapperFile, shellWrapper(d.Dir, d.serviceBin, d.Env))
 		if err != nil {
-			return common.Fatal(err)
+			return fatal(err)
 		}
 	}
-	logRunning, err := d.svstat(filepath.Join(d.service, "log"))
-	if err != nil {
-		return common.Fatal(err)
+
+	for _, logdir := range d.logDirs() {
+		err = createOwnedDirs(filepath.Dir(logdir), d.Uid, d.Gid)
+		if err != nil {
+			return fatal(err)
+		}
+		if !common.IsDir(logdir) {
+			err = os.Mkdir(logdir, 0770)
+			if err != nil {
+				return fatal(err)
+			}
+			debugLog("mkdir", "path", logdir)
+		}
+		if d.supervisor == "runit" {
+			// svlogd reads its rotation settings from the log directory
+			err = writeFileAtomic(filepath.Join(logdir, "config"), d.svlogdConfig(), 0640)
+			if err != nil {
+				return fatal(err)
+			}
+		}
 	}
-	if logRunning {
-		err = exec.Command("svc", "-d", filepath.Join(d.service, "log")).Run()
+	if d.Logging == "file" {
+		err = d.createLogFile()
 		if err != nil {
-			return common.Fatal(err)
+			return fatal(err)
 		}
 	}
-	err = os.RemoveAll(d.service)
-	if err != nil {
-		return common.Fatal(err)
+	// the supervisor starts an auto service as soon as it is linked
+	if d.StartType != "auto" {
+		err = writeFileAtomic(filepath.Join(dir, "down"), []byte{}, 0600)
+		if err != nil {
+			return fatal(err)
+		}
 	}
-	err = os.RemoveAll(filepath.Join("/var/svc.d", d.Name))
+	// Force has allowed replacing a service entry that isn't ours
+	err = symlinkAtomic(dir, d.service)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	if d.supervisor == "s6" {
+		err = d.rescan(false)
+		if err != nil {
+			return fatal(err)
+		}
 	}
 	return nil
 }
 
-func (d *Daemontools) Start() error {
-	err := d.enable()
-	if err != nil {
-		return common.Fatal(err)
-	}
-	err = exec.Command("svc", "-u", d.service).Run()
+// tell s6-svscan to pick up added services, and with prune to stop
+// supervising removed ones
+func (d *Daemontools) rescan(prune bool) error {
+	args := d.rescanArgs(prune)
+	_, _, _, err := runTimeout(d.CommandTimeout, args[0], args[1:]...)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
 	return nil
 }
 
-func (d *Daemontools) Stop() error {
-	err := exec.Command("svc", "-d", d.service).Run()
-	if err != nil {
-		return common.Fatal(err)
+func (d *Daemontools) rescanArgs(prune bool) []string {
+	flags := "-a"
+	if prune {
+		flags = "-an"
 	}
-	return nil
+	return []string{"s6-svscanctl", flags, filepath.Dir(d.service)}
 }
 
-func (d *Daemontools) GetConfig() (string, error) {
-	runData, err := os.ReadFile(filepath.Join(d.service, "run"))
-	if err != nil {
-		return "", common.Fatal(err)
+// svc -x tells supervise to exit once the service is down
+func (d *Daemontools) exitArgs() []string {
+	if !d.hasLogService() {
+		return []string{"svc", "-dx", d.definition}
 	}
-	return string(runData), nil
+	return []string{"svc", "-dx", d.definition, filepath.Join(d.definition, "log")}
 }
 
-func (d *Daemontools) Query() (bool, error) {
-	running, err := d.svstat(d.service)
-	if err != nil {
-		return false, common.Fatal(err)
+// the run scripts, the down file, and the svlogd configs and wrapper in use
+func (d *Daemontools) ConfigFiles() ([]ConfigFile, error) {
+	runTemplate, logTemplate := d.templates()
+	files := []ConfigFile{
+		{filepath.Join(d.definition, "run"), 0700, stampSpec(d.templateData(runTemplate))},
+	}
+	if d.hasLogService() {
+		files = append(files, ConfigFile{filepath.Join(d.definition, "log", "run"), 0700, stampSpec(d.templateData(logTemplate))})
+	}
+	files = append(files, ConfigFile{filepath.Join(d.definition, "down"), 0600, []byte{}})
+	if d.supervisor == "runit" {
+		for _, logdir := range d.logDirs() {
+			files = append(files, ConfigFile{filepath.Join(logdir, "config"), 0640, d.svlogdConfig()})
+		}
+	}
+	if d.Wrapper {
+		files = append(files, ConfigFile{d.wrapperFile, 0755, shellWrapper(d.Dir, d.serviceBin, d.Env)})
+	}
+	return files, nil
+}
+
+func (d *Daemontools) binaries() (string, string) {
+	return d.Executable, d.serviceBin
+}
+
+func (d *Daemontools) updateBinary() error {
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
 	}
-	return running, nil
+	return copyBinary(d.Executable, d.serviceBin, owner, group)
 }
 
-func (d *Daemontools) svstat(serviceDir string) (bool, error) {
-	stdout, err := exec.Command("svstat", serviceDir).Output()
+// the supervisor runs the run scripts each time it starts the service;
+// the down file follows enable and start, so it is left as it is
+func (d *Daemontools) rewriteConfig() (bool, error) {
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return false, fatal(err)
+	}
+	files = slices.DeleteFunc(files, func(file ConfigFile) bool {
+		return file.Path == filepath.Join(d.definition, "down")
+	})
+	changed, err := rewriteFiles(files)
 	if err != nil {
-		return false, common.Fatal(err)
+		return false, fatal(err)
+	}
+	return changed, nil
+}
+
+// return the multilog directory the daemon writes, or with file logging
+// the file; daemon.logfile when set
+func (d *Daemontools) LogPath() (string, error) {
+	if d.LogFile == "" {
+		return "", fatalf("%w: %s has no log with daemontools logging none", ErrNotSupported, d.Name)
+	}
+	return d.LogFile, nil
+}
+
+// return the installed locations; log is the log directory
+func (d *Daemontools) Paths() map[string]string {
+	paths := map[string]string{
+		"binary":     d.serviceBin,
+		"config":     filepath.Join(d.definition, "run"),
+		"definition": d.definition,
+		"dir":        d.Dir,
+		"service":    d.service,
+	}
+	if d.LogFile != "" {
+		paths["log"] = d.LogFile
+	}
+	if d.Wrapper {
+		paths["wrapper"] = d.wrapperFile
 	}
-	status := strings.TrimSpace(string(stdout))
-	fields := strings.Fields(status)
-	if len(fields) < 2 {
-		return false, common.Fatalf("unexpected svstat output: %s", status)
+	if d.PidFile != "" {
+		paths["pidfile"] = d.PidFile
+	}
+	if d.ErrorLog != "" {
+		paths["stderr"] = d.ErrorLog
+	}
+	return paths
+}
+
+// the stdout log directory, then the stderr one when logs are split;
+// none without a log service
+func (d *Daemontools) logDirs() []string {
+	if !d.hasLogService() {
+		return nil
 	}
-	if fields[0] != serviceDir+":" {
-		return false, common.Fatalf("unexpected svstat dir output: %s", fields[0])
+	if d.ErrorLog == "" {
+		return []string{d.LogFile}
 	}
-	running := false
-	if fields[1] == "up" {
-		running = true
+	return []string{d.LogFile, d.ErrorLog}
+}
+
+// remove whatever parts of the service exist, stopping it only when the
+// supervised directory is present; each teardown step runs even when an
+// earlier one fails, and the errors are returned together; with Force, a
+// failed stop is reported and the removal continues
+func (d *Daemontools) Delete() error {
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if !d.installed() && !common.IsDir(d.definition) {
+		return fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	err = checkPrivileges("delete", d.service)
+	if err != nil {
+		return fatal(err)
+	}
+	errs := []error{}
+	stopFailed := func(name string, err error) {
+		if d.Force {
+			forceWarning(name, err)
+			return
+		}
+		errs = append(errs, err)
+	}
+	supervised := false
+	if common.IsDir(d.service) {
+		// a status error is reported by Stop if it persists
+		status, err := d.svstat(d.service)
+		if err == nil {
+			supervised = status.Supervised
+		}
+		if err != nil || status.isUp() {
+			err := d.Stop()
+			if err != nil {
+				stopFailed(d.Name, fatal(err))
+			}
+		}
+	}
+	logService := d.logService()
+	if common.IsDir(logService) {
+		logStatus, err := d.svstat(logService)
+		if err != nil || logStatus.isUp() {
+			commands := []string{"down"}
+			if d.Force {
+				commands = append(commands, "kill")
+			}
+			err = d.control(logService, commands...)
+			if err != nil {
+				stopFailed(d.Name+"/log", fatal(err))
+			}
+		}
+	}
+	err = os.RemoveAll(d.service)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	} else {
+		debugLog("remove", "path", d.service)
+	}
+	// svscan leaves supervise running for a removed service; runsvdir stops
+	// runsv itself and s6-svscan does so when told to prune
+	switch {
+	case supervised && d.supervisor == "daemontools":
+		args := d.exitArgs()
+		_, _, _, err = runTimeout(d.CommandTimeout, args[0], args[1:]...)
+		if err != nil && !d.Force {
+			errs = append(errs, fatal(err))
+		}
+	case d.supervisor == "s6":
+		err = d.rescan(true)
+		if err != nil && !d.Force {
+			errs = append(errs, fatal(err))
+		}
+	}
+	err = os.RemoveAll(d.definition)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	} else {
+		debugLog("remove", "path", d.definition)
+	}
+	err = removePidFile(d.PidFile)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	}
+	err = removeWrapper(d.wrapperFile)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	}
+	return errors.Join(errs...)
+}
+
+// delete the service and remove its log directory and copied binary
+func (d *Daemontools) Purge() error {
+	return purge(d, d.Executable, d.serviceBin, filepath.Join(filepath.Dir(d.definition), "*", "run"))
+}
+
+// return daemon.daemontools.logging: multilog, the default, runs the
+// supervisor's logger as a log service reading stdout; file passes the
+// daemon its log file; none does neither
+func daemontoolsLogging(settings daemonSettings) (string, error) {
+	value := settings.getString("daemon.daemontools.logging")
+	switch value {
+	case "":
+		return "multilog", nil
+	case "multilog", "file", "none":
+		return value, nil
+	}
+	return "", fatalf("invalid daemontools logging: %s; expected multilog, file, or none", value)
+}
+
+// svscan and runsvdir pick up a new service on their next scan, every
+// five seconds
+const defaultSettleTimeout = 10 * time.Second
+
+// return the configured daemon.settle_timeout duration; 0 skips the wait
+func settleTimeout(settings daemonSettings) (time.Duration, error) {
+	value := settings.getString("daemon.settle_timeout")
+	if value == "" {
+		return defaultSettleTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fatalf("invalid settle_timeout: %s", value)
+	}
+	return timeout, nil
+}
+
+// wait up to timeout for the supervisor to create the supervise directory
+// of the service and its log service, so a Start right after Install does
+// not race the scanner
+func (d *Daemontools) waitSupervised(ctx context.Context, timeout time.Duration) error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	dirs := []string{d.service}
+	if common.IsDir(d.logService()) {
+		dirs = append(dirs, d.logService())
+	}
+	deadline := time.Now().Add(timeout)
+	for _, dir := range dirs {
+		supervise := filepath.Join(dir, "supervise")
+		for !common.IsDir(supervise) {
+			if time.Now().After(deadline) {
+				return fatalf("%w: %s not supervised after %s; is %s running on %s?", ErrSupervisorUnavailable, dir, timeout, d.scanner(), filepath.Dir(d.service))
+			}
+			err := sleepContext(ctx, pollInterval)
+			if err != nil {
+				return fatal(err)
+			}
+		}
+	}
+	return nil
+}
+
+// the process that scans the service directory for new services
+func (d *Daemontools) scanner() string {
+	switch d.supervisor {
+	case "runit":
+		return "runsvdir"
+	case "s6":
+		return "s6-svscan"
+	}
+	return "svscan"
+}
+
+// a running service is left alone; a oneshot is run once
+func (d *Daemontools) Start() error {
+	// a settle timeout of 0 skips the wait
+	if d.SettleTimeout > 0 && d.installed() {
+		err := d.waitSupervised(context.Background(), d.SettleTimeout)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	running, err := d.active()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		debugLog("already running", "name", d.Name)
+		return nil
+	}
+	err = checkStartType(d.Name, d.StartType)
+	if err != nil {
+		return fatal(err)
+	}
+	// svc -u starts a manual service without removing its down file
+	if d.StartType != "manual" {
+		err = d.enable()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	// start the logger first so it is reading when the daemon writes
+	if common.IsDir(d.logService()) {
+		err = d.control(d.logService(), "up")
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	commands := []string{"up"}
+	if d.oneshot() {
+		commands = append(commands, "once")
+	}
+	err = d.control(d.service, commands...)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// the log service supervised beside the main service
+func (d *Daemontools) logService() string {
+	return filepath.Join(d.service, "log")
+}
+
+// only multilog logging runs a log service; Delete, Start, and Stop also
+// look for one left by an install with other settings
+func (d *Daemontools) hasLogService() bool {
+	return d.Logging == "multilog"
+}
+
+// create the log file the daemon writes with file logging, owned by the
+// daemon user
+func (d *Daemontools) createLogFile() error {
+	err := createOwnedDirs(filepath.Dir(d.LogFile), d.Uid, d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	if !common.IsFile(d.LogFile) {
+		file, err := os.Create(d.LogFile)
+		if err != nil {
+			return fatal(err)
+		}
+		file.Close()
+		debugLog("create", "path", d.LogFile)
+	}
+	uid, err := strconv.Atoi(d.Uid)
+	if err != nil {
+		return fatal(err)
+	}
+	gid, err := strconv.Atoi(d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chown(d.LogFile, uid, gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chmod(d.LogFile, 0640)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// stop the log service once the daemon has stopped
+func (d *Daemontools) stopLog() error {
+	if !common.IsDir(d.logService()) {
+		return nil
+	}
+	err := d.control(d.logService(), "down")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+func (d *Daemontools) Stop() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	commands, err := d.stopCommands()
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.control(d.service, commands...)
+	if err != nil {
+		return fatal(err)
+	}
+	isUp := func() (bool, error) {
+		status, err := d.svstat(d.service)
+		if err != nil {
+			return false, err
+		}
+		return status.isUp(), nil
+	}
+	stopped, err := waitStopped(isUp, d.StopTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if !stopped {
+		err = d.control(d.service, "down", "kill")
+		if err != nil {
+			return fatal(err)
+		}
+		stopped, err = waitStopped(isUp, killTimeout)
+		if err != nil {
+			return fatal(err)
+		}
+		if !stopped {
+			return fatalf("%s still running after kill", d.Name)
+		}
+	}
+	err = d.stopLog()
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// the supervisor commands run by start, stop, query, or delete
+func (d *Daemontools) Commands(action string) ([][]string, error) {
+	switch action {
+	case "start":
+		argv := [][]string{}
+		if d.hasLogService() {
+			argv = d.controlArgs(d.logService(), "up")
+		}
+		if d.oneshot() {
+			return append(argv, d.controlArgs(d.service, "up", "once")...), nil
+		}
+		return append(argv, d.controlArgs(d.service, "up")...), nil
+	case "stop", "delete":
+		commands, err := d.stopCommands()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		argv := d.controlArgs(d.service, commands...)
+		if d.hasLogService() {
+			argv = append(argv, d.controlArgs(d.logService(), "down")...)
+		}
+		switch {
+		case action == "stop":
+		case d.supervisor == "daemontools":
+			argv = append(argv, d.exitArgs())
+		case d.supervisor == "s6":
+			argv = append(argv, d.rescanArgs(true))
+		}
+		return argv, nil
+	case "query":
+		// a oneshot query reads the exit status file
+		if d.oneshot() {
+			return [][]string{}, nil
+		}
+		return [][]string{d.statusArgs(d.service)}, nil
+	}
+	return nil, fatalf("unknown action: %s", action)
+}
+
+// svc -d returns before the process exits, so wait for Stop to complete
+// before bringing the service back up
+func (d *Daemontools) Restart() error {
+	err := d.Stop()
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.Start()
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+func (d *Daemontools) GetConfig() (string, error) {
+	if !d.installed() {
+		return "", fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	runData, err := os.ReadFile(filepath.Join(d.service, "run"))
+	if err != nil {
+		return "", fatal(err)
+	}
+	return string(runData), nil
+}
+
+func (d *Daemontools) GetDaemonConfig() (*DaemonConfig, error) {
+	script, err := d.GetConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config, err := parseRunScript(script)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config.Name = d.Name
+	config.Enabled = !common.IsFile(filepath.Join(d.service, "down"))
+	return config, nil
+}
+
+func (d *Daemontools) DesiredConfig() (*DaemonConfig, error) {
+	runTemplate, _ := d.templates()
+	config, err := parseRunScript(string(d.templateData(runTemplate)))
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config.Name = d.Name
+	return config, nil
+}
+
+// parse the cd and exec lines of a run script in the form written by Install
+func parseRunScript(script string) (*DaemonConfig, error) {
+	lines, err := shellSplit(script)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config := DaemonConfig{Env: make(map[string]string)}
+	for _, words := range lines {
+		switch {
+		case words[0] == "cd" && len(words) == 2:
+			config.Dir = words[1]
+		case (words[0] == "exec" || words[0] == "command") && len(words) > 1 && !strings.HasPrefix(words[1], "2>") && !strings.HasPrefix(words[1], "<"):
+			words = words[1:]
+			if words[len(words)-1] == "&" {
+				words = words[:len(words)-1]
+			}
+			for len(words) > 2 && (words[0] == "nice" || words[0] == "ionice" || words[0] == "taskset" || words[0] == "softlimit" || words[0] == "s6-softlimit" || (words[0] == "chpst" && words[1] != "-u")) {
+				words = words[1:]
+				for len(words) > 1 && strings.HasPrefix(words[0], "-") {
+					words = words[2:]
+				}
+			}
+			switch {
+			case (words[0] == "setuidgid" || words[0] == "s6-setuidgid") && len(words) > 1:
+				config.User = words[1]
+				words = words[2:]
+			case len(words) > 2 && words[0] == "s6-applyuidgid" && words[1] == "-u":
+				config.User = words[2]
+				if u, err := user.LookupId(words[2]); err == nil {
+					config.User = u.Username
+				}
+				words = words[3:]
+				for len(words) > 1 && strings.HasPrefix(words[0], "-") {
+					words = words[2:]
+				}
+			case len(words) > 2 && words[0] == "chpst" && words[1] == "-u":
+				config.User, _, _ = strings.Cut(words[2], ":")
+				words = words[3:]
+			}
+			if len(words) > 0 && words[0] == "env" {
+				words = words[1:]
+				for len(words) > 0 && strings.Contains(words[0], "=") {
+					key, value, _ := strings.Cut(words[0], "=")
+					config.Env[key] = value
+					words = words[1:]
+				}
+			}
+			if len(words) == 0 {
+				return nil, fatalf("no command in run script exec line")
+			}
+			config.Executable = words[0]
+			config.Args = words[1:]
+		}
+	}
+	if config.Executable == "" {
+		return nil, fatalf("no exec line in run script")
+	}
+	return &config, nil
+}
+
+// replace the run script, restarting the process if it is running
+func (d *Daemontools) SetConfig(config string) error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	err := checkConfig(config)
+	if err != nil {
+		return fatal(err)
+	}
+	err = writeFileAtomic(filepath.Join(d.definition, "run"), []byte(config), 0700)
+	if err != nil {
+		return fatal(err)
+	}
+	running, err := d.active()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		err = d.control(d.service, "term")
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
+
+// the run script sets the groups itself rather than using the user's
+// primary group
+func (d *Daemontools) setsGroups() bool {
+	return d.altGroup || len(d.Groups) > 0
+}
+
+// the chpst -u account: user:group, then any supplementary groups
+func (d *Daemontools) chpstUser() string {
+	return strings.Join(append([]string{d.Username, d.Group}, d.Groups...), ":")
+}
+
+// return the supervisor name and the commands the service needs
+func (d *Daemontools) tools() (string, []string) {
+	tools := []string{"svc", "svstat", "setuidgid", "multilog"}
+	switch {
+	case d.supervisor == "runit":
+		tools = []string{"sv", "chpst", "svlogd"}
+	case d.supervisor == "s6":
+		tools = []string{"s6-svc", "s6-svstat", "s6-svscanctl", "s6-log"}
+		if d.setsGroups() {
+			tools = append(tools, "s6-applyuidgid")
+		} else {
+			tools = append(tools, "s6-setuidgid")
+		}
+		if d.MemoryLimit > 0 || d.NofileLimit > 0 {
+			tools = append(tools, "s6-softlimit")
+		}
+	case d.setsGroups():
+		tools = append(tools, "chpst")
+	}
+	if d.CPUAffinity != "" {
+		tools = append(tools, "taskset")
+	}
+	if !d.hasLogService() {
+		tools = slices.DeleteFunc(tools, func(tool string) bool {
+			return slices.Contains([]string{"multilog", "svlogd", "s6-log"}, tool)
+		})
+	}
+	return d.supervisor, tools
+}
+
+func (d *Daemontools) Validate() error {
+	return errors.Join(
+		checkTools(d.tools()),
+		checkExecutable(d.Executable),
+		checkRunDir(d.settings, d.Dir, d.Uid, d.Gid),
+		checkPidDir(d.PidFile, "0", "0"),
+	)
+}
+
+// report whether the daemon is running, or for a oneshot whether its
+// last run exited 0
+func (d *Daemontools) Query() (bool, error) {
+	if d.oneshot() {
+		if !d.installed() {
+			return false, fatalf("%w: %s", ErrNotInstalled, d.service)
+		}
+		data, err := os.ReadFile(d.exitFile())
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fatal(err)
+		}
+		return strings.TrimSpace(string(data)) == "0", nil
+	}
+	return d.active()
+}
+
+// the supervisor restarts a service it wants up, so one that is down while
+// wanted up has exited on its own; a oneshot has failed when its last
+// run exited non-zero
+func (d *Daemontools) Status() (DaemonState, error) {
+	if !d.installed() {
+		return "", fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	status, err := d.svstat(d.service)
+	if err != nil {
+		return "", fatal(err)
+	}
+	if !d.oneshot() || status.running() {
+		return status.state(), nil
+	}
+	data, err := os.ReadFile(d.exitFile())
+	if os.IsNotExist(err) {
+		return StateStopped, nil
+	}
+	if err != nil {
+		return "", fatal(err)
+	}
+	if strings.TrimSpace(string(data)) != "0" {
+		return StateFailed, nil
+	}
+	return StateStopped, nil
+}
+
+// report whether the service process is running
+func (d *Daemontools) active() (bool, error) {
+	if !d.installed() {
+		return false, fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	status, err := d.svstat(d.service)
+	if err != nil {
+		return false, fatal(err)
+	}
+	return status.running(), nil
+}
+
+var daemontoolsCapabilities = DaemonCapabilities{
+	Pid:          true,
+	PidFile:      true,
+	StopSignal:   true,
+	Dependencies: true,
+	LogService:   true,
+	Oneshot:      true,
+}
+
+func (d *Daemontools) Capabilities() DaemonCapabilities {
+	return daemontoolsCapabilities
+}
+
+// the settings the service was created with
+func (d *Daemontools) specSettings() daemonSettings {
+	return d.settings
+}
+
+// report whether the log service is running
+func (d *Daemontools) QueryLog() (bool, error) {
+	if !d.installed() {
+		return false, fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	if !common.IsDir(d.logService()) {
+		return false, nil
+	}
+	status, err := d.svstat(d.logService())
+	if err != nil {
+		return false, fatal(err)
+	}
+	return status.running(), nil
+}
+
+// return the pid of the running daemon, or 0 if it is not running; the
+// pid file is preferred as the supervised process is the run script's
+// shell when poststop is set
+func (d *Daemontools) Pid() (int, error) {
+	if !d.installed() {
+		return 0, fatalf("%w: %s", ErrNotInstalled, d.service)
+	}
+	status, err := d.svstat(d.service)
+	if err != nil {
+		return 0, fatal(err)
+	}
+	if !status.isUp() {
+		return 0, nil
+	}
+	if d.PidFile != "" {
+		pid, err := readPidFile(d.PidFile)
+		if err != nil {
+			return 0, fatal(err)
+		}
+		if pid != 0 {
+			return pid, nil
+		}
+	}
+	return status.Pid, nil
+}
+
+type svstatState int
+
+const (
+	svstatDown svstatState = iota
+	svstatUp
+	svstatUpWantDown
+	svstatDownWantUp
+)
+
+type svstatStatus struct {
+	State      svstatState
+	Supervised bool
+	Pid        int
+	Seconds    int
+	NormallyUp bool
+	Paused     bool
+}
+
+// the process exists, whether or not it has been told to go down
+func (s *svstatStatus) isUp() bool {
+	return s.State == svstatUp || s.State == svstatUpWantDown
+}
+
+// the process exists and is not shutting down
+func (s *svstatStatus) running() bool {
+	return s.State == svstatUp
+}
+
+func (s *svstatStatus) state() DaemonState {
+	switch s.State {
+	case svstatUp, svstatUpWantDown:
+		return StateRunning
+	case svstatDownWantUp:
+		return StateFailed
+	}
+	return StateStopped
+}
+
+func (d *Daemontools) svstat(serviceDir string) (*svstatStatus, error) {
+	var status *svstatStatus
+	err := retry(d.Retries, d.RetryDelay, func() error {
+		var err error
+		status, err = d.supervisorStatus(serviceDir)
+		return err
+	})
+	if errors.Is(err, ErrPermissionDenied) && d.supervisor != "s6" {
+		// the status file may be readable where the control fifo is not
+		return readSuperviseStatus(serviceDir)
+	}
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return status, nil
+}
+
+func (d *Daemontools) statusArgs(serviceDir string) []string {
+	switch d.supervisor {
+	case "s6":
+		return []string{"s6-svstat", serviceDir}
+	case "runit":
+		return []string{"sv", "status", serviceDir}
+	}
+	return []string{"svstat", serviceDir}
+}
+
+func (d *Daemontools) supervisorStatus(serviceDir string) (*svstatStatus, error) {
+	args := d.statusArgs(serviceDir)
+	switch d.supervisor {
+	case "s6":
+		stdout, stderr, _, err := runTimeout(d.CommandTimeout, args[0], args[1:]...)
+		if err != nil {
+			// s6-svstat fails when no s6-supervise process holds the directory
+			if strings.Contains(stdout+stderr, "supervisor not listening") {
+				return &svstatStatus{}, nil
+			}
+			return nil, fatal(err)
+		}
+		status, err := parseS6Svstat(stdout)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		return status, nil
+	case "runit":
+		stdout, _, _, err := runTimeout(d.CommandTimeout, args[0], args[1:]...)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		status, err := parseSv(serviceDir, stdout)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		return status, nil
+	}
+	stdout, _, _, err := runTimeout(d.CommandTimeout, args[0], args[1:]...)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// svstat reports an unreadable service on stdout and exits 0
+	if permissionDenied(stdout) {
+		return nil, fatalf("%w: %s", ErrPermissionDenied, strings.TrimSpace(stdout))
+	}
+	status, err := parseSvstat(serviceDir, stdout)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return status, nil
+}
+
+// TAI64 label of the unix epoch, as written by supervise and runsv
+const tai64Epoch = 4611686018427387914
+
+// read the binary status file written by daemontools supervise (18 bytes)
+// or runit runsv (20 bytes); unlike svstat and sv, this does not need write
+// access to the supervise/ok fifo, so it works for an unprivileged user when
+// the supervise directory is readable
+func readSuperviseStatus(serviceDir string) (*svstatStatus, error) {
+	superviseDir := filepath.Join(serviceDir, "supervise")
+	data, err := os.ReadFile(filepath.Join(superviseDir, "status"))
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, fatalf("%w: %v", ErrPermissionDenied, err)
+		}
+		if os.IsNotExist(err) {
+			return &svstatStatus{}, nil
+		}
+		return nil, fatal(err)
+	}
+	if len(data) != 18 && len(data) != 20 {
+		return nil, fatalf("unexpected status file size: %d", len(data))
+	}
+	ok, err := os.OpenFile(filepath.Join(superviseDir, "ok"), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	switch {
+	case err == nil:
+		ok.Close()
+	case errors.Is(err, syscall.ENXIO), os.IsNotExist(err):
+		// no supervise process is reading the fifo
+		return &svstatStatus{}, nil
+	case !os.IsPermission(err):
+		return nil, fatal(err)
+	}
+	status := svstatStatus{Supervised: true}
+	changed := int64(binary.BigEndian.Uint64(data[:8]) - tai64Epoch)
+	status.Seconds = int(max(time.Now().Unix()-changed, 0))
+	status.Pid = int(binary.LittleEndian.Uint32(data[12:16]))
+	status.Paused = data[16] != 0
+	status.NormallyUp = !common.IsFile(filepath.Join(serviceDir, "down"))
+	running := status.Pid != 0
+	if len(data) == 20 {
+		// runit records the finish script pid; state 1 is run
+		running = data[19] == 1
+	}
+	switch {
+	case running && data[17] == 'd':
+		status.State = svstatUpWantDown
+	case running:
+		status.State = svstatUp
+	case data[17] == 'u':
+		status.State = svstatDownWantUp
+	default:
+		status.State = svstatDown
+	}
+	if !running {
+		status.Pid = 0
+	}
+	return &status, nil
+}
+
+// parse svstat output of the forms:
+//
+//	DIR: up (pid N) N seconds[, normally down][, paused][, want down]
+//	DIR: down N seconds[, normally up][, want up]
+//	DIR: supervise not running
+func parseSvstat(serviceDir, output string) (*svstatStatus, error) {
+	line := strings.TrimSpace(output)
+	detail, ok := strings.CutPrefix(line, serviceDir+": ")
+	if !ok {
+		return nil, fatalf("unexpected svstat dir output: %s", line)
+	}
+	status := svstatStatus{}
+	if detail == "supervise not running" {
+		return &status, nil
+	}
+	clauses := strings.Split(detail, ", ")
+	fields := strings.Fields(clauses[0])
+	var seconds string
+	switch {
+	case len(fields) == 5 && fields[0] == "up" && fields[1] == "(pid" && fields[4] == "seconds":
+		pid, err := strconv.Atoi(strings.TrimSuffix(fields[2], ")"))
+		if err != nil {
+			return nil, fatalf("unexpected svstat pid output: %s", line)
+		}
+		status.State = svstatUp
+		status.Pid = pid
+		status.NormallyUp = true
+		seconds = fields[3]
+	case len(fields) == 3 && fields[0] == "down" && fields[2] == "seconds":
+		status.State = svstatDown
+		seconds = fields[1]
+	default:
+		return nil, fatalf("unexpected svstat output: %s", line)
+	}
+	secs, err := strconv.Atoi(seconds)
+	if err != nil {
+		return nil, fatalf("unexpected svstat seconds output: %s", line)
+	}
+	status.Seconds = secs
+	status.Supervised = true
+	err = parseSvstatClauses(&status, clauses[1:])
+	if err != nil {
+		return nil, fatalf("unexpected svstat output: %s", line)
+	}
+	return &status, nil
+}
+
+// parse sv status output of the forms:
+//
+//	run: DIR: (pid N) Ns[, normally down][, paused][, want down][; run: log: ...]
+//	down: DIR: Ns[, normally up][, want up][; run: log: ...]
+//	finish: DIR: (pid N) Ns[, ...]
+func parseSv(serviceDir, output string) (*svstatStatus, error) {
+	line := strings.TrimSpace(output)
+	main, _, _ := strings.Cut(line, "; ")
+	state, detail, ok := strings.Cut(main, ": ")
+	if !ok {
+		return nil, fatalf("unexpected sv status output: %s", line)
+	}
+	detail, ok = strings.CutPrefix(detail, serviceDir+": ")
+	if !ok {
+		return nil, fatalf("unexpected sv status dir output: %s", line)
+	}
+	status := svstatStatus{Supervised: true}
+	clauses := strings.Split(detail, ", ")
+	fields := strings.Fields(clauses[0])
+	var seconds string
+	switch {
+	case (state == "run" || state == "finish") && len(fields) == 3 && fields[0] == "(pid":
+		pid, err := strconv.Atoi(strings.TrimSuffix(fields[1], ")"))
+		if err != nil {
+			return nil, fatalf("unexpected sv status pid output: %s", line)
+		}
+		status.Pid = pid
+		seconds = fields[2]
+		if state == "run" {
+			status.State = svstatUp
+			status.NormallyUp = true
+		}
+	case state == "down" && len(fields) == 1:
+		seconds = fields[0]
+	default:
+		return nil, fatalf("unexpected sv status output: %s", line)
+	}
+	secs, err := strconv.Atoi(strings.TrimSuffix(seconds, "s"))
+	if err != nil {
+		return nil, fatalf("unexpected sv status seconds output: %s", line)
+	}
+	status.Seconds = secs
+	err = parseSvstatClauses(&status, clauses[1:])
+	if err != nil {
+		return nil, fatalf("unexpected sv status output: %s", line)
+	}
+	return &status, nil
+}
+
+// apply the trailing status clauses shared by svstat and sv status
+func parseSvstatClauses(status *svstatStatus, clauses []string) error {
+	for _, clause := range clauses {
+		switch clause {
+		case "normally up":
+			status.NormallyUp = true
+		case "normally down":
+			status.NormallyUp = false
+		case "paused":
+			status.Paused = true
+		case "want up":
+			if status.State == svstatDown {
+				status.State = svstatDownWantUp
+			}
+		case "want down":
+			if status.State == svstatUp {
+				status.State = svstatUpWantDown
+			}
+		default:
+			return fatalf("unexpected clause: %s", clause)
+		}
+	}
+	return nil
+}
+
+// parse s6-svstat output of the forms:
+//
+//	up (pid N) N seconds[, normally down][, want down][, ready N seconds]
+//	down (exitcode N) N seconds[, normally up][, want up][, ready N seconds]
+//	down (signal SIG) N seconds[, ...]
+func parseS6Svstat(output string) (*svstatStatus, error) {
+	line := strings.TrimSpace(output)
+	status := svstatStatus{Supervised: true}
+	clauses := strings.Split(line, ", ")
+	fields := strings.Fields(clauses[0])
+	if len(fields) < 3 || fields[len(fields)-1] != "seconds" {
+		return nil, fatalf("unexpected s6-svstat output: %s", line)
+	}
+	// the parenthesized detail is one or more key value pairs
+	detail := strings.Fields(strings.Trim(strings.Join(fields[1:len(fields)-2], " "), "()"))
+	switch fields[0] {
+	case "up":
+		if len(detail) < 2 || detail[0] != "pid" {
+			return nil, fatalf("unexpected s6-svstat output: %s", line)
+		}
+		pid, err := strconv.Atoi(detail[1])
+		if err != nil {
+			return nil, fatalf("unexpected s6-svstat pid output: %s", line)
+		}
+		status.State = svstatUp
+		status.Pid = pid
+		status.NormallyUp = true
+	case "down":
+	default:
+		return nil, fatalf("unexpected s6-svstat output: %s", line)
+	}
+	secs, err := strconv.Atoi(fields[len(fields)-2])
+	if err != nil {
+		return nil, fatalf("unexpected s6-svstat seconds output: %s", line)
+	}
+	status.Seconds = secs
+	remaining := []string{}
+	for _, clause := range clauses[1:] {
+		if !strings.HasPrefix(clause, "ready ") {
+			remaining = append(remaining, clause)
+		}
+	}
+	err = parseSvstatClauses(&status, remaining)
+	if err != nil {
+		return nil, fatalf("unexpected s6-svstat output: %s", line)
+	}
+	return &status, nil
+}
+
+// return the service definition and scan directories of supervisor
+func daemontoolsRoots(supervisor string) (string, string) {
+	switch supervisor {
+	case "runit":
+		return svRoot, serviceRoot
+	case "s6":
+		return s6Root, s6ScanRoot
+	}
+	return svcRoot, serviceRoot
+}
+
+// return a service of supervisor that can only inspect the installed
+// service name; a oneshot is queried as a daemon
+func daemontoolsByName(supervisor, name string) (CobraDaemon, error) {
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	root, scanRoot := daemontoolsRoots(supervisor)
+	return &Daemontools{
+		Name:           name,
+		CommandTimeout: timeout,
+		service:        filepath.Join(scanRoot, name),
+		definition:     filepath.Join(root, name),
+		supervisor:     supervisor,
+	}, nil
+}
+
+func listDaemontools(supervisor string) ([]DaemonInfo, error) {
+	root, scanRoot := daemontoolsRoots(supervisor)
+	list := []DaemonInfo{}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+		return nil, fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		target, err := os.Readlink(filepath.Join(scanRoot, name))
+		if err != nil || target != filepath.Join(root, name) {
+			continue
+		}
+		d, err := daemontoolsByName(supervisor, name)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		running, err := d.Query()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		list = append(list, DaemonInfo{Name: name, Running: running})
 	}
-	return running, nil
+	return list, nil
 }
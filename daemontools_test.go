@@ -0,0 +1,1194 @@
+package daemon
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/rstms/cobra-daemon/common"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDaemontoolsMultipleInstances(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	fakeCommand(t, "svc", "exit 0")
+	executable := testExecutable(t, root)
+	u := testUser(t)
+
+	web, err := NewDaemontools("myapp_web", u, root, executable, "--port", "8080")
+	require.Nil(t, err)
+	worker, err := NewDaemontools("myapp_worker", u, root, executable, "--queue", "jobs")
+	require.Nil(t, err)
+
+	require.Nil(t, web.Install())
+	require.Nil(t, worker.Install())
+
+	for _, name := range []string{"myapp_web", "myapp_worker"} {
+		target, err := os.Readlink(filepath.Join(serviceRoot, name))
+		require.Nil(t, err)
+		require.Equal(t, filepath.Join(svcRoot, name), target)
+		require.DirExists(t, filepath.Join(logRoot, name))
+	}
+
+	config, err := worker.GetConfig()
+	require.Nil(t, err)
+	require.Contains(t, config, "--queue jobs")
+	require.NotContains(t, config, "--port")
+
+	require.Nil(t, web.Delete())
+	require.NoDirExists(t, filepath.Join(svcRoot, "myapp_web"))
+	require.NoFileExists(t, filepath.Join(serviceRoot, "myapp_web"))
+
+	_, err = os.Readlink(filepath.Join(serviceRoot, "myapp_worker"))
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(svcRoot, "myapp_worker", "run"))
+	require.FileExists(t, filepath.Join(binRoot, "testd"))
+
+	list, err := listDaemontools("daemontools")
+	require.Nil(t, err)
+	require.Equal(t, []DaemonInfo{{Name: "myapp_worker", Running: false}}, list)
+}
+
+func TestParseSvstat(t *testing.T) {
+	dir := "/etc/service/testd"
+	tests := []struct {
+		output  string
+		status  svstatStatus
+		running bool
+		state   DaemonState
+	}{
+		{"/etc/service/testd: up (pid 1234) 56 seconds\n", svstatStatus{State: svstatUp, Supervised: true, Pid: 1234, Seconds: 56, NormallyUp: true}, true, StateRunning},
+		{"/etc/service/testd: up (pid 1234) 56 seconds, normally down\n", svstatStatus{State: svstatUp, Supervised: true, Pid: 1234, Seconds: 56}, true, StateRunning},
+		{"/etc/service/testd: up (pid 1234) 56 seconds, paused\n", svstatStatus{State: svstatUp, Supervised: true, Pid: 1234, Seconds: 56, NormallyUp: true, Paused: true}, true, StateRunning},
+		{"/etc/service/testd: up (pid 1234) 56 seconds, want down\n", svstatStatus{State: svstatUpWantDown, Supervised: true, Pid: 1234, Seconds: 56, NormallyUp: true}, false, StateRunning},
+		{"/etc/service/testd: up (pid 1234) 56 seconds, normally down, paused, want down\n", svstatStatus{State: svstatUpWantDown, Supervised: true, Pid: 1234, Seconds: 56, Paused: true}, false, StateRunning},
+		{"/etc/service/testd: down 7 seconds\n", svstatStatus{State: svstatDown, Supervised: true, Seconds: 7}, false, StateStopped},
+		{"/etc/service/testd: down 7 seconds, normally up\n", svstatStatus{State: svstatDown, Supervised: true, Seconds: 7, NormallyUp: true}, false, StateStopped},
+		{"/etc/service/testd: down 7 seconds, normally up, want up\n", svstatStatus{State: svstatDownWantUp, Supervised: true, Seconds: 7, NormallyUp: true}, false, StateFailed},
+		{"/etc/service/testd: supervise not running\n", svstatStatus{State: svstatDown}, false, StateStopped},
+	}
+	for _, test := range tests {
+		status, err := parseSvstat(dir, test.output)
+		require.Nil(t, err, test.output)
+		require.Equal(t, test.status, *status, test.output)
+		require.Equal(t, test.running, status.running(), test.output)
+		require.Equal(t, test.state, status.state(), test.output)
+	}
+	for _, output := range []string{
+		"/etc/service/other: up (pid 1234) 56 seconds",
+		"/etc/service/testd: unable to open supervise/ok: file does not exist",
+		"/etc/service/testd: up (pid 1234) 56 seconds, bogus",
+		"",
+	} {
+		_, err := parseSvstat(dir, output)
+		require.NotNil(t, err, output)
+	}
+}
+
+func TestParseSv(t *testing.T) {
+	dir := "/etc/service/testd"
+	tests := []struct {
+		output  string
+		status  svstatStatus
+		running bool
+		state   DaemonState
+	}{
+		{"run: /etc/service/testd: (pid 1234) 56s; run: log: (pid 1233) 56s\n", svstatStatus{State: svstatUp, Supervised: true, Pid: 1234, Seconds: 56, NormallyUp: true}, true, StateRunning},
+		{"run: /etc/service/testd: (pid 1234) 56s, normally down, want down\n", svstatStatus{State: svstatUpWantDown, Supervised: true, Pid: 1234, Seconds: 56}, false, StateRunning},
+		{"down: /etc/service/testd: 7s, normally up; run: log: (pid 1233) 56s\n", svstatStatus{State: svstatDown, Supervised: true, Seconds: 7, NormallyUp: true}, false, StateStopped},
+		{"down: /etc/service/testd: 7s, normally up, want up\n", svstatStatus{State: svstatDownWantUp, Supervised: true, Seconds: 7, NormallyUp: true}, false, StateFailed},
+		{"finish: /etc/service/testd: (pid 1240) 1s\n", svstatStatus{State: svstatDown, Supervised: true, Pid: 1240, Seconds: 1}, false, StateStopped},
+	}
+	for _, test := range tests {
+		status, err := parseSv(dir, test.output)
+		require.Nil(t, err, test.output)
+		require.Equal(t, test.status, *status, test.output)
+		require.Equal(t, test.running, status.running(), test.output)
+		require.Equal(t, test.state, status.state(), test.output)
+	}
+	_, err := parseSv(dir, "warning: /etc/service/testd: unable to open supervise/ok: file does not exist")
+	require.NotNil(t, err)
+}
+
+func TestParseS6Svstat(t *testing.T) {
+	tests := []struct {
+		output  string
+		status  svstatStatus
+		running bool
+		state   DaemonState
+	}{
+		{"up (pid 1234) 56 seconds\n", svstatStatus{State: svstatUp, Supervised: true, Pid: 1234, Seconds: 56, NormallyUp: true}, true, StateRunning},
+		{"up (pid 1234 pgid 1234) 56 seconds, ready 55 seconds\n", svstatStatus{State: svstatUp, Supervised: true, Pid: 1234, Seconds: 56, NormallyUp: true}, true, StateRunning},
+		{"up (pid 1234) 56 seconds, normally down, want down\n", svstatStatus{State: svstatUpWantDown, Supervised: true, Pid: 1234, Seconds: 56}, false, StateRunning},
+		{"down (exitcode 0) 7 seconds, normally up, want up, ready 7 seconds\n", svstatStatus{State: svstatDownWantUp, Supervised: true, Seconds: 7, NormallyUp: true}, false, StateFailed},
+		{"down (signal SIGTERM) 7 seconds\n", svstatStatus{State: svstatDown, Supervised: true, Seconds: 7}, false, StateStopped},
+	}
+	for _, test := range tests {
+		status, err := parseS6Svstat(test.output)
+		require.Nil(t, err, test.output)
+		require.Equal(t, test.status, *status, test.output)
+		require.Equal(t, test.running, status.running(), test.output)
+		require.Equal(t, test.state, status.state(), test.output)
+	}
+	for _, output := range []string{
+		"up 56 seconds",
+		"up (pid x) 56 seconds",
+		"down (exitcode 0) 7 seconds, bogus",
+		"",
+	} {
+		_, err := parseS6Svstat(output)
+		require.NotNil(t, err, output)
+	}
+}
+
+func TestS6Install(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	u := testUser(t)
+	fakeCommand(t, "s6-svscanctl", "exit 0")
+	fakeCommand(t, "s6-svc", "exit 0")
+	fakeCommand(t, "s6-svstat", "echo 'up (pid 1234) 56 seconds, normally down'")
+
+	d, err := NewS6("testd", u, root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	target, err := os.Readlink(filepath.Join(s6ScanRoot, "testd"))
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(s6Root, "testd"), target)
+	data, err := os.ReadFile(filepath.Join(s6Root, "testd", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "    s6-setuidgid "+u.Username+" \\\n")
+	data, err = os.ReadFile(filepath.Join(s6Root, "testd", "log", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "exec s6-log t s")
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, u.Username, config.User)
+	require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.True(t, running)
+	list, err := listDaemontools("s6")
+	require.Nil(t, err)
+	require.Equal(t, []DaemonInfo{{Name: "testd", Running: true}}, list)
+}
+
+func TestDaemontoolsErrors(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+
+	_, err = d.GetConfig()
+	require.ErrorIs(t, err, ErrNotInstalled)
+	require.ErrorIs(t, d.Delete(), ErrNotInstalled)
+
+	require.Nil(t, d.Install())
+	require.ErrorIs(t, d.Install(), ErrAlreadyInstalled)
+}
+
+func TestDaemontoolsLogRotation(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.log_size", 1000000)
+	testConfig(t, "daemon.log_keep", 5)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	data, err := os.ReadFile(filepath.Join(svcRoot, "testd", "log", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "multilog t s1000000 n5 ")
+
+	testConfig(t, "daemon.log_keep", 1)
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid log_keep")
+}
+
+func TestDaemontoolsRestartAwaitsStop(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	// report "want down" for the first two polls after svc -d
+	fakeCommand(t, "svstat", `
+if [ -f $FAKE_STATE/down ]; then
+	polls=$(( $(cat $FAKE_STATE/polls 2>/dev/null || echo 0) + 1 ))
+	echo $polls > $FAKE_STATE/polls
+	if [ $polls -lt 3 ]; then
+		echo "$1: up (pid 123) 5 seconds, want down"
+	else
+		echo "$1: down 1 seconds, normally up"
+	fi
+else
+	echo "$1: up (pid 123) 5 seconds"
+fi`)
+	fakeCommand(t, "svc", `
+echo "$1 $(cat $FAKE_STATE/polls 2>/dev/null || echo 0)" >> $FAKE_STATE/svc.log
+if [ "$1" = "-d" ]; then touch $FAKE_STATE/down; fi`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Restart())
+
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-d 0\n-d 3\n-u 4\n-u 4\n", string(log))
+}
+
+func TestDaemontoolsGroup(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+	u := testUser(t)
+	fakeDaemontools(t)
+
+	d, err := NewDaemon("testd", u.Username, root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	config, err := d.GetConfig()
+	require.Nil(t, err)
+	require.Contains(t, config, "setuidgid "+u.Username+" ")
+	require.Nil(t, os.RemoveAll(filepath.Join(serviceRoot, "testd")))
+
+	testConfig(t, "daemon.group", "nonexistent_test_group")
+	_, err = NewDaemon("testd", u.Username, root, executable)
+	require.NotNil(t, err)
+
+	var alternate *user.Group
+	for _, name := range []string{"daemon", "nogroup", "users", "adm"} {
+		group, err := user.LookupGroup(name)
+		if err == nil && group.Gid != u.Gid {
+			alternate = group
+			break
+		}
+	}
+	if alternate == nil {
+		t.Skip("no alternate group available")
+	}
+	testConfig(t, "daemon.group", alternate.Name)
+	d, err = NewDaemon("testd", u.Username, root, executable)
+	require.Nil(t, err)
+	require.Equal(t, alternate.Gid, d.(*Daemontools).Gid)
+	require.Nil(t, d.Install())
+	config, err = d.GetConfig()
+	require.Nil(t, err)
+	require.Contains(t, config, "chpst -u "+u.Username+":"+alternate.Name+" ")
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	u := testUser(t)
+
+	testConfig(t, "daemon.supplementary_groups", []string{"nonexistent_test_group"})
+	_, err := NewDaemontools("testd", u, root, executable)
+	require.ErrorContains(t, err, "supplementary group nonexistent_test_group")
+
+	groups := testGroups(t)
+	primary, err := user.LookupGroupId(u.Gid)
+	require.Nil(t, err)
+	testConfig(t, "daemon.supplementary_groups", []string{groups[0].Name, groups[1].Name})
+
+	d, err := NewDaemontools("testd", u, root, executable)
+	require.Nil(t, err)
+	runTemplate, _ := d.(*Daemontools).templates()
+	require.Contains(t, string(d.(*Daemontools).templateData(runTemplate)), "chpst -u "+u.Username+":"+primary.Name+":"+groups[0].Name+":"+groups[1].Name+" ")
+	_, tools := d.(*Daemontools).tools()
+	require.Contains(t, tools, "chpst")
+
+	d, err = NewS6("testd", u, root, executable)
+	require.Nil(t, err)
+	runTemplate, _ = d.(*Daemontools).templates()
+	require.Contains(t, string(d.(*Daemontools).templateData(runTemplate)), "s6-applyuidgid -u "+u.Uid+" -g "+u.Gid+" -G "+u.Gid+","+groups[0].Gid+","+groups[1].Gid+" ")
+
+	testConfig(t, "daemon.nice", 5)
+	d, err = NewRunit("testd", u, root, executable)
+	require.Nil(t, err)
+	runTemplate, _ = d.(*Daemontools).templates()
+	require.Contains(t, string(d.(*Daemontools).templateData(runTemplate)), "nice -n 5 chpst -u "+u.Username+":"+primary.Name+":"+groups[0].Name+":"+groups[1].Name+" ")
+}
+
+func TestDaemontoolsValidate(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	t.Setenv("PATH", t.TempDir())
+
+	d, err := NewDaemontools("testd", testUser(t), filepath.Join(root, "missing"), executable)
+	require.Nil(t, err)
+	require.Nil(t, os.Chmod(executable, 0644))
+	err = d.Validate()
+	require.ErrorIs(t, err, ErrSupervisorUnavailable)
+	require.ErrorContains(t, err, "svc not found in PATH")
+	require.ErrorContains(t, err, "svstat not found in PATH")
+	require.ErrorContains(t, err, "executable is not executable")
+	require.ErrorContains(t, err, "run directory")
+
+	for _, tool := range []string{"svc", "svstat", "setuidgid", "multilog"} {
+		fakeCommand(t, tool, "exit 0")
+	}
+	require.Nil(t, os.Chmod(executable, 0755))
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Validate())
+}
+
+func TestDaemontoolsGetDaemonConfig(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	u := testUser(t)
+
+	for _, newDaemon := range []func(string, *user.User, string, string, ...string) (CobraDaemon, error){NewDaemontools, NewRunit} {
+		d, err := newDaemon("testd", u, root, executable, "--message", "it's here")
+		require.Nil(t, err)
+		require.Nil(t, d.Install())
+		config, err := d.GetDaemonConfig()
+		require.Nil(t, err)
+		require.Equal(t, "testd", config.Name)
+		require.Equal(t, u.Username, config.User)
+		require.Equal(t, filepath.Join(binRoot, "testd"), config.Executable)
+		require.Equal(t, []string{"--message", "it's here", "-L-"}, config.Args)
+		require.Equal(t, root, config.Dir)
+		require.Equal(t, map[string]string{"HOME": root}, config.Env)
+		require.False(t, config.Enabled)
+		require.Nil(t, os.Remove(filepath.Join(serviceRoot, "testd")))
+	}
+}
+
+func TestDaemontoolsDiff(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable, "--port", "8080")
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	diff, err := Diff(d)
+	require.Nil(t, err)
+	require.Empty(t, diff)
+
+	changed, err := NewDaemontools("testd", testUser(t), root, executable, "--port", "9090")
+	require.Nil(t, err)
+	diff, err = Diff(changed)
+	require.Nil(t, err)
+	require.Contains(t, diff, "-arg: \"8080\"\n")
+	require.Contains(t, diff, "+arg: \"9090\"\n")
+}
+
+func TestDaemontoolsPriority(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.nice", "10")
+	testConfig(t, "daemon.ionice", "best-effort:6")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	data, err := os.ReadFile(filepath.Join(svcRoot, "testd", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "    nice -n 10 ionice -c 2 -n 6 setuidgid ")
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, testUser(t).Username, config.User)
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nNice=10\nIOSchedulingClass=best-effort\nIOSchedulingPriority=6\n")
+
+	testConfig(t, "daemon.ionice", "idle:3")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid ionice")
+	testConfig(t, "daemon.nice", "20")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid nice")
+}
+
+func TestDaemontoolsDeletePartial(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	t.Setenv("PATH", t.TempDir())
+	service := filepath.Join(serviceRoot, "testd")
+	definition := filepath.Join(svcRoot, "testd")
+
+	// definition present, service link absent
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, os.Remove(service))
+	require.Nil(t, d.Delete())
+	require.NoDirExists(t, definition)
+
+	// service link present, definition absent
+	require.Nil(t, d.Install())
+	require.Nil(t, os.RemoveAll(definition))
+	require.Nil(t, d.Delete())
+	_, err = os.Lstat(service)
+	require.True(t, os.IsNotExist(err))
+
+	require.ErrorIs(t, d.Delete(), ErrNotInstalled)
+}
+
+func TestDaemontoolsDeleteForce(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeCommand(t, "svstat", `echo "svstat: fatal: unable to control $1" >&2; exit 111`)
+	fakeCommand(t, "svc", "exit 0")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	// the stop error is returned after the service is removed anyway
+	require.ErrorContains(t, d.Delete(), "exit status 111")
+	require.NoDirExists(t, filepath.Join(svcRoot, "testd"))
+	require.NoFileExists(t, filepath.Join(serviceRoot, "testd"))
+	require.ErrorIs(t, d.Delete(), ErrNotInstalled)
+
+	testConfig(t, "force", true)
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Delete())
+	require.NoDirExists(t, filepath.Join(svcRoot, "testd"))
+}
+
+func TestDaemontoolsLogFile(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	logDir := filepath.Join(root, "srv", "logs", "testd")
+	testConfig(t, "daemon.logfile", logDir)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	data, err := os.ReadFile(filepath.Join(svcRoot, "testd", "log", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), " n10 "+logDir+"\n")
+	require.DirExists(t, logDir)
+	require.NoDirExists(t, filepath.Join(logRoot, "testd"))
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, unit.(*Systemd).Args, "--logfile "+logDir)
+
+	testConfig(t, "daemon.logfile", "logs/testd")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "logfile must be an absolute path")
+}
+
+func TestReinstall(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `
+if [ -f $FAKE_STATE/up ]; then
+	echo "$1: up (pid 123) 5 seconds"
+else
+	echo "$1: down 1 seconds"
+fi`)
+	fakeCommand(t, "svc", `
+echo "$1" >> $FAKE_STATE/svc.log
+case "$1" in
+-u) touch $FAKE_STATE/up;;
+-d) rm -f $FAKE_STATE/up;;
+esac`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, Reinstall(d))
+	require.NoFileExists(t, filepath.Join(state, "svc.log"))
+	require.Nil(t, d.Start())
+	require.Nil(t, Reinstall(d))
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.True(t, running)
+	require.NoFileExists(t, filepath.Join(svcRoot, "testd", "down"))
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-u\n-u\n-d\n-d\n-dx\n-u\n-u\n", string(log))
+}
+
+func TestDaemontoolsRepointLink(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	service := filepath.Join(serviceRoot, "testd")
+	other := filepath.Join(root, "other", "testd")
+	require.Nil(t, os.MkdirAll(other, 0755))
+	require.Nil(t, os.MkdirAll(serviceRoot, 0755))
+	require.Nil(t, os.Symlink(other, service))
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, d.Install(), ErrAlreadyInstalled)
+	testConfig(t, "force", true)
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	target, err := os.Readlink(service)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(svcRoot, "testd"), target)
+	require.DirExists(t, other)
+	entries, err := os.ReadDir(serviceRoot)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+
+	require.Nil(t, symlinkAtomic(other, service))
+	target, err = os.Readlink(service)
+	require.Nil(t, err)
+	require.Equal(t, other, target)
+}
+
+func TestChownBinary(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	owner := &user.User{Username: "nobody", Uid: "65534", Gid: "65534", HomeDir: root}
+
+	d, err := NewDaemontools("testd", owner, root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	info, err := os.Stat(filepath.Join(binRoot, "testd"))
+	require.Nil(t, err)
+	uid, _, ok := fileOwner(info)
+	require.True(t, ok)
+	require.Equal(t, strconv.Itoa(os.Geteuid()), uid)
+
+	testConfig(t, "daemon.chown_binary", "true")
+	d, err = NewDaemontools("teste", owner, root, executable)
+	require.Nil(t, err)
+	err = d.Install()
+	if os.Geteuid() != 0 {
+		require.ErrorIs(t, err, ErrPermissionDenied)
+		return
+	}
+	require.Nil(t, err)
+	info, err = os.Stat(filepath.Join(binRoot, "testd"))
+	require.Nil(t, err)
+	uid, gid, _ := fileOwner(info)
+	require.Equal(t, "65534", uid)
+	require.Equal(t, "65534", gid)
+
+	testConfig(t, "daemon.chown_binary", "sometimes")
+	_, err = NewDaemontools("testd", owner, root, executable)
+	require.ErrorContains(t, err, "invalid chown_binary")
+}
+
+func TestDaemontoolsPaths(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.wrapper", true)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	paths := d.Paths()
+	require.Equal(t, filepath.Join(serviceRoot, "testd"), paths["service"])
+	require.Nil(t, d.Install())
+	for _, name := range []string{"binary", "config", "wrapper"} {
+		require.FileExists(t, paths[name], name)
+	}
+	for _, name := range []string{"definition", "dir", "log"} {
+		require.DirExists(t, paths[name], name)
+	}
+	target, err := os.Readlink(paths["service"])
+	require.Nil(t, err)
+	require.Equal(t, paths["definition"], target)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.command_timeout", "200ms")
+	fakeCommand(t, "svstat", "sleep 10")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	start := time.Now()
+	_, err = d.Query()
+	require.ErrorIs(t, err, ErrCommandTimeout)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	testConfig(t, "daemon.command_timeout", "soon")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid command_timeout")
+}
+
+func TestQueryUnprivileged(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	fakeCommand(t, "svstat", `echo "$1: unable to open supervise/ok: access denied"`)
+	fakeCommand(t, "svc", `echo "svc: warning: unable to control $2: access denied" >&2; exit 111`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+
+	// without a status file the service has never been supervised
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.False(t, running)
+
+	service := filepath.Join(serviceRoot, "testd")
+	supervise := filepath.Join(service, "supervise")
+	require.Nil(t, os.MkdirAll(supervise, 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(supervise, "ok"), []byte{}, 0600))
+	data := make([]byte, 18)
+	binary.BigEndian.PutUint64(data, uint64(time.Now().Unix()-5+tai64Epoch))
+	binary.LittleEndian.PutUint32(data[12:], 1234)
+	data[17] = 'u'
+	require.Nil(t, os.WriteFile(filepath.Join(supervise, "status"), data, 0644))
+	running, err = d.Query()
+	require.Nil(t, err)
+	require.True(t, running)
+	status, err := readSuperviseStatus(service)
+	require.Nil(t, err)
+	require.Equal(t, 1234, status.Pid)
+	require.GreaterOrEqual(t, status.Seconds, 5)
+	require.False(t, status.NormallyUp)
+
+	data[17] = 'd'
+	require.Nil(t, os.WriteFile(filepath.Join(supervise, "status"), data, 0644))
+	status, err = readSuperviseStatus(service)
+	require.Nil(t, err)
+	require.Equal(t, svstatUpWantDown, status.State)
+
+	err = d.Start()
+	require.ErrorIs(t, err, ErrPermissionDenied)
+}
+
+func TestCopyBinaryFalse(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.copy_binary", "false")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Equal(t, executable, d.Paths()["binary"])
+	require.False(t, common.IsFile(filepath.Join(binRoot, "testd")))
+	run, err := os.ReadFile(filepath.Join(svcRoot, "testd", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(run), executable+" ")
+
+	_, err = NewDaemontools("testd", testUser(t), root, "testd")
+	require.ErrorContains(t, err, "requires an absolute executable path")
+
+	testConfig(t, "daemon.copy_binary", "maybe")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid copy_binary")
+}
+
+func TestStopSignal(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	flags := []struct {
+		supervisor string
+		signal     string
+		flags      string
+	}{
+		{"daemontools", "TERM", "-d"},
+		{"daemontools", "INT", "-oi"},
+		{"daemontools", "HUP", "-oh"},
+		{"daemontools", "ALRM", "-oa"},
+		{"daemontools", "KILL", "-ok"},
+		{"s6", "TERM", "-d"},
+		{"s6", "QUIT", "-Oq"},
+		{"s6", "USR1", "-O1"},
+		{"s6", "USR2", "-O2"},
+	}
+	for _, f := range flags {
+		d := Daemontools{supervisor: f.supervisor, StopSignal: f.signal}
+		commands, err := d.stopCommands()
+		require.Nil(t, err)
+		require.Equal(t, f.flags, d.controlFlags(commands), f.supervisor+" "+f.signal)
+	}
+	d := Daemontools{supervisor: "runit", StopSignal: "INT"}
+	commands, err := d.stopCommands()
+	require.Nil(t, err)
+	require.Equal(t, []string{"once", "interrupt"}, commands)
+
+	testConfig(t, "daemon.stop_signal", "sigquit")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorIs(t, err, ErrNotSupported)
+	_, err = NewRunit("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+
+	testConfig(t, "daemon.stop_signal", "SIGINT")
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	fakeCommand(t, "svc", `echo "$1" >> $FAKE_STATE/svc.log`)
+	dt, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, dt.Install())
+	require.Nil(t, dt.Stop())
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-oi\n-d\n", string(log))
+
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nTimeoutStopSec=10\nKillSignal=SIGINT\n")
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(rc.(*RCDaemon).rcData()), "\nrc_stop() {\n\tpkill -INT -T \"${daemon_rtable}\" -xf \"${pexp}\"\n}\n")
+
+	testConfig(t, "daemon.stop_signal", "STOP")
+	_, err = NewSystemd("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid stop_signal: STOP")
+}
+
+func TestDaemontoolsEnable(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.ErrorIs(t, d.Enable(), ErrNotInstalled)
+	require.Nil(t, d.Install())
+	downFile := filepath.Join(serviceRoot, "testd", "down")
+	require.True(t, common.IsFile(downFile))
+	require.Nil(t, d.Enable())
+	require.False(t, common.IsFile(downFile))
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.True(t, config.Enabled)
+
+	changed, err := SetEnabled(d, true)
+	require.Nil(t, err)
+	require.False(t, changed)
+	changed, err = SetEnabled(d, false)
+	require.Nil(t, err)
+	require.True(t, changed)
+	require.True(t, common.IsFile(downFile))
+	changed, err = SetEnabled(d, false)
+	require.Nil(t, err)
+	require.False(t, changed)
+}
+
+func TestRetryTransient(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	testConfig(t, "daemon.retry.delay", "10ms")
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	// fail until svscan would have started supervise
+	fakeCommand(t, "svc", `
+echo "$1" >> $FAKE_STATE/svc.log
+if [ $(wc -l < $FAKE_STATE/svc.log) -lt 3 ]; then
+	echo "svc: warning: unable to control $2: file does not exist" >&2
+	exit 111
+fi`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Start())
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-u\n-u\n-u\n-u\n", string(log))
+
+	require.Nil(t, os.Remove(filepath.Join(state, "svc.log")))
+	testConfig(t, "daemon.retry.count", "1")
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	err = d.Start()
+	require.ErrorIs(t, err, errTransient)
+	require.ErrorContains(t, err, "exit status 111")
+
+	fakeCommand(t, "svc", `echo "$1" >> $FAKE_STATE/permanent.log; exit 100`)
+	require.Error(t, d.Start())
+	log, err = os.ReadFile(filepath.Join(state, "permanent.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-u\n", string(log))
+
+	testConfig(t, "daemon.retry.count", "-1")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid retry.count")
+}
+
+func TestSettle(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	fakeCommand(t, "svc", `echo "$1" >> $FAKE_STATE/svc.log`)
+	testConfig(t, "daemon.settle_timeout", "5s")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	service := filepath.Join(serviceRoot, "testd")
+
+	// Start waits for svscan to create the supervise directories
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		os.Mkdir(filepath.Join(service, "supervise"), 0700)
+		os.Mkdir(filepath.Join(service, "log", "supervise"), 0700)
+	}()
+	started := time.Now()
+	require.Nil(t, d.Start())
+	require.GreaterOrEqual(t, time.Since(started), 300*time.Millisecond)
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-u\n-u\n", string(log))
+
+	// an unsupervised service fails after the settle timeout without svc
+	require.Nil(t, os.Remove(filepath.Join(state, "svc.log")))
+	require.Nil(t, os.Remove(filepath.Join(service, "supervise")))
+	testConfig(t, "daemon.settle_timeout", "100ms")
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	err = d.Start()
+	require.ErrorIs(t, err, ErrSupervisorUnavailable)
+	require.ErrorContains(t, err, "not supervised after 100ms")
+	require.NoFileExists(t, filepath.Join(state, "svc.log"))
+
+	testConfig(t, "daemon.settle_timeout", "-1s")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid settle_timeout")
+}
+
+func TestWaitFor(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeDaemontools(t)
+	up := filepath.Join(root, "up")
+	fakeCommand(t, "svstat", `if [ -f `+up+` ]; then echo "$1: up (pid 1234) 5 seconds"; else echo "$1: down 5 seconds"; fi`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, WaitFor(d, false, time.Second))
+	err = WaitFor(d, true, 500*time.Millisecond)
+	require.ErrorIs(t, err, ErrWaitTimeout)
+	require.ErrorContains(t, err, "daemon not running")
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		os.WriteFile(up, []byte{}, 0644)
+	}()
+	require.Nil(t, WaitFor(d, true, 5*time.Second))
+
+	require.Nil(t, os.Remove(up))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	err = WaitForContext(ctx, d, true, 5*time.Second)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestDaemontoolsLogService(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `
+if [ -f $FAKE_STATE/$(basename $1) ]; then
+	echo "$1: up (pid 123) 5 seconds"
+else
+	echo "$1: down 1 seconds"
+fi`)
+	fakeCommand(t, "svc", `
+echo "$1 $2" >> $FAKE_STATE/svc.log
+case "$1" in
+-u) touch $FAKE_STATE/$(basename $2);;
+-d) rm -f $FAKE_STATE/$(basename $2);;
+esac`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Start())
+	logRunning, err := d.(*Daemontools).QueryLog()
+	require.Nil(t, err)
+	require.True(t, logRunning)
+	require.Nil(t, d.Stop())
+	logRunning, err = d.(*Daemontools).QueryLog()
+	require.Nil(t, err)
+	require.False(t, logRunning)
+
+	service := filepath.Join(serviceRoot, "testd")
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("-u %[1]s/log\n-u %[1]s\n-d %[1]s\n-d %[1]s/log\n", service), string(log))
+}
+
+func TestDaemontoolsPurge(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	fakeCommand(t, "svc", "exit 0")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	other, err := NewDaemontools("other", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, other.Install())
+	paths := d.Paths()
+	require.Nil(t, os.WriteFile(filepath.Join(paths["log"], "current"), []byte("log\n"), 0644))
+
+	// the binary is kept while the other instance runs it
+	require.Nil(t, d.Purge())
+	require.NoDirExists(t, paths["log"])
+	require.NoDirExists(t, paths["definition"])
+	require.FileExists(t, paths["binary"])
+
+	otherLog := other.Paths()["log"]
+	require.Nil(t, os.WriteFile(filepath.Join(otherLog, "notes.txt"), []byte{}, 0644))
+	require.ErrorContains(t, other.Purge(), "contains notes.txt; not removed")
+	require.NoFileExists(t, filepath.Join(other.Paths()["definition"], "run"))
+	require.Nil(t, os.Remove(filepath.Join(otherLog, "notes.txt")))
+	require.Nil(t, other.Purge())
+	require.NoDirExists(t, otherLog)
+	require.NoFileExists(t, paths["binary"])
+	require.FileExists(t, executable)
+
+	require.Nil(t, d.Purge())
+}
+
+func TestUmask(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.umask", "27")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(d.(*Daemontools).templateData(runTemplate)), "\numask 0027\ncd ")
+	r, err := NewRunit("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(r.(*Daemontools).templateData(runitRunTemplate)), "\numask 0027\ncd ")
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nUMask=0027\nWorkingDirectory=")
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(rc.(*RCDaemon).rcData()), "\trc_exec \"umask 0027; ${daemon} ${daemon_flags} </dev/null\"\n")
+
+	for _, value := range []string{"8", "1000", "u=rwx"} {
+		testConfig(t, "daemon.umask", value)
+		_, err = NewDaemontools("testd", testUser(t), root, executable)
+		require.ErrorContains(t, err, "invalid umask: "+value)
+	}
+}
+
+func TestStartRunning(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `
+if [ -f $FAKE_STATE/up ]; then
+	echo "$1: up (pid 123) 5 seconds"
+else
+	echo "$1: down 1 seconds"
+fi`)
+	fakeCommand(t, "svc", `echo "$1" >> $FAKE_STATE/svc.log`)
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, os.WriteFile(filepath.Join(state, "up"), []byte{}, 0644))
+	require.Nil(t, d.Start())
+	require.NoFileExists(t, filepath.Join(state, "svc.log"))
+
+	require.Nil(t, os.Remove(filepath.Join(state, "up")))
+	require.Nil(t, d.Start())
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, "-u\n-u\n", string(log))
+}
+
+func TestCPUAffinity(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.cpuaffinity", "0-3,7")
+	testConfig(t, "daemon.nice", "5")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	script := string(d.(*Daemontools).templateData(runTemplate))
+	require.Contains(t, script, "    nice -n 5 taskset -c 0-3,7 setuidgid ")
+	config, err := parseRunScript(script)
+	require.Nil(t, err)
+	require.Equal(t, testUser(t).Username, config.User)
+	_, tools := d.(*Daemontools).tools()
+	require.Contains(t, tools, "taskset")
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(unit.(*Systemd).templateData(unitTemplate)), "\nNice=5\nCPUAffinity=0-3,7\n")
+
+	for _, value := range []string{"3-1", "a", "1,,2", "-1"} {
+		testConfig(t, "daemon.cpuaffinity", value)
+		_, err = NewSystemd("testd", testUser(t), root, executable)
+		require.ErrorContains(t, err, "invalid cpuaffinity: "+value)
+	}
+}
+
+func TestStartType(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	fakeCommand(t, "svc", `echo "$1" >> $FAKE_STATE/svc.log`)
+	fakeCommand(t, "systemctl", `echo "$@" >> $FAKE_STATE/systemctl.log; [ "$1" != is-active ]`)
+	downFile := filepath.Join(svcRoot, "testd", "down")
+
+	testConfig(t, "daemon.start_type", "auto")
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.NoFileExists(t, downFile)
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, unit.Install())
+	log, err := os.ReadFile(filepath.Join(state, "systemctl.log"))
+	require.Nil(t, err)
+	require.Equal(t, "daemon-reload\nenable testd\n", string(log))
+	require.Nil(t, d.Delete())
+
+	testConfig(t, "daemon.start_type", "manual")
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Start())
+	require.FileExists(t, downFile)
+	log, err = os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Contains(t, string(log), "-u\n")
+	require.Nil(t, d.Delete())
+
+	testConfig(t, "daemon.start_type", "disabled")
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.FileExists(t, downFile)
+	require.ErrorContains(t, d.Start(), "start_type disabled")
+	task, err := NewWindowsTask("testd", testUser(t), root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	data, err := task.(*WindowsTask).xmlData()
+	require.Nil(t, err)
+	require.Contains(t, data, "<Enabled>false</Enabled>")
+
+	testConfig(t, "daemon.start_type", "boot")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid start_type: boot")
+}
+
+func TestDaemontoolsLogging(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	testConfig(t, "daemon.settle_timeout", "0")
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "svstat", `
+if [ -f $FAKE_STATE/$(basename $1) ]; then
+	echo "$1: up (pid 123) 5 seconds"
+else
+	echo "$1: down 1 seconds"
+fi`)
+	fakeCommand(t, "svc", `
+echo "$@" >> $FAKE_STATE/svc.log
+case "$1" in
+-u) touch $FAKE_STATE/$(basename $2);;
+-d) rm -f $FAKE_STATE/$(basename $2);;
+esac`)
+	service := filepath.Join(serviceRoot, "testd")
+	definition := filepath.Join(svcRoot, "testd")
+
+	// file logging passes the daemon its log file and has no log service
+	testConfig(t, "daemon.daemontools.logging", "file")
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	logFile := filepath.Join(logRoot, "testd.log")
+	require.Equal(t, "--logfile "+logFile, d.(*Daemontools).Args)
+	require.Nil(t, d.Install())
+	require.NoDirExists(t, filepath.Join(definition, "log"))
+	require.FileExists(t, logFile)
+	path, err := d.LogPath()
+	require.Nil(t, err)
+	require.Equal(t, logFile, path)
+	commands, err := d.Commands("start")
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"svc", "-u", service}}, commands)
+	require.Nil(t, d.Start())
+	require.Nil(t, d.Stop())
+	require.Nil(t, d.Delete())
+	log, err := os.ReadFile(filepath.Join(state, "svc.log"))
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("-u %[1]s\n-d %[1]s\n-dx %[2]s\n", service, definition), string(log))
+
+	// none injects no log flag and has no log path
+	testConfig(t, "daemon.daemontools.logging", "none")
+	d, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Equal(t, "", d.(*Daemontools).Args)
+	require.Nil(t, d.Install())
+	require.NoDirExists(t, filepath.Join(definition, "log"))
+	_, err = d.LogPath()
+	require.ErrorIs(t, err, ErrNotSupported)
+	require.NotContains(t, d.Paths(), "log")
+	require.Equal(t, []string{"svc", "-dx", definition}, d.(*Daemontools).exitArgs())
+	_, tools := d.(*Daemontools).tools()
+	require.NotContains(t, tools, "multilog")
+	require.Nil(t, d.Delete())
+
+	testConfig(t, "daemon.split_logs", "true")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorIs(t, err, ErrNotSupported)
+	testConfig(t, "daemon.daemontools.logging", "syslog")
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid daemontools logging")
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// one line of the Doctor checklist; the check passed if Err is nil
+type DoctorCheck struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// check the prerequisites of installing the daemon NewDaemon would create
+// with these arguments: the backend selected on this host, its supervisor
+// tools, the daemon user, that the current user can write the install
+// locations, and the Validate checks; checks that depend on a failed one
+// are left out
+func Doctor(name, username, dir, command string, args ...string) []DoctorCheck {
+	checks := []DoctorCheck{}
+	selected, err := backendName(nil)
+	checks = append(checks, DoctorCheck{Name: "backend", Detail: selected, Err: err})
+	if err != nil {
+		return checks
+	}
+	backend, err := platformBackend(nil)
+	if err != nil {
+		return append(checks, DoctorCheck{Name: "backend", Detail: selected, Err: err})
+	}
+	taskUser, err := daemonUser(nil, username)
+	if err != nil {
+		return append(checks, DoctorCheck{Name: "user", Detail: username, Err: err})
+	}
+	checks = append(checks, DoctorCheck{Name: "user", Detail: taskUser.Username})
+	taskDir := dir
+	if taskDir == "" {
+		taskDir = taskUser.HomeDir
+	}
+	d, err := backend.factory(DaemonSpec{Name: name, User: taskUser.Username, Dir: taskDir, Executable: command, Args: args})
+	checks = append(checks, DoctorCheck{Name: "config", Detail: name, Err: err})
+	if err != nil {
+		return checks
+	}
+	supervisor, tools := "", []string{}
+	if s, ok := d.(supervisorTools); ok {
+		supervisor, tools = s.tools()
+	}
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			err = fatalf("%w: %s not installed: %s not found in PATH", ErrSupervisorUnavailable, supervisor, tool)
+			path = tool
+		}
+		checks = append(checks, DoctorCheck{Name: "supervisor", Detail: path, Err: err})
+	}
+	// the run directory is written by the daemon user, and checked by Validate
+	paths := d.Paths()
+	for _, key := range sortedKeys(paths) {
+		if key == "dir" {
+			continue
+		}
+		checks = append(checks, DoctorCheck{Name: "write " + key, Detail: paths[key], Err: checkCreate(filepath.Dir(paths[key]))})
+	}
+	// the tools were checked above
+	for _, err := range joinedErrors(d.Validate()) {
+		if !errors.Is(err, ErrSupervisorUnavailable) {
+			checks = append(checks, DoctorCheck{Name: "validate", Err: err})
+		}
+	}
+	return checks
+}
+
+// return an error unless the current user can create a file in dir, or in
+// the nearest existing directory above it that install would create dir in
+func checkCreate(dir string) error {
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	file, err := os.CreateTemp(dir, ".doctor-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// split an errors.Join result into the errors it holds
+func joinedErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
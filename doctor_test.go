@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	t.Setenv("PATH", t.TempDir())
+	fakeDaemontools(t)
+	testConfig(t, "daemon.linux.backend", "daemontools")
+
+	failed := func(checks []DoctorCheck) []string {
+		names := []string{}
+		for _, check := range checks {
+			if check.Err != nil {
+				names = append(names, check.Name)
+			}
+		}
+		return names
+	}
+	checks := Doctor("testd", "", root, executable)
+	require.Equal(t, DoctorCheck{Name: "backend", Detail: "daemontools"}, checks[0])
+	require.Equal(t, "user", checks[1].Name)
+	require.Empty(t, failed(checks))
+
+	require.Nil(t, os.Chmod(binRoot, 0555))
+	t.Cleanup(func() { os.Chmod(binRoot, 0755) })
+	if os.Geteuid() != 0 {
+		require.Equal(t, []string{"write binary"}, failed(Doctor("testd", "", root, executable)))
+	}
+	require.Nil(t, os.Chmod(binRoot, 0755))
+
+	t.Setenv("PATH", t.TempDir())
+	checks = Doctor("testd", "", root, executable)
+	require.NotEmpty(t, failed(checks))
+	for _, name := range failed(checks) {
+		require.Equal(t, "supervisor", name)
+	}
+
+	checks = Doctor("testd", "no_such_user", root, executable)
+	require.Equal(t, []string{"user"}, failed(checks))
+	require.Len(t, checks, 2)
+}
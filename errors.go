@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+)
+
+var (
+	ErrAlreadyInstalled      = errors.New("already installed")
+	ErrNotInstalled          = errors.New("not installed")
+	ErrNotSupported          = errors.New("not supported")
+	ErrSupervisorUnavailable = errors.New("supervisor not available")
+	ErrCommandTimeout        = errors.New("command timed out")
+	ErrPermissionDenied      = errors.New("permission denied")
+	ErrWaitTimeout           = errors.New("wait timed out")
+	ErrLocked                = errors.New("locked")
+)
+
+// prefix err with the caller's source location, preserving it for errors.Is
+func fatal(err error) error {
+	location := callerLocation()
+	if location == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", location, err)
+}
+
+// format an error prefixed with the caller's source location; %w verbs are
+// wrapped so sentinel errors can be detected with errors.Is
+func fatalf(format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	location := callerLocation()
+	if location == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", location, err)
+}
+
+func callerLocation() string {
+	pc := make([]uintptr, 1)
+	if runtime.Callers(3, pc) == 0 {
+		return ""
+	}
+	frame, _ := runtime.CallersFrames(pc).Next()
+	if frame.Function == "" {
+		return ""
+	}
+	_, function := path.Split(frame.Function)
+	parts := strings.Split(function, ".")
+	_, file := path.Split(frame.File)
+	return fmt.Sprintf("%s:%d %s", file, frame.Line, parts[len(parts)-1])
+}
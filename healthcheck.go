@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"context"
+	"github.com/rstms/cobra-daemon/common"
+	"net"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+const defaultHealthTimeout = 30 * time.Second
+
+// longest delay between health check attempts
+const maxHealthInterval = 5 * time.Second
+
+// run the configured health check until it passes, retrying with backoff
+// until daemon.healthcheck.timeout expires; a port check passes when
+// HOST:PORT accepts a TCP connection, a command check when it exits 0
+func HealthCheck() error {
+	return HealthCheckContext(context.Background())
+}
+
+// HealthCheck, returning the ctx error if ctx is cancelled before the
+// check passes
+func HealthCheckContext(ctx context.Context) error {
+	port := common.ViperGetString("daemon.healthcheck.port")
+	command := common.ViperGetString("daemon.healthcheck.command")
+	if port == "" && command == "" {
+		return fatalf("no healthcheck configured")
+	}
+	timeout := defaultHealthTimeout
+	value := common.ViperGetString("daemon.healthcheck.timeout")
+	if value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return fatalf("invalid healthcheck.timeout: %s", value)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	interval := pollInterval
+	for {
+		var err error
+		if port != "" {
+			err = checkPort(ctx, port, interval)
+		}
+		if err == nil && command != "" {
+			err = checkCommand(ctx, command)
+		}
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fatalf("healthcheck failed after %v: %w", timeout, err)
+		}
+		err = sleepContext(ctx, interval)
+		if err != nil {
+			return fatal(err)
+		}
+		interval = min(interval*2, maxHealthInterval)
+	}
+}
+
+func checkPort(ctx context.Context, address string, timeout time.Duration) error {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkCommand(ctx context.Context, command string) error {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd.exe", "/C", command).Run()
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command).Run()
+}
@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	initTestConfig(t)
+	require.ErrorContains(t, HealthCheck(), "no healthcheck configured")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := listener.Addr().String()
+	testConfig(t, "daemon.healthcheck.port", address)
+	testConfig(t, "daemon.healthcheck.timeout", "1s")
+	require.Nil(t, HealthCheck())
+
+	listener.Close()
+	require.ErrorContains(t, HealthCheck(), "healthcheck failed")
+
+	testConfig(t, "daemon.healthcheck.port", "")
+	testConfig(t, "daemon.healthcheck.command", "true")
+	require.Nil(t, HealthCheck())
+	testConfig(t, "daemon.healthcheck.command", "exit 1")
+	require.ErrorContains(t, HealthCheck(), "exit status 1")
+
+	testConfig(t, "daemon.healthcheck.timeout", "10s")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	require.ErrorIs(t, HealthCheckContext(ctx), context.Canceled)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
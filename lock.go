@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// the directory holding the per-user lock directories; tests replace it
+var lockRoot = os.TempDir()
+
+// install, delete and reinstall wait this long for another one on the same
+// daemon to finish
+const defaultLockTimeout = time.Minute
+
+// tryLockFile reports a lock held by another process with errLockBusy
+var errLockBusy = errors.New("lock busy")
+
+// a daemon name locked by one daemon value, which may lock it again while
+// it holds it, as Reinstall does around Delete and Install
+type daemonLock struct {
+	owner CobraDaemon
+	count int
+	file  *os.File
+}
+
+var locks = struct {
+	sync.Mutex
+	held map[string]*daemonLock
+}{held: make(map[string]*daemonLock)}
+
+// return the configured daemon.lock_timeout duration; 0 fails at once
+func lockTimeout(settings daemonSettings) (time.Duration, error) {
+	value := settings.getString("daemon.lock_timeout")
+	if value == "" {
+		return defaultLockTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fatalf("invalid lock_timeout: %s", value)
+	}
+	return timeout, nil
+}
+
+// return the lock file of name, in a directory only the current user can
+// write so another user can't hold or replace it
+func lockPath(name string) (string, error) {
+	current, err := user.Current()
+	if err != nil {
+		return "", fatal(err)
+	}
+	dir := filepath.Join(lockRoot, "cobra-daemon-"+filepath.Base(current.Uid))
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fatal(err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", fatal(err)
+	}
+	if !info.IsDir() {
+		return "", fatalf("lock directory %s is not a directory", dir)
+	}
+	if uid, _, ok := fileOwner(info); ok && uid != current.Uid {
+		return "", fatalf("lock directory %s is owned by uid %s", dir, uid)
+	}
+	return filepath.Join(dir, name+".lock"), nil
+}
+
+// lock the daemon d manages across an operation that deletes and installs
+// it, such as Reinstall
+func lockOperation(d CobraDaemon) (func(), error) {
+	config, err := d.DesiredConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return lockDaemon(d, config.Name)
+}
+
+// lock name for d so only one install, delete or reinstall runs on it at a
+// time, in this process or another, waiting up to daemon.lock_timeout for
+// the other to finish; call the returned func to release it
+func lockDaemon(d CobraDaemon, name string) (func(), error) {
+	timeout, err := lockTimeout(settingsOf(d))
+	if err != nil {
+		return nil, fatal(err)
+	}
+	path, err := lockPath(name)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	release := func() {
+		locks.Lock()
+		defer locks.Unlock()
+		l := locks.held[name]
+		l.count--
+		if l.count == 0 {
+			delete(locks.held, name)
+			l.file.Close()
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locks.Lock()
+		l, held := locks.held[name]
+		if held && l.owner == d {
+			l.count++
+			locks.Unlock()
+			return release, nil
+		}
+		if !held {
+			file, err := tryLockFile(path)
+			if err == nil {
+				locks.held[name] = &daemonLock{owner: d, count: 1, file: file}
+				locks.Unlock()
+				debugLog("lock", "path", path)
+				return release, nil
+			}
+			if !errors.Is(err, errLockBusy) {
+				locks.Unlock()
+				return nil, fatal(err)
+			}
+		}
+		locks.Unlock()
+		if !time.Now().Before(deadline) {
+			return nil, fatalf("%w: %s is being installed or deleted by another process; lock %s", ErrLocked, name, path)
+		}
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds"`)
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	_, err = d.Query()
+	require.Nil(t, err)
+	log := buf.String()
+	require.Contains(t, log, "msg=write path="+filepath.Join(svcRoot, "testd", "run")+" mode=-rwx------")
+	require.Contains(t, log, "msg=copy src="+executable+" path="+filepath.Join(binRoot, "testd")+"\n")
+	require.Contains(t, log, "msg=link path="+filepath.Join(serviceRoot, "testd"))
+	require.Contains(t, log, "msg=exec args=\"[svstat "+filepath.Join(serviceRoot, "testd")+"]\"")
+	require.Contains(t, log, " exit=0 output=")
+
+	SetLogger(nil)
+	buf.Reset()
+	_, err = d.Query()
+	require.Nil(t, err)
+	require.Empty(t, buf.String())
+}
@@ -0,0 +1,978 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/rstms/cobra-daemon/common"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed template/netbsd_rcfile
+var netbsdRCTemplate string
+
+// a NetBSD rc.d script run by rc.subr, enabled by its rcvar in
+// /etc/rc.conf.d/NAME and controlled with service(8)
+type NetBSDDaemon struct {
+	Name           string
+	Username       string
+	Uid            string
+	Gid            string
+	Executable     string
+	Args           string
+	Dir            string
+	LogFile        string
+	ErrorLog       string
+	Stdin          string
+	Umask          string
+	Nice           string
+	StopTimeout    time.Duration
+	StopSignal     string
+	CommandTimeout time.Duration
+	Retries        int
+	RetryDelay     time.Duration
+	Env            map[string]string
+	Wrapper        bool
+	MemoryLimit    int64
+	NofileLimit    int
+	ChownBinary    bool
+	Force          bool
+	StartType      string
+	After          []string
+	Requires       []string
+	PreStart       string
+	PostStop       string
+	ExtraConfig    string
+	serviceBin     string
+	wrapperFile    string
+	customRC       string
+	pexp           string
+	settings       daemonSettings
+}
+
+// the positional form of NewNetBSDDaemonFromSpec, kept for compatibility
+func NewNetBSDDaemon(name string, daemonUser *user.User, runDir string, command string, args ...string) (CobraDaemon, error) {
+	return NewNetBSDDaemonFromSpec(DaemonSpec{Name: name, Dir: runDir, Executable: command, Args: args}, daemonUser)
+}
+
+func NewNetBSDDaemonFromSpec(spec DaemonSpec, daemonUser *user.User) (CobraDaemon, error) {
+	settings := daemonSettings(spec.Config)
+	name, runDir, command := spec.Name, spec.Dir, spec.Executable
+	args := append([]string{}, spec.Args...)
+
+	logFile, err := logPath(settings, filepath.Join(logRoot, name))
+	if err != nil {
+		return nil, fatal(err)
+	}
+	stdin, err := daemonStdin(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	split, err := splitLogs(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	errorLog := ""
+	if split {
+		errorLog = logFile + ".stderr"
+	}
+	// rc.subr runs the daemon with su -m, which sets the login groups of
+	// the user
+	_, alternate, err := userGroup(daemonUser)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if alternate {
+		return nil, fatalf("%w: rc.d daemons run with the primary group of %s", ErrNotSupported, daemonUser.Username)
+	}
+	supplementary, err := supplementaryGroups(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if len(supplementary) > 0 {
+		return nil, fatalf("%w: rc.d daemons run with the login groups of %s; add the user to the groups instead", ErrNotSupported, daemonUser.Username)
+	}
+
+	timeout, err := stopTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	signal, err := stopSignal(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	cmdTimeout, err := commandTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	retries, retryDelay, err := retryPolicy(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	nice, err := niceness(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	memoryLimit, nofileLimit, err := resourceLimits(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	mask, err := umask(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// rc.subr has no sandbox, so daemon.sandbox is only validated
+	_, err = sandbox(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	after, requires, err := dependencies(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	prestart, poststop, err := hooks(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	extra, err := extraConfig(settings, "load_rc_config", "run_rc_command")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// su -m passes the environment of rc.subr, not the daemon's settings
+	env, err := daemonEnv(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	wrapper := settings.getBool("daemon.wrapper")
+	if len(env) > 0 && !wrapper {
+		return nil, fatalf("%w: rc.d daemons require daemon.wrapper for env settings", ErrNotSupported)
+	}
+	serviceBin, err := serviceBinary(settings, binRoot, command)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	chown, err := chownBinary(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	pidfile, err := pidFile(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if pidfile != "" {
+		return nil, fatalf("%w: netbsd rc.d daemons are matched by process name, not a pid file", ErrNotSupported)
+	}
+	start, err := startType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	kind, err := daemonType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if kind == "oneshot" {
+		return nil, fatalf("%w: oneshot netbsd rc.d daemons", ErrNotSupported)
+	}
+	custom, err := customTemplate(settings, "netbsd_rcfile")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logFlags, err := logArgs(settings, logFile)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	args = append(args, logFlags...)
+
+	t := NetBSDDaemon{
+		Name:           name,
+		Username:       daemonUser.Username,
+		Uid:            daemonUser.Uid,
+		Gid:            daemonUser.Gid,
+		Executable:     command,
+		Args:           quoteArgs(args, quoteShellDouble),
+		Dir:            runDir,
+		LogFile:        logFile,
+		ErrorLog:       errorLog,
+		Stdin:          stdin,
+		Umask:          mask,
+		Nice:           nice,
+		StopTimeout:    timeout,
+		StopSignal:     signal,
+		CommandTimeout: cmdTimeout,
+		Retries:        retries,
+		RetryDelay:     retryDelay,
+		Env:            env,
+		Wrapper:        wrapper,
+		MemoryLimit:    memoryLimit,
+		NofileLimit:    nofileLimit,
+		ChownBinary:    chown,
+		Force:          common.ViperGetBool("force"),
+		StartType:      start,
+		After:          after,
+		Requires:       requires,
+		PreStart:       prestart,
+		PostStop:       poststop,
+		ExtraConfig:    extra,
+		serviceBin:     serviceBin,
+		wrapperFile:    wrapperPath(name, ""),
+		customRC:       custom,
+		pexp:           strings.Join(append([]string{serviceBin}, args...), " "),
+		settings:       settings,
+	}
+
+	return &t, nil
+}
+
+func (d *NetBSDDaemon) template() string {
+	if d.customRC != "" {
+		return d.customRC
+	}
+	return netbsdRCTemplate
+}
+
+func (d *NetBSDDaemon) rcFile() string {
+	return filepath.Join(rcRoot, d.Name)
+}
+
+// the rc.conf.d file holding the rcvar and any overrides of the script's
+// variables, read by load_rc_config
+func (d *NetBSDDaemon) rcConfFile() string {
+	return filepath.Join(rcConfRoot, d.Name)
+}
+
+func (d *NetBSDDaemon) installed() bool {
+	return common.IsFile(d.rcFile())
+}
+
+func (d *NetBSDDaemon) Install() error {
+	err := checkPrivileges("install", d.rcFile())
+	if err != nil {
+		return fatal(err)
+	}
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	err = checkInstallTarget(d.rcFile(), d.Force)
+	if err != nil {
+		return fatal(err)
+	}
+	err = checkDependencies(append(d.After, d.Requires...), func(name string) bool {
+		return common.IsFile(filepath.Join(rcRoot, name))
+	})
+	if err != nil {
+		return fatal(err)
+	}
+	err = createRunDir(d.Dir, d.Uid, d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	for _, logFile := range []string{d.LogFile, d.ErrorLog} {
+		if logFile == "" {
+			continue
+		}
+		err = d.createLogFile(logFile)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	err = copyBinary(d.Executable, d.serviceBin, owner, group)
+	if err != nil {
+		return fatal(err)
+	}
+	if d.Wrapper {
+		err = writeWrapper(d.wrapperFile, shellWrapper(d.Dir, d.serviceBin, d.Env))
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	err = writeFileAtomic(d.rcFile(), d.rcData(), 0755)
+	if err != nil {
+		return fatal(err)
+	}
+	// rc.subr warns about an unset rcvar, so a daemon that is not enabled
+	// is set to NO
+	value := "NO"
+	if d.StartType == "auto" {
+		value = "YES"
+	}
+	err = d.setRCVar(value)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// create a daemon log file writable by the daemon's group
+func (d *NetBSDDaemon) createLogFile(logFile string) error {
+	err := createOwnedDirs(filepath.Dir(logFile), d.Uid, d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	if !common.IsFile(logFile) {
+		file, err := os.Create(logFile)
+		if err != nil {
+			return fatal(err)
+		}
+		file.Close()
+		debugLog("create", "path", logFile)
+	}
+	gid, err := strconv.Atoi(d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chown(logFile, -1, gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chmod(logFile, 0660)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// values are shell quoted; TASK_BIN, TASK_ARGS and TASK_LOG render inside
+// double quoted variables, so they are escaped for that context; the
+// result carries its spec marker
+func (d *NetBSDDaemon) rcData() []byte {
+	data := os.Expand(d.template(), func(key string) string {
+		switch key {
+		case "TASK_NAME":
+			// names are plain words, and the template uses this one in
+			// variable names
+			return d.Name
+		case "TASK_USER":
+			return shellQuote(d.Username)
+		case "TASK_UID":
+			return shellQuote(d.Uid)
+		case "TASK_BIN":
+			if d.Wrapper {
+				return quoteArgs([]string{d.wrapperFile}, quoteShellDouble)
+			}
+			return quoteArgs([]string{d.serviceBin}, quoteShellDouble)
+		case "TASK_ARGS":
+			return d.Args
+		case "TASK_LOG":
+			return quoteArgs([]string{d.LogFile}, quoteShellDouble)
+		case "TASK_EXTRA":
+			return d.ExtraConfig
+		case "TASK_STDIN":
+			if d.Stdin == "" {
+				return ""
+			}
+			return "<" + quoteArgs([]string{d.Stdin}, quoteShellDouble) + " "
+		case "TASK_STDERR":
+			if d.ErrorLog == "" {
+				return "2>&1"
+			}
+			return "2>>" + quoteArgs([]string{d.ErrorLog}, quoteShellDouble)
+		case "TASK_DIR":
+			return shellQuote(d.Dir)
+		case "TASK_REQUIRE":
+			// rcorder starts the dependencies first
+			names := ""
+			for _, name := range append(append([]string{}, d.After...), d.Requires...) {
+				names += " " + name
+			}
+			return names
+		case "TASK_VARS":
+			vars := ""
+			// the wrapper execs the daemon, so rc.subr must match the daemon's name
+			if d.Wrapper {
+				vars += "procname=" + shellQuote(d.serviceBin) + "\n"
+			}
+			if d.Nice != "" {
+				vars += d.Name + "_nice=" + d.Nice + "\n"
+			}
+			if d.StopSignal != "" && d.StopSignal != "TERM" {
+				vars += "sig_stop=" + d.StopSignal + "\n"
+			}
+			return vars
+		case "TASK_PRE":
+			// the daemon inherits the umask and limits set here, and is not
+			// started until each required daemon is running and prestart succeeds
+			checks := []string{}
+			if d.Umask != "" {
+				checks = append(checks, "umask "+d.Umask)
+			}
+			if d.MemoryLimit > 0 {
+				checks = append(checks, fmt.Sprintf("ulimit -d %d", (d.MemoryLimit+1023)/1024))
+			}
+			if d.NofileLimit > 0 {
+				checks = append(checks, fmt.Sprintf("ulimit -n %d", d.NofileLimit))
+			}
+			for _, name := range d.Requires {
+				checks = append(checks, "service "+shellQuote(name)+" onestatus >/dev/null")
+			}
+			if d.PreStart != "" {
+				checks = append(checks, "sh -c "+shellQuote(d.PreStart))
+			}
+			if len(checks) == 0 {
+				return ""
+			}
+			return "start_precmd=" + d.Name + "_precmd\n" + d.Name + "_precmd() {\n\t" + strings.Join(checks, " &&\n\t") + "\n}\n"
+		case "TASK_POST":
+			// rc.subr runs stop_postcmd after service stop, not when the daemon exits on its own
+			if d.PostStop == "" {
+				return ""
+			}
+			return "stop_postcmd=" + d.Name + "_postcmd\n" + d.Name + "_postcmd() {\n\tsh -c " + shellQuote(d.PostStop) + "\n}\n"
+		}
+		return "${" + key + "}"
+	})
+	return stampSpec([]byte(data))
+}
+
+// set the rcvar line of the rc.conf.d file, keeping any other settings
+func (d *NetBSDDaemon) setRCVar(value string) error {
+	lines := []string{}
+	data, err := os.ReadFile(d.rcConfFile())
+	if err != nil && !os.IsNotExist(err) {
+		return fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		key, _, _ := strings.Cut(strings.TrimSpace(line), "=")
+		if line != "" && key != d.Name {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, d.Name+"="+value)
+	err = os.MkdirAll(rcConfRoot, 0755)
+	if err != nil {
+		return fatal(err)
+	}
+	err = writeFileAtomic(d.rcConfFile(), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// service waits for the daemon as it stops it, so it is allowed the stop
+// timeout as well
+func (d *NetBSDDaemon) service(command string) error {
+	return retry(d.Retries, d.RetryDelay, func() error {
+		argv := d.argv(command)
+		stdout, stderr, _, err := runTimeout(d.CommandTimeout+d.StopTimeout, argv[0], argv[1:]...)
+		printOutput(stdout, stderr)
+		return err
+	})
+}
+
+// the service command line acting on the daemon
+func (d *NetBSDDaemon) argv(command string) []string {
+	return []string{"service", d.Name, command}
+}
+
+// the service commands run by start, stop, query, or delete; the one
+// prefixed commands act whether or not the rcvar is set
+func (d *NetBSDDaemon) Commands(action string) ([][]string, error) {
+	switch action {
+	case "start":
+		if d.StartType == "manual" {
+			return [][]string{d.argv("onestart")}, nil
+		}
+		return [][]string{d.argv("start")}, nil
+	case "stop":
+		return [][]string{d.argv("onestop")}, nil
+	case "query":
+		return [][]string{d.argv("onestatus")}, nil
+	case "delete":
+		return [][]string{d.argv("onestop")}, nil
+	}
+	return nil, fatalf("unknown action: %s", action)
+}
+
+func (d *NetBSDDaemon) ConfigFiles() ([]ConfigFile, error) {
+	files := []ConfigFile{{d.rcFile(), 0755, d.rcData()}}
+	if d.Wrapper {
+		files = append(files, ConfigFile{d.wrapperFile, 0755, shellWrapper(d.Dir, d.serviceBin, d.Env)})
+	}
+	return files, nil
+}
+
+func (d *NetBSDDaemon) binaries() (string, string) {
+	return d.Executable, d.serviceBin
+}
+
+func (d *NetBSDDaemon) updateBinary() error {
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	return copyBinary(d.Executable, d.serviceBin, owner, group)
+}
+
+// rc.subr reads the script each time it runs, so it only needs writing
+func (d *NetBSDDaemon) rewriteConfig() (bool, error) {
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return false, fatal(err)
+	}
+	changed, err := rewriteFiles(files)
+	if err != nil {
+		return false, fatal(err)
+	}
+	return changed, nil
+}
+
+// each teardown step runs even when an earlier one fails, and the errors
+// are returned together; with Force a failed stop is only a warning
+func (d *NetBSDDaemon) Delete() error {
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err = checkPrivileges("delete", d.rcFile())
+	if err != nil {
+		return fatal(err)
+	}
+	errs := []error{}
+	err = d.Stop()
+	if err != nil {
+		if d.Force {
+			forceWarning(d.Name, err)
+			runTimeout(d.CommandTimeout, "pkill", "-KILL", "-xf", d.pexp)
+		} else {
+			errs = append(errs, fatal(err))
+		}
+	}
+	for _, path := range []string{d.rcConfFile(), d.rcFile()} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fatal(err))
+		} else if err == nil {
+			debugLog("remove", "path", path)
+		}
+	}
+	err = removeWrapper(d.wrapperFile)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	}
+	return errors.Join(errs...)
+}
+
+func (d *NetBSDDaemon) Enable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := d.setRCVar("YES")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+func (d *NetBSDDaemon) Disable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := d.setRCVar("NO")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a running daemon is left alone
+func (d *NetBSDDaemon) Start() error {
+	running, err := d.Query()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		debugLog("already running", "name", d.Name)
+		return nil
+	}
+	err = checkStartType(d.Name, d.StartType)
+	if err != nil {
+		return fatal(err)
+	}
+	// onestart starts a manual daemon that is not enabled
+	if d.StartType == "manual" {
+		err = d.service("onestart")
+		if err != nil {
+			return fatal(err)
+		}
+		return nil
+	}
+	err = d.Enable()
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.service("start")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+func (d *NetBSDDaemon) Stop() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := d.service("onestop")
+	if err != nil {
+		return fatal(err)
+	}
+	stopped, err := waitStopped(d.Query, d.StopTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if stopped {
+		return nil
+	}
+	_, _, _, err = runTimeout(d.CommandTimeout, "pkill", "-KILL", "-xf", d.pexp)
+	if err != nil {
+		return fatal(err)
+	}
+	stopped, err = waitStopped(d.Query, killTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if !stopped {
+		return fatalf("%s still running after pkill -KILL", d.Name)
+	}
+	return nil
+}
+
+func (d *NetBSDDaemon) Restart() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := d.service("onerestart")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+var netbsdDaemonCapabilities = DaemonCapabilities{
+	Pid:          true,
+	StopSignal:   true,
+	Dependencies: true,
+}
+
+func (d *NetBSDDaemon) Capabilities() DaemonCapabilities {
+	return netbsdDaemonCapabilities
+}
+
+// the settings the daemon was created with
+func (d *NetBSDDaemon) specSettings() daemonSettings {
+	return d.settings
+}
+
+// delete the rc script and remove its log file and copied binary
+func (d *NetBSDDaemon) Purge() error {
+	return purge(d, d.Executable, d.serviceBin, filepath.Join(rcRoot, "*"))
+}
+
+// return the log file the daemon writes, daemon.logfile when set
+func (d *NetBSDDaemon) LogPath() (string, error) {
+	return d.LogFile, nil
+}
+
+func (d *NetBSDDaemon) Paths() map[string]string {
+	paths := map[string]string{
+		"binary":   d.serviceBin,
+		"config":   d.rcFile(),
+		"dir":      d.Dir,
+		"log":      d.LogFile,
+		"settings": d.rcConfFile(),
+	}
+	if d.Wrapper {
+		paths["wrapper"] = d.wrapperFile
+	}
+	if d.ErrorLog != "" {
+		paths["stderr"] = d.ErrorLog
+	}
+	return paths
+}
+
+// return the rc.conf.d settings of the daemon
+func (d *NetBSDDaemon) GetConfig() (string, error) {
+	if !d.installed() {
+		return "", fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	data, err := os.ReadFile(d.rcConfFile())
+	if err != nil && !os.IsNotExist(err) {
+		return "", fatal(err)
+	}
+	return string(data), nil
+}
+
+func (d *NetBSDDaemon) GetDaemonConfig() (*DaemonConfig, error) {
+	rcData, err := os.ReadFile(d.rcFile())
+	if err != nil {
+		return nil, fatal(err)
+	}
+	settings, err := d.GetConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config, err := parseNetBSDRCFile(d.Name, string(rcData), settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return config, nil
+}
+
+func (d *NetBSDDaemon) DesiredConfig() (*DaemonConfig, error) {
+	config, err := parseNetBSDRCFile(d.Name, string(d.rcData()), "")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return config, nil
+}
+
+// parse the rc script variables, then the rc.conf.d settings which
+// override them; the output redirection ending command_args is left out
+func parseNetBSDRCFile(name, rcData, settings string) (*DaemonConfig, error) {
+	config := DaemonConfig{Name: name, Env: make(map[string]string)}
+	var flags string
+	for _, script := range []string{rcData, settings} {
+		lines, err := shellSplit(script)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		for _, words := range lines {
+			key, value, ok := strings.Cut(words[0], "=")
+			if len(words) != 1 || !ok {
+				continue
+			}
+			switch key {
+			case "command":
+				config.Executable = value
+			case "command_args":
+				args, err := shellSplit(value)
+				if err != nil {
+					return nil, fatal(err)
+				}
+				config.Args = []string{}
+				for _, line := range args {
+					config.Args = append(config.Args, line...)
+				}
+				// drop the trailing redirections and &
+				for n := len(config.Args); n > 0 && (config.Args[n-1] == "&" || strings.HasPrefix(config.Args[n-1], "<") || strings.HasPrefix(config.Args[n-1], ">>") || strings.HasPrefix(config.Args[n-1], "2>")); n-- {
+					config.Args = config.Args[:n-1]
+				}
+			case name:
+				config.Enabled = strings.EqualFold(value, "YES")
+			case name + "_user":
+				config.User = value
+			case name + "_chdir":
+				config.Dir = value
+			case name + "_flags":
+				flags = value
+			}
+		}
+	}
+	if flags != "" {
+		words, err := shellSplit(flags)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		for _, line := range words {
+			config.Args = append(config.Args, line...)
+		}
+	}
+	if config.Executable == "" {
+		return nil, fatalf("no command in rc file")
+	}
+	return &config, nil
+}
+
+// replace the rc.conf.d settings with NAME=value and NAME_var=value lines
+func (d *NetBSDDaemon) SetConfig(config string) error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := checkConfig(config)
+	if err != nil {
+		return fatal(err)
+	}
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, ok := strings.Cut(line, "=")
+		if !ok || (key != d.Name && !strings.HasPrefix(key, d.Name+"_")) {
+			return fatalf("unexpected config line: %s", line)
+		}
+	}
+	err = writeFileAtomic(d.rcConfFile(), []byte(strings.TrimRight(config, "\n")+"\n"), 0644)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// service NAME onestatus exits 0 when the daemon is running and 1 when it
+// is not; any other failure is an error
+func (d *NetBSDDaemon) Query() (bool, error) {
+	if !d.installed() {
+		return false, fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	var exitCode int
+	err := retry(d.Retries, d.RetryDelay, func() error {
+		argv := d.argv("onestatus")
+		var err error
+		_, _, exitCode, err = runTimeout(d.CommandTimeout, argv[0], argv[1:]...)
+		if err != nil && exitFailure(err) && exitCode == 1 {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, fatal(err)
+	}
+	return exitCode == 0, nil
+}
+
+// rc.d doesn't record why a daemon stopped, so an enabled daemon that is
+// not running is reported failed, even when it was stopped by hand
+func (d *NetBSDDaemon) Status() (DaemonState, error) {
+	running, err := d.Query()
+	if err != nil {
+		return "", fatal(err)
+	}
+	if running {
+		return StateRunning, nil
+	}
+	config, err := d.GetDaemonConfig()
+	if err != nil {
+		return "", fatal(err)
+	}
+	if config.Enabled {
+		return StateFailed, nil
+	}
+	return StateStopped, nil
+}
+
+// return the pid of the running daemon, or 0 if it is not running
+func (d *NetBSDDaemon) Pid() (int, error) {
+	running, err := d.Query()
+	if err != nil {
+		return 0, fatal(err)
+	}
+	if !running {
+		return 0, nil
+	}
+	stdout, _, exitCode, err := runTimeout(d.CommandTimeout, "pgrep", "-xf", d.pexp)
+	if err != nil {
+		// pgrep exits 1 when no process matches
+		if exitFailure(err) && exitCode == 1 {
+			return 0, nil
+		}
+		return 0, fatal(err)
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fatalf("unexpected pgrep output: %s", strings.TrimSpace(stdout))
+	}
+	return pid, nil
+}
+
+func (d *NetBSDDaemon) tools() (string, []string) {
+	return "rc.d", []string{"service"}
+}
+
+func (d *NetBSDDaemon) Validate() error {
+	return errors.Join(
+		checkTools(d.tools()),
+		checkExecutable(d.Executable),
+		checkRunDir(d.settings, d.Dir, d.Uid, d.Gid),
+	)
+}
+
+// return a daemon that can only inspect the installed rc.d script of name
+func netBSDDaemonByName(name string) (CobraDaemon, error) {
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return &NetBSDDaemon{Name: name, CommandTimeout: timeout}, nil
+}
+
+func listNetBSDDaemons() ([]DaemonInfo, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	serviceBin, err := serviceBinary(nil, binRoot, executable)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	marker := `command="` + serviceBin + `"`
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	entries, err := os.ReadDir(rcRoot)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	list := []DaemonInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(rcRoot, entry.Name()))
+		if err != nil {
+			return nil, fatal(err)
+		}
+		if !strings.Contains(string(data), marker) {
+			continue
+		}
+		d := NetBSDDaemon{Name: entry.Name(), CommandTimeout: timeout}
+		running, err := d.Query()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		list = append(list, DaemonInfo{Name: entry.Name(), Running: running})
+	}
+	return list, nil
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a stand-in for service(8) that keeps the daemon state in $FAKE_STATE
+const fakeService = `
+echo "$2" >> $FAKE_STATE/service.log
+case "$2" in
+*start) touch $FAKE_STATE/up;;
+*stop) rm -f $FAKE_STATE/up;;
+*status)
+	[ -f $FAKE_STATE/broken ] && exit 2
+	if [ -f $FAKE_STATE/up ]; then echo "$1 is running as pid 123."; exit 0; fi
+	echo "$1 is not running."; exit 1;;
+esac`
+
+func TestNetBSDDaemon(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "service", fakeService)
+	testConfig(t, "daemon.stop_signal", "INT")
+	testConfig(t, "daemon.after", "database")
+	testConfig(t, "daemon.umask", "027")
+
+	d, err := NewNetBSDDaemon("testd", testUser(t), root, executable, "--port", "8080")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(rcRoot, "database"), []byte{}, 0755))
+	logFile := filepath.Join(logRoot, "testd")
+	require.Nil(t, d.Install())
+	data, err := os.ReadFile(filepath.Join(rcRoot, "testd"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "\n# PROVIDE: testd\n# REQUIRE: DAEMON database\n")
+	require.Contains(t, string(data), "\nname=testd\nrcvar=${name}\ncommand=\""+filepath.Join(binRoot, "testd")+"\"\n")
+	require.Contains(t, string(data), "\ncommand_args=\"--port 8080 --logfile "+logFile+" </dev/null >>"+logFile+" 2>&1 &\"\n")
+	require.Contains(t, string(data), "\nsig_stop=INT\nstart_precmd=testd_precmd\ntestd_precmd() {\n\tumask 0027\n}\n")
+	require.Contains(t, string(data), "\nload_rc_config ${name}\nrun_rc_command \"${1}\"\n")
+	settings, err := d.GetConfig()
+	require.Nil(t, err)
+	require.Equal(t, "testd=NO\n", settings)
+
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.False(t, running)
+	diff, err := Diff(d)
+	require.Nil(t, err)
+	require.Empty(t, diff)
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, []string{"--port", "8080", "--logfile", logFile}, config.Args)
+	require.Equal(t, root, config.Dir)
+	require.False(t, config.Enabled)
+
+	require.Nil(t, d.SetConfig("testd=NO\ntestd_flags=--debug\n"))
+	require.Nil(t, d.Start())
+	settings, err = d.GetConfig()
+	require.Nil(t, err)
+	require.Equal(t, "testd_flags=--debug\ntestd=YES\n", settings)
+	config, err = d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, []string{"--port", "8080", "--logfile", logFile, "--debug"}, config.Args)
+	require.True(t, config.Enabled)
+	running, err = d.Query()
+	require.Nil(t, err)
+	require.True(t, running)
+	require.ErrorContains(t, d.SetConfig("other_flags=--debug\n"), "unexpected config line")
+
+	require.Nil(t, os.WriteFile(filepath.Join(state, "broken"), []byte{}, 0644))
+	_, err = d.Query()
+	require.ErrorContains(t, err, "exit status 2")
+	require.Nil(t, os.Remove(filepath.Join(state, "broken")))
+
+	require.Nil(t, d.Delete())
+	require.NoFileExists(t, filepath.Join(rcRoot, "testd"))
+	require.NoFileExists(t, filepath.Join(rcConfRoot, "testd"))
+	log, err := os.ReadFile(filepath.Join(state, "service.log"))
+	require.Nil(t, err)
+	require.Equal(t, "onestatus\nonestatus\nstart\nonestatus\nonestatus\nonestop\nonestatus\n", string(log))
+
+	testConfig(t, "daemon.pidfile", filepath.Join(root, "testd.pid"))
+	_, err = NewNetBSDDaemon("testd", testUser(t), root, executable)
+	require.ErrorIs(t, err, ErrNotSupported)
+}
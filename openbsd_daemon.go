@@ -24,171 +24,1027 @@ package daemon
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
 	"github.com/rstms/cobra-daemon/common"
-	"io"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //go:embed template/rcfile
 var rcTemplate string
 
 type RCDaemon struct {
-	Name       string
-	Username   string
-	Uid        string
-	Executable string
-	Args       string
-	Dir        string
-	LogFile    string
-	serviceBin string
+	Name           string
+	Username       string
+	Uid            string
+	Gid            string
+	Executable     string
+	Args           string
+	Dir            string
+	LogFile        string
+	ErrorLog       string
+	Stdin          string
+	PidFile        string
+	Umask          string
+	StopTimeout    time.Duration
+	StopSignal     string
+	CommandTimeout time.Duration
+	Retries        int
+	RetryDelay     time.Duration
+	Env            map[string]string
+	Wrapper        bool
+	MemoryLimit    int64
+	NofileLimit    int
+	ChownBinary    bool
+	Force          bool
+	StartType      string
+	After          []string
+	Requires       []string
+	PreStart       string
+	PostStop       string
+	ExtraConfig    string
+	Flags          string
+	Rtable         int
+	Timeout        int
+	Reload         string
+	RCCtlSet       bool
+	serviceBin     string
+	wrapperFile    string
+	customRC       string
+	pexp           string
+	settings       daemonSettings
 }
 
+// the positional form of NewRCDaemonFromSpec, kept for compatibility
 func NewRCDaemon(name string, daemonUser *user.User, runDir string, command string, args ...string) (CobraDaemon, error) {
+	return NewRCDaemonFromSpec(DaemonSpec{Name: name, Dir: runDir, Executable: command, Args: args}, daemonUser)
+}
 
-	logFile := filepath.Join("/var/log", name)
-	_, basename := filepath.Split(command)
-	if !common.IsFile(logFile) {
-		file, err := os.Create(logFile)
-		if err != nil {
-			return nil, common.Fatal(err)
-		}
-		file.Close()
+func NewRCDaemonFromSpec(spec DaemonSpec, daemonUser *user.User) (CobraDaemon, error) {
+	settings := daemonSettings(spec.Config)
+	name, runDir, command := spec.Name, spec.Dir, spec.Executable
+	args := append([]string{}, spec.Args...)
+
+	logFile, err := logPath(settings, filepath.Join(logRoot, name))
+	if err != nil {
+		return nil, fatal(err)
 	}
-	gid, err := strconv.Atoi(daemonUser.Gid)
+	stdin, err := daemonStdin(settings)
 	if err != nil {
-		return nil, common.Fatal(err)
+		return nil, fatal(err)
 	}
-	err = os.Chown(logFile, -1, gid)
+	split, err := splitLogs(settings)
 	if err != nil {
-		return nil, common.Fatal(err)
+		return nil, fatal(err)
 	}
-	err = os.Chmod(logFile, 0660)
+	errorLog := ""
+	if split {
+		errorLog = logFile + ".stderr"
+	}
+	// rc.subr runs the daemon with the login groups of daemon_user
+	_, alternate, err := userGroup(daemonUser)
 	if err != nil {
-		return nil, common.Fatal(err)
+		return nil, fatal(err)
+	}
+	if alternate {
+		return nil, fatalf("%w: rc.d daemons run with the primary group of %s", ErrNotSupported, daemonUser.Username)
+	}
+	supplementary, err := supplementaryGroups(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if len(supplementary) > 0 {
+		return nil, fatalf("%w: rc.d daemons run with the login groups of %s; add the user to the groups instead", ErrNotSupported, daemonUser.Username)
 	}
 
+	timeout, err := stopTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	signal, err := stopSignal(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	cmdTimeout, err := commandTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	retries, retryDelay, err := retryPolicy(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// daemon.nice and daemon.ionice are not applied; rc.d daemons take their
+	// priority from the login class set with rcctl set NAME class
+	_, err = niceness(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	memoryLimit, nofileLimit, err := resourceLimits(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	mask, err := umask(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// pledge and unveil are called by the program itself, so rc.d has no
+	// sandbox and daemon.sandbox is only validated
+	_, err = sandbox(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	after, requires, err := dependencies(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	prestart, poststop, err := hooks(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	extra, err := extraConfig(settings, "rc_cmd")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// rc.subr runs daemon with a cleared environment
+	env, err := daemonEnv(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	wrapper := settings.getBool("daemon.wrapper")
+	if len(env) > 0 && !wrapper {
+		return nil, fatalf("%w: rc.d daemons require daemon.wrapper for env settings", ErrNotSupported)
+	}
+	serviceBin, err := serviceBinary(settings, binRoot, command)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	chown, err := chownBinary(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	pidfile, err := pidFile(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	start, err := startType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	kind, err := daemonType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if kind == "oneshot" {
+		return nil, fatalf("%w: oneshot rc.d daemons", ErrNotSupported)
+	}
+	custom, err := customTemplate(settings, "rcfile")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	rtable, rcTimeout, err := rcVariables(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logFlags, err := logArgs(settings, logFile)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	args = append(args, logFlags...)
+
 	t := RCDaemon{
-		Name:       name,
-		Username:   daemonUser.Username,
-		Uid:        daemonUser.Uid,
-		Executable: command,
-		Args:       strings.Join(append(args, "--logfile", logFile), " "),
-		Dir:        runDir,
-		LogFile:    logFile,
-		serviceBin: filepath.Join("/usr/local/bin", basename),
+		Name:           name,
+		Username:       daemonUser.Username,
+		Uid:            daemonUser.Uid,
+		Gid:            daemonUser.Gid,
+		Executable:     command,
+		Args:           quoteArgs(args, quoteShellDouble),
+		Dir:            runDir,
+		LogFile:        logFile,
+		ErrorLog:       errorLog,
+		Stdin:          stdin,
+		PidFile:        pidfile,
+		Umask:          mask,
+		StopTimeout:    timeout,
+		StopSignal:     signal,
+		CommandTimeout: cmdTimeout,
+		Retries:        retries,
+		RetryDelay:     retryDelay,
+		Env:            env,
+		Wrapper:        wrapper,
+		MemoryLimit:    memoryLimit,
+		NofileLimit:    nofileLimit,
+		ChownBinary:    chown,
+		Force:          common.ViperGetBool("force"),
+		StartType:      start,
+		After:          after,
+		Requires:       requires,
+		PreStart:       prestart,
+		PostStop:       poststop,
+		ExtraConfig:    extra,
+		Flags:          settings.getString("daemon.openbsd.flags"),
+		Rtable:         rtable,
+		Timeout:        rcTimeout,
+		Reload:         settings.getString("daemon.openbsd.reload"),
+		RCCtlSet:       settings.getBool("daemon.openbsd.rcctl_set"),
+		serviceBin:     serviceBin,
+		wrapperFile:    wrapperPath(name, ""),
+		customRC:       custom,
+		// match the process the way rc.subr does, by its command line
+		pexp:     strings.Join(append([]string{serviceBin}, args...), " "),
+		settings: settings,
 	}
 
 	return &t, nil
 }
 
+// daemon.openbsd.rtable and daemon.openbsd.timeout, zero when unset so
+// rc.subr uses its defaults
+func rcVariables(settings daemonSettings) (int, int, error) {
+	rtable := settings.getInt("daemon.openbsd.rtable")
+	if rtable < 0 || rtable > 255 {
+		return 0, 0, fatalf("invalid daemon.openbsd.rtable: %d", rtable)
+	}
+	timeout := settings.getInt("daemon.openbsd.timeout")
+	if timeout < 0 {
+		return 0, 0, fatalf("invalid daemon.openbsd.timeout: %d", timeout)
+	}
+	return rtable, timeout, nil
+}
+
+func (d *RCDaemon) template() string {
+	if d.customRC != "" {
+		return d.customRC
+	}
+	return rcTemplate
+}
+
+func (d *RCDaemon) rcFile() string {
+	return filepath.Join(rcRoot, d.Name)
+}
+
+func (d *RCDaemon) installed() bool {
+	return common.IsFile(d.rcFile())
+}
+
 func (d *RCDaemon) Install() error {
+	err := checkPrivileges("install", d.rcFile())
+	if err != nil {
+		return fatal(err)
+	}
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	err = checkInstallTarget(d.rcFile(), d.Force)
+	if err != nil {
+		return fatal(err)
+	}
+	err = checkDependencies(append(d.After, d.Requires...), func(name string) bool {
+		return common.IsFile(filepath.Join(rcRoot, name))
+	})
+	if err != nil {
+		return fatal(err)
+	}
+	err = createRunDir(d.Dir, d.Uid, d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	for _, logFile := range []string{d.LogFile, d.ErrorLog} {
+		if logFile == "" {
+			continue
+		}
+		err = d.createLogFile(logFile)
+		if err != nil {
+			return fatal(err)
+		}
+	}
 
-	rcData := os.Expand(rcTemplate, func(key string) string {
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	err = copyBinary(d.Executable, d.serviceBin, owner, group)
+	if err != nil {
+		return fatal(err)
+	}
+	if d.Wrapper {
+		err = writeWrapper(d.wrapperFile, shellWrapper(d.Dir, d.serviceBin, d.Env))
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	err = writeFileAtomic(d.rcFile(), d.rcData(), 0700)
+	if err != nil {
+		return fatal(err)
+	}
+	if d.RCCtlSet {
+		err = d.setVariables()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	if d.StartType == "auto" {
+		err = d.Enable()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
+
+// create a daemon log file writable by the daemon's group
+func (d *RCDaemon) createLogFile(logFile string) error {
+	err := createOwnedDirs(filepath.Dir(logFile), d.Uid, d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	if !common.IsFile(logFile) {
+		file, err := os.Create(logFile)
+		if err != nil {
+			return fatal(err)
+		}
+		file.Close()
+		debugLog("create", "path", logFile)
+	}
+	gid, err := strconv.Atoi(d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chown(logFile, -1, gid)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Chmod(logFile, 0660)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// values are shell quoted; TASK_BIN and TASK_ARGS render inside the
+// double quoted daemon= string, so they are escaped for that context; the
+// result carries its spec marker
+func (d *RCDaemon) rcData() []byte {
+	data := os.Expand(d.template(), func(key string) string {
 		switch key {
 		case "TASK_USER":
-			return d.Username
+			return shellQuote(d.Username)
 		case "TASK_UID":
-			return d.Uid
+			return shellQuote(d.Uid)
 		case "TASK_BIN":
-			return d.serviceBin
+			if d.Wrapper {
+				return quoteArgs([]string{d.wrapperFile}, quoteShellDouble)
+			}
+			return quoteArgs([]string{d.serviceBin}, quoteShellDouble)
+		case "TASK_PEXP":
+			// the wrapper execs the daemon, so rc.subr must match the daemon's command line
+			if d.Wrapper {
+				return `pexp="` + doubleQuoteEscape(d.pexp) + `"` + "\n"
+			}
+			return ""
+		case "TASK_LIMITS":
+			// su -l applies the login class limits and umask, so ulimit and
+			// umask run in the daemon's shell
+			limits := ""
+			if d.Umask != "" {
+				limits += "umask " + d.Umask + "; "
+			}
+			if d.MemoryLimit > 0 {
+				limits += fmt.Sprintf("ulimit -d %d; ", (d.MemoryLimit+1023)/1024)
+			}
+			if d.NofileLimit > 0 {
+				limits += fmt.Sprintf("ulimit -n %d; ", d.NofileLimit)
+			}
+			// the daemon's shell writes its own pid and execs the daemon
+			if d.PidFile != "" {
+				limits += `echo \$\$ > ` + doubleQuoteEscape(shellQuote(d.PidFile)) + "; exec "
+			}
+			// daemon_logger would take stdout too, so split logs
+			// redirect stderr on the daemon's command line
+			stderr := ""
+			if d.ErrorLog != "" {
+				stderr = " 2>>" + doubleQuoteEscape(shellQuote(d.ErrorLog))
+			}
+			stdin := ""
+			if d.Stdin != "" {
+				stdin = " <" + doubleQuoteEscape(shellQuote(d.Stdin))
+			}
+			if limits == "" && stdin == "" && stderr == "" {
+				return ""
+			}
+			return "rc_start() {\n\trc_exec \"" + limits + "${daemon} ${daemon_flags}" + stdin + stderr + "\"\n}\n"
+		case "TASK_EXTRA":
+			return d.ExtraConfig
+		case "TASK_PRE":
+			// refuse to start until each required daemon is running and prestart succeeds
+			checks := []string{}
+			for _, name := range d.Requires {
+				checks = append(checks, "rcctl check "+shellQuote(name)+" >/dev/null")
+			}
+			if d.PreStart != "" {
+				checks = append(checks, "sh -c "+shellQuote(d.PreStart))
+			}
+			if len(checks) == 0 {
+				return ""
+			}
+			return "rc_pre() {\n\t" + strings.Join(checks, " &&\n\t") + "\n}\n"
+		case "TASK_STOP":
+			// the rc.subr default rc_stop, with the configured signal
+			if d.StopSignal == "" || d.StopSignal == "TERM" {
+				return ""
+			}
+			return "rc_stop() {\n\tpkill -" + d.StopSignal + " -T \"${daemon_rtable}\" -xf \"${pexp}\"\n}\n"
+		case "TASK_POST":
+			// rc.subr runs rc_post after rcctl stop, not when the daemon exits on its own
+			if d.PostStop == "" {
+				return ""
+			}
+			return "rc_post() {\n\tsh -c " + shellQuote(d.PostStop) + "\n}\n"
+		case "TASK_RELOAD":
+			switch d.Reload {
+			case "":
+				return ""
+			case "NO":
+				return "rc_reload=NO\n"
+			}
+			return "rc_reload() {\n\tsh -c " + shellQuote(d.Reload) + "\n}\n"
+		case "TASK_FLAGS":
+			if d.Flags == "" {
+				return ""
+			}
+			return shellQuote(d.Flags)
+		case "TASK_RC_VARS":
+			vars := ""
+			if d.Rtable > 0 {
+				vars += fmt.Sprintf("daemon_rtable=%d\n", d.Rtable)
+			}
+			if d.Timeout > 0 {
+				vars += fmt.Sprintf("daemon_timeout=%d\n", d.Timeout)
+			}
+			return vars
 		case "TASK_ARGS":
 			return d.Args
 		case "TASK_DIR":
-			return d.Dir
+			return shellQuote(d.Dir)
 		}
 		return "${" + key + "}"
 	})
-	if d.Executable != d.serviceBin {
-		src, err := os.Open(d.Executable)
-		if err != nil {
-			return common.Fatal(err)
-		}
-		defer src.Close()
-		dst, err := os.OpenFile(d.serviceBin, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	return stampSpec([]byte(data))
+}
+
+// store the flags, rtable and timeout in rc.conf.local with rcctl set, where
+// they override the rc script's defaults
+func (d *RCDaemon) setVariables() error {
+	settings := [][]string{}
+	if d.Flags != "" {
+		settings = append(settings, []string{"flags", d.Flags})
+	}
+	if d.Rtable > 0 {
+		settings = append(settings, []string{"rtable", strconv.Itoa(d.Rtable)})
+	}
+	if d.Timeout > 0 {
+		settings = append(settings, []string{"timeout", strconv.Itoa(d.Timeout)})
+	}
+	for _, setting := range settings {
+		_, _, _, err := runTimeout(d.CommandTimeout, "rcctl", append([]string{"set", d.Name}, setting...)...)
 		if err != nil {
-			return common.Fatal(err)
+			return fatalf("rcctl set %s %s: %w", d.Name, setting[0], err)
 		}
-		defer dst.Close()
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			return common.Fatal(err)
+	}
+	return nil
+}
+
+// rcctl waits for the daemon as it starts and stops it, so it is allowed
+// the stop timeout as well
+func (d *RCDaemon) rcctl(args ...string) error {
+	return retry(d.Retries, d.RetryDelay, func() error {
+		argv := d.argv(args...)
+		stdout, stderr, _, err := runTimeout(d.CommandTimeout+d.StopTimeout, argv[0], argv[1:]...)
+		printOutput(stdout, stderr)
+		return err
+	})
+}
+
+// the rcctl command line acting on the daemon
+func (d *RCDaemon) argv(args ...string) []string {
+	return append(append([]string{"rcctl"}, args...), d.Name)
+}
+
+// the rcctl commands run by start, stop, query, or delete
+func (d *RCDaemon) Commands(action string) ([][]string, error) {
+	switch action {
+	case "start":
+		if d.StartType == "manual" {
+			return [][]string{d.argv("-f", "start")}, nil
 		}
+		return [][]string{d.argv("enable"), d.argv("start")}, nil
+	case "stop":
+		return [][]string{d.argv("stop")}, nil
+	case "query":
+		return [][]string{d.argv("check")}, nil
+	case "delete":
+		return [][]string{d.argv("stop"), d.argv("disable")}, nil
 	}
-	rcFile := filepath.Join("/etc/rc.d", d.Name)
-	err := os.WriteFile(rcFile, []byte(rcData), 0700)
-	if err != nil {
-		return common.Fatal(err)
+	return nil, fatalf("unknown action: %s", action)
+}
+
+func (d *RCDaemon) ConfigFiles() ([]ConfigFile, error) {
+	files := []ConfigFile{{d.rcFile(), 0700, d.rcData()}}
+	if d.Wrapper {
+		files = append(files, ConfigFile{d.wrapperFile, 0755, shellWrapper(d.Dir, d.serviceBin, d.Env)})
 	}
-	return nil
+	return files, nil
 }
 
-func (d *RCDaemon) rcctl(command string) error {
-	cmd := exec.Command("rcctl", command, d.Name)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	fmt.Printf("%v\n", cmd)
-	return cmd.Run()
+func (d *RCDaemon) binaries() (string, string) {
+	return d.Executable, d.serviceBin
 }
 
+func (d *RCDaemon) updateBinary() error {
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	return copyBinary(d.Executable, d.serviceBin, owner, group)
+}
+
+// rc.subr reads the script each time it runs, so it only needs writing
+func (d *RCDaemon) rewriteConfig() (bool, error) {
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return false, fatal(err)
+	}
+	changed, err := rewriteFiles(files)
+	if err != nil {
+		return false, fatal(err)
+	}
+	return changed, nil
+}
+
+// each teardown step runs even when an earlier one fails, and the errors
+// are returned together; with Force a failed stop is only a warning
 func (d *RCDaemon) Delete() error {
-	err := d.rcctl("stop")
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err = checkPrivileges("delete", d.rcFile())
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	errs := []error{}
+	err = d.Stop()
+	if err != nil {
+		if d.Force {
+			forceWarning(d.Name, err)
+			// -f stops the daemon even when it is not enabled
+			runTimeout(d.CommandTimeout, "rcctl", "-f", "stop", d.Name)
+			runTimeout(d.CommandTimeout, "pkill", "-KILL", "-xf", d.pexp)
+		} else {
+			errs = append(errs, fatal(err))
+		}
 	}
 	err = d.rcctl("disable")
 	if err != nil {
-		return common.Fatal(err)
+		errs = append(errs, fatal(err))
+	}
+	err = os.Remove(d.rcFile())
+	if err != nil {
+		errs = append(errs, fatal(err))
+	} else {
+		debugLog("remove", "path", d.rcFile())
+	}
+	err = removePidFile(d.PidFile)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	}
+	err = removeWrapper(d.wrapperFile)
+	if err != nil {
+		errs = append(errs, fatal(err))
+	}
+	return errors.Join(errs...)
+}
+
+func (d *RCDaemon) Enable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
 	}
-	err = os.Remove(filepath.Join("/etc/rc.d", d.Name))
+	err := d.rcctl("enable")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	// boot order follows pkg_scripts, so place the dependencies before this daemon
+	dependencies := append(append([]string{}, d.After...), d.Requires...)
+	if len(dependencies) > 0 {
+		_, _, _, err = runTimeout(d.CommandTimeout, "rcctl", append(append([]string{"order"}, dependencies...), d.Name)...)
+		if err != nil {
+			return fatalf("rcctl order: %w", err)
+		}
 	}
 	return nil
 }
 
+func (d *RCDaemon) Disable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := d.rcctl("disable")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a running daemon is left alone
 func (d *RCDaemon) Start() error {
-	err := d.rcctl("enable")
+	running, err := d.Query()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		debugLog("already running", "name", d.Name)
+		return nil
+	}
+	err = checkStartType(d.Name, d.StartType)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	// -f starts a manual daemon that is not enabled
+	if d.StartType == "manual" {
+		err = d.rcctl("-f", "start")
+		if err != nil {
+			return fatal(err)
+		}
+		return nil
+	}
+	err = d.Enable()
+	if err != nil {
+		return fatal(err)
 	}
 	err = d.rcctl("start")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
 	return nil
 }
 
 func (d *RCDaemon) Stop() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
 	err := d.rcctl("stop")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	stopped, err := waitStopped(d.Query, d.StopTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if stopped {
+		return nil
+	}
+	_, _, _, err = runTimeout(d.CommandTimeout, "pkill", "-KILL", "-xf", d.pexp)
+	if err != nil {
+		return fatal(err)
+	}
+	stopped, err = waitStopped(d.Query, killTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if !stopped {
+		return fatalf("%s still running after pkill -KILL", d.Name)
+	}
+	return nil
+}
+
+func (d *RCDaemon) Restart() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := d.rcctl("restart")
+	if err != nil {
+		return fatal(err)
 	}
 	return nil
 }
 
+var rcDaemonCapabilities = DaemonCapabilities{
+	Pid:          true,
+	PidFile:      true,
+	StopSignal:   true,
+	Dependencies: true,
+}
+
+func (d *RCDaemon) Capabilities() DaemonCapabilities {
+	return rcDaemonCapabilities
+}
+
+// the settings the daemon was created with
+func (d *RCDaemon) specSettings() daemonSettings {
+	return d.settings
+}
+
+// delete the rc script and remove its log file and copied binary
+func (d *RCDaemon) Purge() error {
+	return purge(d, d.Executable, d.serviceBin, filepath.Join(rcRoot, "*"))
+}
+
+// return the log file the daemon writes, daemon.logfile when set
+func (d *RCDaemon) LogPath() (string, error) {
+	return d.LogFile, nil
+}
+
+func (d *RCDaemon) Paths() map[string]string {
+	paths := map[string]string{
+		"binary": d.serviceBin,
+		"config": d.rcFile(),
+		"dir":    d.Dir,
+		"log":    d.LogFile,
+	}
+	if d.Wrapper {
+		paths["wrapper"] = d.wrapperFile
+	}
+	if d.PidFile != "" {
+		paths["pidfile"] = d.PidFile
+	}
+	if d.ErrorLog != "" {
+		paths["stderr"] = d.ErrorLog
+	}
+	return paths
+}
+
 func (d *RCDaemon) GetConfig() (string, error) {
-	config, err := exec.Command("rcctl", "get", d.Name).Output()
+	if !d.installed() {
+		return "", fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	config, _, _, err := runTimeout(d.CommandTimeout, "rcctl", "get", d.Name)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return config, nil
+}
+
+func (d *RCDaemon) GetDaemonConfig() (*DaemonConfig, error) {
+	rcData, err := os.ReadFile(d.rcFile())
+	if err != nil {
+		return nil, fatal(err)
+	}
+	settings, err := d.GetConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config, err := parseRCFile(d.Name, string(rcData), settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return config, nil
+}
+
+func (d *RCDaemon) DesiredConfig() (*DaemonConfig, error) {
+	config, err := parseRCFile(d.Name, string(d.rcData()), "")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return config, nil
+}
+
+// parse the rc file variables, then the rcctl get settings which override them
+func parseRCFile(name, rcData, settings string) (*DaemonConfig, error) {
+	lines, err := shellSplit(rcData)
 	if err != nil {
-		return "", common.Fatal(err)
+		return nil, fatal(err)
+	}
+	config := DaemonConfig{Name: name, Env: make(map[string]string), Enabled: true}
+	var flags string
+	for _, words := range lines {
+		key, value, ok := strings.Cut(words[0], "=")
+		if len(words) != 1 || !ok {
+			continue
+		}
+		switch key {
+		case "daemon":
+			command, err := shellSplit(value)
+			if err != nil {
+				return nil, fatal(err)
+			}
+			if len(command) != 1 {
+				return nil, fatalf("unexpected daemon command: %s", value)
+			}
+			config.Executable = command[0][0]
+			config.Args = command[0][1:]
+		case "daemon_user":
+			config.User = value
+		case "daemon_execdir":
+			config.Dir = value
+		case "daemon_flags":
+			flags = value
+		}
+	}
+	for _, line := range strings.Split(settings, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		variable, found := strings.CutPrefix(key, name+"_")
+		if !ok || !found {
+			continue
+		}
+		switch variable {
+		case "user":
+			config.User = value
+		case "flags":
+			if value == "NO" {
+				config.Enabled = false
+			} else {
+				flags = value
+			}
+		}
+	}
+	if flags != "" {
+		words, err := shellSplit(flags)
+		if err != nil {
+			return nil, fatal(err)
+		}
+		for _, line := range words {
+			config.Args = append(config.Args, line...)
+		}
 	}
-	return string(config), nil
+	if config.Executable == "" {
+		return nil, fatalf("no daemon command in rc file")
+	}
+	return &config, nil
+}
+
+// apply NAME_var=value lines in the format output by rcctl get
+func (d *RCDaemon) SetConfig(config string) error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	err := checkConfig(config)
+	if err != nil {
+		return fatal(err)
+	}
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		variable, found := strings.CutPrefix(key, d.Name+"_")
+		if !ok || !found {
+			return fatalf("unexpected config line: %s", line)
+		}
+		if variable == "flags" && value == "NO" {
+			continue
+		}
+		stdout, stderr, _, err := runTimeout(d.CommandTimeout, "rcctl", "set", d.Name, variable, value)
+		printOutput(stdout, stderr)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
 }
 
 func (d *RCDaemon) Query() (bool, error) {
-	cmd := exec.Command("rcctl", "check", d.Name)
-	err := cmd.Run()
-	switch err.(type) {
-	case nil:
-	case *exec.ExitError:
-	default:
-		return false, common.Fatal(err)
-	}
-	exitCode := cmd.ProcessState.ExitCode()
+	if !d.installed() {
+		return false, fatalf("%w: %s", ErrNotInstalled, d.rcFile())
+	}
+	var exitCode int
+	err := retry(d.Retries, d.RetryDelay, func() error {
+		argv := d.argv("check")
+		var err error
+		_, _, exitCode, err = runTimeout(d.CommandTimeout, argv[0], argv[1:]...)
+		return err
+	})
+	if err != nil && !exitFailure(err) {
+		return false, fatal(err)
+	}
 	return exitCode == 0, nil
 }
+
+// rc.d doesn't record why a daemon stopped, so an enabled daemon that is
+// not running is reported failed, even when it was stopped by hand
+func (d *RCDaemon) Status() (DaemonState, error) {
+	running, err := d.Query()
+	if err != nil {
+		return "", fatal(err)
+	}
+	if running {
+		return StateRunning, nil
+	}
+	config, err := d.GetDaemonConfig()
+	if err != nil {
+		return "", fatal(err)
+	}
+	if config.Enabled {
+		return StateFailed, nil
+	}
+	return StateStopped, nil
+}
+
+// return the pid of the running daemon, or 0 if it is not running
+func (d *RCDaemon) Pid() (int, error) {
+	running, err := d.Query()
+	if err != nil {
+		return 0, fatal(err)
+	}
+	if !running {
+		return 0, nil
+	}
+	if d.PidFile != "" {
+		pid, err := readPidFile(d.PidFile)
+		if err != nil {
+			return 0, fatal(err)
+		}
+		if pid != 0 {
+			return pid, nil
+		}
+	}
+	stdout, _, exitCode, err := runTimeout(d.CommandTimeout, "pgrep", "-xf", d.pexp)
+	if err != nil {
+		// pgrep exits 1 when no process matches
+		if exitFailure(err) && exitCode == 1 {
+			return 0, nil
+		}
+		return 0, fatal(err)
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fatalf("unexpected pgrep output: %s", strings.TrimSpace(stdout))
+	}
+	return pid, nil
+}
+
+func (d *RCDaemon) tools() (string, []string) {
+	return "rc.d", []string{"rcctl"}
+}
+
+func (d *RCDaemon) Validate() error {
+	return errors.Join(
+		checkTools(d.tools()),
+		checkExecutable(d.Executable),
+		checkRunDir(d.settings, d.Dir, d.Uid, d.Gid),
+		checkPidDir(d.PidFile, d.Uid, d.Gid),
+	)
+}
+
+// return a daemon that can only inspect the installed rc.d script of name
+func rcDaemonByName(name string) (CobraDaemon, error) {
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return &RCDaemon{Name: name, CommandTimeout: timeout}, nil
+}
+
+func listRCDaemons() ([]DaemonInfo, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	serviceBin, err := serviceBinary(nil, binRoot, executable)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	marker := `daemon="` + serviceBin
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	entries, err := os.ReadDir(rcRoot)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	list := []DaemonInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(rcRoot, entry.Name()))
+		if err != nil {
+			return nil, fatal(err)
+		}
+		if !strings.Contains(string(data), marker+" ") && !strings.Contains(string(data), marker+`"`) {
+			continue
+		}
+		d := RCDaemon{Name: entry.Name(), CommandTimeout: timeout}
+		running, err := d.Query()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		list = append(list, DaemonInfo{Name: entry.Name(), Running: running})
+	}
+	return list, nil
+}
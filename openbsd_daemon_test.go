@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRCDaemonDeleteErrors(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "rcctl", `
+echo "$1" >> $FAKE_STATE/rcctl.log
+if [ "$1" = stop ]; then echo "rcctl: $2: failed" >&2; exit 1; fi`)
+	testConfig(t, "daemon.wrapper", true)
+
+	d, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	paths := d.Paths()
+	require.FileExists(t, paths["wrapper"])
+	err = d.Delete()
+	require.ErrorContains(t, err, "exit status 1")
+	require.NoFileExists(t, paths["config"])
+	require.NoFileExists(t, paths["wrapper"])
+	log, err := os.ReadFile(filepath.Join(state, "rcctl.log"))
+	require.Nil(t, err)
+	require.Equal(t, "stop\ndisable\n", string(log))
+}
+
+func TestRCVariables(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "rcctl", `echo "$@" >> $FAKE_STATE/rcctl.log`)
+	testConfig(t, "daemon.openbsd.flags", "--debug --name 'a b'")
+	testConfig(t, "daemon.openbsd.rtable", 2)
+	testConfig(t, "daemon.openbsd.timeout", 60)
+	testConfig(t, "daemon.openbsd.reload", "pkill -USR1 -xf testrc")
+
+	d, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	data := string(d.(*RCDaemon).rcData())
+	require.Contains(t, data, `
+daemon_flags='--debug --name '\''a b'\'''
+`)
+	require.Contains(t, data, "\ndaemon_execdir="+root+"\ndaemon_rtable=2\ndaemon_timeout=60\nrc_bg=YES\n")
+	require.Contains(t, data, "\nrc_reload() {\n\tsh -c 'pkill -USR1 -xf testrc'\n}\n\nrc_cmd ${1}\n")
+	config, err := d.DesiredConfig()
+	require.Nil(t, err)
+	require.Equal(t, []string{"--logfile", filepath.Join(logRoot, "testrc"), "--debug", "--name", "a b"}, config.Args)
+
+	require.Nil(t, d.Install())
+	require.NoFileExists(t, filepath.Join(state, "rcctl.log"))
+
+	require.Nil(t, os.Remove(d.Paths()["config"]))
+
+	testConfig(t, "daemon.openbsd.rcctl_set", true)
+	d, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	log, err := os.ReadFile(filepath.Join(state, "rcctl.log"))
+	require.Nil(t, err)
+	require.Equal(t, "set testrc flags --debug --name 'a b'\nset testrc rtable 2\nset testrc timeout 60\n", string(log))
+
+	testConfig(t, "daemon.openbsd.reload", "NO")
+	testConfig(t, "daemon.openbsd.flags", "")
+	d, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	data = string(d.(*RCDaemon).rcData())
+	require.Contains(t, data, "\ndaemon_flags=\n")
+	require.Contains(t, data, "\nrc_reload=NO\n")
+
+	testConfig(t, "daemon.openbsd.rtable", 256)
+	_, err = NewRCDaemon("testrc", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid daemon.openbsd.rtable: 256")
+}
+
+func TestRCSupplementaryGroups(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	groups := testGroups(t)
+
+	testConfig(t, "daemon.supplementary_groups", []string{groups[0].Name, groups[1].Name})
+	_, err := NewRCDaemon("testd", testUser(t), root, executable)
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestRCInstallAtomic(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	// a non-empty directory at the rc file path makes the rename fail
+	rcFile := filepath.Join(rcRoot, "testrc")
+	require.Nil(t, os.MkdirAll(filepath.Join(rcFile, "blocker"), 0755))
+	d, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.NotNil(t, d.Install())
+	entries, err := os.ReadDir(rcRoot)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	require.DirExists(t, rcFile)
+
+	require.Nil(t, os.RemoveAll(rcFile))
+	require.Nil(t, d.Install())
+	data, err := os.ReadFile(rcFile)
+	require.Nil(t, err)
+	require.Equal(t, d.(*RCDaemon).rcData(), data)
+	info, err := os.Stat(rcFile)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	entries, err = os.ReadDir(rcRoot)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+}
@@ -0,0 +1,59 @@
+//go:build windows
+
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+const enableEchoInput = 0x0004
+
+// prompt on the console for a password, with echo turned off while it is typed
+func readPassword(prompt string) (string, error) {
+	console := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	err := syscall.GetConsoleMode(console, &mode)
+	if err != nil {
+		return "", fatalf("no console for password prompt: %v", err)
+	}
+	ok, _, err := setConsoleMode.Call(uintptr(console), uintptr(mode&^enableEchoInput))
+	if ok == 0 {
+		return "", fatal(err)
+	}
+	defer setConsoleMode.Call(uintptr(console), uintptr(mode))
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
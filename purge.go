@@ -0,0 +1,123 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rstms/cobra-daemon/common"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// files multilog and svlogd write in their log directory
+var logDirEntry = regexp.MustCompile(`^(current|lock|state|newstate|config|previous|processed|@[0-9a-f]+\.[su])$`)
+
+// delete d, then remove its logs and copied binary; a daemon that is no
+// longer installed still has any leftover files removed
+func purge(d CobraDaemon, executable, binary, configs string) error {
+	err := d.Delete()
+	if err != nil && !errors.Is(err, ErrNotInstalled) {
+		return fatal(err)
+	}
+	err = removeLog(d.Paths()["log"])
+	if err != nil {
+		return fatal(err)
+	}
+	err = removeLog(d.Paths()["stderr"])
+	if err != nil {
+		return fatal(err)
+	}
+	err = removeServiceBinary(executable, binary, configs)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// remove a log file, or a log directory holding only the files written
+// by the log service, so a logfile setting naming a shared directory
+// doesn't remove other files
+func removeLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fatal(err)
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return fatal(err)
+		}
+		for _, entry := range entries {
+			if !logDirEntry.MatchString(entry.Name()) {
+				return fatalf("log directory %s contains %s; not removed", path, entry.Name())
+			}
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fatal(err)
+		}
+	} else {
+		err = os.Remove(path)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	debugLog("remove", "path", path)
+	return nil
+}
+
+// remove the binary install copied from executable unless a config file
+// matching the configs glob still runs it, as other instances may
+func removeServiceBinary(executable, binary, configs string) error {
+	if binary == "" || binary == executable || !common.IsFile(binary) {
+		return nil
+	}
+	files, err := filepath.Glob(configs)
+	if err != nil {
+		return fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fatal(err)
+		}
+		if bytes.Contains(data, []byte(binary)) {
+			debugLog("keep", "path", binary, "config", file)
+			return nil
+		}
+	}
+	err = os.Remove(binary)
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("remove", "path", binary)
+	return nil
+}
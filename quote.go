@@ -0,0 +1,274 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"regexp"
+	"strings"
+)
+
+type quoteSyntax int
+
+const (
+	// words in a shell script
+	quoteShell quoteSyntax = iota
+	// shell words inside a double quoted shell string, as in an rc.d daemon= line
+	quoteShellDouble
+	// words in a systemd unit Exec line
+	quoteSystemd
+	// a windows command line as parsed by CommandLineToArgvW
+	quoteWindows
+)
+
+var safeWord = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// join args into a single string that the target syntax splits back into args
+func quoteArgs(args []string, syntax quoteSyntax) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		switch syntax {
+		case quoteShell:
+			words[i] = shellQuote(arg)
+		case quoteShellDouble:
+			words[i] = doubleQuoteEscape(shellQuote(arg))
+		case quoteSystemd:
+			words[i] = systemdQuote(arg)
+		case quoteWindows:
+			words[i] = windowsQuote(arg)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func shellQuote(arg string) string {
+	if safeWord.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// escape the characters that remain special inside shell double quotes
+func doubleQuoteEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value)
+}
+
+// systemd expands $VAR and %specifiers even in quoted words; a raw
+// newline would end the directive, so it is written as a C escape
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("$", "$$", "%", "%%").Replace(arg)
+	if safeWord.MatchString(arg) {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(arg) + `"`
+}
+
+// backslashes are literal except when they precede a double quote
+func windowsQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\v\"") {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for _, c := range arg {
+		switch c {
+		case '\\':
+			slashes++
+			continue
+		case '"':
+			b.WriteString(strings.Repeat(`\`, 2*slashes+1))
+		default:
+			b.WriteString(strings.Repeat(`\`, slashes))
+		}
+		slashes = 0
+		b.WriteRune(c)
+	}
+	b.WriteString(strings.Repeat(`\`, 2*slashes))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// split a shell script into the words of each command line, undoing
+// shellQuote and doubleQuoteEscape; comments and empty lines are dropped
+func shellSplit(script string) ([][]string, error) {
+	lines := [][]string{}
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endLine := func() {
+		endWord()
+		if len(words) > 0 {
+			lines = append(lines, words)
+			words = []string{}
+		}
+	}
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\n' || c == ';':
+			endLine()
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '#' && !inWord:
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			endLine()
+		case c == '\\':
+			i++
+			if i == len(runes) {
+				return nil, fatalf("trailing backslash")
+			}
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexRune(string(runes[i+1:]), '\'')
+			if end < 0 {
+				return nil, fatalf("unterminated single quote")
+			}
+			quoted := []rune(string(runes[i+1:])[:end])
+			word.WriteString(string(quoted))
+			i += len(quoted) + 1
+		case c == '"':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\\\"$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, fatalf("unterminated double quote")
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	endLine()
+	return lines, nil
+}
+
+// split a systemd Exec or Environment value into words, undoing systemdQuote
+func systemdSplit(value string) ([]string, error) {
+	words := []string{}
+	unescape := strings.NewReplacer("$$", "$", "%%", "%")
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == ' ' || runes[i] == '\t' {
+			continue
+		}
+		var word strings.Builder
+		quote := rune(0)
+		if runes[i] == '"' || runes[i] == '\'' {
+			quote = runes[i]
+			i++
+		}
+		for ; i < len(runes); i++ {
+			c := runes[i]
+			if quote == 0 && (c == ' ' || c == '\t') {
+				break
+			}
+			if c == quote {
+				quote = 0
+				break
+			}
+			if c == '\\' && i+1 < len(runes) {
+				i++
+				switch runes[i] {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				default:
+					c = runes[i]
+				}
+			}
+			word.WriteRune(c)
+		}
+		if quote != 0 {
+			return nil, fatalf("unterminated quote: %s", value)
+		}
+		words = append(words, unescape.Replace(word.String()))
+	}
+	return words, nil
+}
+
+// split a windows command line the way CommandLineToArgvW does, undoing windowsQuote
+func windowsSplit(line string) []string {
+	words := []string{}
+	var word strings.Builder
+	inWord, quoted := false, false
+	slashes := 0
+	for _, c := range line {
+		if c == '\\' {
+			slashes++
+			inWord = true
+			continue
+		}
+		if c == '"' {
+			word.WriteString(strings.Repeat(`\`, slashes/2))
+			if slashes%2 == 1 {
+				word.WriteRune(c)
+			} else {
+				quoted = !quoted
+			}
+			slashes = 0
+			inWord = true
+			continue
+		}
+		word.WriteString(strings.Repeat(`\`, slashes))
+		slashes = 0
+		if !quoted && (c == ' ' || c == '\t') {
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		}
+		word.WriteRune(c)
+		inWord = true
+	}
+	word.WriteString(strings.Repeat(`\`, slashes))
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
@@ -0,0 +1,183 @@
+package daemon
+
+import (
+	"encoding/xml"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+var quoteTestArgs = []string{
+	"--message", "hello world",
+	"--quote", `it's "quoted"`,
+	"--dollar", "$HOME and $(id) and `id`",
+	"--backslash", `C:\path\`,
+	"--empty", "",
+	"-L-",
+}
+
+// run script with sh and return the NUL separated words it prints
+func shellWords(t *testing.T, script string) []string {
+	out, err := exec.Command("sh", "-c", script).Output()
+	require.Nil(t, err)
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+func TestQuoteShell(t *testing.T) {
+	quoted := quoteArgs(quoteTestArgs, quoteShell)
+	require.Equal(t, quoteTestArgs, shellWords(t, `printf '%s\0' `+quoted))
+	require.Equal(t, "--logfile /var/log/testd -L-", quoteArgs([]string{"--logfile", "/var/log/testd", "-L-"}, quoteShell))
+}
+
+func TestQuoteShellDouble(t *testing.T) {
+	// rc.subr evaluates the daemon= string with sh
+	quoted := quoteArgs(quoteTestArgs, quoteShellDouble)
+	require.Equal(t, quoteTestArgs, shellWords(t, `daemon="`+quoted+`"; eval "printf '%s\0' $daemon"`))
+}
+
+func TestQuoteSystemd(t *testing.T) {
+	quoted := quoteArgs([]string{"--message", "hello world", "--say", `a "b" \c`, "--cost", "$5 100%"}, quoteSystemd)
+	require.Equal(t, `--message "hello world" --say "a \"b\" \\c" --cost "$$5 100%%"`, quoted)
+}
+
+func TestQuoteWindows(t *testing.T) {
+	quoted := quoteArgs([]string{"--message", "hello world", "--say", `a "b"`, "--dir", `C:\Program Files\`, ""}, quoteWindows)
+	require.Equal(t, `--message "hello world" --say "a \"b\"" --dir "C:\Program Files\\" ""`, quoted)
+}
+
+const hostileDir = "/tmp/run dir;touch '$HOME' & <x>"
+
+func TestTemplateEscapeShell(t *testing.T) {
+	d := Daemontools{
+		Username:   "user;id",
+		Group:      "group",
+		serviceBin: `/usr/local/bin/a "b"`,
+		Args:       quoteArgs(quoteTestArgs, quoteShell),
+		Dir:        hostileDir,
+	}
+	script := string(d.templateData(`printf '%s\0' ${TASK_DIR} ${TASK_SETUID} ${TASK_USER_GROUP} ${TASK_BIN} ${TASK_ARGS}`))
+	expected := append([]string{hostileDir, "setuidgid", "user;id", "user;id:group", `/usr/local/bin/a "b"`}, quoteTestArgs...)
+	require.Equal(t, expected, shellWords(t, script))
+}
+
+func TestTemplateEscapeRC(t *testing.T) {
+	d := RCDaemon{
+		Username:   "user;id",
+		serviceBin: "/usr/local/bin/$(id)",
+		Args:       quoteArgs(quoteTestArgs, quoteShellDouble),
+		Dir:        hostileDir,
+	}
+	var script string
+	for _, line := range strings.Split(string(d.rcData()), "\n") {
+		if strings.HasPrefix(line, "daemon") {
+			script += line + "\n"
+		}
+	}
+	script += `eval "printf '%s\0' $daemon"; printf '%s\0' "$daemon_user" "$daemon_execdir"`
+	expected := append(append([]string{"/usr/local/bin/$(id)"}, quoteTestArgs...), "user;id", hostileDir)
+	require.Equal(t, expected, shellWords(t, script))
+}
+
+func TestTemplateEscapeXML(t *testing.T) {
+	task := WindowsTask{
+		Username:   `host\user&<x>`,
+		Uid:        "S-1-5-21",
+		Executable: `C:\bin\a&b.exe`,
+		Args:       quoteArgs([]string{"--say", `<"a" & 'b'>`}, quoteWindows),
+		Dir:        hostileDir,
+		Trigger:    "logon",
+	}
+	data, err := task.xmlData()
+	require.Nil(t, err)
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	values := map[string]string{}
+	var element string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		switch token := token.(type) {
+		case xml.StartElement:
+			element = token.Name.Local
+		case xml.CharData:
+			if strings.TrimSpace(string(token)) != "" {
+				values[element] = string(token)
+			}
+		}
+	}
+	require.Equal(t, task.Executable, values["Command"])
+	require.Equal(t, task.Args, values["Arguments"])
+	require.Equal(t, hostileDir, values["WorkingDirectory"])
+	require.Equal(t, task.Username, values["UserId"])
+}
+
+func TestTemplateEscapeSystemd(t *testing.T) {
+	quoted := systemdQuote("line one\nline two")
+	require.Equal(t, `"line one\nline two"`, quoted)
+	require.NotContains(t, quoted, "\n")
+	d := Systemd{serviceBin: "/usr/local/bin/a b", Dir: "/tmp/run dir"}
+	require.Equal(t, `ExecStart="/usr/local/bin/a b" Environment="HOME=/tmp/run dir"`, string(d.templateData("ExecStart=${TASK_BIN} Environment=${TASK_ENV}")))
+}
+
+func TestSplit(t *testing.T) {
+	lines, err := shellSplit("# comment\ncd /tmp\nexec \\\n    " + quoteArgs(quoteTestArgs, quoteShell) + "\n")
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"cd", "/tmp"}, append([]string{"exec"}, quoteTestArgs...)}, lines)
+
+	lines, err = shellSplit(`daemon="/bin/testd ` + quoteArgs(quoteTestArgs, quoteShellDouble) + `"`)
+	require.Nil(t, err)
+	lines, err = shellSplit(strings.TrimPrefix(lines[0][0], "daemon="))
+	require.Nil(t, err)
+	require.Equal(t, append([]string{"/bin/testd"}, quoteTestArgs...), lines[0])
+
+	args := []string{"--message", "hello world", "--say", `a "b" \c`, "--cost", "$5 100%", "--lines", "one\ntwo"}
+	words, err := systemdSplit(quoteArgs(args, quoteSystemd))
+	require.Nil(t, err)
+	require.Equal(t, args, words)
+
+	args = []string{"--message", "hello world", "--say", `a "b"`, "--dir", `C:\Program Files\`, `C:\bin`, ""}
+	require.Equal(t, args, windowsSplit(quoteArgs(args, quoteWindows)))
+}
+
+func TestParseConfigFormats(t *testing.T) {
+	args := []string{"--message", `<"it's" & $HOME>`, "--logfile", "/var/log/testd"}
+
+	unit := Systemd{Username: "testuser", serviceBin: "/usr/local/bin/testd", Args: quoteArgs(args, quoteSystemd), Dir: "/home/test user"}
+	config, err := parseUnit(string(unit.templateData(unitTemplate)))
+	require.Nil(t, err)
+	require.Equal(t, "testuser", config.User)
+	require.Equal(t, "/usr/local/bin/testd", config.Executable)
+	require.Equal(t, args, config.Args)
+	require.Equal(t, "/home/test user", config.Dir)
+	require.Equal(t, map[string]string{"HOME": "/home/test user"}, config.Env)
+
+	rc := RCDaemon{Username: "testuser", serviceBin: "/usr/local/bin/testd", Args: quoteArgs(args, quoteShellDouble), Dir: hostileDir}
+	config, err = parseRCFile("testd", string(rc.rcData()), "testd_flags=--debug\ntestd_user=other\n")
+	require.Nil(t, err)
+	require.Equal(t, "other", config.User)
+	require.Equal(t, "/usr/local/bin/testd", config.Executable)
+	require.Equal(t, append(args, "--debug"), config.Args)
+	require.Equal(t, hostileDir, config.Dir)
+	require.True(t, config.Enabled)
+	config, err = parseRCFile("testd", string(rc.rcData()), "testd_flags=NO\n")
+	require.Nil(t, err)
+	require.False(t, config.Enabled)
+
+	task := WindowsTask{Uid: "S-1-5-18", Executable: `C:\bin\testd.exe`, Args: quoteArgs(args, quoteWindows), Dir: `C:\Users\test`, Trigger: "boot", StartType: "auto"}
+	xmlData, err := task.xmlData()
+	require.Nil(t, err)
+	config, err = parseTaskXML(xmlData)
+	require.Nil(t, err)
+	require.Equal(t, `NT AUTHORITY\SYSTEM`, config.User)
+	require.Equal(t, task.Executable, config.Executable)
+	require.Equal(t, args, config.Args)
+	require.Equal(t, task.Dir, config.Dir)
+	require.True(t, config.Enabled)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// a file written by Install, at its installed path
+type ConfigFile struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// write the files Install would write to w, each after a header naming its path
+func Render(d CobraDaemon, w io.Writer) error {
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return fatal(err)
+	}
+	for i, file := range files {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "==> %s <==\n", file.Path)
+		_, err = w.Write(file.Data)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
+
+// write the supervisor commands action would run to w, one command line
+// each, quoted for the platform's shell
+func ShowCommands(d CobraDaemon, action string, w io.Writer) error {
+	commands, err := d.Commands(action)
+	if err != nil {
+		return fatal(err)
+	}
+	syntax := quoteShell
+	if runtime.GOOS == "windows" {
+		syntax = quoteWindows
+	}
+	for _, argv := range commands {
+		fmt.Fprintln(w, quoteArgs(argv, syntax))
+	}
+	return nil
+}
+
+// write the files Install would write under dir, at their installed paths
+// relative to dir
+func RenderDir(d CobraDaemon, dir string) error {
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return fatal(err)
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, strings.TrimPrefix(file.Path, filepath.VolumeName(file.Path)))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fatal(err)
+		}
+		err = writeFileAtomic(path, file.Data, file.Mode)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	d, err := NewRunit("testd", testUser(t), root, executable, "--port", "8080")
+	require.Nil(t, err)
+	var out bytes.Buffer
+	require.Nil(t, Render(d, &out))
+	require.Contains(t, out.String(), "==> "+filepath.Join(svRoot, "testd", "run")+" <==\n#!/bin/sh\n")
+	require.Contains(t, out.String(), "==> "+filepath.Join(logRoot, "testd", "config")+" <==\ns10000000\nn10\n")
+
+	staging := t.TempDir()
+	require.Nil(t, RenderDir(d, staging))
+	data, err := os.ReadFile(filepath.Join(staging, svRoot, "testd", "run"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "--port 8080")
+	info, err := os.Stat(filepath.Join(staging, svRoot, "testd", "run"))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	require.NoDirExists(t, filepath.Join(svRoot, "testd"))
+	require.NoFileExists(t, filepath.Join(binRoot, "testd"))
+}
+
+func TestShowCommands(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	show := func(d CobraDaemon, action string) string {
+		var buf bytes.Buffer
+		require.Nil(t, ShowCommands(d, action, &buf))
+		return buf.String()
+	}
+	service := filepath.Join(serviceRoot, "testd")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Equal(t, "svc -u "+service+"/log\nsvc -u "+service+"\n", show(d, "start"))
+	require.Equal(t, "svstat "+service+"\n", show(d, "query"))
+	require.Equal(t, "svc -d "+service+"\nsvc -d "+service+"/log\nsvc -dx "+filepath.Join(svcRoot, "testd")+" "+filepath.Join(svcRoot, "testd", "log")+"\n", show(d, "delete"))
+
+	testConfig(t, "daemon.stop_signal", "INT")
+	d, err = NewRunit("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Equal(t, "sv once "+service+"\nsv interrupt "+service+"\nsv down "+service+"/log\n", show(d, "stop"))
+
+	testConfig(t, "daemon.start_type", "manual")
+	unit, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Equal(t, "systemctl start testd\n", show(unit, "start"))
+	require.Equal(t, "systemctl is-active --quiet testd\n", show(unit, "query"))
+
+	rc, err := NewRCDaemon("testrc", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Equal(t, "rcctl stop testrc\nrcctl disable testrc\n", show(rc, "delete"))
+	_, err = rc.Commands("restart")
+	require.ErrorContains(t, err, "unknown action: restart")
+}
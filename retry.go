@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultRetries = 4
+
+const defaultRetryDelay = 500 * time.Millisecond
+
+// marks a supervisor command failure that may clear when it is retried
+var errTransient = errors.New("transient failure")
+
+// messages printed when a supervisor has not yet picked up a new service,
+// or the task scheduler is busy
+var transientMessages = []string{
+	"supervise not running",
+	"file does not exist",
+	"runsv not running",
+	"supervisor not listening",
+	"being used by another process",
+	"resource temporarily unavailable",
+}
+
+// return true if output reports a failure that may clear on its own
+func transientFailure(output string) bool {
+	output = strings.ToLower(output)
+	for _, message := range transientMessages {
+		if strings.Contains(output, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the number of retries from daemon.retry.count and the initial
+// delay from daemon.retry.delay
+func retryPolicy(settings daemonSettings) (int, time.Duration, error) {
+	count := defaultRetries
+	value := settings.getString("daemon.retry.count")
+	if value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return 0, 0, fatalf("invalid retry.count: %s", value)
+		}
+	}
+	delay := defaultRetryDelay
+	value = settings.getString("daemon.retry.delay")
+	if value != "" {
+		var err error
+		delay, err = time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			return 0, 0, fatalf("invalid retry.delay: %s", value)
+		}
+	}
+	return count, delay, nil
+}
+
+// call fn until it succeeds, fails with an error that is not transient,
+// or has been retried count times, doubling the delay after each retry
+func retry(count int, delay time.Duration, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !errors.Is(err, errTransient) || attempt > count {
+			return err
+		}
+		debugLog("retry", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"github.com/rstms/go-common"
+	"strconv"
+	"strings"
+)
+
+// the daemon.* settings a daemon is created with: the Config of its
+// DaemonSpec, keyed without the daemon. prefix, and the global config for
+// the keys the spec doesn't set; nil reads only the global config. The
+// spec is never copied into the global config, so one spec's settings
+// don't carry over to the next and specs can be created concurrently
+type daemonSettings map[string]string
+
+// return the spec value of key, given with its daemon. prefix
+func (s daemonSettings) lookup(key string) (string, bool) {
+	value, ok := s[strings.TrimPrefix(key, "daemon.")]
+	return value, ok
+}
+
+func (s daemonSettings) get(key string) any {
+	if value, ok := s.lookup(key); ok {
+		return value
+	}
+	return common.ViperGet(key)
+}
+
+func (s daemonSettings) getString(key string) string {
+	if value, ok := s.lookup(key); ok {
+		return value
+	}
+	return common.ViperGetString(key)
+}
+
+// an invalid spec value reads as false, as it does in the global config
+func (s daemonSettings) getBool(key string) bool {
+	if value, ok := s.lookup(key); ok {
+		enabled, _ := strconv.ParseBool(value)
+		return enabled
+	}
+	return common.ViperGetBool(key)
+}
+
+// an invalid spec value reads as 0, as it does in the global config
+func (s daemonSettings) getInt(key string) int {
+	if value, ok := s.lookup(key); ok {
+		n, _ := strconv.Atoi(strings.TrimSpace(value))
+		return n
+	}
+	return common.ViperGetInt(key)
+}
+
+// a spec value is split on white space
+func (s daemonSettings) getStringSlice(key string) []string {
+	if value, ok := s.lookup(key); ok {
+		return strings.Fields(value)
+	}
+	return common.ViperGetStringSlice(key)
+}
+
+// return the settings d was created with; the daemon of a registered
+// backend reads only the global config
+func settingsOf(d CobraDaemon) daemonSettings {
+	if s, ok := d.(interface{ specSettings() daemonSettings }); ok {
+		return s.specSettings()
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// the comment text in each generated config that records the sha256 of the
+// rest of the file, so the installed config can be checked against the one
+// Install would write now without parsing it
+const specMarker = "cobra-daemon-spec: "
+
+// return the hex sha256 of data with any spec marker line left out
+func specHash(data []byte) string {
+	lines := []string{}
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if _, ok := specValue(line); !ok {
+			lines = append(lines, line)
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// return the hash recorded by a spec marker line, as a shell or xml comment
+func specValue(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if value, ok := strings.CutPrefix(line, "# "+specMarker); ok {
+		return value, true
+	}
+	if value, ok := strings.CutPrefix(line, "<!-- "+specMarker); ok {
+		return strings.TrimSuffix(value, " -->"), true
+	}
+	return "", false
+}
+
+// add a spec marker line as a shell comment, after generatedMarker or the
+// #! line when data has one, or first
+func stampSpec(data []byte) []byte {
+	marker := "# " + specMarker + specHash(data) + "\n"
+	text := string(data)
+	index := strings.Index(text, generatedMarker+"\n")
+	switch {
+	case index >= 0:
+		index += len(generatedMarker) + 1
+	case strings.HasPrefix(text, "#!"):
+		index = strings.Index(text, "\n") + 1
+		if index == 0 {
+			text += "\n"
+			index = len(text)
+		}
+	default:
+		index = 0
+	}
+	return []byte(text[:index] + marker + text[index:])
+}
+
+// add a spec marker line as an xml comment, after the xml declaration
+func stampSpecXML(data string) string {
+	marker := "<!-- " + specMarker + specHash([]byte(data)) + " -->\n"
+	index := 0
+	if strings.HasPrefix(data, "<?xml") {
+		index = strings.Index(data, "\n") + 1
+		if index == 0 {
+			data += "\n"
+			index = len(data)
+		}
+	}
+	return data[:index] + marker + data[index:]
+}
+
+// return the spec hash recorded in the installed config file; the windows
+// backends keep no config file and return ErrNotSupported, and a config
+// installed without a marker returns an empty hash
+func ConfigHash(d CobraDaemon) (string, error) {
+	path, ok := d.Paths()["config"]
+	if !ok {
+		return "", fatalf("%w: no config file to hash", ErrNotSupported)
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fatalf("%w: %s", ErrNotInstalled, path)
+	}
+	if err != nil {
+		return "", fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := specValue(line); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// return the spec hash of the config file Install would write now
+func SpecHash(d CobraDaemon) (string, error) {
+	path, ok := d.Paths()["config"]
+	if !ok {
+		return "", fatalf("%w: no config file to hash", ErrNotSupported)
+	}
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return "", fatal(err)
+	}
+	for _, file := range files {
+		if file.Path == path {
+			return specHash(file.Data), nil
+		}
+	}
+	return "", fatalf("config file not rendered: %s", path)
+}
+
+// report whether the installed config records spec, the hash SpecHash
+// returns; an empty spec is compared with the current SpecHash of d
+func IsCurrent(d CobraDaemon, spec string) (bool, error) {
+	if spec == "" {
+		hash, err := SpecHash(d)
+		if err != nil {
+			return false, fatal(err)
+		}
+		spec = hash
+	}
+	installed, err := ConfigHash(d)
+	if err != nil {
+		return false, fatal(err)
+	}
+	return installed != "" && strings.EqualFold(installed, spec), nil
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpecHash(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+
+	data := []byte("#!/bin/sh\nexec true\n")
+	stamped := stampSpec(data)
+	require.Equal(t, "#!/bin/sh\n# "+specMarker+specHash(data)+"\nexec true\n", string(stamped))
+	require.Equal(t, specHash(data), specHash(stamped))
+	require.True(t, strings.HasPrefix(string(stampSpec([]byte("[Unit]\n"))), "# "+specMarker))
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable, "serve")
+	require.Nil(t, err)
+	_, err = ConfigHash(d)
+	require.ErrorIs(t, err, ErrNotInstalled)
+	require.Nil(t, d.Install())
+	spec, err := SpecHash(d)
+	require.Nil(t, err)
+	installed, err := ConfigHash(d)
+	require.Nil(t, err)
+	require.Equal(t, spec, installed)
+	current, err := IsCurrent(d, "")
+	require.Nil(t, err)
+	require.True(t, current)
+	current, err = IsCurrent(d, strings.ToUpper(spec))
+	require.Nil(t, err)
+	require.True(t, current)
+
+	changed, err := NewDaemontools("testd", testUser(t), root, executable, "serve", "--debug")
+	require.Nil(t, err)
+	current, err = IsCurrent(changed, "")
+	require.Nil(t, err)
+	require.False(t, current)
+
+	run := filepath.Join(svcRoot, "testd", "run")
+	script, err := os.ReadFile(run)
+	require.Nil(t, err)
+	require.Contains(t, string(script), generatedMarker+"\n# "+specMarker+spec+"\n")
+	require.Nil(t, os.WriteFile(run, []byte(strings.Replace(string(script), "# "+specMarker+spec+"\n", "", 1)), 0700))
+	installed, err = ConfigHash(d)
+	require.Nil(t, err)
+	require.Equal(t, "", installed)
+	current, err = IsCurrent(d, spec)
+	require.Nil(t, err)
+	require.False(t, current)
+
+	principal, _ := windowsPrincipal("LocalSystem")
+	t.Setenv("SystemRoot", root)
+	task, err := NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	xmlData, err := task.(*WindowsTask).xmlData()
+	require.Nil(t, err)
+	lines := strings.SplitN(xmlData, "\n", 3)
+	require.True(t, strings.HasPrefix(lines[0], "<?xml"))
+	require.Equal(t, "<!-- "+specMarker+specHash([]byte(xmlData))+" -->", lines[1])
+	_, err = ConfigHash(task)
+	require.ErrorIs(t, err, ErrNotSupported)
+}
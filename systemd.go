@@ -0,0 +1,1150 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"github.com/rstms/cobra-daemon/common"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed template/systemd_unit
+var unitTemplate string
+
+type Systemd struct {
+	Name           string
+	Username       string
+	Uid            string
+	Gid            string
+	Group          string
+	Groups         []string
+	Executable     string
+	Args           string
+	Dir            string
+	LogFile        string
+	ErrorLog       string
+	Stdin          string
+	PidFile        string
+	Umask          string
+	StopTimeout    time.Duration
+	StopSignal     string
+	CommandTimeout time.Duration
+	Env            map[string]string
+	Wrapper        bool
+	Nice           string
+	IOClass        string
+	IOLevel        string
+	CPUAffinity    string
+	MemoryLimit    int64
+	NofileLimit    int
+	Sandbox        []string
+	ChownBinary    bool
+	Force          bool
+	StartType      string
+	Type           string
+	After          []string
+	Requires       []string
+	PreStart       string
+	PostStop       string
+	ExtraConfig    string
+	Scope          string
+	unitFile       string
+	serviceBin     string
+	wrapperFile    string
+	customUnit     string
+	settings       daemonSettings
+}
+
+// return the daemon.systemd.scope, its unit directory, and where its units'
+// binaries are installed; the scope defaults to user when not run as root
+func systemdScope(settings daemonSettings) (string, string, string, error) {
+	scope := settings.getString("daemon.systemd.scope")
+	if scope == "" {
+		scope = "user"
+		if os.Geteuid() == 0 {
+			scope = "system"
+		}
+	}
+	switch scope {
+	case "system":
+		return scope, systemdRoot, binRoot, nil
+	case "user":
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", "", "", fatal(err)
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", "", fatal(err)
+		}
+		return scope, filepath.Join(configDir, "systemd", "user"), filepath.Join(home, ".local", "bin"), nil
+	}
+	return "", "", "", fatalf("unsupported systemd scope: %s", scope)
+}
+
+// the positional form of NewSystemdFromSpec, kept for compatibility
+func NewSystemd(name string, serviceUser *user.User, runDir string, command string, args ...string) (CobraDaemon, error) {
+	return NewSystemdFromSpec(DaemonSpec{Name: name, Dir: runDir, Executable: command, Args: args}, serviceUser)
+}
+
+func NewSystemdFromSpec(spec DaemonSpec, serviceUser *user.User) (CobraDaemon, error) {
+	settings := daemonSettings(spec.Config)
+	name, runDir, command := spec.Name, spec.Dir, spec.Executable
+	args := append([]string{}, spec.Args...)
+
+	// the journal collects stdout unless daemon.logfile is set
+	logFile, err := logPath(settings, "")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logFlags, err := logArgs(settings, logFile)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	args = append(args, logFlags...)
+	timeout, err := stopTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	signal, err := stopSignal(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	cmdTimeout, err := commandTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	group, _, err := userGroup(serviceUser)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	supplementary, err := supplementaryGroups(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	groups := []string{}
+	for _, g := range supplementary {
+		groups = append(groups, g.Name)
+	}
+	// unit directive values end at a newline and can't be quoted
+	for _, value := range []string{name, serviceUser.Username, group, runDir} {
+		if strings.ContainsAny(value, "\n\r") {
+			return nil, fatalf("invalid newline in unit value: %q", value)
+		}
+	}
+	env, err := daemonEnv(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	nice, err := niceness(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	ioClass, ioLevel, err := ioScheduling(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	cpus, err := cpuAffinity(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	memoryLimit, nofileLimit, err := resourceLimits(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	mask, err := umask(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	directives, err := sandbox(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	after, requires, err := dependencies(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	prestart, poststop, err := hooks(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	extra, err := extraConfig(settings, "[")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	scope, unitDir, binDir, err := systemdScope(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	serviceBin, err := serviceBinary(settings, binDir, command)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	chown, err := chownBinary(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	pidfile, err := pidFile(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	start, err := startType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	kind, err := daemonType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	custom, err := customTemplate(settings, "systemd_unit")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// a user manager runs its units as the user running systemctl --user
+	if scope == "user" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		if serviceUser.Uid != current.Uid || serviceUser.Gid != current.Gid {
+			return nil, fatalf("%w: user scope units run as %s", ErrNotSupported, current.Username)
+		}
+		if len(groups) > 0 {
+			return nil, fatalf("%w: user scope units run with the groups of %s", ErrNotSupported, current.Username)
+		}
+	}
+	// split logs send stderr to a file, next to daemon.logfile when set
+	stdin, err := daemonStdin(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	split, err := splitLogs(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	errorLog := ""
+	switch {
+	case split && logFile != "":
+		errorLog = logFile + ".stderr"
+	case split && scope == "user":
+		return nil, fatalf("%w: split logs of user scope units without daemon.logfile", ErrNotSupported)
+	case split:
+		errorLog = filepath.Join(logRoot, name+".stderr")
+	}
+	d := Systemd{
+		Name:           name,
+		Username:       serviceUser.Username,
+		Uid:            serviceUser.Uid,
+		Gid:            serviceUser.Gid,
+		Group:          group,
+		Groups:         groups,
+		Executable:     command,
+		Args:           quoteArgs(args, quoteSystemd),
+		Dir:            runDir,
+		LogFile:        logFile,
+		ErrorLog:       errorLog,
+		Stdin:          stdin,
+		PidFile:        pidfile,
+		Umask:          mask,
+		StopTimeout:    timeout,
+		StopSignal:     signal,
+		CommandTimeout: cmdTimeout,
+		Env:            env,
+		Wrapper:        settings.getBool("daemon.wrapper"),
+		Nice:           nice,
+		IOClass:        ioClass,
+		IOLevel:        ioLevel,
+		CPUAffinity:    cpus,
+		MemoryLimit:    memoryLimit,
+		NofileLimit:    nofileLimit,
+		Sandbox:        directives,
+		ChownBinary:    chown,
+		Force:          common.ViperGetBool("force"),
+		StartType:      start,
+		Type:           kind,
+		After:          after,
+		Requires:       requires,
+		PreStart:       prestart,
+		PostStop:       poststop,
+		ExtraConfig:    extra,
+		Scope:          scope,
+		unitFile:       filepath.Join(unitDir, name+".service"),
+		serviceBin:     serviceBin,
+		wrapperFile:    filepath.Join(binDir, name+"-wrapper"),
+		customUnit:     custom,
+		settings:       settings,
+	}
+	return &d, nil
+}
+
+func (d *Systemd) template() string {
+	if d.customUnit != "" {
+		return d.customUnit
+	}
+	return unitTemplate
+}
+
+func (d *Systemd) templateData(template string) []byte {
+	data := os.Expand(template, func(key string) string {
+		switch key {
+		case "TASK_NAME":
+			return d.Name
+		case "TASK_CREDENTIALS":
+			// a user manager can't change credentials, so User= and Group= are omitted
+			if d.Scope == "user" {
+				return ""
+			}
+			credentials := "User=" + d.Username + "\nGroup=" + d.Group + "\n"
+			if len(d.Groups) > 0 {
+				credentials += "SupplementaryGroups=" + strings.Join(d.Groups, " ") + "\n"
+			}
+			return credentials
+		case "TASK_WANTED_BY":
+			if d.Scope == "user" {
+				return "default.target"
+			}
+			return "multi-user.target"
+		case "TASK_UID":
+			return d.Uid
+		case "TASK_BIN":
+			if d.Wrapper {
+				return systemdQuote(d.wrapperFile)
+			}
+			return systemdQuote(d.serviceBin)
+		case "TASK_ARGS":
+			return d.Args
+		case "TASK_DIR":
+			return d.Dir
+		case "TASK_ENV":
+			words := []string{systemdQuote("HOME=" + d.Dir)}
+			for _, key := range sortedKeys(d.Env) {
+				words = append(words, systemdQuote(key+"="+d.Env[key]))
+			}
+			return strings.Join(words, " ")
+		case "TASK_UMASK":
+			if d.Umask == "" {
+				return ""
+			}
+			return "UMask=" + d.Umask + "\n"
+		case "TASK_PRESTART":
+			// the + prefix runs the hook as root rather than as User=
+			if d.PreStart == "" {
+				return ""
+			}
+			return "ExecStartPre=+" + quoteArgs([]string{"/bin/sh", "-c", d.PreStart}, quoteSystemd) + "\n"
+		case "TASK_PIDFILE":
+			// systemd sets MAINPID for ExecStartPost
+			if d.PidFile == "" {
+				return ""
+			}
+			return "\nExecStartPost=+" + quoteArgs([]string{"/bin/sh", "-c", "echo $MAINPID > " + shellQuote(d.PidFile)}, quoteSystemd) +
+				"\nExecStopPost=+" + quoteArgs([]string{"/bin/rm", "-f", d.PidFile}, quoteSystemd)
+		case "TASK_POSTSTOP":
+			if d.PostStop == "" {
+				return ""
+			}
+			return "\nExecStopPost=+" + quoteArgs([]string{"/bin/sh", "-c", d.PostStop}, quoteSystemd)
+		case "TASK_RESTART":
+			// a oneshot unit runs once each time it is started
+			if d.oneshot() {
+				return "Type=oneshot"
+			}
+			return "Restart=always"
+		case "TASK_STOP_TIMEOUT":
+			return strconv.Itoa(int(d.StopTimeout.Seconds()))
+		case "TASK_KILL_SIGNAL":
+			// systemd sends SIGKILL when the unit outlives TimeoutStopSec
+			if d.StopSignal == "" || d.StopSignal == "TERM" {
+				return ""
+			}
+			return "\nKillSignal=SIG" + d.StopSignal
+		case "TASK_PRIORITY":
+			// optional directives, each on its own line after the preceding one
+			directives := ""
+			if d.Nice != "" {
+				directives += "\nNice=" + d.Nice
+			}
+			if d.IOClass != "" {
+				directives += "\nIOSchedulingClass=" + d.IOClass
+			}
+			if d.IOLevel != "" {
+				directives += "\nIOSchedulingPriority=" + d.IOLevel
+			}
+			if d.CPUAffinity != "" {
+				directives += "\nCPUAffinity=" + d.CPUAffinity
+			}
+			return directives
+		case "TASK_AFTER":
+			// required units are ordered after as well, as Requires= alone starts them in parallel
+			units := ""
+			for _, name := range append(append([]string{}, d.After...), d.Requires...) {
+				units += " " + unitName(name)
+			}
+			return units
+		case "TASK_REQUIRES":
+			if len(d.Requires) == 0 {
+				return ""
+			}
+			units := []string{}
+			for _, name := range d.Requires {
+				units = append(units, unitName(name))
+			}
+			return "\nRequires=" + strings.Join(units, " ")
+		case "TASK_LIMITS":
+			directives := ""
+			if d.MemoryLimit > 0 {
+				directives += "\nMemoryMax=" + strconv.FormatInt(d.MemoryLimit, 10)
+			}
+			if d.NofileLimit > 0 {
+				directives += "\nLimitNOFILE=" + strconv.Itoa(d.NofileLimit)
+			}
+			return directives
+		case "TASK_SANDBOX":
+			directives := ""
+			for _, directive := range d.Sandbox {
+				directives += "\n" + directive
+			}
+			return directives
+		case "TASK_EXTRA":
+			if d.ExtraConfig == "" {
+				return ""
+			}
+			return "\n" + strings.TrimSuffix(d.ExtraConfig, "\n")
+		case "TASK_STDIN":
+			// the service manager has no stdin to inherit, and gives the
+			// unit /dev/null without StandardInput=
+			switch d.Stdin {
+			case "":
+				return ""
+			case os.DevNull:
+				return "\nStandardInput=null"
+			}
+			return "\nStandardInput=file:" + d.Stdin
+		case "TASK_STDERR":
+			if d.ErrorLog == "" {
+				return ""
+			}
+			return "\nStandardError=append:" + d.ErrorLog
+		}
+		return "${" + key + "}"
+	})
+	return []byte(data)
+}
+
+// map a daemon name to its unit, leaving names with a unit suffix unchanged
+func unitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// run systemctl for the unit's scope
+func (d *Systemd) run(timeout time.Duration, args ...string) (string, string, int, error) {
+	argv := d.argv(args...)
+	return runTimeout(timeout, argv[0], argv[1:]...)
+}
+
+// the systemctl command line for the unit's scope
+func (d *Systemd) argv(args ...string) []string {
+	if d.Scope == "user" {
+		args = append([]string{"--user"}, args...)
+	}
+	return append([]string{"systemctl"}, args...)
+}
+
+// the systemctl commands run by start, stop, query, or delete
+func (d *Systemd) Commands(action string) ([][]string, error) {
+	switch action {
+	case "start":
+		start := d.argv(d.startArgs()...)
+		if d.StartType == "manual" {
+			return [][]string{start}, nil
+		}
+		return [][]string{d.argv("enable", d.Name), start}, nil
+	case "stop":
+		return [][]string{d.argv("stop", d.Name)}, nil
+	case "query":
+		if d.oneshot() {
+			return [][]string{d.argv(d.resultArgs()...)}, nil
+		}
+		return [][]string{d.argv("is-active", "--quiet", d.Name)}, nil
+	case "delete":
+		return [][]string{d.argv("stop", d.Name), d.argv("disable", d.Name), d.argv("daemon-reload")}, nil
+	}
+	return nil, fatalf("unknown action: %s", action)
+}
+
+// a oneshot unit runs once each time it is started, and stays inactive
+// once its command exits
+func (d *Systemd) oneshot() bool {
+	return d.Type == "oneshot"
+}
+
+// systemctl start waits for a oneshot unit's command to exit, so it is
+// queued with --no-block
+func (d *Systemd) startArgs() []string {
+	if d.oneshot() {
+		return []string{"start", "--no-block", d.Name}
+	}
+	return []string{"start", d.Name}
+}
+
+// the systemctl show command reporting the result of the last run
+func (d *Systemd) resultArgs() []string {
+	return []string{"show", "--property", "Result,ExecMainStatus,ExecMainExitTimestampMonotonic", d.Name}
+}
+
+// start and stop wait for the unit, so they are allowed the stop timeout as well
+func (d *Systemd) systemctl(args ...string) error {
+	stdout, stderr, _, err := d.run(d.CommandTimeout+d.StopTimeout, args...)
+	printOutput(stdout, stderr)
+	return err
+}
+
+func (d *Systemd) installed() bool {
+	_, err := os.Stat(d.unitFile)
+	return err == nil
+}
+
+// system units need root; user units are written to the user's own config
+func (d *Systemd) checkPrivileges(action string) error {
+	if d.Scope == "user" {
+		return nil
+	}
+	return checkPrivileges(action, d.unitFile)
+}
+
+func (d *Systemd) Install() error {
+	err := d.checkPrivileges("install")
+	if err != nil {
+		return fatal(err)
+	}
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	err = checkInstallTarget(d.unitFile, d.Force)
+	if err != nil {
+		return fatal(err)
+	}
+	err = checkDependencies(append(d.After, d.Requires...), func(name string) bool {
+		_, _, _, err := d.run(d.CommandTimeout, "cat", unitName(name))
+		return err == nil
+	})
+	if err != nil {
+		return fatal(err)
+	}
+	err = createRunDir(d.Dir, d.Uid, d.Gid)
+	if err != nil {
+		return fatal(err)
+	}
+	for _, logFile := range []string{d.LogFile, d.ErrorLog} {
+		if logFile == "" {
+			continue
+		}
+		err = createOwnedDirs(filepath.Dir(logFile), d.Uid, d.Gid)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	// user scope directories may not exist yet
+	for _, dir := range []string{filepath.Dir(d.serviceBin), filepath.Dir(d.unitFile)} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	err = copyBinary(d.Executable, d.serviceBin, owner, group)
+	if err != nil {
+		return fatal(err)
+	}
+	if d.Wrapper {
+		err = writeWrapper(d.wrapperFile, shellWrapper(d.Dir, d.serviceBin, d.Env))
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	err = writeFileAtomic(d.unitFile, stampSpec(d.templateData(d.template())), 0644)
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.systemctl("daemon-reload")
+	if err != nil {
+		return fatal(err)
+	}
+	if d.StartType == "auto" {
+		err = d.systemctl("enable", d.Name)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return nil
+}
+
+func (d *Systemd) ConfigFiles() ([]ConfigFile, error) {
+	files := []ConfigFile{{d.unitFile, 0644, stampSpec(d.templateData(d.template()))}}
+	if d.Wrapper {
+		files = append(files, ConfigFile{d.wrapperFile, 0755, shellWrapper(d.Dir, d.serviceBin, d.Env)})
+	}
+	return files, nil
+}
+
+func (d *Systemd) binaries() (string, string) {
+	return d.Executable, d.serviceBin
+}
+
+func (d *Systemd) updateBinary() error {
+	owner, group := "", ""
+	if d.ChownBinary {
+		owner, group = d.Uid, d.Gid
+	}
+	return copyBinary(d.Executable, d.serviceBin, owner, group)
+}
+
+// rewrite the unit and wrapper, and have systemd reload a changed unit
+func (d *Systemd) rewriteConfig() (bool, error) {
+	files, err := d.ConfigFiles()
+	if err != nil {
+		return false, fatal(err)
+	}
+	changed, err := rewriteFiles(files)
+	if err != nil {
+		return false, fatal(err)
+	}
+	if changed {
+		err = d.systemctl("daemon-reload")
+		if err != nil {
+			return false, fatal(err)
+		}
+	}
+	return changed, nil
+}
+
+func (d *Systemd) Delete() error {
+	unlock, err := lockDaemon(d, d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	err = d.checkPrivileges("delete")
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.Stop()
+	if err != nil {
+		if !d.Force {
+			return fatal(err)
+		}
+		forceWarning(d.Name, err)
+		err = d.systemctl("kill", "-s", "KILL", d.Name)
+		if err != nil {
+			forceWarning(d.Name, err)
+		}
+	}
+	err = d.systemctl("disable", d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	err = os.Remove(d.unitFile)
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("remove", "path", d.unitFile)
+	err = removePidFile(d.PidFile)
+	if err != nil {
+		return fatal(err)
+	}
+	err = removeWrapper(d.wrapperFile)
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.systemctl("daemon-reload")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+func (d *Systemd) Enable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	err := d.systemctl("enable", d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a disabled unit is not started at boot; it can still be started
+func (d *Systemd) Disable() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	err := d.systemctl("disable", d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a running unit is left alone
+func (d *Systemd) Start() error {
+	running, err := d.active()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		debugLog("already running", "name", d.Name)
+		return nil
+	}
+	err = checkStartType(d.Name, d.StartType)
+	if err != nil {
+		return fatal(err)
+	}
+	if d.StartType != "manual" {
+		err = d.Enable()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	err = d.systemctl(d.startArgs()...)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// systemctl stop blocks until the unit is down, sending SIGKILL itself
+// once the TimeoutStopSec rendered from the stop timeout has elapsed
+func (d *Systemd) Stop() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	err := d.systemctl("stop", d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	running, err := d.active()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		return fatalf("%s still running after systemctl stop", d.Name)
+	}
+	return nil
+}
+
+func (d *Systemd) Restart() error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	err := d.systemctl("restart", d.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// the journal or the unit's log file collects output, with no log service
+var systemdCapabilities = DaemonCapabilities{
+	Pid:          true,
+	PidFile:      true,
+	StopSignal:   true,
+	Dependencies: true,
+	Sandbox:      true,
+	Oneshot:      true,
+}
+
+func (d *Systemd) Capabilities() DaemonCapabilities {
+	return systemdCapabilities
+}
+
+// the settings the unit was created with
+func (d *Systemd) specSettings() daemonSettings {
+	return d.settings
+}
+
+// delete the unit and remove its log file and copied binary
+func (d *Systemd) Purge() error {
+	return purge(d, d.Executable, d.serviceBin, filepath.Join(filepath.Dir(d.unitFile), "*.service"))
+}
+
+// return daemon.logfile, the log file the daemon writes; without one the
+// journal collects its output and there is no path
+func (d *Systemd) LogPath() (string, error) {
+	if d.LogFile == "" {
+		return "", fatalf("%w: %s logs to the journal; use journalctl -u %s", ErrNotSupported, d.Name, unitName(d.Name))
+	}
+	return d.LogFile, nil
+}
+
+// return the installed locations; log is absent when the journal collects output
+func (d *Systemd) Paths() map[string]string {
+	paths := map[string]string{
+		"binary": d.serviceBin,
+		"config": d.unitFile,
+		"dir":    d.Dir,
+	}
+	if d.LogFile != "" {
+		paths["log"] = d.LogFile
+	}
+	if d.ErrorLog != "" {
+		paths["stderr"] = d.ErrorLog
+	}
+	if d.Wrapper {
+		paths["wrapper"] = d.wrapperFile
+	}
+	if d.PidFile != "" {
+		paths["pidfile"] = d.PidFile
+	}
+	return paths
+}
+
+func (d *Systemd) GetConfig() (string, error) {
+	if !d.installed() {
+		return "", fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	data, err := os.ReadFile(d.unitFile)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return string(data), nil
+}
+
+func (d *Systemd) GetDaemonConfig() (*DaemonConfig, error) {
+	unit, err := d.GetConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config, err := parseUnit(unit)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config.Name = d.Name
+	if d.Scope == "user" {
+		config.User = d.Username
+	}
+	_, _, _, err = d.run(d.CommandTimeout, "is-enabled", "--quiet", d.Name)
+	config.Enabled = err == nil
+	return config, nil
+}
+
+func (d *Systemd) DesiredConfig() (*DaemonConfig, error) {
+	config, err := parseUnit(string(d.templateData(d.template())))
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config.Name = d.Name
+	if d.Scope == "user" {
+		config.User = d.Username
+	}
+	return config, nil
+}
+
+// parse the [Service] directives of a unit file in the form written by Install
+func parseUnit(unit string) (*DaemonConfig, error) {
+	config := DaemonConfig{Env: make(map[string]string)}
+	for _, line := range strings.Split(unit, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "User":
+			config.User = value
+		case "WorkingDirectory":
+			config.Dir = value
+		case "Environment":
+			words, err := systemdSplit(value)
+			if err != nil {
+				return nil, fatal(err)
+			}
+			for _, word := range words {
+				name, setting, _ := strings.Cut(word, "=")
+				config.Env[name] = setting
+			}
+		case "ExecStart":
+			words, err := systemdSplit(value)
+			if err != nil {
+				return nil, fatal(err)
+			}
+			if len(words) == 0 {
+				return nil, fatalf("empty ExecStart")
+			}
+			config.Executable = words[0]
+			config.Args = words[1:]
+		}
+	}
+	if config.Executable == "" {
+		return nil, fatalf("no ExecStart in unit")
+	}
+	return &config, nil
+}
+
+func (d *Systemd) SetConfig(config string) error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	err := checkConfig(config)
+	if err != nil {
+		return fatal(err)
+	}
+	err = writeFileAtomic(d.unitFile, []byte(config), 0644)
+	if err != nil {
+		return fatal(err)
+	}
+	err = d.systemctl("daemon-reload")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// report whether the unit is active, or for a oneshot whether its last
+// run exited 0
+func (d *Systemd) Query() (bool, error) {
+	if !d.oneshot() {
+		return d.active()
+	}
+	if !d.installed() {
+		return false, fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	stdout, _, _, err := d.run(d.CommandTimeout, d.resultArgs()...)
+	if err != nil {
+		return false, fatal(err)
+	}
+	properties := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			properties[key] = value
+		}
+	}
+	// the exit timestamp is 0 until the command has run
+	ran := properties["ExecMainExitTimestampMonotonic"] != "" && properties["ExecMainExitTimestampMonotonic"] != "0"
+	return ran && properties["Result"] == "success" && properties["ExecMainStatus"] == "0", nil
+}
+
+// wait up to timeout for systemd to load the unit; Install and Delete run
+// daemon-reload before returning, so Start has no need to wait
+func (d *Systemd) waitSupervised(ctx context.Context, timeout time.Duration) error {
+	if !d.installed() {
+		return fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	state := ""
+	deadline := time.Now().Add(timeout)
+	for {
+		stdout, _, _, err := d.run(d.CommandTimeout, "show", "--property", "LoadState", "--value", d.Name)
+		if err != nil {
+			return fatal(err)
+		}
+		state = strings.TrimSpace(stdout)
+		if state == "loaded" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		err = sleepContext(ctx, pollInterval)
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	return fatalf("%w: %s is %s after %s; run systemctl daemon-reload", ErrSupervisorUnavailable, unitName(d.Name), state, timeout)
+}
+
+// a unit whose process exited with an error is failed, or activating in
+// auto-restart while Restart= waits to start it again
+func (d *Systemd) Status() (DaemonState, error) {
+	if !d.installed() {
+		return "", fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	stdout, _, _, err := d.run(d.CommandTimeout, "show", "--property", "ActiveState,SubState", d.Name)
+	if err != nil {
+		return "", fatal(err)
+	}
+	state, err := parseSystemdState(stdout)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return state, nil
+}
+
+// parse the ActiveState and SubState properties of systemctl show
+func parseSystemdState(output string) (DaemonState, error) {
+	properties := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			properties[key] = value
+		}
+	}
+	active, sub := properties["ActiveState"], properties["SubState"]
+	switch {
+	case active == "failed" || sub == "auto-restart":
+		return StateFailed, nil
+	case active == "inactive":
+		return StateStopped, nil
+	case active == "active" || active == "activating" || active == "deactivating" || active == "reloading" || active == "refreshing":
+		return StateRunning, nil
+	}
+	return "", fatalf("unexpected systemctl show output: %s", strings.TrimSpace(output))
+}
+
+// report whether the unit is active
+func (d *Systemd) active() (bool, error) {
+	if !d.installed() {
+		return false, fatalf("%w: %s", ErrNotInstalled, d.unitFile)
+	}
+	_, _, code, err := d.run(d.CommandTimeout, "is-active", "--quiet", d.Name)
+	if err != nil && !exitFailure(err) {
+		return false, fatal(err)
+	}
+	return code == 0, nil
+}
+
+// return the pid of the running daemon, or 0 if it is not running
+func (d *Systemd) Pid() (int, error) {
+	running, err := d.active()
+	if err != nil {
+		return 0, fatal(err)
+	}
+	if !running {
+		return 0, nil
+	}
+	if d.PidFile != "" {
+		pid, err := readPidFile(d.PidFile)
+		if err != nil {
+			return 0, fatal(err)
+		}
+		if pid != 0 {
+			return pid, nil
+		}
+	}
+	stdout, _, _, err := d.run(d.CommandTimeout, "show", "--property", "MainPID", "--value", d.Name)
+	if err != nil {
+		return 0, fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout))
+	if err != nil {
+		return 0, fatalf("unexpected MainPID: %s", strings.TrimSpace(stdout))
+	}
+	return pid, nil
+}
+
+func (d *Systemd) tools() (string, []string) {
+	return "systemd", []string{"systemctl"}
+}
+
+func (d *Systemd) Validate() error {
+	// a user manager runs ExecStartPost as the user rather than root
+	pidUid, pidGid := "0", "0"
+	if d.Scope == "user" {
+		pidUid, pidGid = d.Uid, d.Gid
+	}
+	return errors.Join(
+		checkTools(d.tools()),
+		checkExecutable(d.Executable),
+		checkRunDir(d.settings, d.Dir, d.Uid, d.Gid),
+		checkPidDir(d.PidFile, pidUid, pidGid),
+	)
+}
+
+// return a unit that can only inspect the installed unit of name, in the
+// scope selected for this user; a oneshot is queried as a daemon
+func systemdByName(name string) (CobraDaemon, error) {
+	scope, unitDir, _, err := systemdScope(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return &Systemd{Name: name, CommandTimeout: timeout, Scope: scope, unitFile: filepath.Join(unitDir, name+".service")}, nil
+}
+
+func listSystemd() ([]DaemonInfo, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	scope, unitDir, binDir, err := systemdScope(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	serviceBin, err := serviceBinary(nil, binDir, executable)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	marker := "ExecStart=" + serviceBin
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	list := []DaemonInfo{}
+	entries, err := os.ReadDir(unitDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+		return nil, fatal(err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".service")
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(unitDir, entry.Name()))
+		if err != nil {
+			return nil, fatal(err)
+		}
+		if !strings.Contains(string(data), marker+" ") && !strings.Contains(string(data), marker+"\n") {
+			continue
+		}
+		d := Systemd{Name: name, CommandTimeout: timeout, Scope: scope, unitFile: filepath.Join(unitDir, entry.Name())}
+		running, err := d.Query()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		list = append(list, DaemonInfo{Name: name, Running: running})
+	}
+	return list, nil
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestSystemdUserScope(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "systemctl", `echo "$@" >> $FAKE_STATE/systemctl.log; [ "$2" != is-active ]`)
+	testConfig(t, "daemon.systemd.scope", "user")
+	u, err := user.Current()
+	require.Nil(t, err)
+
+	d, err := NewSystemd("testd", u, root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	require.Nil(t, d.Start())
+	unitFile := filepath.Join(home, ".config", "systemd", "user", "testd.service")
+	data, err := os.ReadFile(unitFile)
+	require.Nil(t, err)
+	require.NotContains(t, string(data), "User=")
+	require.Contains(t, string(data), "\nExecStart="+filepath.Join(home, ".local", "bin", "testd")+" -L-\n")
+	require.Contains(t, string(data), "\nWantedBy=default.target\n")
+	require.FileExists(t, filepath.Join(home, ".local", "bin", "testd"))
+	log, err := os.ReadFile(filepath.Join(state, "systemctl.log"))
+	require.Nil(t, err)
+	require.Equal(t, "--user daemon-reload\n--user is-active --quiet testd\n--user enable testd\n--user start testd\n", string(log))
+	config, err := d.DesiredConfig()
+	require.Nil(t, err)
+	require.Equal(t, u.Username, config.User)
+
+	testConfig(t, "daemon.systemd.scope", "system")
+	d, err = NewSystemd("testd", u, root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(d.(*Systemd).templateData(unitTemplate)), "\nUser="+u.Username+"\n")
+
+	testConfig(t, "daemon.systemd.scope", "session")
+	_, err = NewSystemd("testd", u, root, executable)
+	require.ErrorContains(t, err, "unsupported systemd scope")
+}
+
+func TestSystemdSupplementaryGroups(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	groups := testGroups(t)
+
+	testConfig(t, "daemon.supplementary_groups", []string{groups[0].Name, groups[1].Name})
+	testConfig(t, "daemon.systemd.scope", "system")
+	d, err := NewSystemd("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Contains(t, string(d.(*Systemd).templateData(unitTemplate)), "\nSupplementaryGroups="+groups[0].Name+" "+groups[1].Name+"\n")
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// the TASK_* keys each template must use; a template without them would
+// not run the daemon, or would run it as root
+var templateKeys = map[string][]string{
+	"daemontools_run": {"TASK_BIN", "TASK_ARGS", "TASK_SETUID"},
+	"daemontools_log": {"TASK_LOG_DIR"},
+	"runit_run":       {"TASK_BIN", "TASK_ARGS", "TASK_USER_GROUP"},
+	"runit_log":       {"TASK_LOG_DIR"},
+	"s6_log":          {"TASK_LOG_DIR"},
+	"systemd_unit":    {"TASK_BIN", "TASK_ARGS", "TASK_CREDENTIALS"},
+	"rcfile":          {"TASK_BIN", "TASK_ARGS", "TASK_USER"},
+	"netbsd_rcfile":   {"TASK_BIN", "TASK_ARGS", "TASK_USER"},
+	"task_xml":        {"TASK_BIN", "TASK_ARGS", "TASK_UID"},
+}
+
+// templates set by SetTemplate, keyed by name
+var customTemplates = struct {
+	sync.Mutex
+	templates map[string]string
+}{templates: make(map[string]string)}
+
+// replace the named template for daemons created afterwards; the content
+// is expanded with the same TASK_* keys as the embedded template
+func SetTemplate(name, content string) error {
+	err := checkTemplate(name, content)
+	if err != nil {
+		return fatal(err)
+	}
+	customTemplates.Lock()
+	defer customTemplates.Unlock()
+	customTemplates.templates[name] = content
+	return nil
+}
+
+// the custom template for name, set by SetTemplate or read from the file
+// named by daemon.template.NAME; empty when the embedded one is used
+func customTemplate(settings daemonSettings, name string) (string, error) {
+	customTemplates.Lock()
+	content, ok := customTemplates.templates[name]
+	customTemplates.Unlock()
+	if ok {
+		return content, nil
+	}
+	path := settings.getString("daemon.template." + name)
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fatal(err)
+	}
+	err = checkTemplate(name, string(data))
+	if err != nil {
+		return "", fatal(err)
+	}
+	return string(data), nil
+}
+
+func checkTemplate(name, content string) error {
+	required, ok := templateKeys[name]
+	if !ok {
+		return fatalf("unknown template: %s", name)
+	}
+	used := map[string]bool{}
+	os.Expand(content, func(key string) string {
+		used[key] = true
+		return ""
+	})
+	missing := []string{}
+	for _, key := range required {
+		if !used[key] {
+			missing = append(missing, "${"+key+"}")
+		}
+	}
+	if len(missing) > 0 {
+		return fatalf("template %s does not use %s", name, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,717 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rstms/cobra-daemon/common"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sc.exe exit codes
+const (
+	scAccessDenied     = 5
+	scServiceNotActive = 1062
+	scNotAccepting     = 1061
+	scNoService        = 1060
+	scServiceExists    = 1073
+)
+
+// a windows service registered with the service control manager; the
+// executable, or daemon.windows.service_shim which receives the daemon
+// command line as its arguments, must implement the service control
+// protocol, so the service runs at boot without a logged on user
+type WindowsService struct {
+	Name           string
+	Username       string
+	Uid            string
+	Account        string
+	Executable     string
+	Args           string
+	Shim           string
+	Dir            string
+	LogFile        string
+	Force          bool
+	StartType      string
+	StopTimeout    time.Duration
+	CommandTimeout time.Duration
+	Retries        int
+	RetryDelay     time.Duration
+	settings       daemonSettings
+}
+
+// the service account names sc.exe accepts for the built-in principals
+var serviceAccounts = map[string]string{
+	"S-1-5-18": "LocalSystem",
+	"S-1-5-19": `NT AUTHORITY\LocalService`,
+	"S-1-5-20": `NT AUTHORITY\NetworkService`,
+}
+
+// the positional form of NewWindowsServiceFromSpec, kept for compatibility
+func NewWindowsService(serviceName string, serviceUser *user.User, serviceDir string, serviceCommand string, serviceArgs ...string) (CobraDaemon, error) {
+	return NewWindowsServiceFromSpec(DaemonSpec{Name: serviceName, Dir: serviceDir, Executable: serviceCommand, Args: serviceArgs}, serviceUser)
+}
+
+func NewWindowsServiceFromSpec(spec DaemonSpec, serviceUser *user.User) (CobraDaemon, error) {
+	settings := daemonSettings(spec.Config)
+	serviceName, serviceDir, serviceCommand := spec.Name, spec.Dir, spec.Executable
+	serviceArgs := append([]string{}, spec.Args...)
+
+	account, ok := serviceAccounts[serviceUser.Uid]
+	if !ok {
+		account = serviceUser.Username
+	}
+	timeout, err := stopTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// sc stop sends the service a stop control, not a signal
+	signal, err := stopSignal(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if signal != "TERM" {
+		return nil, fatalf("%w: windows services cannot be stopped with SIG%s", ErrNotSupported, signal)
+	}
+	pidfile, err := pidFile(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	start, err := startType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	kind, err := daemonType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if kind == "oneshot" {
+		return nil, fatalf("%w: oneshot windows services", ErrNotSupported)
+	}
+	if pidfile != "" {
+		return nil, fatalf("%w: windows services do not write a pid file", ErrNotSupported)
+	}
+	cmdTimeout, err := commandTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	retries, retryDelay, err := retryPolicy(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// the service control manager starts the command line as given, so
+	// there is nowhere to set env, run hooks, or apply a wrapper
+	env, err := daemonEnv(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	prestart, poststop, err := hooks(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if len(env) > 0 || prestart != "" || poststop != "" || settings.getBool("daemon.wrapper") {
+		return nil, fatalf("%w: windows services do not support env, prestart, poststop, or wrapper", ErrNotSupported)
+	}
+	after, requires, err := dependencies(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if len(after) > 0 || len(requires) > 0 {
+		return nil, fatalf("%w: windows services are installed without dependencies", ErrNotSupported)
+	}
+	_, _, err = resourceLimits(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// windows files have no mode bits, so daemon.umask is only validated
+	_, err = umask(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// there is no sandbox setting, so daemon.sandbox is only validated
+	_, err = sandbox(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// the service control manager doesn't capture the daemon's output or
+	// connect its input, so daemon.split_logs and daemon.stdin are only
+	// validated
+	_, err = splitLogs(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	_, err = daemonStdin(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	extra, err := extraConfig(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if extra != "" {
+		return nil, fatalf("%w: extra_config for windows services", ErrNotSupported)
+	}
+	logFile, err := logPath(settings, filepath.Join(serviceUser.HomeDir, "logs", serviceName+"-service.log"))
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logFlags, err := logArgs(settings, logFile)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	serviceArgs = append(serviceArgs, logFlags...)
+	s := WindowsService{
+		Name:           serviceName,
+		Username:       serviceUser.Username,
+		Uid:            serviceUser.Uid,
+		Account:        account,
+		Executable:     serviceCommand,
+		Args:           quoteArgs(serviceArgs, quoteWindows),
+		Shim:           settings.getString("daemon.windows.service_shim"),
+		Dir:            serviceDir,
+		LogFile:        logFile,
+		Force:          common.ViperGetBool("force"),
+		StartType:      start,
+		StopTimeout:    timeout,
+		CommandTimeout: cmdTimeout,
+		Retries:        retries,
+		RetryDelay:     retryDelay,
+		settings:       settings,
+	}
+	return &s, nil
+}
+
+// return the backend for daemon.windows.mode, task or service
+func windowsBackend(settings daemonSettings) (string, error) {
+	switch mode := settings.getString("daemon.windows.mode"); mode {
+	case "", "task":
+		return "schtasks", nil
+	case "service":
+		return "service", nil
+	default:
+		return "", fatalf("unsupported windows mode: %s", mode)
+	}
+}
+
+// the sc command line acting on the service
+func (s *WindowsService) argv(cmd string, args ...string) []string {
+	return append([]string{"sc.exe", cmd, s.Name}, args...)
+}
+
+// the sc commands run by start, stop, query, or delete
+func (s *WindowsService) Commands(action string) ([][]string, error) {
+	switch action {
+	case "start":
+		if s.StartType == "manual" {
+			return [][]string{s.argv("start")}, nil
+		}
+		return [][]string{s.argv("config", "start=", "auto"), s.argv("start")}, nil
+	case "stop":
+		return [][]string{s.argv("stop")}, nil
+	case "query":
+		return [][]string{s.argv("query")}, nil
+	case "delete":
+		return [][]string{s.argv("stop"), s.argv("delete")}, nil
+	}
+	return nil, fatalf("unknown action: %s", action)
+}
+
+// run sc.exe, returning the windows error code and its output; sc reports
+// errors on stdout as "FAILED CODE:" and exits with the code
+func (s *WindowsService) serviceControl(cmd string, args ...string) (int, string, error) {
+	var stdout string
+	exitCode := 0
+	argv := s.argv(cmd, args...)
+	err := retry(s.Retries, s.RetryDelay, func() error {
+		var err error
+		stdout, _, exitCode, err = runTimeout(s.CommandTimeout, argv[0], argv[1:]...)
+		if match := regexp.MustCompile(`FAILED (\d+):`).FindStringSubmatch(stdout); match != nil {
+			exitCode, _ = strconv.Atoi(match[1])
+		}
+		if err != nil && exitCode == scNotAccepting {
+			return fmt.Errorf("%w: %w", errTransient, err)
+		}
+		return err
+	})
+	ostr := strings.TrimSpace(stdout)
+	if err != nil {
+		switch exitCode {
+		case scNoService:
+			return exitCode, "", fmt.Errorf("%w: service %s", ErrNotInstalled, s.Name)
+		case scServiceExists:
+			return exitCode, "", fmt.Errorf("%w: service %s", ErrAlreadyInstalled, s.Name)
+		case scAccessDenied:
+			return exitCode, "", fmt.Errorf("%w: %s", ErrPermissionDenied, ostr)
+		}
+		if ostr != "" && !errors.Is(err, ErrPermissionDenied) && !errors.Is(err, ErrCommandTimeout) {
+			return exitCode, "", fmt.Errorf("%s: %w", ostr, err)
+		}
+		return exitCode, "", err
+	}
+	return exitCode, ostr, nil
+}
+
+func (s *WindowsService) installed() bool {
+	_, _, err := s.serviceControl("query")
+	return err == nil
+}
+
+// the command line the service control manager starts
+func (s *WindowsService) binPath() string {
+	command := quoteArgs([]string{s.Executable}, quoteWindows)
+	if s.Shim != "" {
+		command = quoteArgs([]string{s.Shim}, quoteWindows) + " " + command
+	}
+	return strings.TrimSpace(command + " " + s.Args)
+}
+
+// return the sc.exe create arguments, without the password
+func (s *WindowsService) createArgs() []string {
+	// unset, the service starts on demand until Start sets it to auto
+	start := "demand"
+	switch s.StartType {
+	case "auto":
+		start = "auto"
+	case "disabled":
+		start = "disabled"
+	}
+	return []string{"binPath=", s.binPath(), "start=", start, "obj=", s.Account, "DisplayName=", s.Name}
+}
+
+// accounts other than the built-in principals need their password
+func (s *WindowsService) needsPassword() bool {
+	_, ok := serviceAccounts[s.Uid]
+	return !ok
+}
+
+func (s *WindowsService) Install() error {
+	err := checkPrivileges("install service", s.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	unlock, err := lockDaemon(s, s.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if s.installed() {
+		return fatalf("%w: service %s", ErrAlreadyInstalled, s.Name)
+	}
+	err = createRunDir(s.Dir, s.Uid, "")
+	if err != nil {
+		return fatal(err)
+	}
+	err = createOwnedDirs(filepath.Dir(s.LogFile), s.Uid, "")
+	if err != nil {
+		return fatal(err)
+	}
+	args := s.createArgs()
+	if s.needsPassword() {
+		password, err := windowsPassword(s.settings, s.Username)
+		if err != nil {
+			return fatal(err)
+		}
+		args = append(args, "password=", password)
+	}
+	_, _, err = s.serviceControl("create", args...)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// the service has no config file, so it renders as the sc.exe command
+// that creates it, with the password left for sc to prompt for
+func (s *WindowsService) ConfigFiles() ([]ConfigFile, error) {
+	command := quoteArgs(append([]string{"sc.exe", "create", s.Name}, s.createArgs()...), quoteWindows) + "\r\n"
+	return []ConfigFile{{s.Name + ".cmd", 0600, []byte(command)}}, nil
+}
+
+// return the log file the daemon writes, daemon.logfile when set
+func (s *WindowsService) LogPath() (string, error) {
+	return s.LogFile, nil
+}
+
+func (s *WindowsService) Paths() map[string]string {
+	return map[string]string{
+		"binary": s.Executable,
+		"dir":    s.Dir,
+		"log":    s.LogFile,
+	}
+}
+
+func (s *WindowsService) Delete() error {
+	unlock, err := lockDaemon(s, s.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if !s.installed() {
+		return fatalf("%w: service %s", ErrNotInstalled, s.Name)
+	}
+	err = checkPrivileges("delete service", s.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	err = s.Stop()
+	if err != nil {
+		if !s.Force {
+			return fatal(err)
+		}
+		forceWarning(s.Name, err)
+	}
+	_, _, err = s.serviceControl("delete")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// delete the service and remove its log file; the executable runs from
+// where it was installed from, so it is left in place
+func (s *WindowsService) Purge() error {
+	return purge(s, s.Executable, s.Executable, "")
+}
+
+// sc stop sends a stop control, and queryex reports the process id
+var windowsServiceCapabilities = DaemonCapabilities{
+	Pid: true,
+}
+
+func (s *WindowsService) Capabilities() DaemonCapabilities {
+	return windowsServiceCapabilities
+}
+
+// the settings the service was created with
+func (s *WindowsService) specSettings() daemonSettings {
+	return s.settings
+}
+
+// set the service to start at boot
+func (s *WindowsService) Enable() error {
+	if !s.installed() {
+		return fatalf("%w: service %s", ErrNotInstalled, s.Name)
+	}
+	_, _, err := s.serviceControl("config", "start=", "auto")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// set the service start type to disabled, which the service control
+// manager refuses to start until it is enabled again
+func (s *WindowsService) Disable() error {
+	if !s.installed() {
+		return fatalf("%w: service %s", ErrNotInstalled, s.Name)
+	}
+	_, _, err := s.serviceControl("config", "start=", "disabled")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a running service is left alone
+func (s *WindowsService) Start() error {
+	running, err := s.Query()
+	if err != nil {
+		return fatal(err)
+	}
+	if running {
+		debugLog("already running", "name", s.Name)
+		return nil
+	}
+	err = checkStartType(s.Name, s.StartType)
+	if err != nil {
+		return fatal(err)
+	}
+	if s.StartType != "manual" {
+		err = s.Enable()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	_, _, err = s.serviceControl("start")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// send a stop control, then end the process if it is still running after
+// the stop timeout
+func (s *WindowsService) Stop() error {
+	if !s.installed() {
+		return fatalf("%w: service %s", ErrNotInstalled, s.Name)
+	}
+	exitCode, _, err := s.serviceControl("stop")
+	if err != nil && exitCode != scServiceNotActive {
+		return fatal(err)
+	}
+	stopped, err := waitStopped(s.Query, s.StopTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if stopped {
+		return nil
+	}
+	pid, err := s.Pid()
+	if err != nil {
+		return fatal(err)
+	}
+	if pid != 0 {
+		_, _, _, err = runTimeout(s.CommandTimeout, "taskkill.exe", "/F", "/PID", strconv.Itoa(pid))
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	stopped, err = waitStopped(s.Query, killTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if !stopped {
+		return fatalf("%s still running after taskkill /F", s.Name)
+	}
+	return nil
+}
+
+func (s *WindowsService) Restart() error {
+	err := s.Stop()
+	if err != nil {
+		return fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// return the sc qc report of the service configuration
+func (s *WindowsService) GetConfig() (string, error) {
+	_, out, err := s.serviceControl("qc")
+	if err != nil {
+		return "", fatal(err)
+	}
+	return out, nil
+}
+
+func (s *WindowsService) GetDaemonConfig() (*DaemonConfig, error) {
+	report, err := s.GetConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	fields := scFields(report)
+	config := s.commandConfig(fields["BINARY_PATH_NAME"])
+	config.User = serviceUser(fields["SERVICE_START_NAME"])
+	config.Enabled = !strings.Contains(fields["START_TYPE"], "DISABLED")
+	return config, nil
+}
+
+func (s *WindowsService) DesiredConfig() (*DaemonConfig, error) {
+	config := s.commandConfig(s.binPath())
+	config.User = serviceUser(s.Account)
+	config.Enabled = s.StartType != "disabled"
+	return config, nil
+}
+
+// parse a service command line, leaving out the shim
+func (s *WindowsService) commandConfig(binPath string) *DaemonConfig {
+	words := windowsSplit(binPath)
+	if s.Shim != "" && len(words) > 0 && strings.EqualFold(words[0], s.Shim) {
+		words = words[1:]
+	}
+	config := DaemonConfig{Name: s.Name, Env: make(map[string]string)}
+	if len(words) > 0 {
+		config.Executable = words[0]
+		config.Args = words[1:]
+	}
+	return &config
+}
+
+// return the username of a service account, naming the built-in
+// principals as the task scheduler does
+func serviceUser(account string) string {
+	if principal, ok := windowsPrincipal(account); ok {
+		return principal.Username
+	}
+	return strings.TrimPrefix(account, `.\`)
+}
+
+// return the KEY : VALUE fields of sc query and qc output
+func scFields(report string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(report, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return fields
+}
+
+// the service control manager keeps its configuration in the registry;
+// replace it with Delete and Install instead
+func (s *WindowsService) SetConfig(config string) error {
+	return fatalf("%w: windows service config is not editable", ErrNotSupported)
+}
+
+// a service is running from the time it starts until it reports STOPPED
+func (s *WindowsService) Query() (bool, error) {
+	_, out, err := s.serviceControl("query")
+	if err != nil {
+		return false, fatal(err)
+	}
+	match := regexp.MustCompile(`^\d+\s+(\w+)`).FindStringSubmatch(scFields(out)["STATE"])
+	if match == nil {
+		return false, fatalf("unexpected output: %v", out)
+	}
+	return match[1] != "STOPPED", nil
+}
+
+// a stopped service has failed when it exited with an error code, which
+// sc stop leaves at 0
+func (s *WindowsService) Status() (DaemonState, error) {
+	_, out, err := s.serviceControl("query")
+	if err != nil {
+		return "", fatal(err)
+	}
+	state, err := parseServiceState(out)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return state, nil
+}
+
+// parse the STATE and exit codes of sc query
+func parseServiceState(report string) (DaemonState, error) {
+	fields := scFields(report)
+	match := regexp.MustCompile(`^\d+\s+(\w+)`).FindStringSubmatch(fields["STATE"])
+	if match == nil {
+		return "", fatalf("unexpected output: %v", report)
+	}
+	if match[1] != "STOPPED" {
+		return StateRunning, nil
+	}
+	for _, key := range []string{"WIN32_EXIT_CODE", "SERVICE_EXIT_CODE"} {
+		code, _, _ := strings.Cut(fields[key], " ")
+		// 1077 is ERROR_SERVICE_NEVER_STARTED
+		if code != "" && code != "0" && code != "1077" {
+			return StateFailed, nil
+		}
+	}
+	return StateStopped, nil
+}
+
+// return the service process id, 0 when it is stopped
+func (s *WindowsService) Pid() (int, error) {
+	_, out, err := s.serviceControl("queryex")
+	if err != nil {
+		return 0, fatal(err)
+	}
+	value, ok := scFields(out)["PID"]
+	if !ok {
+		return 0, fatalf("unexpected output: %v", out)
+	}
+	pid, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fatalf("invalid pid: %s", value)
+	}
+	return pid, nil
+}
+
+func (s *WindowsService) tools() (string, []string) {
+	return "service control manager", []string{"sc.exe"}
+}
+
+func (s *WindowsService) Validate() error {
+	var userErr error
+	if s.needsPassword() {
+		_, err := user.Lookup(s.Username)
+		if err != nil {
+			userErr = fmt.Errorf("service user: %w", err)
+		}
+	}
+	var shimErr error
+	if s.Shim != "" {
+		shimErr = checkExecutable(s.Shim)
+	}
+	return errors.Join(
+		checkTools(s.tools()),
+		checkExecutable(s.Executable),
+		shimErr,
+		checkRunDir(s.settings, s.Dir, s.Uid, ""),
+		userErr,
+	)
+}
+
+// list the services whose command line runs this executable
+// return a service that can only inspect the installed service name
+func windowsServiceByName(name string) (CobraDaemon, error) {
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return &WindowsService{Name: name, CommandTimeout: timeout}, nil
+}
+
+func listWindowsServices() ([]DaemonInfo, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	stdout, _, _, err := runTimeout(timeout, "sc.exe", "query", "type=", "service", "state=", "all")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	list := []DaemonInfo{}
+	for _, match := range regexp.MustCompile(`(?m)^SERVICE_NAME:\s*(\S+)`).FindAllStringSubmatch(stdout, -1) {
+		s := WindowsService{Name: match[1], CommandTimeout: timeout}
+		report, err := s.GetConfig()
+		if err != nil {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(scFields(report)["BINARY_PATH_NAME"]), strings.ToLower(executable)) {
+			continue
+		}
+		running, err := s.Query()
+		if err != nil {
+			return nil, fatal(err)
+		}
+		list = append(list, DaemonInfo{Name: s.Name, Running: running})
+	}
+	return list, nil
+}
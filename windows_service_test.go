@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a stand-in for sc.exe that keeps the service state in $FAKE_STATE
+const fakeSC = `
+printf '%s\n' "$*" >> $FAKE_STATE/sc.log
+if [ "$1" != create ] && [ ! -f $FAKE_STATE/binpath ]; then
+	echo "[SC] OpenService FAILED 1060:"
+	exit 36
+fi
+case "$1" in
+create)
+	printf '%s\n' "$4" > $FAKE_STATE/binpath
+	echo "$8" > $FAKE_STATE/account
+	echo STOPPED > $FAKE_STATE/state
+	echo "[SC] CreateService SUCCESS";;
+start)
+	echo RUNNING > $FAKE_STATE/state;;
+stop)
+	echo STOPPED > $FAKE_STATE/state;;
+delete)
+	rm $FAKE_STATE/binpath;;
+query|queryex)
+	echo "SERVICE_NAME: $2"
+	echo "        STATE              : 4  $(cat $FAKE_STATE/state)"
+	echo "        PID                : 4321";;
+qc)
+	echo "[SC] QueryServiceConfig SUCCESS"
+	echo "SERVICE_NAME: $2"
+	echo "        START_TYPE         : 2   AUTO_START"
+	printf '        BINARY_PATH_NAME   : %s\n' "$(cat $FAKE_STATE/binpath)"
+	echo "        SERVICE_START_NAME : $(cat $FAKE_STATE/account)";;
+esac
+`
+
+func TestWindowsService(t *testing.T) {
+	initTestConfig(t)
+	root := t.TempDir()
+	t.Setenv("SystemRoot", root)
+	state := t.TempDir()
+	t.Setenv("FAKE_STATE", state)
+	fakeCommand(t, "sc.exe", fakeSC)
+	testConfig(t, "daemon.retry.delay", "10ms")
+	testPrivileged(t, true)
+
+	u := *testUser(t)
+	u.HomeDir = root
+	// the directories are created and owned by sid only on windows
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "logs"), 0755))
+	t.Setenv("DAEMON_PASSWORD", "s3cret")
+	d, err := NewWindowsService("testd", &u, root, `C:\Program Files\testd.exe`, "serve")
+	require.Nil(t, err)
+	_, err = d.Query()
+	require.ErrorIs(t, err, ErrNotInstalled)
+	require.Nil(t, d.Install())
+	require.ErrorIs(t, d.Install(), ErrAlreadyInstalled)
+	running, err := d.Query()
+	require.Nil(t, err)
+	require.False(t, running)
+	require.Nil(t, d.Start())
+	running, err = d.Query()
+	require.Nil(t, err)
+	require.True(t, running)
+	pid, err := d.Pid()
+	require.Nil(t, err)
+	require.Equal(t, 4321, pid)
+
+	diff, err := Diff(d)
+	require.Nil(t, err)
+	require.Empty(t, diff)
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, `C:\Program Files\testd.exe`, config.Executable)
+	require.Equal(t, "serve", config.Args[0])
+	require.Equal(t, u.Username, config.User)
+
+	require.Nil(t, d.Delete())
+	require.NoFileExists(t, filepath.Join(state, "binpath"))
+	log, err := os.ReadFile(filepath.Join(state, "sc.log"))
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	require.Contains(t, lines, `create testd binPath= "C:\Program Files\testd.exe" serve --logfile `+d.Paths()["log"]+` start= demand obj= `+u.Username+` DisplayName= testd password= s3cret`)
+	require.Contains(t, lines, "config testd start= auto")
+	require.Equal(t, "delete testd", lines[len(lines)-1])
+
+	testConfig(t, "daemon.windows.mode", "service")
+	backend, err := windowsBackend(nil)
+	require.Nil(t, err)
+	require.Equal(t, "service", backend)
+	testConfig(t, "daemon.env", []string{"KEY=value"})
+	_, err = NewWindowsService("testd", &u, root, `C:\bin\testd.exe`)
+	require.ErrorIs(t, err, ErrNotSupported)
+
+	principal, _ := windowsPrincipal("NetworkService")
+	testConfig(t, "daemon.env", nil)
+	d, err = NewWindowsService("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	require.Equal(t, `NT AUTHORITY\NetworkService`, d.(*WindowsService).Account)
+	require.False(t, d.(*WindowsService).needsPassword())
+}
+
+func TestParseServiceState(t *testing.T) {
+	report := func(state, win32, service string) string {
+		return "SERVICE_NAME: testd\r\n" +
+			"        TYPE               : 10  WIN32_OWN_PROCESS\r\n" +
+			"        STATE              : " + state + "\r\n" +
+			"        WIN32_EXIT_CODE    : " + win32 + "\r\n" +
+			"        SERVICE_EXIT_CODE  : " + service + "\r\n"
+	}
+	for output, expected := range map[string]DaemonState{
+		report("4  RUNNING", "0  (0x0)", "0  (0x0)"):       StateRunning,
+		report("2  START_PENDING", "0  (0x0)", "0  (0x0)"): StateRunning,
+		report("1  STOPPED", "0  (0x0)", "0  (0x0)"):       StateStopped,
+		report("1  STOPPED", "1077  (0x435)", "0  (0x0)"):  StateStopped,
+		report("1  STOPPED", "1067  (0x42b)", "0  (0x0)"):  StateFailed,
+		report("1  STOPPED", "1066  (0x42a)", "3  (0x3)"):  StateFailed,
+	} {
+		state, err := parseServiceState(output)
+		require.Nil(t, err, output)
+		require.Equal(t, expected, state, output)
+	}
+	_, err := parseServiceState("[SC] EnumQueryServicesStatus:OpenService FAILED 1060:\r\n")
+	require.ErrorContains(t, err, "unexpected output")
+}
@@ -25,153 +25,1076 @@ package daemon
 import (
 	"bytes"
 	_ "embed"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/rstms/cobra-daemon/common"
+	"io"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf16"
 )
 
 //go:embed template/task.xml
 var xmlTemplate string
 
 type WindowsTask struct {
-	Name       string
-	Username   string
-	Uid        string
-	Executable string
-	Args       string
-	Dir        string
-	LogFile    string
+	Name           string
+	Username       string
+	Uid            string
+	Executable     string
+	Args           string
+	Dir            string
+	LogFile        string
+	Trigger        string
+	LogonType      string
+	RunLevel       string
+	Priority       int
+	StartDelay     time.Duration
+	StopIfIdle     time.Duration
+	Force          bool
+	StartType      string
+	Type           string
+	StopTimeout    time.Duration
+	CommandTimeout time.Duration
+	Retries        int
+	RetryDelay     time.Duration
+	Env            map[string]string
+	Wrapper        bool
+	PreStart       string
+	PostStop       string
+	wrapperFile    string
+	customXML      string
+	settings       daemonSettings
 }
 
+// built-in service accounts accepted as daemon.user; tasks run as these
+// need no stored password or interactive login
+var windowsPrincipals = map[string]struct {
+	username string
+	sid      string
+	profile  string
+}{
+	"system":         {`NT AUTHORITY\SYSTEM`, "S-1-5-18", `System32\config\systemprofile`},
+	"localsystem":    {`NT AUTHORITY\SYSTEM`, "S-1-5-18", `System32\config\systemprofile`},
+	"localservice":   {`NT AUTHORITY\LOCAL SERVICE`, "S-1-5-19", `ServiceProfiles\LocalService`},
+	"networkservice": {`NT AUTHORITY\NETWORK SERVICE`, "S-1-5-20", `ServiceProfiles\NetworkService`},
+}
+
+// return a user for a built-in principal name, which user.Lookup can't resolve
+func windowsPrincipal(username string) (*user.User, bool) {
+	name := strings.ToLower(strings.TrimPrefix(strings.ToUpper(username), `NT AUTHORITY\`))
+	name = strings.ReplaceAll(name, " ", "")
+	principal, ok := windowsPrincipals[name]
+	if !ok {
+		return nil, false
+	}
+	return &user.User{
+		Username: principal.username,
+		Uid:      principal.sid,
+		Name:     principal.username,
+		HomeDir:  filepath.Join(os.Getenv("SystemRoot"), principal.profile),
+	}, true
+}
+
+func isWindowsPrincipal(sid string) bool {
+	for _, principal := range windowsPrincipals {
+		if principal.sid == sid {
+			return true
+		}
+	}
+	return false
+}
+
+// the positional form of NewWindowsTaskFromSpec, kept for compatibility
 func NewWindowsTask(taskName string, taskUser *user.User, taskDir string, taskCommand string, taskArgs ...string) (CobraDaemon, error) {
+	return NewWindowsTaskFromSpec(DaemonSpec{Name: taskName, Dir: taskDir, Executable: taskCommand, Args: taskArgs}, taskUser)
+}
+
+func NewWindowsTaskFromSpec(spec DaemonSpec, taskUser *user.User) (CobraDaemon, error) {
+	settings := daemonSettings(spec.Config)
+	taskName, taskDir, taskCommand := spec.Name, spec.Dir, spec.Executable
+	taskArgs := append([]string{}, spec.Args...)
 
 	logDir := filepath.Join(taskUser.HomeDir, "logs")
-	err := os.MkdirAll(logDir, 0700)
+	// built-in principals never log on, so they default to starting at boot
+	logonType, runLevel := "InteractiveToken", "LeastPrivilege"
+	trigger := settings.getString("daemon.windows.trigger")
+	// a stored password lets the task run whether or not the user is logged on
+	logon := settings.getString("daemon.windows.logon")
+	switch logon {
+	case "":
+		if settings.getString("daemon.password") != "" {
+			logon = "password"
+		}
+	case "interactive", "password":
+	default:
+		return nil, fatalf("unsupported windows logon: %s", logon)
+	}
+	if logon == "password" {
+		logonType = "Password"
+	}
+	if isWindowsPrincipal(taskUser.Uid) {
+		if logon == "password" {
+			return nil, fatalf("%w: %s runs without a password", ErrNotSupported, taskUser.Username)
+		}
+		logonType, runLevel = "ServiceAccount", "HighestAvailable"
+		if trigger == "" {
+			trigger = "boot"
+		}
+	}
+	if trigger == "" {
+		trigger = "logon"
+	}
+	startDelay, err := taskDuration(settings, "daemon.windows.start_delay")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	stopIfIdle, err := taskDuration(settings, "daemon.windows.stop_if_idle")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// the task scheduler accepts idle durations of one minute to two hours
+	if stopIfIdle != 0 && (stopIfIdle < time.Minute || stopIfIdle > 2*time.Hour) {
+		return nil, fatalf("invalid stop_if_idle: %s; expected 1m to 2h", stopIfIdle)
+	}
+	_, err = taskTrigger(trigger, taskUser.Username, startDelay)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	timeout, err := stopTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// schtasks /END terminates the task process; there are no signals
+	signal, err := stopSignal(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if signal != "TERM" {
+		return nil, fatalf("%w: windows tasks cannot be stopped with SIG%s", ErrNotSupported, signal)
+	}
+	pidfile, err := pidFile(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	start, err := startType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	kind, err := daemonType(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// a oneshot runs on a schedule rather than staying up from boot or logon
+	if kind == "oneshot" && !strings.HasPrefix(trigger, "daily@") {
+		return nil, fatalf("oneshot tasks require a daemon.windows.trigger of daily@HH:MM, not %s", trigger)
+	}
+	custom, err := customTemplate(settings, "task_xml")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if pidfile != "" {
+		return nil, fatalf("%w: windows tasks do not write a pid file", ErrNotSupported)
+	}
+	cmdTimeout, err := commandTimeout(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	retries, retryDelay, err := retryPolicy(settings)
 	if err != nil {
-		return nil, common.Fatal(err)
+		return nil, fatal(err)
 	}
-	logFile := filepath.Join(logDir, taskName+"-task.log")
-	taskArgs = append(taskArgs, "--logfile", logFile)
+	// scheduled tasks have no environment setting of their own
+	env, err := daemonEnv(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	wrapper := settings.getBool("daemon.wrapper")
+	if len(env) > 0 && !wrapper {
+		return nil, fatalf("%w: windows tasks require daemon.wrapper for env settings", ErrNotSupported)
+	}
+	// task priority replaces nice; there is no io scheduling setting, and
+	// daemon.limits are not applied because tasks have no resource limits
+	_, _, err = resourceLimits(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// windows files have no mode bits, so daemon.umask is only validated
+	_, err = umask(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// there is no sandbox setting, so daemon.sandbox is only validated
+	_, err = sandbox(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// the task scheduler doesn't capture the daemon's output or
+	// connect its input, so daemon.split_logs and daemon.stdin are only
+	// validated
+	_, err = splitLogs(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	_, err = daemonStdin(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	extra, err := extraConfig(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if extra != "" {
+		return nil, fatalf("%w: extra_config for windows tasks", ErrNotSupported)
+	}
+	nice, err := niceness(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	// hooks run in the wrapper, as the task user
+	prestart, poststop, err := hooks(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if (prestart != "" || poststop != "") && !wrapper {
+		return nil, fatalf("%w: windows tasks require daemon.wrapper for prestart and poststop", ErrNotSupported)
+	}
+	after, requires, err := dependencies(settings)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if len(after) > 0 || len(requires) > 0 {
+		return nil, fatalf("%w: windows tasks have no dependency ordering", ErrNotSupported)
+	}
+	logFile, err := logPath(settings, filepath.Join(logDir, taskName+"-task.log"))
+	if err != nil {
+		return nil, fatal(err)
+	}
+	logFlags, err := logArgs(settings, logFile)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	taskArgs = append(taskArgs, logFlags...)
 	t := WindowsTask{
-		Name:       taskName,
-		Username:   taskUser.Username,
-		Uid:        taskUser.Uid,
-		Executable: taskCommand,
-		Args:       strings.Join(taskArgs, " "),
-		Dir:        taskDir,
-		LogFile:    logFile,
+		Name:           taskName,
+		Username:       taskUser.Username,
+		Uid:            taskUser.Uid,
+		Executable:     taskCommand,
+		Args:           quoteArgs(taskArgs, quoteWindows),
+		Dir:            taskDir,
+		LogFile:        logFile,
+		Trigger:        trigger,
+		LogonType:      logonType,
+		RunLevel:       runLevel,
+		Priority:       taskPriority(nice),
+		StartDelay:     startDelay,
+		StopIfIdle:     stopIfIdle,
+		Force:          common.ViperGetBool("force"),
+		StartType:      start,
+		Type:           kind,
+		StopTimeout:    timeout,
+		CommandTimeout: cmdTimeout,
+		Retries:        retries,
+		RetryDelay:     retryDelay,
+		Env:            env,
+		Wrapper:        wrapper,
+		PreStart:       prestart,
+		PostStop:       poststop,
+		wrapperFile:    wrapperPath(taskName, filepath.Join(taskUser.HomeDir, "tasks")),
+		customXML:      custom,
+		settings:       settings,
 	}
 
 	return &t, nil
 }
 
 func (t *WindowsTask) taskScheduler(cmd string, args ...string) (int, string, error) {
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	taskArgs := append([]string{"/" + cmd, "/TN", t.Name}, args...)
-	command := exec.Command("schtasks.exe", taskArgs...)
-	command.Stdout = &stdout
-	command.Stderr = &stderr
-	err := command.Run()
-	exitCode := command.ProcessState.ExitCode()
-	estr := strings.TrimSpace(stderr.String())
-	ostr := strings.TrimSpace(stdout.String())
-	if common.ViperGetBool("verbose") {
-		fmt.Printf("%s\n", ostr)
-	}
-	if err != nil {
-		if estr != "" {
-			return exitCode, "", fmt.Errorf("%v", estr)
-		}
+	var stdout string
+	var exitCode int
+	argv := t.argv(cmd, args...)
+	// schtasks fails while another process holds the task
+	err := retry(t.Retries, t.RetryDelay, func() error {
+		var err error
+		stdout, _, exitCode, err = runTimeout(t.CommandTimeout, argv[0], argv[1:]...)
+		return err
+	})
+	if err != nil {
 		return exitCode, "", err
 	}
-	return exitCode, ostr, nil
+	return exitCode, strings.TrimSpace(decodeTaskOutput(stdout)), nil
 }
 
-func (t *WindowsTask) Install() error {
+var utf16Declaration = regexp.MustCompile(`(<\?xml[^>]*encoding=["'])(?i:utf-16)(["'])`)
+
+// schtasks writes UTF-16 with a byte order mark on some locales, and
+// without one for /XML; return such output as UTF-8, declared as UTF-8,
+// and anything else as it was written less a UTF-8 byte order mark
+func decodeTaskOutput(output string) string {
+	data := []byte(output)
+	var bigEndian bool
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return string(data[3:])
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		data = data[2:]
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		data, bigEndian = data[2:], true
+	case len(data) >= 2 && data[0] != 0 && data[1] == 0:
+	case len(data) >= 2 && data[0] == 0 && data[1] != 0:
+		bigEndian = true
+	default:
+		return output
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return utf16Declaration.ReplaceAllString(string(utf16.Decode(units)), "${1}UTF-8${2}")
+}
+
+// the schtasks command line acting on the task
+func (t *WindowsTask) argv(cmd string, args ...string) []string {
+	return append([]string{"schtasks.exe", "/" + cmd, "/TN", t.Name}, args...)
+}
+
+// the schtasks commands run by start, stop, query, or delete
+func (t *WindowsTask) Commands(action string) ([][]string, error) {
+	switch action {
+	case "start":
+		if t.StartType == "manual" {
+			return [][]string{t.argv("RUN")}, nil
+		}
+		return [][]string{t.argv("CHANGE", "/ENABLE"), t.argv("RUN")}, nil
+	case "stop":
+		return [][]string{t.argv("END")}, nil
+	case "query":
+		if t.oneshot() {
+			return [][]string{t.argv("QUERY", "/V", "/FO", "LIST")}, nil
+		}
+		return [][]string{t.argv("QUERY", "/FO", "csv", "/NH")}, nil
+	case "delete":
+		return [][]string{t.argv("END"), t.argv("DELETE", "/F")}, nil
+	}
+	return nil, fatalf("unknown action: %s", action)
+}
+
+func xmlEscape(value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
+// render the task xml trigger element for boot, logon, or daily@HH:MM;
+// a boot or logon trigger waits delay before starting the task
+func taskTrigger(trigger, username string, delay time.Duration) (string, error) {
+	var delayElement string
+	if delay > 0 {
+		delayElement = "\n      <Delay>" + isoDuration(delay) + "</Delay>"
+	}
+	switch trigger {
+	case "boot":
+		return "<BootTrigger>\n      <Enabled>true</Enabled>" + delayElement + "\n    </BootTrigger>", nil
+	case "logon":
+		return "<LogonTrigger>\n      <UserId>" + xmlEscape(username) + "</UserId>" + delayElement + "\n    </LogonTrigger>", nil
+	}
+	at, ok := strings.CutPrefix(trigger, "daily@")
+	if ok {
+		if delay > 0 {
+			return "", fatalf("%w: start_delay with a daily trigger", ErrNotSupported)
+		}
+		start, err := time.Parse("15:04", at)
+		if err != nil {
+			return "", fatalf("invalid daily trigger time: %s", at)
+		}
+		return "<CalendarTrigger>\n" +
+			"      <StartBoundary>2000-01-01T" + start.Format("15:04:05") + "</StartBoundary>\n" +
+			"      <ScheduleByDay>\n" +
+			"        <DaysInterval>1</DaysInterval>\n" +
+			"      </ScheduleByDay>\n" +
+			"    </CalendarTrigger>", nil
+	}
+	return "", fatalf("unsupported trigger: %s", trigger)
+}
+
+// parse the duration set for key, zero if unset; the task xml counts
+// whole seconds
+func taskDuration(settings daemonSettings, key string) (time.Duration, error) {
+	value := settings.getString(key)
+	if value == "" {
+		return 0, nil
+	}
+	_, name, _ := strings.Cut(strings.TrimPrefix(key, "daemon."), ".")
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 || duration%time.Second != 0 {
+		return 0, fatalf("invalid %s: %s", name, value)
+	}
+	return duration, nil
+}
+
+// format d as an ISO 8601 duration such as PT1H30S, as the task xml
+// expects
+func isoDuration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	value := "PT"
+	hours, minutes, seconds := int(d/time.Hour), int(d%time.Hour/time.Minute), int(d%time.Minute/time.Second)
+	if hours > 0 {
+		value += strconv.Itoa(hours) + "H"
+	}
+	if minutes > 0 {
+		value += strconv.Itoa(minutes) + "M"
+	}
+	if seconds > 0 {
+		value += strconv.Itoa(seconds) + "S"
+	}
+	return value
+}
 
-	xmlData := os.Expand(xmlTemplate, func(key string) string {
+// map a nice value onto the task priority classes, where 1 is high, 3 above
+// normal, 5 normal, 8 below normal, and 10 idle; unset keeps the default 7
+func taskPriority(nice string) int {
+	if nice == "" {
+		return 7
+	}
+	n, _ := strconv.Atoi(nice)
+	switch {
+	case n <= -15:
+		return 1
+	case n <= -5:
+		return 3
+	case n < 5:
+		return 5
+	case n < 15:
+		return 8
+	}
+	return 10
+}
+
+func (t *WindowsTask) installed() bool {
+	_, _, err := t.taskScheduler("QUERY")
+	return err == nil
+}
+
+func (t *WindowsTask) template() string {
+	if t.customXML != "" {
+		return t.customXML
+	}
+	return xmlTemplate
+}
+
+func (t *WindowsTask) xmlData() (string, error) {
+	data, err := t.renderXML(t.template())
+	if err != nil {
+		return "", fatal(err)
+	}
+	return stampSpecXML(data), nil
+}
+
+// values are xml escaped; the result is checked so a template error is
+// reported here rather than by schtasks
+func (t *WindowsTask) renderXML(template string) (string, error) {
+	trigger, err := taskTrigger(t.Trigger, t.Username, t.StartDelay)
+	if err != nil {
+		return "", fatal(err)
+	}
+	data := os.Expand(template, func(key string) string {
 		switch key {
+		case "TASK_TRIGGER":
+			// a manual task runs only when started
+			if t.StartType == "manual" {
+				return ""
+			}
+			return trigger
+		case "TASK_ENABLED":
+			// unset, the task is enabled by Start, as the other backends are
+			return strconv.FormatBool(t.StartType == "auto" || t.StartType == "manual")
 		case "TASK_USER":
-			return t.Username
+			return xmlEscape(t.Username)
 		case "TASK_UID":
-			return t.Uid
+			return xmlEscape(t.Uid)
+		case "TASK_PRIORITY":
+			return strconv.Itoa(t.Priority)
+		case "TASK_RUN_ONLY_IF_IDLE":
+			return strconv.FormatBool(t.StopIfIdle > 0)
+		case "TASK_IDLE_SETTINGS":
+			// the task waits for the computer to be idle this long, and
+			// is stopped when it is in use again
+			if t.StopIfIdle > 0 {
+				return "<Duration>" + isoDuration(t.StopIfIdle) + "</Duration>\n\n      <StopOnIdleEnd>true</StopOnIdleEnd>"
+			}
+			return "<StopOnIdleEnd>false</StopOnIdleEnd>"
+		case "TASK_LOGON_TYPE":
+			return t.LogonType
+		case "TASK_RUN_LEVEL":
+			return t.RunLevel
 		case "TASK_BIN":
-			return t.Executable
+			if t.Wrapper {
+				return "powershell.exe"
+			}
+			return xmlEscape(t.Executable)
 		case "TASK_ARGS":
-			return t.Args
+			if t.Wrapper {
+				wrapperArgs := []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", t.wrapperFile}
+				return xmlEscape(strings.TrimSpace(quoteArgs(wrapperArgs, quoteWindows) + " " + t.Args))
+			}
+			return xmlEscape(t.Args)
 		case "TASK_DIR":
-			return t.Dir
+			return xmlEscape(t.Dir)
 		}
-		return "UNEXPANDED_XML_PARAM_" + key
+		return unexpandedParam + key
 	})
+	err = checkTaskXML(data)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return data, nil
+}
+
+// rendered in place of a template key that has no value
+const unexpandedParam = "UNEXPANDED_XML_PARAM_"
+
+// return an error naming any unexpanded template keys, or describing the
+// first xml syntax error
+func checkTaskXML(data string) error {
+	keys := []string{}
+	for _, match := range regexp.MustCompile(unexpandedParam+`(\w+)`).FindAllStringSubmatch(data, -1) {
+		if !slices.Contains(keys, match[1]) {
+			keys = append(keys, match[1])
+		}
+	}
+	if len(keys) > 0 {
+		return fatalf("unresolved task xml parameter: %s", strings.Join(keys, ", "))
+	}
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fatalf("invalid task xml: %v", err)
+		}
+	}
+}
+
+// a task run as a built-in principal or as another user is machine-wide,
+// and creating or deleting it needs Administrator
+func (t *WindowsTask) checkPrivileges(action string) error {
+	current, err := user.Current()
+	if err != nil {
+		return fatal(err)
+	}
+	if current.Uid == t.Uid && !isWindowsPrincipal(t.Uid) {
+		return nil
+	}
+	return checkPrivileges(action+" task", t.Name)
+}
+
+func (t *WindowsTask) Install() error {
+	err := t.checkPrivileges("install")
+	if err != nil {
+		return fatal(err)
+	}
+	unlock, err := lockDaemon(t, t.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if t.installed() {
+		return fatalf("%w: task %s", ErrAlreadyInstalled, t.Name)
+	}
+	err = createRunDir(t.Dir, t.Uid, "")
+	if err != nil {
+		return fatal(err)
+	}
+	err = createOwnedDirs(filepath.Dir(t.LogFile), t.Uid, "")
+	if err != nil {
+		return fatal(err)
+	}
+
+	xmlData, err := t.xmlData()
+	if err != nil {
+		return fatal(err)
+	}
+	if t.Wrapper {
+		err = writeWrapper(t.wrapperFile, powershellWrapper(t.Dir, t.Executable, t.Env, t.PreStart, t.PostStop))
+		if err != nil {
+			return fatal(err)
+		}
+	}
 
 	tempDir, err := os.MkdirTemp("", "task-create-*")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
 	defer os.RemoveAll(tempDir)
 
 	xmlFile := filepath.Join(tempDir, "task.xml")
 	err = os.WriteFile(filepath.Join(tempDir, "task.xml"), []byte(xmlData), 0600)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
 	createArgs := []string{
 		"/XML", xmlFile,
 	}
+	if t.LogonType == "Password" {
+		password, err := t.password()
+		if err != nil {
+			return fatal(err)
+		}
+		createArgs = append(createArgs, "/RU", t.Username, "/RP", password)
+	}
 	_, _, err = t.taskScheduler("CREATE", createArgs...)
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
 	}
 	return nil
 }
 
+// the password goes only to schtasks and is never written to the task xml
+func (t *WindowsTask) password() (string, error) {
+	return windowsPassword(t.settings, t.Username)
+}
+
+// return daemon.password, then DAEMON_PASSWORD, and otherwise prompt
+func windowsPassword(settings daemonSettings, username string) (string, error) {
+	password := settings.getString("daemon.password")
+	if password == "" {
+		password = os.Getenv("DAEMON_PASSWORD")
+	}
+	if password == "" {
+		var err error
+		password, err = readPassword("password for " + username + ": ")
+		if err != nil {
+			return "", fatal(err)
+		}
+	}
+	if password == "" {
+		return "", fatalf("no password for %s", username)
+	}
+	return password, nil
+}
+
+// the task definition has no file once created, so it renders as NAME.xml
+func (t *WindowsTask) ConfigFiles() ([]ConfigFile, error) {
+	xmlData, err := t.xmlData()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	files := []ConfigFile{{t.Name + ".xml", 0600, []byte(xmlData)}}
+	if t.Wrapper {
+		files = append(files, ConfigFile{t.wrapperFile, 0755, powershellWrapper(t.Dir, t.Executable, t.Env, t.PreStart, t.PostStop)})
+	}
+	return files, nil
+}
+
 func (t *WindowsTask) Delete() error {
-	_, _, err := t.taskScheduler("END")
+	unlock, err := lockDaemon(t, t.Name)
+	if err != nil {
+		return fatal(err)
+	}
+	defer unlock()
+	if !t.installed() {
+		return fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
+	err = t.checkPrivileges("delete")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	if t.Force {
+		// Stop escalates to taskkill /F when END leaves the task running
+		err = t.Stop()
+		if err != nil {
+			forceWarning(t.Name, err)
+		}
+	} else {
+		_, _, err = t.taskScheduler("END")
+		if err != nil {
+			return fatal(err)
+		}
 	}
 	_, _, err = t.taskScheduler("DELETE", "/F")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	err = removeWrapper(t.wrapperFile)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// schtasks ends a task without a signal and has no process id or
+// dependency ordering
+var windowsTaskCapabilities = DaemonCapabilities{
+	Oneshot: true,
+}
+
+func (t *WindowsTask) Capabilities() DaemonCapabilities {
+	return windowsTaskCapabilities
+}
+
+// the settings the task was created with
+func (t *WindowsTask) specSettings() daemonSettings {
+	return t.settings
+}
+
+// delete the task and remove its log file; the executable runs from
+// where it was installed from, so it is left in place
+func (t *WindowsTask) Purge() error {
+	return purge(t, t.Executable, t.Executable, "")
+}
+
+// a task created disabled, or disabled in the task scheduler, does not
+// run at its trigger
+func (t *WindowsTask) Enable() error {
+	if !t.installed() {
+		return fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
+	_, _, err := t.taskScheduler("CHANGE", "/ENABLE")
+	if err != nil {
+		return fatal(err)
 	}
 	return nil
 }
 
+// a disabled task does not run at its trigger, and schtasks /RUN refuses
+// to start it
+func (t *WindowsTask) Disable() error {
+	if !t.installed() {
+		return fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
+	_, _, err := t.taskScheduler("CHANGE", "/DISABLE")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a running task is left alone
 func (t *WindowsTask) Start() error {
-	_, _, err := t.taskScheduler("RUN")
+	running, err := t.active()
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	if running {
+		debugLog("already running", "name", t.Name)
+		return nil
+	}
+	err = checkStartType(t.Name, t.StartType)
+	if err != nil {
+		return fatal(err)
+	}
+	if t.StartType != "manual" {
+		err = t.Enable()
+		if err != nil {
+			return fatal(err)
+		}
+	}
+	_, _, err = t.taskScheduler("RUN")
+	if err != nil {
+		return fatal(err)
 	}
 	return nil
 }
 
 func (t *WindowsTask) Stop() error {
+	if !t.installed() {
+		return fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
 	_, _, err := t.taskScheduler("END")
 	if err != nil {
-		return common.Fatal(err)
+		return fatal(err)
+	}
+	stopped, err := waitStopped(t.active, t.StopTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if stopped {
+		return nil
+	}
+	_, image := filepath.Split(t.Executable)
+	_, _, _, err = runTimeout(t.CommandTimeout, "taskkill.exe", "/F", "/IM", image, "/FI", "USERNAME eq "+t.Username)
+	if err != nil {
+		return fatal(err)
+	}
+	stopped, err = waitStopped(t.active, killTimeout)
+	if err != nil {
+		return fatal(err)
+	}
+	if !stopped {
+		return fatalf("%s still running after taskkill /F", t.Name)
+	}
+	return nil
+}
+
+// schtasks has no restart, so end the task and wait for it to exit first
+func (t *WindowsTask) Restart() error {
+	err := t.Stop()
+	if err != nil {
+		return fatal(err)
+	}
+	err = t.Start()
+	if err != nil {
+		return fatal(err)
 	}
 	return nil
 }
 
+// return the installed locations; the task definition is held by the task
+// scheduler, and the executable runs from where it was installed from
+// return the log file the daemon writes, daemon.logfile when set
+func (t *WindowsTask) LogPath() (string, error) {
+	return t.LogFile, nil
+}
+
+func (t *WindowsTask) Paths() map[string]string {
+	paths := map[string]string{
+		"binary": t.Executable,
+		"dir":    t.Dir,
+		"log":    t.LogFile,
+	}
+	if t.Wrapper {
+		paths["wrapper"] = t.wrapperFile
+	}
+	return paths
+}
+
 func (t *WindowsTask) GetConfig() (string, error) {
+	if !t.installed() {
+		return "", fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
 	_, out, err := t.taskScheduler("QUERY", "/XML", "ONE")
 	if err != nil {
-		return "", common.Fatal(err)
+		return "", fatal(err)
 	}
 	return out, nil
 }
 
+func (t *WindowsTask) GetDaemonConfig() (*DaemonConfig, error) {
+	xmlData, err := t.GetConfig()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config, err := parseTaskXML(xmlData)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config.Name = t.Name
+	return config, nil
+}
+
+func (t *WindowsTask) DesiredConfig() (*DaemonConfig, error) {
+	xmlData, err := t.xmlData()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config, err := parseTaskXML(xmlData)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	config.Name = t.Name
+	return config, nil
+}
+
+// parse the principal, exec action, and enabled setting of a task definition
+func parseTaskXML(xmlData string) (*DaemonConfig, error) {
+	var task struct {
+		UserId  string `xml:"Principals>Principal>UserId"`
+		Enabled string `xml:"Settings>Enabled"`
+		Exec    []struct {
+			Command          string `xml:"Command"`
+			Arguments        string `xml:"Arguments"`
+			WorkingDirectory string `xml:"WorkingDirectory"`
+		} `xml:"Actions>Exec"`
+	}
+	decoder := xml.NewDecoder(strings.NewReader(xmlData))
+	// schtasks declares UTF-16 but writes the console encoding
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	err := decoder.Decode(&task)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	if len(task.Exec) != 1 {
+		return nil, fatalf("expected one exec action, found %d", len(task.Exec))
+	}
+	config := DaemonConfig{
+		User:       task.UserId,
+		Executable: task.Exec[0].Command,
+		Args:       windowsSplit(task.Exec[0].Arguments),
+		Dir:        task.Exec[0].WorkingDirectory,
+		Env:        make(map[string]string),
+		Enabled:    task.Enabled != "false",
+	}
+	for _, principal := range windowsPrincipals {
+		if principal.sid == config.User {
+			config.User = principal.username
+		}
+	}
+	taskUser, err := user.LookupId(config.User)
+	if err == nil {
+		config.User = taskUser.Username
+	}
+	return &config, nil
+}
+
+func (t *WindowsTask) SetConfig(config string) error {
+	if !t.installed() {
+		return fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
+	err := checkConfig(config)
+	if err != nil {
+		return fatal(err)
+	}
+	err = checkTaskXML(config)
+	if err != nil {
+		return fatal(err)
+	}
+	tempDir, err := os.MkdirTemp("", "task-update-*")
+	if err != nil {
+		return fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	xmlFile := filepath.Join(tempDir, "task.xml")
+	err = os.WriteFile(xmlFile, []byte(config), 0600)
+	if err != nil {
+		return fatal(err)
+	}
+	_, _, err = t.taskScheduler("CREATE", "/XML", xmlFile, "/F")
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// a oneshot task runs on its trigger and exits
+func (t *WindowsTask) oneshot() bool {
+	return t.Type == "oneshot"
+}
+
+// report whether the task is running, or for a oneshot whether its last
+// run exited 0
 func (t *WindowsTask) Query() (bool, error) {
+	if !t.oneshot() {
+		return t.active()
+	}
+	history, err := t.History()
+	if err != nil {
+		return false, fatal(err)
+	}
+	// a task that has not run reports 267011, SCHED_S_TASK_HAS_NOT_RUN
+	return history.LastTaskResult == "0", nil
+}
+
+// a task that is not running has failed when its last run exited with an
+// error
+func (t *WindowsTask) Status() (DaemonState, error) {
+	running, err := t.active()
+	if err != nil {
+		return "", fatal(err)
+	}
+	if running {
+		return StateRunning, nil
+	}
+	history, err := t.History()
+	if err != nil {
+		return "", fatal(err)
+	}
+	return history.state(), nil
+}
+
+// when the task scheduler last ran a task and the result code it recorded,
+// as schtasks prints them; a task that never ran has a LastRunTime of N/A
+type TaskHistory struct {
+	LastRunTime    string
+	LastTaskResult string
+}
+
+// the last results of a task that wasn't running and didn't fail:
+// success, SCHED_S_TASK_HAS_NOT_RUN, and SCHED_S_TASK_TERMINATED, which
+// schtasks /END leaves
+var stoppedTaskResults = []string{"0", "267011", "267014"}
+
+func (h *TaskHistory) state() DaemonState {
+	if slices.Contains(stoppedTaskResults, h.LastTaskResult) {
+		return StateStopped
+	}
+	return StateFailed
+}
+
+// return the last run time and result of the task, which can be Ready
+// while every run fails
+func (t *WindowsTask) History() (*TaskHistory, error) {
+	if !t.installed() {
+		return nil, fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
+	_, stdout, err := t.taskScheduler("QUERY", "/V", "/FO", "LIST")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	history, err := parseTaskHistory(stdout)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return history, nil
+}
+
+// parse the Last Run Time and Last Result of schtasks /QUERY /V /FO LIST
+func parseTaskHistory(report string) (*TaskHistory, error) {
+	history := TaskHistory{}
+	found := false
+	for _, line := range strings.Split(report, "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, "Last Run Time:"); ok {
+			history.LastRunTime = strings.TrimSpace(value)
+		}
+		if value, ok := strings.CutPrefix(line, "Last Result:"); ok {
+			history.LastTaskResult = strings.TrimSpace(value)
+			found = true
+		}
+	}
+	if !found {
+		return nil, fatalf("no last result in task report")
+	}
+	return &history, nil
+}
+
+// parse the state of a stopped task from schtasks /QUERY /V /FO LIST
+func parseTaskState(report string) (DaemonState, error) {
+	history, err := parseTaskHistory(report)
+	if err != nil {
+		return "", fatal(err)
+	}
+	return history.state(), nil
+}
+
+// report whether the task is running
+func (t *WindowsTask) active() (bool, error) {
+	if !t.installed() {
+		return false, fatalf("%w: task %s", ErrNotInstalled, t.Name)
+	}
 
 	_, stdout, err := t.taskScheduler("QUERY", "/FO", "csv", "/NH")
 	if err != nil {
-		return false, common.Fatal(err)
+		return false, fatal(err)
 	}
 	fields := []string{}
 	lines := strings.Split(stdout, "\n")
@@ -179,14 +1102,103 @@ func (t *WindowsTask) Query() (bool, error) {
 		fields = strings.Split(lines[0], ",")
 	}
 	if len(lines) != 1 || len(fields) != 3 {
-		return false, common.Fatalf("unexpected output: %v", stdout)
+		return false, fatalf("unexpected output: %v", stdout)
 	}
 	taskName := `"\` + t.Name + `"`
 	if fields[0] != taskName {
-		return false, common.Fatalf("unexpected task name: %s", fields[0])
+		return false, fatalf("unexpected task name: %s", fields[0])
 	}
 	if fields[2] == `"Running"` {
 		return true, nil
 	}
 	return false, nil
 }
+
+// the task scheduler does not report the process id of a running task
+func (t *WindowsTask) Pid() (int, error) {
+	return 0, fatalf("%w: windows task pid", ErrNotSupported)
+}
+
+func (t *WindowsTask) tools() (string, []string) {
+	return "task scheduler", []string{"schtasks.exe"}
+}
+
+func (t *WindowsTask) Validate() error {
+	var userErr error
+	if !isWindowsPrincipal(t.Uid) {
+		_, err := user.Lookup(t.Username)
+		if err != nil {
+			userErr = fmt.Errorf("task user: %w", err)
+		}
+	}
+	return errors.Join(
+		checkTools(t.tools()),
+		checkExecutable(t.Executable),
+		checkRunDir(t.settings, t.Dir, t.Uid, ""),
+		userErr,
+	)
+}
+
+// return a task that can only inspect the installed task name; a oneshot
+// is queried as a daemon
+func windowsTaskByName(name string) (CobraDaemon, error) {
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	return &WindowsTask{Name: name, CommandTimeout: timeout}, nil
+}
+
+func listWindowsTasks() ([]DaemonInfo, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	timeout, err := commandTimeout(nil)
+	if err != nil {
+		return nil, fatal(err)
+	}
+	stdout, _, _, err := runTimeout(timeout, "schtasks.exe", "/QUERY", "/FO", "csv", "/V")
+	if err != nil {
+		return nil, fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(decodeTaskOutput(stdout))).ReadAll()
+	if err != nil {
+		return nil, fatal(err)
+	}
+	list := []DaemonInfo{}
+	if len(records) == 0 {
+		return list, nil
+	}
+	nameField, statusField, commandField := -1, -1, -1
+	for i, field := range records[0] {
+		switch field {
+		case "TaskName":
+			nameField = i
+		case "Status":
+			statusField = i
+		case "Task To Run":
+			commandField = i
+		}
+	}
+	if nameField < 0 || statusField < 0 || commandField < 0 {
+		return nil, fatalf("unexpected output header: %v", records[0])
+	}
+	seen := make(map[string]bool)
+	for _, record := range records[1:] {
+		if len(record) != len(records[0]) || record[nameField] == "TaskName" {
+			continue
+		}
+		command := strings.Trim(record[commandField], `"`)
+		if !strings.HasPrefix(strings.ToLower(command), strings.ToLower(executable)) {
+			continue
+		}
+		name := strings.TrimPrefix(record[nameField], `\`)
+		if strings.Contains(name, `\`) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		list = append(list, DaemonInfo{Name: name, Running: record[statusField] == "Running"})
+	}
+	return list, nil
+}
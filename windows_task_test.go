@@ -0,0 +1,214 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestWindowsPrincipal(t *testing.T) {
+	initTestConfig(t)
+	root := t.TempDir()
+	t.Setenv("SystemRoot", root)
+	for _, name := range []string{"SYSTEM", "LocalSystem", `NT AUTHORITY\NETWORK SERVICE`, "NetworkService"} {
+		principal, ok := windowsPrincipal(name)
+		require.True(t, ok, name)
+		require.True(t, strings.HasPrefix(principal.HomeDir, root))
+	}
+	_, ok := windowsPrincipal("Administrator")
+	require.False(t, ok)
+
+	principal, _ := windowsPrincipal("LocalSystem")
+	d, err := NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	data, err := d.(*WindowsTask).xmlData()
+	require.Nil(t, err)
+	require.Contains(t, data, "<UserId>S-1-5-18</UserId>")
+	require.Contains(t, data, "<LogonType>ServiceAccount</LogonType>")
+	require.Contains(t, data, "<RunLevel>HighestAvailable</RunLevel>")
+	require.Contains(t, data, "<BootTrigger>")
+}
+
+func TestWindowsPasswordLogon(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	u := &user.User{Username: `HOST\svc`, Uid: "S-1-5-21-1-2-3-1001", HomeDir: root}
+	testConfig(t, "daemon.windows.logon", "password")
+
+	d, err := NewWindowsTask("testd", u, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	data, err := d.(*WindowsTask).xmlData()
+	require.Nil(t, err)
+	require.Contains(t, data, "<LogonType>Password</LogonType>")
+	t.Setenv("DAEMON_PASSWORD", "s3cret")
+	password, err := d.(*WindowsTask).password()
+	require.Nil(t, err)
+	require.Equal(t, "s3cret", password)
+	require.NotContains(t, data, "s3cret")
+
+	principal, ok := windowsPrincipal("SYSTEM")
+	require.True(t, ok)
+	_, err = NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.ErrorIs(t, err, ErrNotSupported)
+
+	testConfig(t, "daemon.windows.logon", "bogus")
+	_, err = NewWindowsTask("testd", u, root, `C:\bin\testd.exe`)
+	require.ErrorContains(t, err, "unsupported windows logon")
+}
+
+func TestWindowsTaskXMLCheck(t *testing.T) {
+	initTestConfig(t)
+	root := t.TempDir()
+	t.Setenv("SystemRoot", root)
+	principal, _ := windowsPrincipal("LocalSystem")
+	d, err := NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	task := d.(*WindowsTask)
+
+	missing := strings.Replace(xmlTemplate, "${TASK_ARGS}", "${TASK_MISSING}", 1)
+	require.NotEqual(t, xmlTemplate, missing)
+	_, err = task.renderXML(missing)
+	require.ErrorContains(t, err, "TASK_MISSING")
+
+	_, err = task.renderXML(strings.Replace(xmlTemplate, "</Task>", "", 1))
+	require.ErrorContains(t, err, "invalid task xml")
+
+	require.ErrorContains(t, checkTaskXML("<Task><Actions></Task>"), "invalid task xml")
+	require.Nil(t, checkTaskXML(`<?xml version="1.0" encoding="UTF-16"?><Task></Task>`))
+}
+
+func TestWindowsTaskDelayIdle(t *testing.T) {
+	initTestConfig(t)
+	root := t.TempDir()
+	t.Setenv("SystemRoot", root)
+	principal, _ := windowsPrincipal("LocalSystem")
+	testConfig(t, "daemon.windows.start_delay", "90s")
+	testConfig(t, "daemon.windows.stop_if_idle", "10m")
+
+	d, err := NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.Nil(t, err)
+	data, err := d.(*WindowsTask).xmlData()
+	require.Nil(t, err)
+	require.Contains(t, data, "<Enabled>true</Enabled>\n      <Delay>PT1M30S</Delay>\n    </BootTrigger>")
+	require.Contains(t, data, "<RunOnlyIfIdle>true</RunOnlyIfIdle>")
+	require.Contains(t, data, "<Duration>PT10M</Duration>")
+	require.Contains(t, data, "<StopOnIdleEnd>true</StopOnIdleEnd>")
+
+	require.Equal(t, "PT0S", isoDuration(0))
+	require.Equal(t, "PT2H5S", isoDuration(2*time.Hour+5*time.Second))
+
+	testConfig(t, "daemon.windows.stop_if_idle", "3h")
+	_, err = NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.ErrorContains(t, err, "invalid stop_if_idle")
+
+	testConfig(t, "daemon.windows.stop_if_idle", "")
+	testConfig(t, "daemon.windows.start_delay", "1.5s")
+	_, err = NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.ErrorContains(t, err, "invalid start_delay: 1.5s")
+
+	testConfig(t, "daemon.windows.start_delay", "30s")
+	testConfig(t, "daemon.windows.trigger", "daily@03:00")
+	_, err = NewWindowsTask("testd", principal, root, `C:\bin\testd.exe`)
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+// schtasks /QUERY /TN \testd /V /FO LIST
+const taskVerboseReport = "\r\n" +
+	"Folder: \\\r\n" +
+	"HostName:                             HOST\r\n" +
+	"TaskName:                             \\testd\r\n" +
+	"Next Run Time:                        N/A\r\n" +
+	"Status:                               Ready\r\n" +
+	"Logon Mode:                           Interactive only\r\n" +
+	"Last Run Time:                        10/14/2026 3:04:05 PM\r\n" +
+	"Last Result:                          -2147024894\r\n" +
+	"Author:                               HOST\\admin\r\n" +
+	"Task To Run:                          \"C:\\bin\\testd.exe\" serve\r\n" +
+	"Start In:                             C:\\testd\r\n" +
+	"Comment:                              N/A\r\n" +
+	"Scheduled Task State:                 Enabled\r\n" +
+	"Run As User:                          admin\r\n" +
+	"Schedule Type:                        At logon time\r\n"
+
+func TestParseTaskHistory(t *testing.T) {
+	history, err := parseTaskHistory(taskVerboseReport)
+	require.Nil(t, err)
+	require.Equal(t, TaskHistory{LastRunTime: "10/14/2026 3:04:05 PM", LastTaskResult: "-2147024894"}, *history)
+	state, err := parseTaskState(taskVerboseReport)
+	require.Nil(t, err)
+	require.Equal(t, StateFailed, state)
+
+	// a task that has never run
+	history, err = parseTaskHistory("Last Run Time:                        N/A\r\nLast Result:                          267011\r\n")
+	require.Nil(t, err)
+	require.Equal(t, TaskHistory{LastRunTime: "N/A", LastTaskResult: "267011"}, *history)
+	require.Equal(t, StateStopped, history.state())
+
+	_, err = parseTaskHistory("Status:                               Ready\r\n")
+	require.ErrorContains(t, err, "no last result")
+}
+
+func TestParseTaskState(t *testing.T) {
+	// the Last Result line of schtasks /QUERY /V /FO LIST
+	for result, expected := range map[string]DaemonState{
+		"0":           StateStopped,
+		"267011":      StateStopped,
+		"267014":      StateStopped,
+		"1":           StateFailed,
+		"-1073741510": StateFailed,
+	} {
+		report := "HostName:                             HOST\r\nTaskName:                             \\testd\r\nStatus:                               Ready\r\nLast Result:                          " + result + "\r\n"
+		state, err := parseTaskState(report)
+		require.Nil(t, err, result)
+		require.Equal(t, expected, state, result)
+	}
+	_, err := parseTaskState("ERROR: The system cannot find the file specified.\r\n")
+	require.ErrorContains(t, err, "no last result")
+}
+
+// encode s as schtasks does on some locales
+func utf16Output(s string, bom []byte, bigEndian bool) string {
+	data := append([]byte{}, bom...)
+	for _, unit := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			data = append(data, byte(unit>>8), byte(unit))
+		} else {
+			data = append(data, byte(unit), byte(unit>>8))
+		}
+	}
+	return string(data)
+}
+
+func TestDecodeTaskOutput(t *testing.T) {
+	taskXML := `<?xml version="1.0" encoding="UTF-16"?>` + "\r\n" +
+		`<Task xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task"><Principals><Principal><UserId>S-1-5-18</UserId></Principal></Principals>` +
+		`<Settings><Enabled>true</Enabled></Settings>` +
+		`<Actions><Exec><Command>C:\Programme\Überwachung\testd.exe</Command><Arguments>--größe 5</Arguments><WorkingDirectory>C:\Programme\Überwachung</WorkingDirectory></Exec></Actions></Task>`
+	decodedXML := strings.Replace(taskXML, "UTF-16", "UTF-8", 1)
+	for name, output := range map[string]string{
+		"little endian bom": utf16Output(taskXML, []byte{0xff, 0xfe}, false),
+		"big endian bom":    utf16Output(taskXML, []byte{0xfe, 0xff}, true),
+		"no bom":            utf16Output(taskXML, nil, false),
+	} {
+		decoded := decodeTaskOutput(output)
+		require.Equal(t, decodedXML, decoded, name)
+		config, err := parseTaskXML(decoded)
+		require.Nil(t, err, name)
+		require.Equal(t, `C:\Programme\Überwachung\testd.exe`, config.Executable, name)
+		require.Equal(t, []string{"--größe", "5"}, config.Args, name)
+		require.Equal(t, `C:\Programme\Überwachung`, config.Dir, name)
+	}
+
+	// the verbose report decodes to what parseTaskHistory reads
+	history, err := parseTaskHistory(decodeTaskOutput(utf16Output(taskVerboseReport, []byte{0xff, 0xfe}, false)))
+	require.Nil(t, err)
+	require.Equal(t, "-2147024894", history.LastTaskResult)
+
+	// UTF-8 output is returned as written, less any byte order mark
+	require.Equal(t, taskVerboseReport, decodeTaskOutput(taskVerboseReport))
+	require.Equal(t, "Überwachung", decodeTaskOutput("\xef\xbb\xbfÜberwachung"))
+	require.Equal(t, "", decodeTaskOutput(""))
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// return the daemon.env KEY=VALUE settings
+func daemonEnv(settings daemonSettings) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, setting := range settings.getStringSlice("daemon.env") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok || !envName.MatchString(key) {
+			return nil, fatalf("invalid env setting: %s", setting)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+func sortedKeys(env map[string]string) []string {
+	keys := []string{}
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// return the wrapper script path for name; windows wrappers go in windowsDir
+func wrapperPath(name string, windowsDir string) string {
+	if windowsDir != "" {
+		return filepath.Join(windowsDir, name+"-wrapper.ps1")
+	}
+	return filepath.Join(binRoot, name+"-wrapper")
+}
+
+// render a sh wrapper that sets the run directory and environment, then
+// execs command with the arguments passed by the supervisor
+func shellWrapper(dir, command string, env map[string]string) []byte {
+	lines := []string{
+		"#!/bin/sh",
+		"cd " + shellQuote(dir) + " || exit 1",
+		"HOME=" + shellQuote(dir) + "; export HOME",
+	}
+	for _, key := range sortedKeys(env) {
+		lines = append(lines, key+"="+shellQuote(env[key])+"; export "+key)
+	}
+	lines = append(lines, "exec "+shellQuote(command)+` "$@"`)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func powershellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// render the powershell equivalent of shellWrapper, passing the exit code
+// through; prestart and poststop run with cmd.exe around the command, and
+// poststop is skipped when the task is ended rather than exiting itself
+func powershellWrapper(dir, command string, env map[string]string, prestart, poststop string) []byte {
+	lines := []string{
+		"Set-Location -LiteralPath " + powershellQuote(dir),
+		"$env:HOME = " + powershellQuote(dir),
+	}
+	for _, key := range sortedKeys(env) {
+		lines = append(lines, "$env:"+key+" = "+powershellQuote(env[key]))
+	}
+	if prestart != "" {
+		lines = append(lines,
+			"& cmd.exe /C "+powershellQuote(prestart),
+			"if ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }",
+		)
+	}
+	lines = append(lines, "& "+powershellQuote(command)+" @args")
+	if poststop != "" {
+		lines = append(lines,
+			"$status = $LASTEXITCODE",
+			"& cmd.exe /C "+powershellQuote(poststop),
+			"exit $status",
+		)
+	} else {
+		lines = append(lines, "exit $LASTEXITCODE")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// write a wrapper script, replacing any existing one
+func writeWrapper(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fatal(err)
+	}
+	err = writeFileAtomic(path, data, 0755)
+	if err != nil {
+		return fatal(err)
+	}
+	return nil
+}
+
+// remove a wrapper script if one was written
+func removeWrapper(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fatal(err)
+	}
+	debugLog("remove", "path", path)
+	return nil
+}
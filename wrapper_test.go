@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestShellWrapper(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "run dir")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	command := filepath.Join(root, "testd")
+	require.Nil(t, os.WriteFile(command, []byte("#!/bin/sh\nprintf '%s|%s|%s|%s' \"$(pwd)\" \"$HOME\" \"$GREETING\" \"$*\"\n"), 0755))
+	wrapper := filepath.Join(root, "testd-wrapper")
+	require.Nil(t, writeWrapper(wrapper, shellWrapper(dir, command, map[string]string{"GREETING": "it's $HOME"})))
+
+	out, err := exec.Command(wrapper, "--port", "8080").Output()
+	require.Nil(t, err)
+	require.Equal(t, dir+"|"+dir+"|it's $HOME|--port 8080", string(out))
+
+	require.Nil(t, removeWrapper(wrapper))
+	require.NoFileExists(t, wrapper)
+	require.Nil(t, removeWrapper(wrapper))
+}
+
+func TestDaemontoolsWrapper(t *testing.T) {
+	initTestConfig(t)
+	root := initTestRoots(t)
+	executable := testExecutable(t, root)
+	testConfig(t, "daemon.wrapper", true)
+	testConfig(t, "daemon.env", []string{"GREETING=hello"})
+	fakeCommand(t, "svstat", `echo "$1: down 1 seconds, normally up"`)
+	fakeCommand(t, "svc", "exit 0")
+
+	d, err := NewDaemontools("testd", testUser(t), root, executable)
+	require.Nil(t, err)
+	require.Nil(t, d.Install())
+	wrapper := filepath.Join(binRoot, "testd-wrapper")
+	require.FileExists(t, wrapper)
+	config, err := d.GetDaemonConfig()
+	require.Nil(t, err)
+	require.Equal(t, wrapper, config.Executable)
+	require.Equal(t, "hello", config.Env["GREETING"])
+
+	require.Nil(t, d.Delete())
+	require.NoFileExists(t, wrapper)
+
+	testConfig(t, "daemon.env", []string{"1BAD=value"})
+	_, err = NewDaemontools("testd", testUser(t), root, executable)
+	require.ErrorContains(t, err, "invalid env setting")
+}